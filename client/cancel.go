@@ -0,0 +1,62 @@
+package client
+
+import (
+	"context"
+	"errors"
+)
+
+// errRequestCanceled cancels a request the server gave up on, because the
+// visitor left or the server timed it out. nobody waits for its response.
+var errRequestCanceled = errors.New("request canceled by the server")
+
+type ongoingRequest struct {
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+}
+
+// trackRequest returns the context of a request, registering it on first use.
+// the read pump registers every request before handing it off, so a
+// cancellation that arrives while the request waits for a free slot still
+// reaches it.
+func (c *Client) trackRequest(requestID string) (context.Context, context.CancelCauseFunc) {
+	c.ongoingRequestsMu.Lock()
+	defer c.ongoingRequestsMu.Unlock()
+
+	if req, ok := c.ongoingRequests[requestID]; ok {
+		return req.ctx, req.cancel
+	}
+	ctx, cancel := context.WithCancelCause(c.ctx)
+	c.ongoingRequests[requestID] = &ongoingRequest{ctx: ctx, cancel: cancel}
+	return ctx, cancel
+}
+
+// untrackRequest forgets a finished request and releases its context
+func (c *Client) untrackRequest(requestID string) {
+	c.ongoingRequestsMu.Lock()
+	req, ok := c.ongoingRequests[requestID]
+	delete(c.ongoingRequests, requestID)
+	c.ongoingRequestsMu.Unlock()
+
+	if ok {
+		req.cancel(context.Canceled)
+	}
+}
+
+// cancelRequest aborts a request on behalf of the server, reporting whether
+// it was still running. the request stays tracked until it returns, so one
+// still waiting for a slot picks up the canceled context.
+func (c *Client) cancelRequest(requestID string) bool {
+	c.ongoingRequestsMu.Lock()
+	req, ok := c.ongoingRequests[requestID]
+	c.ongoingRequestsMu.Unlock()
+
+	if ok {
+		req.cancel(errRequestCanceled)
+	}
+	return ok
+}
+
+// requestCanceled reports whether the server canceled the request of ctx
+func requestCanceled(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), errRequestCanceled)
+}
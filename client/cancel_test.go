@@ -0,0 +1,76 @@
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/karol-broda/funnel/shared"
+)
+
+func TestClient_processRequest_ServerCancel(t *testing.T) {
+	started := make(chan struct{}, 1)
+	aborted := make(chan struct{}, 1)
+	var hits int32
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		started <- struct{}{}
+		select {
+		case <-r.Context().Done():
+			aborted <- struct{}{}
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer local.Close()
+
+	c := New("test-tunnel", "http://localhost:8080", strings.TrimPrefix(local.URL, "http://"), "")
+	defer c.cancel()
+
+	t.Run("running request", func(t *testing.T) {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			c.processRequest(local.Client(), shared.Message{Type: "request", RequestID: "req-1", Method: "GET", Path: "/report"})
+		}()
+
+		select {
+		case <-started:
+		case <-time.After(5 * time.Second):
+			t.Fatal("the request never reached the local service")
+		}
+		if !c.cancelRequest("req-1") {
+			t.Fatal("cancelRequest() = false for a running request")
+		}
+
+		select {
+		case <-aborted:
+		case <-time.After(2 * time.Second):
+			t.Fatal("the local request was not aborted")
+		}
+		<-done
+
+		select {
+		case msg := <-c.outgoingMessages:
+			t.Errorf("sent %q with status %d for a canceled request", msg.Type, msg.Status)
+		default:
+		}
+	})
+
+	t.Run("queued request", func(t *testing.T) {
+		before := atomic.LoadInt32(&hits)
+		// the read pump registers a request before it waits for a slot
+		c.trackRequest("req-2")
+		c.cancelRequest("req-2")
+		c.processRequest(local.Client(), shared.Message{Type: "request", RequestID: "req-2", Method: "GET", Path: "/report"})
+
+		if atomic.LoadInt32(&hits) != before {
+			t.Error("a request canceled while queued still reached the local service")
+		}
+		if c.cancelRequest("req-2") {
+			t.Error("a finished request is still tracked")
+		}
+	})
+}
@@ -2,30 +2,71 @@ package client
 
 import (
 	"context"
+	"crypto/tls"
+	"net/http"
 	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/karol-broda/funnel/shared"
+	"github.com/rs/zerolog"
 )
 
 type Client struct {
-	TunnelID          string
-	ServerURL         string
-	LocalAddr         string
-	Token             string
+	TunnelID   string
+	ServerURL  string
+	LocalAddr  string
+	Token      string
+	ClientCert *tls.Certificate
+	Hostnames  []string
+	// Routes send the requests below some paths to other local services
+	Routes []Route
+	// Pool joins the tunnel id together with other clients, using this strategy
+	Pool string
+	// H2C talks http/2 without tls to the local service, grpc requests always do
+	H2C bool
+	// Timeouts asks the server for request timeouts other than its defaults
+	Timeouts *shared.TunnelTimeouts
+	// BodyLimits asks the server for smaller body limits than its own
+	BodyLimits *shared.BodyLimits
+	// Logger is the base logger for this client, the global logger when nil
+	Logger            *zerolog.Logger
+	BasicAuth         *BasicAuth
+	Headers           map[string]string
+	HealthCheck       *HealthCheck
+	PublicURL         string
+	Limits            shared.Limits
 	Conn              *websocket.Conn
+	features          []string
+	binaryFraming     bool
 	connMu            sync.Mutex
 	lastPong          time.Time
 	lastPongMu        sync.Mutex
-	ongoingRequests   map[string]context.CancelFunc
+	ongoingRequests   map[string]*ongoingRequest
 	ongoingRequestsMu sync.Mutex
 	requestSemaphore  chan struct{}
+	requestBodies     map[string]*streamBody
+	requestBodiesMu   sync.Mutex
+	h2cClient         *http.Client
 	outgoingMessages  chan *shared.Message
 	closeOnce         sync.Once
 	requestWg         sync.WaitGroup
 	ctx               context.Context
 	cancel            context.CancelFunc
+
+	// flow and credit are the two sides of flow control, nil when the server
+	// did not negotiate it
+	flow   *shared.FlowWindow
+	credit *shared.CreditLedger
+	// queueStalls counts messages that waited for room in the outgoing queue
+	queueStalls int64
+	// rewriter applies the header rules, nil without any
+	rewriter *headerRewriter
+	// compressionThreshold is the smallest body compressed for the server,
+	// zero when it did not negotiate compression. compressionSaved counts the
+	// bytes that saved in both directions.
+	compressionThreshold int
+	compressionSaved     int64
 }
 
 func New(tunnelID, serverURL, localAddr, token string) *Client {
@@ -35,7 +76,7 @@ func New(tunnelID, serverURL, localAddr, token string) *Client {
 		ServerURL:        serverURL,
 		LocalAddr:        localAddr,
 		Token:            token,
-		ongoingRequests:  make(map[string]context.CancelFunc),
+		ongoingRequests:  make(map[string]*ongoingRequest),
 		requestSemaphore: make(chan struct{}, 128),
 		outgoingMessages: make(chan *shared.Message, 100),
 		lastPong:         time.Now(),
@@ -44,9 +85,30 @@ func New(tunnelID, serverURL, localAddr, token string) *Client {
 	}
 }
 
+func (c *Client) tunnelLogger(component string) zerolog.Logger {
+	if c.Logger == nil {
+		return shared.GetTunnelLogger(component, c.TunnelID)
+	}
+	return c.Logger.With().
+		Str("component", component).
+		Str("tunnel_id", c.TunnelID).
+		Logger()
+}
+
+func (c *Client) requestLogger(component, requestID string) zerolog.Logger {
+	if c.Logger == nil {
+		return shared.GetRequestLogger(component, c.TunnelID, requestID)
+	}
+	return c.Logger.With().
+		Str("component", component).
+		Str("tunnel_id", c.TunnelID).
+		Str("request_id", requestID).
+		Logger()
+}
+
 func (c *Client) Close() {
 	c.closeOnce.Do(func() {
-		logger := shared.GetTunnelLogger("client", c.TunnelID)
+		logger := c.tunnelLogger("client")
 		logger.Debug().Msg("closing client connection")
 
 		c.cancel()
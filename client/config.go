@@ -14,15 +14,21 @@ type Config struct {
 
 // Inlet represents a tunnel server configuration
 type Inlet struct {
-	Server string `toml:"server"`
-	Domain string `toml:"domain,omitempty"`
-	Token  string `toml:"token,omitempty"`
+	Server     string `toml:"server"`
+	Domain     string `toml:"domain,omitempty"`
+	Token      string `toml:"token,omitempty"`
+	ClientCert string `toml:"client_cert,omitempty"`
+	ClientKey  string `toml:"client_key,omitempty"`
+	// TokenCommand is run through the shell to get the token, e.g. from a
+	// password manager. it takes precedence over Token.
+	TokenCommand string `toml:"token_command,omitempty"`
 }
 
 // ConfigManager handles configuration loading and management
 type ConfigManager struct {
-	configPath string
-	config     *Config
+	configPath     string
+	config         *Config
+	secretBackends map[string]SecretBackend
 }
 
 // NewConfigManager creates a new configuration manager
@@ -183,6 +189,127 @@ func (cm *ConfigManager) SetToken(inletName, token string) error {
 	return cm.SaveConfig(cm.config)
 }
 
+// SetTokenSecret stores the token in a secret backend and keeps only a reference
+// to it in the inlet, or the token itself with the plain backend. a token
+// command or a token previously stored in another backend is removed.
+func (cm *ConfigManager) SetTokenSecret(inletName, backendName, token string) error {
+	var backend SecretBackend
+	if backendName != SecretBackendPlain {
+		var err error
+		backend, err = cm.SecretBackend(backendName)
+		if err != nil {
+			return err
+		}
+	}
+
+	if cm.config == nil {
+		cm.config = &Config{Inlets: make(map[string]Inlet)}
+		cm.LoadConfig()
+		if cm.config == nil {
+			cm.config = &Config{Inlets: make(map[string]Inlet)}
+		}
+	}
+
+	stored := token
+	if backend != nil {
+		if err := backend.Set(inletName, token); err != nil {
+			return fmt.Errorf("failed to store token in %s: %w", backendName, err)
+		}
+		stored = SecretRef(backendName, inletName)
+	}
+
+	inlet := cm.config.Inlets[inletName]
+	previous := inlet.Token
+	inlet.Token = stored
+	inlet.TokenCommand = ""
+	cm.config.Inlets[inletName] = inlet
+
+	if err := cm.SaveConfig(cm.config); err != nil {
+		return err
+	}
+
+	if oldBackend, key, ok := ParseSecretRef(previous); ok && previous != inlet.Token {
+		if old, err := cm.SecretBackend(oldBackend); err == nil {
+			old.Delete(key)
+		}
+	}
+	return nil
+}
+
+// SetTokenCommand makes the inlet get its token from a shell command instead of the config
+func (cm *ConfigManager) SetTokenCommand(inletName, command string) error {
+	if cm.config == nil {
+		cm.config = &Config{Inlets: make(map[string]Inlet)}
+		cm.LoadConfig()
+		if cm.config == nil {
+			cm.config = &Config{Inlets: make(map[string]Inlet)}
+		}
+	}
+
+	inlet := cm.config.Inlets[inletName]
+	inlet.TokenCommand = command
+	cm.config.Inlets[inletName] = inlet
+
+	return cm.SaveConfig(cm.config)
+}
+
+// ResolveToken returns the token of an inlet, running its token command or
+// reading the referenced secret when needed
+func (cm *ConfigManager) ResolveToken(inlet *Inlet) (string, error) {
+	if inlet.TokenCommand != "" {
+		return runTokenCommand(inlet.TokenCommand)
+	}
+
+	backendName, key, ok := ParseSecretRef(inlet.Token)
+	if !ok {
+		return inlet.Token, nil
+	}
+
+	backend, err := cm.SecretBackend(backendName)
+	if err != nil {
+		return "", err
+	}
+
+	token, err := backend.Get(key)
+	if err != nil {
+		return "", fmt.Errorf("failed to read token from %s: %w", backendName, err)
+	}
+	return token, nil
+}
+
+// SetSecretBackend registers a secret backend, replacing the default one with the same name
+func (cm *ConfigManager) SetSecretBackend(backend SecretBackend) {
+	if cm.secretBackends == nil {
+		cm.secretBackends = make(map[string]SecretBackend)
+	}
+	cm.secretBackends[backend.Name()] = backend
+}
+
+// SecretBackend returns a registered backend or creates the default for its name
+func (cm *ConfigManager) SecretBackend(name string) (SecretBackend, error) {
+	if backend, ok := cm.secretBackends[name]; ok {
+		return backend, nil
+	}
+
+	var backend SecretBackend
+	switch name {
+	case SecretBackendKeyring:
+		backend = NewKeyringBackend(NewDBusSecretService())
+	case SecretBackendFile:
+		backend = NewEncryptedFileBackend(cm.SecretsPath(), EnvPassphrase)
+	default:
+		return nil, fmt.Errorf("unknown secret backend %q, expected plain, keyring or file", name)
+	}
+
+	cm.SetSecretBackend(backend)
+	return backend, nil
+}
+
+// SecretsPath returns the path of the encrypted secrets file, next to the config file
+func (cm *ConfigManager) SecretsPath() string {
+	return filepath.Join(filepath.Dir(cm.getConfigPath()), "secrets.age")
+}
+
 // SetServer sets the server URL for a specific inlet, creating the inlet if it doesn't exist
 func (cm *ConfigManager) SetServer(inletName, server string) error {
 	if cm.config == nil {
@@ -200,6 +327,25 @@ func (cm *ConfigManager) SetServer(inletName, server string) error {
 	return cm.SaveConfig(cm.config)
 }
 
+// SetClientCertificate sets the client certificate and key files for a specific inlet,
+// creating the inlet if it doesn't exist. empty paths remove the certificate.
+func (cm *ConfigManager) SetClientCertificate(inletName, certFile, keyFile string) error {
+	if cm.config == nil {
+		cm.config = &Config{Inlets: make(map[string]Inlet)}
+		cm.LoadConfig()
+		if cm.config == nil {
+			cm.config = &Config{Inlets: make(map[string]Inlet)}
+		}
+	}
+
+	inlet := cm.config.Inlets[inletName]
+	inlet.ClientCert = certFile
+	inlet.ClientKey = keyFile
+	cm.config.Inlets[inletName] = inlet
+
+	return cm.SaveConfig(cm.config)
+}
+
 // GetConfigPath returns the path to the config file
 func (cm *ConfigManager) GetConfigPath() string {
 	return cm.getConfigPath()
@@ -2,17 +2,18 @@ package client
 
 import (
 	"context"
+	"crypto/tls"
+	"io"
 	"net/http"
 	"net/url"
+	"strings"
 	"time"
 
-	"github.com/karol-broda/funnel/shared"
-
 	"github.com/gorilla/websocket"
 )
 
 func (c *Client) connect(ctx context.Context) error {
-	logger := shared.GetTunnelLogger("client.connection", c.TunnelID)
+	logger := c.tunnelLogger("client.connection")
 	logger.Debug().Msg("starting connection process")
 
 	connectionStart := time.Now()
@@ -29,7 +30,14 @@ func (c *Client) connect(ctx context.Context) error {
 	}
 
 	u.Scheme = wsScheme
-	u.RawQuery = "id=" + c.TunnelID
+	query := url.Values{}
+	if c.TunnelID != "" {
+		query.Set("id", c.TunnelID)
+	}
+	if c.Pool != "" {
+		query.Set("pool", c.Pool)
+	}
+	u.RawQuery = query.Encode()
 	wsURL := u.String()
 
 	logger.Debug().Str("websocket_url", wsURL).Msg("constructed websocket URL")
@@ -47,6 +55,11 @@ func (c *Client) connect(ctx context.Context) error {
 		Bool("compression_enabled", dialer.EnableCompression).
 		Msg("websocket dialer configured")
 
+	if c.ClientCert != nil {
+		dialer.TLSClientConfig = &tls.Config{Certificates: []tls.Certificate{*c.ClientCert}}
+		logger.Debug().Msg("client certificate configured")
+	}
+
 	var headers http.Header
 	if c.Token != "" {
 		headers = http.Header{}
@@ -65,10 +78,19 @@ func (c *Client) connect(ctx context.Context) error {
 			Msg("websocket connection failed")
 		if resp != nil {
 			logger.Error().Int("http_status", resp.StatusCode).Msg("websocket upgrade response status")
+			if rejected := rejectionFromResponse(resp); rejected != nil {
+				return rejected
+			}
 		}
 		return err
 	}
 
+	if err := c.handshake(conn); err != nil {
+		logger.Error().Err(err).Msg("handshake with server failed")
+		conn.Close()
+		return err
+	}
+
 	totalConnectTime := time.Since(connectionStart)
 	logger.Info().
 		Dur("dial_time", dialDuration).
@@ -85,3 +107,18 @@ func (c *Client) connect(ctx context.Context) error {
 	c.connMu.Unlock()
 	return nil
 }
+
+// rejectionFromResponse turns a refused upgrade into a RejectedError when
+// retrying cannot help, e.g. a bad or reserved tunnel id
+func rejectionFromResponse(resp *http.Response) *RejectedError {
+	if resp.StatusCode != http.StatusBadRequest && resp.StatusCode != http.StatusForbidden {
+		return nil
+	}
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	reason := strings.TrimSpace(string(body))
+	if reason == "" {
+		reason = resp.Status
+	}
+	return &RejectedError{Reason: reason}
+}
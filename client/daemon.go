@@ -0,0 +1,535 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/karol-broda/funnel/shared"
+	"github.com/rs/zerolog"
+)
+
+const (
+	daemonLogLines        = 1000
+	daemonShutdownTimeout = 5 * time.Second
+
+	TunnelStateConnecting   = "connecting"
+	TunnelStateConnected    = "connected"
+	TunnelStateReconnecting = "reconnecting"
+	TunnelStateStopped      = "stopped"
+)
+
+var ErrTunnelNotFound = errors.New("tunnel not found")
+
+// DefaultDaemonSocket returns the control socket path, inside XDG_RUNTIME_DIR
+// when available and a per-user directory in the temp dir otherwise
+func DefaultDaemonSocket() string {
+	if runtimeDir := os.Getenv("XDG_RUNTIME_DIR"); runtimeDir != "" {
+		return filepath.Join(runtimeDir, "funnel", "daemon.sock")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("funnel-%d", os.Getuid()), "daemon.sock")
+}
+
+// DaemonStartRequest asks the daemon to start a tunnel. Name identifies it
+// locally and defaults to the tunnel id.
+type DaemonStartRequest struct {
+	Name string `json:"name,omitempty"`
+	Options
+}
+
+// DaemonTunnel is the state of a tunnel owned by the daemon. credentials are
+// never part of it.
+type DaemonTunnel struct {
+	Name       string    `json:"name"`
+	TunnelID   string    `json:"id,omitempty"`
+	ServerURL  string    `json:"server"`
+	LocalAddr  string    `json:"local"`
+	Hostnames  []string  `json:"hostnames,omitempty"`
+	PublicURL  string    `json:"public_url,omitempty"`
+	State      string    `json:"state"`
+	Error      string    `json:"error,omitempty"`
+	Reconnects int       `json:"reconnects"`
+	StartedAt  time.Time `json:"started_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+type daemonResponse struct {
+	Success bool            `json:"success"`
+	Data    json.RawMessage `json:"data,omitempty"`
+	Error   string          `json:"error,omitempty"`
+}
+
+type daemonTunnel struct {
+	logs     *logBuffer
+	shutdown chan struct{}
+	done     chan struct{}
+
+	mu   sync.Mutex
+	info DaemonTunnel
+}
+
+func (t *daemonTunnel) snapshot() DaemonTunnel {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.info
+}
+
+// update applies a runner status. the runner keeps reconnecting on its own,
+// so any error while it is still running means it is reconnecting.
+func (t *daemonTunnel) update(status Status) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if status.TunnelID != "" {
+		t.info.TunnelID = status.TunnelID
+	}
+	if status.PublicURL != "" {
+		t.info.PublicURL = status.PublicURL
+	}
+
+	t.info.Error = ""
+	if status.Err != nil {
+		t.info.Error = status.Err.Error()
+	}
+
+	switch {
+	case status.Connected:
+		t.info.State = TunnelStateConnected
+	case t.info.State == TunnelStateConnected:
+		t.info.State = TunnelStateReconnecting
+		t.info.Reconnects++
+	case t.info.State != TunnelStateConnecting:
+		t.info.State = TunnelStateReconnecting
+	}
+	t.info.UpdatedAt = time.Now()
+}
+
+// Daemon owns tunnels started from other shells and exposes them over a local
+// control socket. every tunnel gets its own runner, which keeps reconnecting
+// until it is stopped.
+type Daemon struct {
+	output io.Writer
+	logger zerolog.Logger
+
+	mu      sync.Mutex
+	tunnels map[string]*daemonTunnel
+	counter int
+}
+
+// NewDaemon creates a daemon writing the logs of its tunnels to output as well
+// as to their log buffers
+func NewDaemon(output io.Writer) *Daemon {
+	if output == nil {
+		output = io.Discard
+	}
+	return &Daemon{
+		output:  output,
+		logger:  shared.GetLogger("client.daemon"),
+		tunnels: make(map[string]*daemonTunnel),
+	}
+}
+
+// Start runs a new tunnel
+func (d *Daemon) Start(req DaemonStartRequest) (DaemonTunnel, error) {
+	if req.ServerURL == "" {
+		return DaemonTunnel{}, fmt.Errorf("server url is required")
+	}
+	if req.LocalAddr == "" {
+		return DaemonTunnel{}, fmt.Errorf("local address is required")
+	}
+
+	d.mu.Lock()
+	name := req.Name
+	if name == "" {
+		name = req.TunnelID
+	}
+	if name == "" {
+		d.counter++
+		name = "tunnel-" + strconv.Itoa(d.counter)
+	}
+	if strings.ContainsAny(name, "/ ") {
+		d.mu.Unlock()
+		return DaemonTunnel{}, fmt.Errorf("invalid tunnel name %q", name)
+	}
+	if _, exists := d.tunnels[name]; exists {
+		d.mu.Unlock()
+		return DaemonTunnel{}, fmt.Errorf("tunnel %q is already running", name)
+	}
+
+	now := time.Now()
+	tunnel := &daemonTunnel{
+		logs:     newLogBuffer(daemonLogLines),
+		shutdown: make(chan struct{}),
+		done:     make(chan struct{}),
+		info: DaemonTunnel{
+			Name:      name,
+			TunnelID:  req.TunnelID,
+			ServerURL: req.ServerURL,
+			LocalAddr: req.LocalAddr,
+			Hostnames: req.Hostnames,
+			State:     TunnelStateConnecting,
+			StartedAt: now,
+			UpdatedAt: now,
+		},
+	}
+	d.tunnels[name] = tunnel
+	d.mu.Unlock()
+
+	logger := zerolog.New(io.MultiWriter(tunnel.logs, d.output)).
+		Level(zerolog.InfoLevel).
+		With().
+		Timestamp().
+		Str("tunnel", name).
+		Logger()
+
+	opts := req.Options
+	opts.Logger = &logger
+	opts.OnStatus = tunnel.update
+
+	go func() {
+		defer close(tunnel.done)
+		defer tunnel.logs.close()
+
+		Run(opts, tunnel.shutdown)
+
+		tunnel.mu.Lock()
+		tunnel.info.State = TunnelStateStopped
+		tunnel.info.UpdatedAt = time.Now()
+		tunnel.mu.Unlock()
+	}()
+
+	d.logger.Info().Str("tunnel", name).Str("local", req.LocalAddr).Msg("started tunnel")
+	return tunnel.snapshot(), nil
+}
+
+// find looks a tunnel up by name, then by tunnel id
+func (d *Daemon) find(ref string) (string, *daemonTunnel, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.findLocked(ref)
+}
+
+func (d *Daemon) findLocked(ref string) (string, *daemonTunnel, error) {
+	if tunnel, ok := d.tunnels[ref]; ok {
+		return ref, tunnel, nil
+	}
+	for name, tunnel := range d.tunnels {
+		if tunnel.snapshot().TunnelID == ref {
+			return name, tunnel, nil
+		}
+	}
+	return "", nil, fmt.Errorf("%w: %s", ErrTunnelNotFound, ref)
+}
+
+// Stop stops a tunnel and forgets it. of concurrent calls for one tunnel only
+// the one that removed it stops it, the others find no tunnel.
+func (d *Daemon) Stop(ref string) error {
+	d.mu.Lock()
+	name, tunnel, err := d.findLocked(ref)
+	if err == nil {
+		delete(d.tunnels, name)
+	}
+	d.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	close(tunnel.shutdown)
+	<-tunnel.done
+
+	d.logger.Info().Str("tunnel", name).Msg("stopped tunnel")
+	return nil
+}
+
+// Inspect returns the state of a single tunnel
+func (d *Daemon) Inspect(ref string) (DaemonTunnel, error) {
+	_, tunnel, err := d.find(ref)
+	if err != nil {
+		return DaemonTunnel{}, err
+	}
+	return tunnel.snapshot(), nil
+}
+
+// List returns all tunnels sorted by name
+func (d *Daemon) List() []DaemonTunnel {
+	d.mu.Lock()
+	tunnels := make([]DaemonTunnel, 0, len(d.tunnels))
+	for _, tunnel := range d.tunnels {
+		tunnels = append(tunnels, tunnel.snapshot())
+	}
+	d.mu.Unlock()
+
+	sort.Slice(tunnels, func(i, j int) bool {
+		return tunnels[i].Name < tunnels[j].Name
+	})
+	return tunnels
+}
+
+// Shutdown stops all tunnels
+func (d *Daemon) Shutdown() {
+	for _, tunnel := range d.List() {
+		if err := d.Stop(tunnel.Name); err != nil && !errors.Is(err, ErrTunnelNotFound) {
+			d.logger.Error().Err(err).Str("tunnel", tunnel.Name).Msg("failed to stop tunnel")
+		}
+	}
+}
+
+// Serve listens on socketPath until ctx is done, then stops all tunnels
+func (d *Daemon) Serve(ctx context.Context, socketPath string) error {
+	if err := os.MkdirAll(filepath.Dir(socketPath), 0700); err != nil {
+		return fmt.Errorf("failed to create socket directory: %w", err)
+	}
+	if err := checkSocketDir(filepath.Dir(socketPath)); err != nil {
+		return err
+	}
+
+	if conn, err := net.Dial("unix", socketPath); err == nil {
+		conn.Close()
+		return fmt.Errorf("a daemon is already listening on %s", socketPath)
+	}
+	// a socket nobody listens on is left over from a crashed daemon
+	os.Remove(socketPath)
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", socketPath, err)
+	}
+	if err := os.Chmod(socketPath, 0600); err != nil {
+		listener.Close()
+		return fmt.Errorf("failed to restrict socket permissions: %w", err)
+	}
+
+	server := &http.Server{Handler: d.Handler()}
+
+	go func() {
+		<-ctx.Done()
+		// stopping the tunnels first ends any log streams still attached
+		d.Shutdown()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), daemonShutdownTimeout)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	d.logger.Info().Str("socket", socketPath).Msg("daemon listening")
+
+	if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("control socket failed: %w", err)
+	}
+	return nil
+}
+
+// Handler serves the control api
+func (d *Daemon) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /tunnels", d.handleList)
+	mux.HandleFunc("POST /tunnels", d.handleStart)
+	mux.HandleFunc("GET /tunnels/{name}", d.handleInspect)
+	mux.HandleFunc("DELETE /tunnels/{name}", d.handleStop)
+	mux.HandleFunc("GET /tunnels/{name}/logs", d.handleLogs)
+	return mux
+}
+
+func (d *Daemon) handleList(w http.ResponseWriter, r *http.Request) {
+	writeDaemonResponse(w, http.StatusOK, d.List())
+}
+
+func (d *Daemon) handleStart(w http.ResponseWriter, r *http.Request) {
+	var req DaemonStartRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeDaemonError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %w", err))
+		return
+	}
+
+	tunnel, err := d.Start(req)
+	if err != nil {
+		writeDaemonError(w, http.StatusConflict, err)
+		return
+	}
+	writeDaemonResponse(w, http.StatusCreated, tunnel)
+}
+
+func (d *Daemon) handleInspect(w http.ResponseWriter, r *http.Request) {
+	tunnel, err := d.Inspect(r.PathValue("name"))
+	if err != nil {
+		writeDaemonError(w, http.StatusNotFound, err)
+		return
+	}
+	writeDaemonResponse(w, http.StatusOK, tunnel)
+}
+
+func (d *Daemon) handleStop(w http.ResponseWriter, r *http.Request) {
+	if err := d.Stop(r.PathValue("name")); err != nil {
+		writeDaemonError(w, http.StatusNotFound, err)
+		return
+	}
+	writeDaemonResponse(w, http.StatusOK, nil)
+}
+
+// handleLogs streams json log lines, the last ?tail lines first and new ones
+// as they arrive when ?follow is set
+func (d *Daemon) handleLogs(w http.ResponseWriter, r *http.Request) {
+	_, tunnel, err := d.find(r.PathValue("name"))
+	if err != nil {
+		writeDaemonError(w, http.StatusNotFound, err)
+		return
+	}
+
+	tail := daemonLogLines
+	if value := r.URL.Query().Get("tail"); value != "" {
+		tail, err = strconv.Atoi(value)
+		if err != nil || tail < 0 {
+			writeDaemonError(w, http.StatusBadRequest, fmt.Errorf("invalid tail %q", value))
+			return
+		}
+	}
+	follow := r.URL.Query().Get("follow") == "true"
+
+	lines, updates, unsubscribe := tunnel.logs.subscribe(tail, follow)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	for _, line := range lines {
+		w.Write(line)
+	}
+
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+	if !follow {
+		return
+	}
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case line, ok := <-updates:
+			if !ok {
+				return
+			}
+			w.Write(line)
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+func writeDaemonResponse(w http.ResponseWriter, status int, data interface{}) {
+	resp := daemonResponse{Success: true}
+	if data != nil {
+		encoded, err := json.Marshal(data)
+		if err != nil {
+			writeDaemonError(w, http.StatusInternalServerError, err)
+			return
+		}
+		resp.Data = encoded
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+func writeDaemonError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(daemonResponse{Error: err.Error()})
+}
+
+// logBuffer keeps the last lines written to it and fans new lines out to
+// followers. zerolog writes exactly one line per Write call.
+type logBuffer struct {
+	mu        sync.Mutex
+	lines     [][]byte
+	max       int
+	followers map[chan []byte]struct{}
+	closed    bool
+}
+
+func newLogBuffer(max int) *logBuffer {
+	return &logBuffer{
+		max:       max,
+		followers: make(map[chan []byte]struct{}),
+	}
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	line := make([]byte, len(p))
+	copy(line, p)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.lines = append(b.lines, line)
+	if len(b.lines) > b.max {
+		b.lines = b.lines[len(b.lines)-b.max:]
+	}
+
+	for follower := range b.followers {
+		select {
+		case follower <- line:
+		default:
+			// a slow follower misses lines rather than blocking the tunnel
+		}
+	}
+	return len(p), nil
+}
+
+// subscribe returns the last tail lines and, when follow is set, a channel of
+// new lines which is closed once the tunnel stops
+func (b *logBuffer) subscribe(tail int, follow bool) ([][]byte, <-chan []byte, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	start := len(b.lines) - tail
+	if start < 0 {
+		start = 0
+	}
+	lines := append([][]byte(nil), b.lines[start:]...)
+
+	if !follow {
+		return lines, nil, func() {}
+	}
+
+	follower := make(chan []byte, 64)
+	if b.closed {
+		close(follower)
+		return lines, follower, func() {}
+	}
+
+	b.followers[follower] = struct{}{}
+	return lines, follower, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, ok := b.followers[follower]; ok {
+			delete(b.followers, follower)
+			close(follower)
+		}
+	}
+}
+
+func (b *logBuffer) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = true
+	for follower := range b.followers {
+		delete(b.followers, follower)
+		close(follower)
+	}
+}
@@ -0,0 +1,157 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+)
+
+var ErrDaemonNotRunning = errors.New("daemon is not running")
+
+// DaemonClient talks to a daemon over its control socket
+type DaemonClient struct {
+	socketPath string
+	httpClient *http.Client
+}
+
+func NewDaemonClient(socketPath string) *DaemonClient {
+	return &DaemonClient{
+		socketPath: socketPath,
+		httpClient: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					// a socket in a directory another user controls is not our daemon
+					if err := checkSocketDir(filepath.Dir(socketPath)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+						return nil, err
+					}
+					var dialer net.Dialer
+					return dialer.DialContext(ctx, "unix", socketPath)
+				},
+			},
+		},
+	}
+}
+
+// do sends a request to the daemon. the host is ignored, the transport always
+// dials the socket.
+func (dc *DaemonClient) do(ctx context.Context, method, path string, body interface{}) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal request: %w", err)
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, "http://funnel-daemon"+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := dc.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w at %s: %v", ErrDaemonNotRunning, dc.socketPath, err)
+	}
+	return resp, nil
+}
+
+func (dc *DaemonClient) call(method, path string, body, result interface{}) error {
+	resp, err := dc.do(context.Background(), method, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var decoded daemonResponse
+	if err := json.NewDecoder(resp.Body).Decode(&decoded); err != nil {
+		return fmt.Errorf("invalid response from daemon: %w", err)
+	}
+	if !decoded.Success {
+		return fmt.Errorf("%s", decoded.Error)
+	}
+
+	if result != nil && len(decoded.Data) > 0 {
+		if err := json.Unmarshal(decoded.Data, result); err != nil {
+			return fmt.Errorf("invalid response from daemon: %w", err)
+		}
+	}
+	return nil
+}
+
+// List returns the tunnels owned by the daemon
+func (dc *DaemonClient) List() ([]DaemonTunnel, error) {
+	var tunnels []DaemonTunnel
+	err := dc.call(http.MethodGet, "/tunnels", nil, &tunnels)
+	return tunnels, err
+}
+
+// Start asks the daemon to start a tunnel
+func (dc *DaemonClient) Start(req DaemonStartRequest) (DaemonTunnel, error) {
+	var tunnel DaemonTunnel
+	err := dc.call(http.MethodPost, "/tunnels", req, &tunnel)
+	return tunnel, err
+}
+
+// Inspect returns a tunnel by name or tunnel id
+func (dc *DaemonClient) Inspect(ref string) (DaemonTunnel, error) {
+	var tunnel DaemonTunnel
+	err := dc.call(http.MethodGet, "/tunnels/"+url.PathEscape(ref), nil, &tunnel)
+	return tunnel, err
+}
+
+// Stop stops a tunnel by name or tunnel id
+func (dc *DaemonClient) Stop(ref string) error {
+	return dc.call(http.MethodDelete, "/tunnels/"+url.PathEscape(ref), nil, nil)
+}
+
+// Logs writes the json log lines of a tunnel to w, one Write per line so w can
+// be a zerolog.ConsoleWriter. with follow it keeps streaming until ctx is done
+// or the tunnel stops.
+func (dc *DaemonClient) Logs(ctx context.Context, ref string, tail int, follow bool, w io.Writer) error {
+	query := url.Values{}
+	query.Set("tail", strconv.Itoa(tail))
+	if follow {
+		query.Set("follow", "true")
+	}
+
+	resp, err := dc.do(ctx, http.MethodGet, "/tunnels/"+url.PathEscape(ref)+"/logs?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var decoded daemonResponse
+		if err := json.NewDecoder(resp.Body).Decode(&decoded); err != nil {
+			return fmt.Errorf("daemon returned %s", resp.Status)
+		}
+		return fmt.Errorf("%s", decoded.Error)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := append(append([]byte(nil), scanner.Bytes()...), '\n')
+		if _, err := w.Write(line); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil && ctx.Err() == nil {
+		return fmt.Errorf("failed to read logs: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,235 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/karol-broda/funnel/shared"
+)
+
+func startTestDaemon(t *testing.T) *DaemonClient {
+	t.Helper()
+
+	// unix socket paths are limited to about 100 bytes, t.TempDir can be longer
+	dir, err := os.MkdirTemp("", "funnel-daemon")
+	if err != nil {
+		t.Fatalf("failed to create socket dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	socketPath := filepath.Join(dir, "daemon.sock")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- NewDaemon(nil).Serve(ctx, socketPath)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("Serve() error = %v", err)
+		}
+	})
+
+	dc := NewDaemonClient(socketPath)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := dc.List(); err == nil {
+			return dc
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("daemon did not start listening")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func waitForTunnelState(t *testing.T, dc *DaemonClient, name, state string) DaemonTunnel {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		tunnel, err := dc.Inspect(name)
+		if err == nil && tunnel.State == state {
+			return tunnel
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("tunnel %s did not reach state %s, last: %+v (err: %v)", name, state, tunnel, err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestDaemon_StartListStop(t *testing.T) {
+	ts := newHandshakeServer(t, func(conn *websocket.Conn, hello *shared.Message) {
+		conn.WriteJSON(&shared.Message{
+			Type: "welcome",
+			Welcome: &shared.Welcome{
+				TunnelID:        "assigned-id",
+				PublicURL:       "https://assigned-id.tunnel.example.com",
+				ProtocolVersion: shared.ProtocolVersion,
+			},
+		})
+	})
+	dc := startTestDaemon(t)
+
+	started, err := dc.Start(DaemonStartRequest{
+		Name:    "web",
+		Options: Options{ServerURL: ts.URL, LocalAddr: "localhost:3000", Token: "sk_secret"},
+	})
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	if started.Name != "web" {
+		t.Errorf("Name = %q, want web", started.Name)
+	}
+
+	if _, err := dc.Start(DaemonStartRequest{Name: "web", Options: Options{ServerURL: ts.URL, LocalAddr: "localhost:3000"}}); err == nil {
+		t.Error("expected an error for a duplicate name")
+	}
+
+	tunnel := waitForTunnelState(t, dc, "web", TunnelStateConnected)
+	if tunnel.TunnelID != "assigned-id" || tunnel.PublicURL != "https://assigned-id.tunnel.example.com" {
+		t.Errorf("unexpected tunnel: %+v", tunnel)
+	}
+
+	// the server assigned id works as a reference too
+	if _, err := dc.Inspect("assigned-id"); err != nil {
+		t.Errorf("Inspect(assigned-id) error = %v", err)
+	}
+
+	tunnels, err := dc.List()
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	if len(tunnels) != 1 || tunnels[0].Name != "web" {
+		t.Errorf("List() = %+v", tunnels)
+	}
+
+	var logs bytes.Buffer
+	if err := dc.Logs(context.Background(), "web", 100, false, &logs); err != nil {
+		t.Fatalf("Logs() error = %v", err)
+	}
+	if !strings.Contains(logs.String(), `"tunnel":"web"`) {
+		t.Errorf("expected tunnel logs, got %q", logs.String())
+	}
+	if strings.Contains(logs.String(), "sk_secret") {
+		t.Error("logs must not contain the token")
+	}
+
+	if err := dc.Stop("web"); err != nil {
+		t.Fatalf("Stop() error = %v", err)
+	}
+	if _, err := dc.Inspect("web"); err == nil {
+		t.Error("expected the stopped tunnel to be gone")
+	}
+}
+
+func TestDaemon_RejectedTunnelStops(t *testing.T) {
+	ts := newHandshakeServer(t, func(conn *websocket.Conn, hello *shared.Message) {
+		conn.WriteJSON(&shared.Message{Type: "rejected", Error: "tunnel id is reserved"})
+	})
+	dc := startTestDaemon(t)
+
+	if _, err := dc.Start(DaemonStartRequest{Options: Options{TunnelID: "taken", ServerURL: ts.URL, LocalAddr: "3000"}}); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+
+	tunnel := waitForTunnelState(t, dc, "taken", TunnelStateStopped)
+	if !strings.Contains(tunnel.Error, "tunnel id is reserved") {
+		t.Errorf("Error = %q, want the rejection reason", tunnel.Error)
+	}
+
+	// follow ends once the tunnel has stopped
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := dc.Logs(ctx, "taken", 10, true, &bytes.Buffer{}); err != nil {
+		t.Fatalf("Logs() error = %v", err)
+	}
+	if ctx.Err() != nil {
+		t.Error("following the logs of a stopped tunnel should return")
+	}
+}
+
+func TestDaemonClient_NotRunning(t *testing.T) {
+	dc := NewDaemonClient(filepath.Join(t.TempDir(), "missing.sock"))
+	if _, err := dc.List(); !errors.Is(err, ErrDaemonNotRunning) {
+		t.Errorf("expected ErrDaemonNotRunning, got %v", err)
+	}
+}
+
+func TestDaemon_ConcurrentStop(t *testing.T) {
+	d := NewDaemon(nil)
+	tunnel := &daemonTunnel{shutdown: make(chan struct{}), done: make(chan struct{})}
+	go func() {
+		<-tunnel.shutdown
+		close(tunnel.done)
+	}()
+	d.tunnels["app"] = tunnel
+
+	var wg sync.WaitGroup
+	var stopped atomic.Int32
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := d.Stop("app"); err == nil {
+				stopped.Add(1)
+			} else if !errors.Is(err, ErrTunnelNotFound) {
+				t.Errorf("Stop() error = %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if stopped.Load() != 1 {
+		t.Errorf("%d calls stopped the tunnel, want 1", stopped.Load())
+	}
+}
+
+func TestDaemon_RefusesForeignSocketDir(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("socket directories are not checked on windows")
+	}
+
+	dir, err := os.MkdirTemp("", "funnel-daemon")
+	if err != nil {
+		t.Fatalf("failed to create socket dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a directory others can write to may hold a socket another user listens on
+	if err := os.Chmod(dir, 0755); err != nil {
+		t.Fatalf("failed to change socket dir mode: %v", err)
+	}
+	// a cancelled context makes Serve return even if it wrongly accepts the dir
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	socketPath := filepath.Join(dir, "daemon.sock")
+	if err := NewDaemon(nil).Serve(ctx, socketPath); err == nil {
+		t.Fatal("expected Serve() to refuse a socket dir with mode 0755")
+	}
+	if _, err := NewDaemonClient(socketPath).List(); err == nil || !strings.Contains(err.Error(), "0755") {
+		t.Errorf("expected the client to refuse the socket dir, got %v", err)
+	}
+
+	link := dir + "-link"
+	if err := os.Symlink(dir, link); err != nil {
+		t.Fatalf("failed to create symlink: %v", err)
+	}
+	defer os.Remove(link)
+	os.Chmod(dir, 0700)
+	if err := NewDaemon(nil).Serve(ctx, filepath.Join(link, "daemon.sock")); err == nil {
+		t.Error("expected Serve() to refuse a symlinked socket dir")
+	}
+}
@@ -0,0 +1,9 @@
+//go:build windows
+
+package client
+
+// checkSocketDir accepts any directory, the socket lives in the temp dir of
+// the user which others cannot write to
+func checkSocketDir(dir string) error {
+	return nil
+}
@@ -0,0 +1,147 @@
+package client
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/karol-broda/funnel/shared"
+)
+
+func TestStreamBody_GrantsCreditAsRead(t *testing.T) {
+	c := New("test-tunnel", "http://localhost:8080", "localhost:3000", "")
+	defer c.cancel()
+	c.credit = shared.NewCreditLedger(shared.DefaultTunnelWindow, 64*1024)
+
+	c.openRequestBody("req-1", nil)
+	chunk := bytes.Repeat([]byte("x"), 20*1024)
+	for i := 0; i < 2; i++ {
+		msg := &shared.Message{Type: "request_body", RequestID: "req-1", Body: chunk}
+		c.credit.Received(shared.ChunkCost(msg))
+		c.handleRequestBody(msg)
+	}
+	c.handleRequestBody(&shared.Message{Type: "request_body", RequestID: "req-1", End: true})
+
+	if updates := c.credit.Updates(); len(updates) != 0 {
+		t.Fatalf("Updates() = %d messages before the local service read anything", len(updates))
+	}
+
+	if _, err := io.ReadAll(c.requestBody("req-1")); err != nil {
+		t.Fatalf("ReadAll() = %v", err)
+	}
+	updates := c.credit.Updates()
+	if len(updates) != 1 || updates[0].RequestID != "req-1" || updates[0].Credit != 2*(20*1024+shared.ChunkOverhead) {
+		t.Fatalf("Updates() = %+v, want the credit of both chunks for req-1", updates)
+	}
+
+	c.closeRequestBody("req-1")
+}
+
+func TestClient_processRequest_StreamWaitsForCredit(t *testing.T) {
+	const chunks = 6
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		chunk := bytes.Repeat([]byte("y"), shared.StreamChunkSize)
+		for i := 0; i < chunks; i++ {
+			w.Write(chunk)
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer local.Close()
+
+	c := New("test-tunnel", "http://localhost:8080", strings.TrimPrefix(local.URL, "http://"), "")
+	defer c.cancel()
+	c.features = []string{shared.FeatureStreaming, shared.FeatureFlowControl}
+	// room for two chunks at a time
+	window := 2 * (shared.StreamChunkSize + shared.ChunkOverhead)
+	c.flow = shared.NewFlowWindow(shared.DefaultTunnelWindow, int64(window))
+
+	go c.processRequest(local.Client(), shared.Message{Type: "request", RequestID: "req-1", Method: "GET", Path: "/download"})
+
+	receive := func() *shared.Message {
+		t.Helper()
+		select {
+		case msg := <-c.outgoingMessages:
+			return msg
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for a message")
+			return nil
+		}
+	}
+
+	if resp := receive(); resp.Type != "response" || !resp.Stream {
+		t.Fatalf("first message = %q stream %v, want a streamed response", resp.Type, resp.Stream)
+	}
+
+	// the client stops once a stream window of chunks is in flight
+	var pending []*shared.Message
+	inFlight := 0
+	for stalled := false; !stalled; {
+		select {
+		case msg := <-c.outgoingMessages:
+			pending = append(pending, msg)
+			inFlight += int(shared.ChunkCost(msg))
+		case <-time.After(200 * time.Millisecond):
+			stalled = true
+		}
+	}
+	if len(pending) == 0 || inFlight > window {
+		t.Fatalf("%d chunks with %d bytes of credit in flight, want the stream to stall within %d", len(pending), inFlight, window)
+	}
+
+	// granting the credit of every chunk back lets the rest through
+	var end *shared.Message
+	for end == nil {
+		for _, msg := range pending {
+			c.flow.Grant("req-1", shared.ChunkCost(msg))
+			c.flow.Grant("", shared.ChunkCost(msg))
+		}
+		msg := receive()
+		if msg.End {
+			end = msg
+		}
+		pending = []*shared.Message{msg}
+	}
+	if end.Error != "" {
+		t.Errorf("stream ended with error %q", end.Error)
+	}
+	if c.flow.Stalls() == 0 {
+		t.Error("the stall was not counted")
+	}
+}
+
+func TestClient_sendResponse_WaitsForRoom(t *testing.T) {
+	c := New("test-tunnel", "http://localhost:8080", "localhost:3000", "")
+	defer c.cancel()
+	for i := 0; i < cap(c.outgoingMessages); i++ {
+		c.outgoingMessages <- &shared.Message{Type: "ping"}
+	}
+
+	sent := make(chan struct{})
+	go func() {
+		c.sendResponse("req-1", http.StatusOK, nil, []byte("ok"))
+		close(sent)
+	}()
+	select {
+	case <-sent:
+		t.Fatal("sendResponse() returned while the queue was full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	<-c.outgoingMessages
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Fatal("sendResponse() still waiting after the queue made room")
+	}
+
+	for len(c.outgoingMessages) > 1 {
+		<-c.outgoingMessages
+	}
+	if resp := <-c.outgoingMessages; resp.RequestID != "req-1" {
+		t.Errorf("last queued message is for %q, want the response to req-1", resp.RequestID)
+	}
+}
@@ -0,0 +1,135 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/karol-broda/funnel/shared"
+	"github.com/karol-broda/funnel/version"
+)
+
+const handshakeTimeout = 10 * time.Second
+
+// clientFeatures lists the protocol features this client can negotiate
+var clientFeatures = []string{shared.FeatureBinaryFraming, shared.FeatureHealthCheck, shared.FeatureStreaming, shared.FeatureFlowControl, shared.FeatureCompression}
+
+// RejectedError is returned when the server refuses the handshake. retrying
+// with the same client will not help, so callers should stop reconnecting.
+type RejectedError struct {
+	Reason string
+}
+
+func (e *RejectedError) Error() string {
+	return "server rejected connection: " + e.Reason
+}
+
+func (c *Client) handshake(conn *websocket.Conn) error {
+	logger := c.tunnelLogger("client.handshake")
+
+	info := version.GetBuildInfo()
+	hello := &shared.Message{
+		Type:     "hello",
+		TunnelID: c.TunnelID,
+		Hello: &shared.Hello{
+			ClientVersion:   info.Version,
+			GitCommit:       info.GitCommit,
+			ProtocolVersion: shared.ProtocolVersion,
+			Features:        clientFeatures,
+			Hostnames:       c.Hostnames,
+			Timeouts:        c.Timeouts,
+			BodyLimits:      c.BodyLimits,
+		},
+	}
+
+	deadline := time.Now().Add(handshakeTimeout)
+	if err := conn.SetWriteDeadline(deadline); err != nil {
+		return fmt.Errorf("failed to set handshake write deadline: %w", err)
+	}
+	if err := conn.WriteJSON(hello); err != nil {
+		return fmt.Errorf("failed to send hello: %w", err)
+	}
+
+	if err := conn.SetReadDeadline(deadline); err != nil {
+		return fmt.Errorf("failed to set handshake read deadline: %w", err)
+	}
+
+	var msg shared.Message
+	if err := conn.ReadJSON(&msg); err != nil {
+		var closeErr *websocket.CloseError
+		if errors.As(err, &closeErr) && closeErr.Code == websocket.ClosePolicyViolation {
+			return &RejectedError{Reason: closeErr.Text}
+		}
+		return fmt.Errorf("failed to read welcome: %w", err)
+	}
+
+	switch msg.Type {
+	case "welcome":
+	case "rejected":
+		return &RejectedError{Reason: msg.Error}
+	default:
+		return fmt.Errorf("expected welcome message, got %q", msg.Type)
+	}
+
+	if msg.Welcome == nil {
+		return errors.New("welcome message has no payload")
+	}
+
+	if err := shared.CheckProtocolVersion(msg.Welcome.ProtocolVersion); err != nil {
+		return &RejectedError{Reason: fmt.Sprintf("server %s is incompatible with this client: %v", msg.Welcome.ServerVersion, err)}
+	}
+
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return fmt.Errorf("failed to clear handshake read deadline: %w", err)
+	}
+	if err := conn.SetWriteDeadline(time.Time{}); err != nil {
+		return fmt.Errorf("failed to clear handshake write deadline: %w", err)
+	}
+
+	welcome := msg.Welcome
+	if welcome.TunnelID != "" {
+		c.TunnelID = welcome.TunnelID
+	}
+	c.PublicURL = welcome.PublicURL
+	c.Limits = welcome.Limits
+	c.features = shared.NegotiateFeatures(welcome.Features, clientFeatures)
+	c.binaryFraming = shared.HasFeature(c.features, shared.FeatureBinaryFraming)
+	if shared.HasFeature(c.features, shared.FeatureFlowControl) {
+		tunnelWindow, streamWindow := welcome.Limits.TunnelWindow, welcome.Limits.StreamWindow
+		if tunnelWindow <= 0 {
+			tunnelWindow = shared.DefaultTunnelWindow
+		}
+		if streamWindow <= 0 {
+			streamWindow = shared.DefaultStreamWindow
+		}
+		c.flow = shared.NewFlowWindow(tunnelWindow, streamWindow)
+		c.credit = shared.NewCreditLedger(tunnelWindow, streamWindow)
+	}
+	c.compressionThreshold = 0
+	if shared.HasFeature(c.features, shared.FeatureCompression) {
+		c.compressionThreshold = welcome.Limits.CompressionThreshold
+		if c.compressionThreshold <= 0 {
+			c.compressionThreshold = shared.DefaultCompressionThreshold
+		}
+	}
+
+	if len(c.Hostnames) > 0 && len(welcome.Hostnames) == 0 {
+		logger.Warn().Strs("hostnames", c.Hostnames).Msg("server did not accept any custom hostnames, it may not support them")
+	}
+	c.Hostnames = welcome.Hostnames
+
+	logger.Info().
+		Str("server_version", welcome.ServerVersion).
+		Int("protocol_version", welcome.ProtocolVersion).
+		Strs("features", c.features).
+		Int64("request_timeout_ms", welcome.Limits.RequestTimeoutMs).
+		Int("path_timeouts", len(welcome.Limits.Timeouts.Paths)).
+		Int64("max_request_body", welcome.Limits.BodyLimits.MaxRequestBody).
+		Int64("max_response_body", welcome.Limits.BodyLimits.MaxResponseBody).
+		Str("public_url", welcome.PublicURL).
+		Strs("hostnames", welcome.Hostnames).
+		Msg("handshake completed")
+
+	return nil
+}
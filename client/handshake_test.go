@@ -0,0 +1,265 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/karol-broda/funnel/shared"
+)
+
+// newHandshakeServer starts a websocket server that answers the hello with reply
+func newHandshakeServer(t *testing.T, reply func(conn *websocket.Conn, hello *shared.Message)) *httptest.Server {
+	t.Helper()
+
+	upgrader := websocket.Upgrader{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		var hello shared.Message
+		if err := conn.ReadJSON(&hello); err != nil {
+			return
+		}
+		reply(conn, &hello)
+
+		// keep the connection open until the client goes away
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		conn.ReadMessage()
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestClientHandshakeWelcome(t *testing.T) {
+	var received *shared.Hello
+	ts := newHandshakeServer(t, func(conn *websocket.Conn, hello *shared.Message) {
+		received = hello.Hello
+		conn.WriteJSON(&shared.Message{
+			Type: "welcome",
+			Welcome: &shared.Welcome{
+				TunnelID:        "assigned-id",
+				PublicURL:       "https://assigned-id.tunnel.example.com",
+				ServerVersion:   "9.9.9",
+				ProtocolVersion: shared.ProtocolVersion,
+				Features:        []string{shared.FeatureBinaryFraming},
+				Limits:          shared.Limits{RequestTimeoutMs: 30000},
+			},
+		})
+	})
+
+	c := New("my-tunnel", ts.URL, "localhost:3000", "")
+	defer c.Close()
+
+	if err := c.connect(context.Background()); err != nil {
+		t.Fatalf("connect failed: %v", err)
+	}
+
+	if received == nil {
+		t.Fatal("server did not receive a hello payload")
+	}
+	if received.ProtocolVersion != shared.ProtocolVersion {
+		t.Errorf("expected protocol version %d, got %d", shared.ProtocolVersion, received.ProtocolVersion)
+	}
+	if received.ClientVersion == "" {
+		t.Error("expected client version to be sent")
+	}
+
+	if c.TunnelID != "assigned-id" {
+		t.Errorf("expected tunnel id from welcome, got %s", c.TunnelID)
+	}
+	if c.PublicURL != "https://assigned-id.tunnel.example.com" {
+		t.Errorf("unexpected public url %s", c.PublicURL)
+	}
+	if c.Limits.RequestTimeoutMs != 30000 {
+		t.Errorf("expected limits to be stored, got %+v", c.Limits)
+	}
+	if !c.binaryFraming {
+		t.Error("expected binary framing to be negotiated")
+	}
+}
+
+func TestClientHandshakeRejected(t *testing.T) {
+	tests := []struct {
+		name   string
+		reply  func(conn *websocket.Conn, hello *shared.Message)
+		reason string
+	}{
+		{
+			name: "rejected message",
+			reply: func(conn *websocket.Conn, hello *shared.Message) {
+				conn.WriteJSON(&shared.Message{Type: "rejected", Error: "please upgrade funnel"})
+			},
+			reason: "please upgrade funnel",
+		},
+		{
+			name: "policy violation close",
+			reply: func(conn *websocket.Conn, hello *shared.Message) {
+				conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "too old"),
+					time.Now().Add(time.Second))
+			},
+			reason: "too old",
+		},
+		{
+			name: "incompatible server protocol",
+			reply: func(conn *websocket.Conn, hello *shared.Message) {
+				conn.WriteJSON(&shared.Message{
+					Type:    "welcome",
+					Welcome: &shared.Welcome{ProtocolVersion: shared.ProtocolVersion + 1},
+				})
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newHandshakeServer(t, tt.reply)
+
+			c := New("my-tunnel", ts.URL, "localhost:3000", "")
+			defer c.Close()
+
+			err := c.connect(context.Background())
+
+			var rejected *RejectedError
+			if !errors.As(err, &rejected) {
+				t.Fatalf("expected RejectedError, got %v", err)
+			}
+			if tt.reason != "" && rejected.Reason != tt.reason {
+				t.Errorf("expected reason %q, got %q", tt.reason, rejected.Reason)
+			}
+		})
+	}
+}
+
+func TestClientOmitsEmptyTunnelID(t *testing.T) {
+	var query string
+	ts := newHandshakeServer(t, func(conn *websocket.Conn, hello *shared.Message) {
+		conn.WriteJSON(&shared.Message{
+			Type:    "welcome",
+			Welcome: &shared.Welcome{TunnelID: "generated-id", ProtocolVersion: shared.ProtocolVersion},
+		})
+	})
+	handler := ts.Config.Handler
+	ts.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.RawQuery
+		handler.ServeHTTP(w, r)
+	})
+
+	c := New("", ts.URL, "localhost:3000", "")
+	defer c.Close()
+
+	if err := c.connect(context.Background()); err != nil {
+		t.Fatalf("connect failed: %v", err)
+	}
+
+	if query != "" {
+		t.Errorf("expected no query string, got %q", query)
+	}
+	if c.TunnelID != "generated-id" {
+		t.Errorf("expected server-assigned id, got %s", c.TunnelID)
+	}
+}
+
+func TestClientUpgradeRefused(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "tunnel id is reserved", http.StatusForbidden)
+	}))
+	defer ts.Close()
+
+	c := New("admin", ts.URL, "localhost:3000", "")
+	defer c.Close()
+
+	err := c.connect(context.Background())
+
+	var rejected *RejectedError
+	if !errors.As(err, &rejected) {
+		t.Fatalf("expected RejectedError, got %v", err)
+	}
+	if rejected.Reason != "tunnel id is reserved" {
+		t.Errorf("unexpected reason %q", rejected.Reason)
+	}
+}
+
+func TestClientHandshakeHostnames(t *testing.T) {
+	var requested []string
+	ts := newHandshakeServer(t, func(conn *websocket.Conn, hello *shared.Message) {
+		requested = hello.Hello.Hostnames
+		conn.WriteJSON(&shared.Message{
+			Type: "welcome",
+			Welcome: &shared.Welcome{
+				TunnelID:        "my-tunnel",
+				ProtocolVersion: shared.ProtocolVersion,
+				Hostnames:       []string{"demo.customer.com"},
+			},
+		})
+	})
+
+	c := New("my-tunnel", ts.URL, "localhost:3000", "")
+	c.Hostnames = []string{"Demo.Customer.com"}
+	defer c.Close()
+
+	if err := c.connect(context.Background()); err != nil {
+		t.Fatalf("connect failed: %v", err)
+	}
+
+	if len(requested) != 1 || requested[0] != "Demo.Customer.com" {
+		t.Errorf("expected hostnames in hello, got %v", requested)
+	}
+	if len(c.Hostnames) != 1 || c.Hostnames[0] != "demo.customer.com" {
+		t.Errorf("expected accepted hostnames from welcome, got %v", c.Hostnames)
+	}
+}
+
+func TestClientHandshakeCompression(t *testing.T) {
+	tests := []struct {
+		name      string
+		features  []string
+		threshold int
+		expected  int
+	}{
+		{"announced threshold", []string{shared.FeatureCompression}, 512, 512},
+		{"default threshold", []string{shared.FeatureCompression}, 0, shared.DefaultCompressionThreshold},
+		{"not offered", nil, 512, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var offered []string
+			ts := newHandshakeServer(t, func(conn *websocket.Conn, hello *shared.Message) {
+				offered = hello.Hello.Features
+				conn.WriteJSON(&shared.Message{
+					Type: "welcome",
+					Welcome: &shared.Welcome{
+						TunnelID:        "my-tunnel",
+						ProtocolVersion: shared.ProtocolVersion,
+						Features:        tt.features,
+						Limits:          shared.Limits{CompressionThreshold: tt.threshold},
+					},
+				})
+			})
+
+			c := New("my-tunnel", ts.URL, "localhost:3000", "")
+			defer c.Close()
+			// a threshold left over from an earlier connection must not survive
+			c.compressionThreshold = 2048
+
+			if err := c.connect(context.Background()); err != nil {
+				t.Fatalf("connect failed: %v", err)
+			}
+			if !shared.HasFeature(offered, shared.FeatureCompression) {
+				t.Errorf("expected compression to be offered, got %v", offered)
+			}
+			if c.compressionThreshold != tt.expected {
+				t.Errorf("compressionThreshold = %d, want %d", c.compressionThreshold, tt.expected)
+			}
+		})
+	}
+}
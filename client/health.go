@@ -0,0 +1,144 @@
+package client
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/karol-broda/funnel/shared"
+)
+
+const (
+	defaultHealthInterval = 10 * time.Second
+	defaultHealthTimeout  = 5 * time.Second
+	// healthFailureThreshold consecutive failed probes mark the local service unhealthy
+	healthFailureThreshold = 2
+)
+
+// HealthCheck configures probing of the local service. while it is unhealthy
+// the server answers visitors with an offline page instead of forwarding requests.
+type HealthCheck struct {
+	Path     string        `json:"path"`
+	Interval time.Duration `json:"interval,omitempty"`
+	Timeout  time.Duration `json:"timeout,omitempty"`
+}
+
+func (c *Client) startHealthChecks() {
+	if c.HealthCheck == nil {
+		return
+	}
+
+	logger := c.tunnelLogger("client.health")
+	if !shared.HasFeature(c.features, shared.FeatureHealthCheck) {
+		logger.Warn().Msg("server does not support health checks, local service health is not reported")
+		return
+	}
+
+	go c.runHealthChecks(*c.HealthCheck)
+}
+
+func (c *Client) runHealthChecks(check HealthCheck) {
+	logger := c.tunnelLogger("client.health")
+
+	interval := check.Interval
+	if interval <= 0 {
+		interval = defaultHealthInterval
+	}
+	timeout := check.Timeout
+	if timeout <= 0 {
+		timeout = defaultHealthTimeout
+	}
+	path := check.Path
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	httpClient := &http.Client{
+		Timeout: timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	logger.Info().
+		Str("path", path).
+		Dur("interval", interval).
+		Dur("timeout", timeout).
+		Msg("health checks of the local service started")
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var reported *shared.Health
+	failures := 0
+	for {
+		health := c.probeHealth(httpClient, path)
+		if health.Healthy {
+			failures = 0
+		} else {
+			failures++
+		}
+
+		// a single failed probe is not enough to take the tunnel offline
+		settled := health.Healthy || failures >= healthFailureThreshold
+		if settled && (reported == nil || reported.Healthy != health.Healthy) {
+			if health.Healthy {
+				logger.Info().Int("status", health.Status).Msg("local service is healthy")
+			} else {
+				logger.Warn().
+					Int("status", health.Status).
+					Str("error", health.Error).
+					Int("failures", failures).
+					Msg("local service is unhealthy")
+			}
+
+			// when the message is dropped it is sent again on the next probe
+			if c.sendHealth(&health) {
+				reported = &health
+			}
+		}
+
+		select {
+		case <-c.ctx.Done():
+			logger.Debug().Msg("context cancelled, stopping health checks")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *Client) probeHealth(httpClient *http.Client, path string) shared.Health {
+	req, err := http.NewRequestWithContext(c.ctx, http.MethodGet, "http://"+c.LocalAddr+path, nil)
+	if err != nil {
+		return shared.Health{Error: err.Error()}
+	}
+	req.Header.Set("User-Agent", "funnel-health-check")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return shared.Health{Error: err.Error()}
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	resp.Body.Close()
+
+	return shared.Health{Healthy: resp.StatusCode < 400, Status: resp.StatusCode}
+}
+
+func (c *Client) sendHealth(health *shared.Health) bool {
+	// Close cancels the context before closing the outgoing channel
+	if c.ctx.Err() != nil {
+		return false
+	}
+
+	select {
+	case c.outgoingMessages <- &shared.Message{Type: "health", Health: health}:
+		return true
+	case <-c.ctx.Done():
+		return false
+	default:
+		logger := c.tunnelLogger("client.health")
+		logger.Warn().Msg("outgoing message channel full, cannot queue health report")
+		return false
+	}
+}
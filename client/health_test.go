@@ -0,0 +1,96 @@
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/karol-broda/funnel/shared"
+)
+
+func nextHealthReport(t *testing.T, c *Client) *shared.Health {
+	t.Helper()
+
+	select {
+	case msg := <-c.outgoingMessages:
+		if msg.Type != "health" || msg.Health == nil {
+			t.Fatalf("unexpected message %+v", msg)
+		}
+		return msg.Health
+	case <-time.After(5 * time.Second):
+		t.Fatal("no health report sent")
+		return nil
+	}
+}
+
+func TestClient_HealthChecks(t *testing.T) {
+	var status atomic.Int32
+	status.Store(http.StatusOK)
+	var probes atomic.Int32
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			t.Errorf("probe path = %q, want /healthz", r.URL.Path)
+		}
+		probes.Add(1)
+		w.WriteHeader(int(status.Load()))
+	}))
+	defer local.Close()
+
+	c := New("myapp", "ws://unused", strings.TrimPrefix(local.URL, "http://"), "")
+	defer c.Close()
+	c.features = []string{shared.FeatureHealthCheck}
+	c.HealthCheck = &HealthCheck{Path: "healthz", Interval: 10 * time.Millisecond}
+	c.startHealthChecks()
+
+	if health := nextHealthReport(t, c); !health.Healthy || health.Status != http.StatusOK {
+		t.Fatalf("first report = %+v, want healthy", health)
+	}
+
+	status.Store(http.StatusServiceUnavailable)
+	before := probes.Load()
+	health := nextHealthReport(t, c)
+	if health.Healthy || health.Status != http.StatusServiceUnavailable {
+		t.Fatalf("report = %+v, want unhealthy with 503", health)
+	}
+	if probes.Load()-before < healthFailureThreshold {
+		t.Errorf("reported unhealthy after %d probes, want at least %d", probes.Load()-before, healthFailureThreshold)
+	}
+
+	status.Store(http.StatusNoContent)
+	if health := nextHealthReport(t, c); !health.Healthy {
+		t.Fatalf("report = %+v, want healthy again", health)
+	}
+}
+
+func TestClient_HealthChecksUnreachable(t *testing.T) {
+	local := httptest.NewServer(http.NotFoundHandler())
+	addr := strings.TrimPrefix(local.URL, "http://")
+	local.Close()
+
+	c := New("myapp", "ws://unused", addr, "")
+	defer c.Close()
+	c.features = []string{shared.FeatureHealthCheck}
+	c.HealthCheck = &HealthCheck{Path: "/", Interval: 10 * time.Millisecond}
+	c.startHealthChecks()
+
+	health := nextHealthReport(t, c)
+	if health.Healthy || health.Status != 0 || health.Error == "" {
+		t.Errorf("report = %+v, want unhealthy with an error", health)
+	}
+}
+
+func TestClient_HealthChecksNotNegotiated(t *testing.T) {
+	c := New("myapp", "ws://unused", "localhost:1", "")
+	defer c.Close()
+	c.HealthCheck = &HealthCheck{Path: "/", Interval: 10 * time.Millisecond}
+	c.startHealthChecks()
+
+	select {
+	case msg := <-c.outgoingMessages:
+		t.Errorf("unexpected message %+v to a server without health checks", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
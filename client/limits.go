@@ -0,0 +1,36 @@
+package client
+
+import (
+	"fmt"
+
+	"github.com/karol-broda/funnel/shared"
+)
+
+// ParseBodyLimits returns the body limits a client asks the server for from
+// sizes like 10MB, nil when both are left to the server. the server never
+// raises its own limits for a client, only lowers them.
+func ParseBodyLimits(request, response string) (*shared.BodyLimits, error) {
+	var limits shared.BodyLimits
+	for _, limit := range []struct {
+		name  string
+		size  string
+		value *int64
+	}{
+		{"request", request, &limits.MaxRequestBody},
+		{"response", response, &limits.MaxResponseBody},
+	} {
+		if limit.size == "" {
+			continue
+		}
+		size, err := shared.ParseByteSize(limit.size)
+		if err != nil {
+			return nil, fmt.Errorf("invalid max %s body: %w", limit.name, err)
+		}
+		*limit.value = size
+	}
+
+	if limits == (shared.BodyLimits{}) {
+		return nil, nil
+	}
+	return &limits, nil
+}
@@ -0,0 +1,95 @@
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/karol-broda/funnel/shared"
+)
+
+func TestParseBodyLimits(t *testing.T) {
+	limits, err := ParseBodyLimits("10MB", "")
+	if err != nil {
+		t.Fatalf("ParseBodyLimits() error = %v", err)
+	}
+	if limits == nil || *limits != (shared.BodyLimits{MaxRequestBody: 10 << 20}) {
+		t.Errorf("ParseBodyLimits() = %v, want a 10MiB request limit", limits)
+	}
+
+	if limits, err := ParseBodyLimits("", ""); err != nil || limits != nil {
+		t.Errorf("ParseBodyLimits() = %v, %v, want nil without limits", limits, err)
+	}
+	if _, err := ParseBodyLimits("", "lots"); err == nil {
+		t.Error("expected an error for an invalid size")
+	}
+}
+
+func TestClient_processRequest_ResponseBodyLimit(t *testing.T) {
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/small":
+			w.Write(make([]byte, 100))
+		case "/declared":
+			w.Header().Set("Content-Length", "4096")
+			w.Write(make([]byte, 4096))
+		default:
+			// no content length, so the size only shows while reading
+			for i := 0; i < 8; i++ {
+				w.Write(make([]byte, 512))
+				w.(http.Flusher).Flush()
+			}
+		}
+	}))
+	defer local.Close()
+
+	c := New("test-tunnel", "http://localhost:8080", strings.TrimPrefix(local.URL, "http://"), "")
+	defer c.cancel()
+	c.Limits.BodyLimits.MaxResponseBody = 1024
+
+	receive := func() *shared.Message {
+		t.Helper()
+		select {
+		case msg := <-c.outgoingMessages:
+			return msg
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for a message")
+			return nil
+		}
+	}
+	request := func(path string) *shared.Message {
+		t.Helper()
+		go c.processRequest(local.Client(), shared.Message{Type: "request", RequestID: "req-" + path, Method: "GET", Path: path})
+		return receive()
+	}
+
+	if resp := request("/small"); resp.Status != http.StatusOK || len(resp.Body) != 100 {
+		t.Errorf("/small answered %d with %d bytes, want the body", resp.Status, len(resp.Body))
+	}
+	for _, path := range []string{"/declared", "/chunked"} {
+		if resp := request(path); resp.Status != http.StatusBadGateway {
+			t.Errorf("%s answered %d, want 502", path, resp.Status)
+		}
+	}
+
+	c.features = []string{shared.FeatureStreaming}
+	if resp := request("/stream"); resp.Status != http.StatusOK || !resp.Stream {
+		t.Fatalf("/stream answered %d stream %v, want a streamed response", resp.Status, resp.Stream)
+	}
+	sent := 0
+	for {
+		chunk := receive()
+		sent += len(chunk.Body)
+		if chunk.End {
+			if chunk.Error == "" {
+				t.Error("stream ended without an error, want it broken off")
+			}
+			break
+		}
+	}
+	if sent > 1024 {
+		t.Errorf("streamed %d bytes, want no more than the limit", sent)
+	}
+}
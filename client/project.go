@@ -0,0 +1,411 @@
+package client
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/karol-broda/funnel/shared"
+)
+
+// ProjectFileName is the file `funnel up` looks for in the working directory and its parents
+const ProjectFileName = "funnel.toml"
+
+const (
+	ProtocolHTTP = "http"
+	// ProtocolH2C speaks http/2 without tls to the local service, e.g. a grpc server
+	ProtocolH2C = "h2c"
+)
+
+// Project is a funnel.toml declaring the tunnels of a project, meant to be
+// checked into the repository
+type Project struct {
+	// Inlet is the default inlet for tunnels that do not name one
+	Inlet   string            `toml:"inlet,omitempty"`
+	Tunnels map[string]Tunnel `toml:"tunnels"`
+
+	path string
+}
+
+// Tunnel is a named tunnel in a project file
+type Tunnel struct {
+	ID        string   `toml:"id,omitempty"`
+	Local     string   `toml:"local"`
+	Protocol  string   `toml:"protocol,omitempty"`
+	Inlet     string   `toml:"inlet,omitempty"`
+	Hostnames []string `toml:"hostnames,omitempty"`
+	// Pool lets several machines serve the same id, see shared.PoolStrategies
+	Pool string `toml:"pool,omitempty"`
+	// Routes send the requests below some paths to other local services
+	Routes []Route `toml:"routes,omitempty"`
+	// Auth protects the tunnel with basic auth, as user:password. environment
+	// variables are expanded so credentials can stay out of the repository.
+	Auth string `toml:"auth,omitempty"`
+	// Headers are set on every request forwarded to the local service,
+	// environment variables are expanded
+	Headers map[string]string `toml:"headers,omitempty"`
+	// RequestHeaders and ResponseHeaders rewrite the headers going to and
+	// coming from the local service, see HeaderRules
+	RequestHeaders  *HeaderRuleSet `toml:"request_headers,omitempty"`
+	ResponseHeaders *HeaderRuleSet `toml:"response_headers,omitempty"`
+	// HealthCheck is a path on the local service probed periodically, the
+	// server shows an offline page while it fails
+	HealthCheck    string `toml:"health_check,omitempty"`
+	HealthInterval string `toml:"health_interval,omitempty"`
+	// Timeouts asks the server for request timeouts other than its defaults
+	Timeouts *ProjectTimeouts `toml:"timeouts,omitempty"`
+	// MaxRequestBody and MaxResponseBody ask the server for smaller body
+	// limits than its own, as sizes like 10MB
+	MaxRequestBody  string `toml:"max_request_body,omitempty"`
+	MaxResponseBody string `toml:"max_response_body,omitempty"`
+}
+
+// ProjectTimeouts are the request timeouts of a tunnel as durations like 2m,
+// Paths maps a path prefix to the total timeout of the requests below it
+type ProjectTimeouts struct {
+	Connect string            `toml:"connect,omitempty"`
+	Header  string            `toml:"header,omitempty"`
+	Idle    string            `toml:"idle,omitempty"`
+	Total   string            `toml:"total,omitempty"`
+	Paths   map[string]string `toml:"paths,omitempty"`
+}
+
+// build converts the durations into the timeouts sent to the server
+func (t *ProjectTimeouts) build() (*shared.TunnelTimeouts, error) {
+	var durations [4]time.Duration
+	for i, value := range []string{t.Connect, t.Header, t.Idle, t.Total} {
+		if value == "" {
+			continue
+		}
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timeout %q: %w", value, err)
+		}
+		durations[i] = duration
+	}
+
+	paths := make(map[string]time.Duration, len(t.Paths))
+	for prefix, value := range t.Paths {
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timeout for %s: %w", prefix, err)
+		}
+		paths[prefix] = duration
+	}
+
+	return BuildTimeouts(durations[0], durations[1], durations[2], durations[3], paths)
+}
+
+// FindProjectFile looks for funnel.toml in dir and its parents
+func FindProjectFile(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve directory: %w", err)
+	}
+
+	for {
+		path := filepath.Join(dir, ProjectFileName)
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", fmt.Errorf("no %s found in the current directory or its parents", ProjectFileName)
+		}
+		dir = parent
+	}
+}
+
+// LoadProject reads and validates a project file
+func LoadProject(path string) (*Project, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve project file: %w", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read project file %s: %w", path, err)
+	}
+
+	project := &Project{}
+	if err := toml.Unmarshal(data, project); err != nil {
+		return nil, fmt.Errorf("failed to parse project file %s: %w", path, err)
+	}
+	project.path = path
+
+	if err := project.validate(); err != nil {
+		return nil, fmt.Errorf("invalid project file %s: %w", path, err)
+	}
+
+	return project, nil
+}
+
+func (p *Project) validate() error {
+	if len(p.Tunnels) == 0 {
+		return fmt.Errorf("no tunnels defined")
+	}
+
+	for name, tunnel := range p.Tunnels {
+		if tunnel.Local == "" {
+			return fmt.Errorf("tunnel '%s' has no local address", name)
+		}
+		if tunnel.Protocol != "" && tunnel.Protocol != ProtocolHTTP && tunnel.Protocol != ProtocolH2C {
+			return fmt.Errorf("tunnel '%s' uses unsupported protocol %q", name, tunnel.Protocol)
+		}
+		if tunnel.Pool != "" {
+			if tunnel.ID == "" {
+				return fmt.Errorf("tunnel '%s' needs an id to join a pool", name)
+			}
+			if err := shared.ValidatePoolStrategy(tunnel.Pool); err != nil {
+				return fmt.Errorf("tunnel '%s': %w", name, err)
+			}
+		}
+		if tunnel.HealthInterval != "" {
+			if tunnel.HealthCheck == "" {
+				return fmt.Errorf("tunnel '%s' sets health_interval without health_check", name)
+			}
+			if _, err := time.ParseDuration(tunnel.HealthInterval); err != nil {
+				return fmt.Errorf("tunnel '%s' has an invalid health_interval: %w", name, err)
+			}
+		}
+		if tunnel.ID != "" {
+			if err := shared.ValidateTunnelID(tunnel.ID); err != nil {
+				return fmt.Errorf("tunnel '%s' has an invalid id: %w", name, err)
+			}
+		}
+		if tunnel.Timeouts != nil {
+			if _, err := tunnel.Timeouts.build(); err != nil {
+				return fmt.Errorf("tunnel '%s': %w", name, err)
+			}
+		}
+		if _, err := ParseBodyLimits(tunnel.MaxRequestBody, tunnel.MaxResponseBody); err != nil {
+			return fmt.Errorf("tunnel '%s': %w", name, err)
+		}
+		if err := ValidateRoutes(tunnel.Routes); err != nil {
+			return fmt.Errorf("tunnel '%s': %w", name, err)
+		}
+		if rules := tunnel.headerRules(); rules != nil {
+			if err := rules.Validate(); err != nil {
+				return fmt.Errorf("tunnel '%s': %w", name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Path returns the absolute path of the project file
+func (p *Project) Path() string {
+	return p.path
+}
+
+// Select returns the requested tunnel names in order, or all tunnels sorted by
+// name when none are given
+func (p *Project) Select(names []string) ([]string, error) {
+	if len(names) == 0 {
+		names = make([]string, 0, len(p.Tunnels))
+		for name := range p.Tunnels {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return names, nil
+	}
+
+	for _, name := range names {
+		if _, ok := p.Tunnels[name]; !ok {
+			return nil, fmt.Errorf("tunnel '%s' is not defined in %s", name, p.path)
+		}
+	}
+	return names, nil
+}
+
+// Options resolves a tunnel into runner options, taking the server, token and
+// client certificate from its inlet
+func (p *Project) Options(cm *ConfigManager, name string) (Options, error) {
+	tunnel, ok := p.Tunnels[name]
+	if !ok {
+		return Options{}, fmt.Errorf("tunnel '%s' is not defined", name)
+	}
+
+	inletName := tunnel.Inlet
+	if inletName == "" {
+		inletName = p.Inlet
+	}
+	if inletName == "" {
+		inletName = "default"
+	}
+
+	inlet, err := cm.GetInlet(inletName)
+	if err != nil {
+		return Options{}, fmt.Errorf("tunnel '%s': %w", name, err)
+	}
+
+	token, err := cm.ResolveToken(inlet)
+	if err != nil {
+		return Options{}, fmt.Errorf("tunnel '%s': failed to resolve token for inlet '%s': %w", name, inletName, err)
+	}
+
+	opts := Options{
+		TunnelID:       tunnel.ID,
+		ServerURL:      inlet.Server,
+		LocalAddr:      NormalizeLocalAddr(tunnel.Local),
+		Token:          token,
+		Hostnames:      tunnel.Hostnames,
+		Routes:         normalizeRoutes(tunnel.Routes),
+		Pool:           tunnel.Pool,
+		H2C:            tunnel.Protocol == ProtocolH2C,
+		ClientCertFile: inlet.ClientCert,
+		ClientKeyFile:  inlet.ClientKey,
+	}
+
+	if tunnel.Auth != "" {
+		user, password, ok := strings.Cut(os.ExpandEnv(tunnel.Auth), ":")
+		if !ok || user == "" || password == "" {
+			return Options{}, fmt.Errorf("tunnel '%s': auth must be user:password", name)
+		}
+		opts.BasicAuth = &BasicAuth{Username: user, Password: password}
+	}
+
+	if len(tunnel.Headers) > 0 {
+		opts.Headers = make(map[string]string, len(tunnel.Headers))
+		for key, value := range tunnel.Headers {
+			opts.Headers[key] = os.ExpandEnv(value)
+		}
+	}
+
+	opts.HeaderRules = tunnel.headerRules()
+	// validated when the project was loaded
+	opts.BodyLimits, _ = ParseBodyLimits(tunnel.MaxRequestBody, tunnel.MaxResponseBody)
+
+	if tunnel.Timeouts != nil {
+		// validated when the project was loaded
+		opts.Timeouts, _ = tunnel.Timeouts.build()
+	}
+
+	if tunnel.HealthCheck != "" {
+		opts.HealthCheck = &HealthCheck{Path: tunnel.HealthCheck}
+		if tunnel.HealthInterval != "" {
+			// validated when the project was loaded
+			opts.HealthCheck.Interval, _ = time.ParseDuration(tunnel.HealthInterval)
+		}
+	}
+
+	return opts, nil
+}
+
+// headerRules combines the request and response header rules of a tunnel,
+// expanding environment variables in their values
+func (t Tunnel) headerRules() *HeaderRules {
+	if t.RequestHeaders == nil && t.ResponseHeaders == nil {
+		return nil
+	}
+	rules := &HeaderRules{}
+	if t.RequestHeaders != nil {
+		rules.Request = t.RequestHeaders.expandEnv()
+	}
+	if t.ResponseHeaders != nil {
+		rules.Response = t.ResponseHeaders.expandEnv()
+	}
+	return rules
+}
+
+func (s HeaderRuleSet) expandEnv() HeaderRuleSet {
+	expand := func(values map[string]string) map[string]string {
+		if values == nil {
+			return nil
+		}
+		expanded := make(map[string]string, len(values))
+		for key, value := range values {
+			expanded[key] = os.ExpandEnv(value)
+		}
+		return expanded
+	}
+	return HeaderRuleSet{Remove: s.Remove, Set: expand(s.Set), Add: expand(s.Add)}
+}
+
+// NormalizeLocalAddr turns a bare port into a localhost address
+func NormalizeLocalAddr(local string) string {
+	if strings.Contains(local, ":") {
+		return local
+	}
+	return "localhost:" + local
+}
+
+// ProjectState is written by `funnel up` so `funnel status` and `funnel down`
+// can find the running process
+type ProjectState struct {
+	PID       int                    `json:"pid"`
+	Project   string                 `json:"project"`
+	StartedAt time.Time              `json:"started_at"`
+	Tunnels   map[string]TunnelState `json:"tunnels"`
+}
+
+type TunnelState struct {
+	ID        string    `json:"id,omitempty"`
+	Local     string    `json:"local"`
+	PublicURL string    `json:"public_url,omitempty"`
+	Connected bool      `json:"connected"`
+	Error     string    `json:"error,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// ProjectStatePath returns where the state of a project file is kept, outside
+// of the project so it never ends up in the repository
+func ProjectStatePath(projectFile string) string {
+	stateDir := os.Getenv("XDG_STATE_HOME")
+	if stateDir == "" {
+		if homeDir, err := os.UserHomeDir(); err == nil {
+			stateDir = filepath.Join(homeDir, ".local", "state")
+		} else {
+			stateDir = os.TempDir()
+		}
+	}
+
+	sum := sha256.Sum256([]byte(projectFile))
+	return filepath.Join(stateDir, "funnel", "projects", hex.EncodeToString(sum[:8])+".json")
+}
+
+// LoadProjectState reads a state file, returning os.ErrNotExist when the
+// project is not running
+func LoadProjectState(path string) (*ProjectState, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	state := &ProjectState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("failed to parse state file %s: %w", path, err)
+	}
+	return state, nil
+}
+
+// Save writes the state atomically
+func (s *ProjectState) Save(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create state directory: %w", err)
+	}
+
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal state: %w", err)
+	}
+
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	return nil
+}
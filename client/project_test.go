@@ -0,0 +1,228 @@
+package client
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/karol-broda/funnel/shared"
+)
+
+func writeProjectFile(t *testing.T, dir, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, ProjectFileName)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("failed to write project file: %v", err)
+	}
+	return path
+}
+
+func TestFindProjectFile(t *testing.T) {
+	root := t.TempDir()
+	path := writeProjectFile(t, root, "[tunnels.web]\nlocal = \"3000\"\n")
+
+	nested := filepath.Join(root, "src", "app")
+	if err := os.MkdirAll(nested, 0755); err != nil {
+		t.Fatalf("failed to create dir: %v", err)
+	}
+
+	found, err := FindProjectFile(nested)
+	if err != nil {
+		t.Fatalf("FindProjectFile() error = %v", err)
+	}
+	if found != path {
+		t.Errorf("FindProjectFile() = %q, want %q", found, path)
+	}
+}
+
+func TestLoadProject_Invalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"no tunnels", "inlet = \"default\"\n"},
+		{"missing local", "[tunnels.web]\nid = \"web\"\n"},
+		{"unsupported protocol", "[tunnels.db]\nlocal = \"5432\"\nprotocol = \"tcp\"\n"},
+		{"invalid id", "[tunnels.web]\nlocal = \"3000\"\nid = \"Not Valid\"\n"},
+		{"invalid toml", "[tunnels.web\n"},
+		{"invalid health interval", "[tunnels.web]\nlocal = \"3000\"\nhealth_check = \"/healthz\"\nhealth_interval = \"often\"\n"},
+		{"pool without id", "[tunnels.web]\nlocal = \"3000\"\npool = \"round_robin\"\n"},
+		{"unknown pool strategy", "[tunnels.web]\nlocal = \"3000\"\nid = \"web\"\npool = \"random\"\n"},
+		{"health interval without check", "[tunnels.web]\nlocal = \"3000\"\nhealth_interval = \"5s\"\n"},
+		{"invalid timeout", "[tunnels.web]\nlocal = \"3000\"\n[tunnels.web.timeouts]\ntotal = \"forever\"\n"},
+		{"route without local", "[tunnels.web]\nlocal = \"3000\"\n[[tunnels.web.routes]]\nprefix = \"/api\"\n"},
+		{"invalid header rule", "[tunnels.web]\nlocal = \"3000\"\n[tunnels.web.response_headers.set]\n\"X-Host\" = \"{{.Nope}}\"\n"},
+		{"invalid body limit", "[tunnels.web]\nlocal = \"3000\"\nmax_request_body = \"lots\"\n"},
+		{"relative timeout path", "[tunnels.web]\nlocal = \"3000\"\n[tunnels.web.timeouts.paths]\n\"reports\" = \"10m\"\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeProjectFile(t, t.TempDir(), tt.content)
+			if _, err := LoadProject(path); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestProject_Options(t *testing.T) {
+	cm := newTestConfigManager(t)
+	if err := cm.SetServer("default", "https://tunnel.example.com"); err != nil {
+		t.Fatalf("SetServer() error = %v", err)
+	}
+	if err := cm.SetServer("staging", "https://staging.example.com"); err != nil {
+		t.Fatalf("SetServer() error = %v", err)
+	}
+	if err := cm.SetToken("staging", "sk_staging"); err != nil {
+		t.Fatalf("SetToken() error = %v", err)
+	}
+	t.Setenv("WEB_PASSWORD", "hunter2")
+
+	path := writeProjectFile(t, t.TempDir(), `
+[tunnels.web]
+id = "my-web"
+local = "3000"
+auth = "dev:${WEB_PASSWORD}"
+health_check = "/healthz"
+health_interval = "5s"
+max_request_body = "10MB"
+
+[tunnels.web.headers]
+X-Environment = "preview"
+
+[tunnels.web.request_headers]
+remove = ["Cookie"]
+set = { "X-Public-Host" = "{{.PublicHost}}" }
+
+[tunnels.web.response_headers]
+add = { "X-Served-By" = "${WEB_PASSWORD}" }
+
+[tunnels.web.timeouts]
+total = "2m"
+connect = "5s"
+
+[tunnels.web.timeouts.paths]
+"/reports" = "10m"
+
+[[tunnels.web.routes]]
+prefix = "/api/*"
+local = "8080"
+strip_prefix = true
+
+[tunnels.api]
+local = "127.0.0.1:8080"
+inlet = "staging"
+hostnames = ["api.example.com"]
+id = "acme-api"
+pool = "least_inflight"
+protocol = "h2c"
+`)
+
+	project, err := LoadProject(path)
+	if err != nil {
+		t.Fatalf("LoadProject() error = %v", err)
+	}
+
+	names, err := project.Select(nil)
+	if err != nil {
+		t.Fatalf("Select() error = %v", err)
+	}
+	if !reflect.DeepEqual(names, []string{"api", "web"}) {
+		t.Errorf("Select() = %v, want [api web]", names)
+	}
+	if _, err := project.Select([]string{"db"}); err == nil {
+		t.Error("expected an error for an unknown tunnel")
+	}
+
+	web, err := project.Options(cm, "web")
+	if err != nil {
+		t.Fatalf("Options(web) error = %v", err)
+	}
+	if web.TunnelID != "my-web" || web.LocalAddr != "localhost:3000" || web.ServerURL != "https://tunnel.example.com" {
+		t.Errorf("unexpected web options: %+v", web)
+	}
+	if web.BasicAuth == nil || web.BasicAuth.Username != "dev" || web.BasicAuth.Password != "hunter2" {
+		t.Errorf("BasicAuth = %+v, want dev/hunter2", web.BasicAuth)
+	}
+	if !reflect.DeepEqual(web.Routes, []Route{{Prefix: "/api/*", Local: "localhost:8080", StripPrefix: true}}) {
+		t.Errorf("Routes = %+v, want /api/* to localhost:8080", web.Routes)
+	}
+	expectedRules := &HeaderRules{
+		Request:  HeaderRuleSet{Remove: []string{"Cookie"}, Set: map[string]string{"X-Public-Host": "{{.PublicHost}}"}},
+		Response: HeaderRuleSet{Add: map[string]string{"X-Served-By": "hunter2"}},
+	}
+	if !reflect.DeepEqual(web.HeaderRules, expectedRules) {
+		t.Errorf("HeaderRules = %+v, want %+v", web.HeaderRules, expectedRules)
+	}
+	if web.Headers["X-Environment"] != "preview" {
+		t.Errorf("Headers = %v", web.Headers)
+	}
+	if web.HealthCheck == nil || web.HealthCheck.Path != "/healthz" || web.HealthCheck.Interval != 5*time.Second {
+		t.Errorf("HealthCheck = %+v, want /healthz every 5s", web.HealthCheck)
+	}
+	expectedTimeouts := &shared.TunnelTimeouts{
+		Timeouts: shared.Timeouts{ConnectMs: 5000, TotalMs: 120000},
+		Paths:    []shared.PathTimeouts{{Prefix: "/reports", Timeouts: shared.Timeouts{TotalMs: 600000}}},
+	}
+	if !reflect.DeepEqual(web.Timeouts, expectedTimeouts) {
+		t.Errorf("Timeouts = %+v, want %+v", web.Timeouts, expectedTimeouts)
+	}
+	if !reflect.DeepEqual(web.BodyLimits, &shared.BodyLimits{MaxRequestBody: 10 << 20}) {
+		t.Errorf("BodyLimits = %+v, want a 10MiB request limit", web.BodyLimits)
+	}
+
+	api, err := project.Options(cm, "api")
+	if err != nil {
+		t.Fatalf("Options(api) error = %v", err)
+	}
+	if api.ServerURL != "https://staging.example.com" || api.Token != "sk_staging" || api.LocalAddr != "127.0.0.1:8080" {
+		t.Errorf("unexpected api options: %+v", api)
+	}
+	if !reflect.DeepEqual(api.Hostnames, []string{"api.example.com"}) {
+		t.Errorf("Hostnames = %v", api.Hostnames)
+	}
+	if api.Pool != shared.PoolLeastInFlight {
+		t.Errorf("Pool = %q, want least_inflight", api.Pool)
+	}
+	if !api.H2C || web.H2C {
+		t.Errorf("H2C = %v for api and %v for web, want only api", api.H2C, web.H2C)
+	}
+	if api.HealthCheck != nil {
+		t.Errorf("HealthCheck = %+v, want none", api.HealthCheck)
+	}
+	if api.Timeouts != nil {
+		t.Errorf("Timeouts = %+v, want the server defaults", api.Timeouts)
+	}
+	if api.BodyLimits != nil {
+		t.Errorf("BodyLimits = %+v, want the server limits", api.BodyLimits)
+	}
+}
+
+func TestProjectState_SaveLoad(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+
+	path := ProjectStatePath("/work/app/funnel.toml")
+	if path == ProjectStatePath("/work/other/funnel.toml") {
+		t.Fatal("different projects must not share a state file")
+	}
+
+	state := &ProjectState{
+		PID:     42,
+		Project: "/work/app/funnel.toml",
+		Tunnels: map[string]TunnelState{"web": {ID: "my-web", Local: "localhost:3000", Connected: true}},
+	}
+	if err := state.Save(path); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+
+	loaded, err := LoadProjectState(path)
+	if err != nil {
+		t.Fatalf("LoadProjectState() error = %v", err)
+	}
+	if loaded.PID != 42 || !loaded.Tunnels["web"].Connected {
+		t.Errorf("unexpected state: %+v", loaded)
+	}
+}
@@ -3,14 +3,21 @@ package client
 import (
 	"bytes"
 	"context"
+	"crypto/subtle"
 	"errors"
 	"io"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/karol-broda/funnel/shared"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func (c *Client) readPump() {
@@ -18,7 +25,7 @@ func (c *Client) readPump() {
 		c.requestWg.Wait()
 		c.Close()
 	}()
-	logger := shared.GetTunnelLogger("client.handler", c.TunnelID)
+	logger := c.tunnelLogger("client.handler")
 
 	logger.Info().Msg("starting request handler loop")
 
@@ -27,23 +34,30 @@ func (c *Client) readPump() {
 		MaxIdleConnsPerHost: 5,
 		IdleConnTimeout:     30 * time.Second,
 		MaxConnsPerHost:     10,
+		DialContext:         dialLocal,
 	}
 
+	// requests are bounded by their context and the tunnel's timeouts, a
+	// client timeout would also cut off responses streamed for longer
 	httpClient := &http.Client{
-		Timeout:   30 * time.Second,
 		Transport: transport,
 		CheckRedirect: func(req *http.Request, via []*http.Request) error {
 			return http.ErrUseLastResponse
 		},
 	}
 
+	c.h2cClient = newH2CClient(httpClient)
+
 	logger.Debug().
-		Dur("http_timeout", httpClient.Timeout).
+		Dur("connect_timeout", c.requestTimeouts("/").Connect()).
+		Dur("request_timeout", c.requestTimeouts("/").Total()).
 		Int("max_conns_per_host", 10).
 		Int("max_idle_conns", 10).
+		Bool("h2c", c.H2C).
 		Msg("http client configured")
 
 	c.setupHeartbeat()
+	c.startHealthChecks()
 
 	requestCount := 0
 	for {
@@ -52,9 +66,8 @@ func (c *Client) readPump() {
 			logger.Info().Msg("read pump shutting down due to context cancellation")
 			return
 		default:
-			var msg shared.Message
 			readStart := time.Now()
-			err := c.Conn.ReadJSON(&msg)
+			frameType, data, err := c.Conn.ReadMessage()
 			readDuration := time.Since(readStart)
 
 			if err != nil {
@@ -66,6 +79,19 @@ func (c *Client) readPump() {
 				return
 			}
 
+			decoded, err := shared.DecodeFrame(frameType == websocket.BinaryMessage, data)
+			if err != nil {
+				logger.Error().Err(err).Int("frame_size", len(data)).Msg("failed to decode message from server")
+				continue
+			}
+			saved, err := shared.DecompressBody(decoded)
+			if err != nil {
+				logger.Error().Err(err).Str("message_type", decoded.Type).Str("request_id", decoded.RequestID).Msg("failed to decompress message from server")
+				return
+			}
+			atomic.AddInt64(&c.compressionSaved, int64(saved))
+			msg := *decoded
+
 			logger.Debug().Dur("message_read_time", readDuration).Str("message_type", msg.Type).Msg("received message from server")
 
 			switch msg.Type {
@@ -77,21 +103,31 @@ func (c *Client) readPump() {
 					Str("method", msg.Method).
 					Str("path", msg.Path).
 					Int("body_size", len(msg.Body)).
+					Bool("streamed_body", msg.Stream).
 					Msg("received request from server")
 
+				// registered before the next message, which may be its first chunk
+				if msg.Stream {
+					c.openRequestBody(msg.RequestID, msg.Trailers)
+				}
+
+				c.trackRequest(msg.RequestID)
 				c.requestWg.Add(1)
 				go func(m shared.Message) {
 					defer c.requestWg.Done()
 					c.processRequest(httpClient, m)
 				}(msg)
+			case "request_body":
+				c.credit.Received(shared.ChunkCost(&msg))
+				c.handleRequestBody(&msg)
+			case "window_update":
+				c.flow.Grant(msg.RequestID, msg.Credit)
 			case "request_cancel":
-				logger.Info().Str("request_id", msg.RequestID).Msg("received request cancellation")
-				c.ongoingRequestsMu.Lock()
-				if cancel, ok := c.ongoingRequests[msg.RequestID]; ok {
-					cancel()
-					delete(c.ongoingRequests, msg.RequestID)
-				}
-				c.ongoingRequestsMu.Unlock()
+				running := c.cancelRequest(msg.RequestID)
+				logger.Info().
+					Str("request_id", msg.RequestID).
+					Bool("running", running).
+					Msg("received request cancellation")
 			default:
 				logger.Debug().Str("message_type", msg.Type).Msg("ignoring unhandled message type")
 			}
@@ -100,7 +136,7 @@ func (c *Client) readPump() {
 }
 
 func (c *Client) setupHeartbeat() {
-	logger := shared.GetTunnelLogger("client.handler", c.TunnelID)
+	logger := c.tunnelLogger("client.handler")
 
 	c.Conn.SetPongHandler(func(string) error {
 		c.updateLastPong()
@@ -152,61 +188,136 @@ func (c *Client) writePump() {
 	defer func() {
 		c.Close()
 	}()
-	logger := shared.GetTunnelLogger("client.handler", c.TunnelID)
+	logger := c.tunnelLogger("client.handler")
 	logger.Info().Msg("starting writer loop")
 
-	for msg := range c.outgoingMessages {
-		if msg.Type == "ping" {
-			if err := c.Conn.WriteMessage(websocket.PingMessage, nil); err != nil {
-				logger.Error().Err(err).Msg("failed to send ping")
+	defer func() {
+		logger.Info().
+			Int64("queue_stalls", atomic.LoadInt64(&c.queueStalls)).
+			Int64("flow_control_stalls", c.flow.Stalls()).
+			Int64("compression_saved_bytes", atomic.LoadInt64(&c.compressionSaved)).
+			Msg("writer loop finished")
+	}()
+
+	for {
+		var batch []*shared.Message
+		select {
+		case msg, ok := <-c.outgoingMessages:
+			if !ok {
 				return
 			}
-			logger.Debug().Msg("ping sent to server")
-			continue
+			batch = []*shared.Message{msg}
+		case <-c.credit.Due():
+			// credit is sent from here so the read pump never waits for the queue
+			batch = c.credit.Updates()
 		}
 
-		c.connMu.Lock()
-		err := c.Conn.WriteJSON(msg)
-		c.connMu.Unlock()
+		for _, msg := range batch {
+			if msg.Type == "ping" {
+				if err := c.Conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+					logger.Error().Err(err).Msg("failed to send ping")
+					return
+				}
+				logger.Debug().Msg("ping sent to server")
+				continue
+			}
 
-		if err != nil {
-			logger.Error().Err(err).Msg("failed to write json message")
-			return
-		}
+			msg, saved := shared.CompressBody(msg, c.compressionThreshold)
+			atomic.AddInt64(&c.compressionSaved, int64(saved))
+
+			c.connMu.Lock()
+			err := c.writeMessage(msg)
+			c.connMu.Unlock()
 
-		if msg.RequestID != "" {
-			logger.Debug().
-				Str("request_id", msg.RequestID).
-				Str("type", msg.Type).
-				Msg("message sent to server")
+			if err != nil {
+				logger.Error().Err(err).Msg("failed to write message")
+				return
+			}
+
+			if msg.RequestID != "" {
+				logger.Debug().
+					Str("request_id", msg.RequestID).
+					Str("type", msg.Type).
+					Msg("message sent to server")
+			}
 		}
 	}
-	logger.Info().Msg("writer loop finished")
 }
 
+func (c *Client) writeMessage(msg *shared.Message) error {
+	if !c.binaryFraming {
+		return c.Conn.WriteJSON(msg)
+	}
+
+	frame, err := shared.EncodeBinaryMessage(msg)
+	if err != nil {
+		return err
+	}
+	return c.Conn.WriteMessage(websocket.BinaryMessage, frame)
+}
+
+var tracer = shared.Tracer("client")
+
 func (c *Client) processRequest(httpClient *http.Client, msg shared.Message) {
-	logger := shared.GetRequestLogger("client.handler", c.TunnelID, msg.RequestID)
+	logger := c.requestLogger("client.handler", msg.RequestID)
+
+	// continues the trace of the server's tunnel hop
+	traceCtx, span := tracer.Start(shared.ExtractTraceContext(context.Background(), msg.Headers), "funnel.client",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("funnel.tunnel_id", c.TunnelID),
+			attribute.String("funnel.request_id", http.Header(msg.Headers).Get(shared.RequestIDHeader)),
+			attribute.String("http.request.method", msg.Method),
+		),
+	)
+	defer span.End()
+	if msg.Stream {
+		defer c.closeRequestBody(msg.RequestID)
+	}
+
+	reqCtx, cancelCause := c.trackRequest(msg.RequestID)
+	defer c.untrackRequest(msg.RequestID)
 
 	select {
 	case c.requestSemaphore <- struct{}{}:
 		defer func() { <-c.requestSemaphore }()
-	case <-c.ctx.Done():
-		logger.Warn().Msg("shutting down, not processing new request")
+	case <-reqCtx.Done():
+		if requestCanceled(reqCtx) {
+			logger.Info().Msg("request canceled before it started")
+		} else {
+			logger.Warn().Msg("shutting down, not processing new request")
+		}
+		return
+	}
+	if requestCanceled(reqCtx) {
+		logger.Info().Msg("request canceled before it started")
 		return
 	}
 
-	reqCtx, cancel := context.WithTimeout(c.ctx, 30*time.Second)
-	defer cancel()
-
-	c.ongoingRequestsMu.Lock()
-	c.ongoingRequests[msg.RequestID] = cancel
-	c.ongoingRequestsMu.Unlock()
+	// every request has the header timeout to get its response headers. grpc
+	// and other streams may then stay open far longer than a plain request,
+	// which has the total timeout to complete unless its response turns out
+	// to be streamed and only has to keep producing data.
+	timeouts := c.requestTimeouts(msg.Path)
+	streaming := msg.Stream || isGRPC(msg.Headers)
+	timedOut := func() { cancelCause(errLocalTimeout) }
+
+	headerTimer := time.AfterFunc(timeouts.Header(), timedOut)
+	defer headerTimer.Stop()
+	var deadline *time.Timer
+	if !streaming {
+		deadline = time.AfterFunc(timeouts.Total(), timedOut)
+		defer deadline.Stop()
+	}
 
-	defer func() {
-		c.ongoingRequestsMu.Lock()
-		delete(c.ongoingRequests, msg.RequestID)
-		c.ongoingRequestsMu.Unlock()
-	}()
+	if c.BasicAuth != nil && !c.BasicAuth.allows(msg.Headers) {
+		logger.Info().Msg("request rejected, missing or invalid basic auth")
+		c.sendResponse(msg.RequestID, http.StatusUnauthorized, http.Header{
+			"Content-Type":     []string{"text/plain"},
+			"Www-Authenticate": []string{`Basic realm="funnel"`},
+		}, []byte("unauthorized"))
+		return
+	}
 
 	processStart := time.Now()
 	logger.Debug().
@@ -217,7 +328,22 @@ func (c *Client) processRequest(httpClient *http.Client, msg shared.Message) {
 		Int("concurrent_requests", len(c.requestSemaphore)).
 		Msg("processing request")
 
-	req, err := http.NewRequestWithContext(reqCtx, msg.Method, "http://"+c.LocalAddr+msg.Path, bytes.NewReader(msg.Body))
+	var reqBody io.Reader = bytes.NewReader(msg.Body)
+	var streamedBody *streamBody
+	if msg.Stream {
+		streamedBody = c.requestBody(msg.RequestID)
+		if streamedBody == nil {
+			logger.Error().Msg("streamed request body is gone")
+			if reqCtx.Err() == nil {
+				c.sendError(msg.RequestID, http.StatusBadGateway, "request body is gone")
+			}
+			return
+		}
+		reqBody = streamedBody
+	}
+
+	local, path, route := c.route(msg.Path)
+	req, err := http.NewRequestWithContext(withConnectTimeout(reqCtx, timeouts.Connect()), msg.Method, "http://"+local+path, reqBody)
 	if err != nil {
 		logger.Error().Err(err).Msg("failed to create request")
 		if reqCtx.Err() == nil {
@@ -227,6 +353,22 @@ func (c *Client) processRequest(httpClient *http.Client, msg shared.Message) {
 	}
 
 	c.setRequestHeaders(req, msg.Headers)
+	if route != nil && route.StripPrefix && route.prefix() != "" {
+		req.Header.Set("X-Forwarded-Prefix", route.prefix())
+	}
+	if streamedBody != nil {
+		req.Trailer = streamedBody.trailer
+		req.ContentLength = -1
+		if length, err := strconv.ParseInt(http.Header(msg.Headers).Get("Content-Length"), 10, 64); err == nil && len(req.Trailer) == 0 {
+			req.ContentLength = length
+		}
+	}
+
+	if c.H2C || isGRPC(msg.Headers) {
+		if c.h2cClient != nil {
+			httpClient = c.h2cClient
+		}
+	}
 
 	logger.Debug().
 		Int("concurrent_requests", len(c.requestSemaphore)).
@@ -234,31 +376,102 @@ func (c *Client) processRequest(httpClient *http.Client, msg shared.Message) {
 		Str("local_url", req.URL.String()).
 		Msg("forwarding request to local service")
 
+	upstreamCtx, upstreamSpan := tracer.Start(traceCtx, "funnel.upstream",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("server.address", local), attribute.String("url.path", req.URL.Path)),
+	)
+	defer upstreamSpan.End()
+	shared.InjectTraceContext(upstreamCtx, req.Header)
+
 	upstreamResponseTimeStart := time.Now()
 	resp, err := httpClient.Do(req)
+	headerTimer.Stop()
 
 	if err != nil {
-		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
-			logger.Warn().Err(err).Msg("request to local service was canceled or timed out")
-			return
+		upstreamSpan.RecordError(err)
+		upstreamSpan.SetStatus(codes.Error, "request to local service failed")
+		var netErr net.Error
+		switch {
+		case errors.Is(context.Cause(reqCtx), errLocalTimeout):
+			logger.Warn().Err(err).
+				Dur("header_timeout", timeouts.Header()).
+				Dur("total_timeout", timeouts.Total()).
+				Msg("local service did not answer in time")
+			c.sendError(msg.RequestID, http.StatusGatewayTimeout, "local service timed out")
+		case requestCanceled(reqCtx):
+			logger.Info().Msg("server canceled the request, local request aborted")
+		case reqCtx.Err() != nil:
+			logger.Warn().Err(err).Msg("request to local service was canceled")
+		case errors.As(err, &netErr) && netErr.Timeout():
+			logger.Error().Err(err).Dur("connect_timeout", timeouts.Connect()).Msg("timed out connecting to local service")
+			c.sendError(msg.RequestID, http.StatusGatewayTimeout, "local service connection timed out")
+		default:
+			logger.Error().Err(err).Msg("failed to make request to local service")
+			c.sendError(msg.RequestID, http.StatusBadGateway, "local service connection failed")
 		}
-		logger.Error().Err(err).Msg("failed to make request to local service")
-		c.sendError(msg.RequestID, http.StatusBadGateway, "local service connection failed")
 		return
 	}
 	defer resp.Body.Close()
+	shared.RecordHTTPStatus(upstreamSpan, resp.StatusCode)
 
 	logger.Debug().
 		Int("status_code", resp.StatusCode).
 		Dur("upstream_response_time", time.Since(upstreamResponseTimeStart)).
 		Int64("content_length", resp.ContentLength).
+		Str("protocol", resp.Proto).
 		Msg("received response from local service")
 
+	if err := c.rewriteResponseHeaders(resp.Header, msg.Headers, local); err != nil {
+		logger.Warn().Err(err).Msg("failed to rewrite response headers")
+	}
+
+	maxBody := c.Limits.BodyLimits.MaxResponseBody
+	if maxBody > 0 && resp.ContentLength > maxBody {
+		logger.Warn().
+			Int64("content_length", resp.ContentLength).
+			Int64("max_response_body", maxBody).
+			Msg("response body too large, not forwarding it")
+		c.sendError(msg.RequestID, http.StatusBadGateway, "response body too large")
+		return
+	}
+
+	if c.streamsResponse(resp) {
+		if deadline != nil {
+			deadline.Stop()
+		}
+		c.streamResponse(reqCtx, timedOut, timeouts.Idle(), msg.RequestID, resp)
+		return
+	}
+
+	// a body of unknown size is read one byte past the limit to tell
+	// whether it exceeds it
+	var bodyReader io.Reader = resp.Body
+	if maxBody > 0 {
+		bodyReader = io.LimitReader(resp.Body, maxBody+1)
+	}
 	bodyReadStart := time.Now()
-	body, err := io.ReadAll(resp.Body)
+	body, err := io.ReadAll(bodyReader)
 	bodyReadDuration := time.Since(bodyReadStart)
+	if err == nil && maxBody > 0 && int64(len(body)) > maxBody {
+		logger.Warn().
+			Int64("max_response_body", maxBody).
+			Msg("response body too large, not forwarding it")
+		c.sendError(msg.RequestID, http.StatusBadGateway, "response body too large")
+		return
+	}
 
 	if err != nil {
+		if requestCanceled(reqCtx) {
+			logger.Info().Msg("server canceled the request, local response abandoned")
+			return
+		}
+		if errors.Is(context.Cause(reqCtx), errLocalTimeout) {
+			logger.Warn().Err(err).
+				Dur("total_timeout", timeouts.Total()).
+				Msg("local service did not finish the response in time")
+			c.sendError(msg.RequestID, http.StatusGatewayTimeout, "local service timed out")
+			return
+		}
 		logger.Error().Err(err).
 			Dur("body_read_duration", bodyReadDuration).
 			Msg("failed to read response body")
@@ -289,16 +502,55 @@ func (c *Client) setRequestHeaders(req *http.Request, headers map[string][]strin
 
 	for k, values := range headers {
 		if c.shouldSkipHeader(k) {
+			// grpc servers want te: trailers, the only value http/2 allows
+			if strings.ToLower(k) == "te" && strings.Contains(strings.ToLower(strings.Join(values, ",")), "trailers") {
+				req.Header.Set("Te", "trailers")
+			}
 			continue
 		}
 		if strings.ToLower(k) == "host" {
 			continue
 		}
+		// the credentials are for the tunnel, not the local service
+		if c.BasicAuth != nil && strings.ToLower(k) == "authorization" {
+			continue
+		}
 		for _, value := range values {
 			req.Header.Add(k, value)
 		}
 	}
+	for k, v := range c.Headers {
+		req.Header.Set(k, v)
+	}
 	req.Host = c.LocalAddr
+	for _, route := range c.Routes {
+		// the request was routed to another local service
+		if req.URL.Host == route.Local {
+			req.Host = route.Local
+		}
+	}
+	if err := c.rewriteRequestHeaders(req.Header, headers, req.Host); err != nil {
+		logger := c.tunnelLogger("client.handler")
+		logger.Warn().Err(err).Msg("failed to rewrite request headers")
+	}
+}
+
+// BasicAuth protects a tunnel with a username and password checked by the client
+type BasicAuth struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+func (a *BasicAuth) allows(headers map[string][]string) bool {
+	req := &http.Request{Header: http.Header(headers)}
+	user, password, ok := req.BasicAuth()
+	if !ok {
+		return false
+	}
+
+	userMatch := subtle.ConstantTimeCompare([]byte(user), []byte(a.Username)) == 1
+	passwordMatch := subtle.ConstantTimeCompare([]byte(password), []byte(a.Password)) == 1
+	return userMatch && passwordMatch
 }
 
 func (c *Client) shouldSkipHeader(headerName string) bool {
@@ -314,15 +566,21 @@ func (c *Client) shouldSkipHeader(headerName string) bool {
 		lower == "proxy-connection"
 }
 
-func (c *Client) sendResponse(requestID string, status int, headers http.Header, body []byte) {
-	logger := shared.GetRequestLogger("client.handler", c.TunnelID, requestID)
-
+// responseHeaders drops the hop-by-hop headers of a local service's response
+func (c *Client) responseHeaders(headers http.Header) map[string][]string {
 	respHeaders := make(map[string][]string)
 	for k, v := range headers {
 		if !c.shouldSkipHeader(k) {
 			respHeaders[k] = v
 		}
 	}
+	return respHeaders
+}
+
+func (c *Client) sendResponse(requestID string, status int, headers http.Header, body []byte) {
+	logger := c.requestLogger("client.handler", requestID)
+
+	respHeaders := c.responseHeaders(headers)
 
 	respMsg := &shared.Message{
 		Type:      "response",
@@ -332,22 +590,21 @@ func (c *Client) sendResponse(requestID string, status int, headers http.Header,
 		Body:      body,
 	}
 
-	select {
-	case c.outgoingMessages <- respMsg:
-		sendDuration := time.Since(time.Now())
-		logger.Debug().
-			Int("status_code", status).
-			Int("header_count", len(respHeaders)).
-			Int("response_size", len(body)).
-			Dur("send_duration", sendDuration).
-			Msg("response queued successfully")
-	default:
-		logger.Warn().Msg("outgoing message channel full, dropping response")
+	sendStart := time.Now()
+	if err := c.sendMessage(respMsg); err != nil {
+		logger.Warn().Err(err).Msg("failed to queue response")
+		return
 	}
+	logger.Debug().
+		Int("status_code", status).
+		Int("header_count", len(respHeaders)).
+		Int("response_size", len(body)).
+		Dur("send_duration", time.Since(sendStart)).
+		Msg("response queued successfully")
 }
 
 func (c *Client) sendError(requestID string, statusCode int, error string) {
-	logger := shared.GetRequestLogger("client.handler", c.TunnelID, requestID)
+	logger := c.requestLogger("client.handler", requestID)
 	logger.Error().Int("status_code", statusCode).Str("error", error).Msg("sending error response")
 	errMessage := &shared.Message{
 		Type:      "response",
@@ -356,9 +613,7 @@ func (c *Client) sendError(requestID string, statusCode int, error string) {
 		Headers:   http.Header{"Content-Type": []string{"text/plain"}},
 		Body:      []byte(error),
 	}
-	select {
-	case c.outgoingMessages <- errMessage:
-	default:
-		logger.Warn().Int("status", statusCode).Msg("outgoing message channel full, dropping error response")
+	if err := c.sendMessage(errMessage); err != nil {
+		logger.Warn().Err(err).Int("status", statusCode).Msg("failed to queue error response")
 	}
 }
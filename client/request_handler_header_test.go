@@ -1,8 +1,13 @@
 package client
 
 import (
+	"encoding/base64"
+	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+
+	"github.com/karol-broda/funnel/shared"
 )
 
 func TestClient_shouldSkipHeader(t *testing.T) {
@@ -153,7 +158,7 @@ func TestClient_setRequestHeaders(t *testing.T) {
 				"Connection":        {"keep-alive"},
 				"Upgrade":           {"websocket"},
 				"Transfer-Encoding": {"chunked"},
-				"TE":                {"trailers"},
+				"TE":                {"gzip"},
 				"User-Agent":        {"TestClient/1.0"},
 				"Content-Type":      {"application/json"},
 			},
@@ -162,6 +167,17 @@ func TestClient_setRequestHeaders(t *testing.T) {
 			expectedForwarded: []string{"User-Agent", "Content-Type"},
 			expectedHost:      "localhost:3000",
 		},
+		{
+			name: "keep te trailers for grpc",
+			inputHeaders: map[string][]string{
+				"Te":           {"trailers"},
+				"Content-Type": {"application/grpc"},
+			},
+			localAddr:         "localhost:50051",
+			expectedSkipped:   []string{},
+			expectedForwarded: []string{"Te", "Content-Type"},
+			expectedHost:      "localhost:50051",
+		},
 		{
 			name: "handle Host header specially",
 			inputHeaders: map[string][]string{
@@ -292,3 +308,55 @@ func TestClient_setRequestHeaders_HeaderValues(t *testing.T) {
 		})
 	}
 }
+
+func TestClient_processRequest_BasicAuth(t *testing.T) {
+	var forwarded http.Header
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.Header.Clone()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer local.Close()
+
+	tests := []struct {
+		name           string
+		authorization  string
+		expectedStatus int
+	}{
+		{"no credentials", "", http.StatusUnauthorized},
+		{"wrong password", "Basic " + base64.StdEncoding.EncodeToString([]byte("dev:wrong")), http.StatusUnauthorized},
+		{"valid credentials", "Basic " + base64.StdEncoding.EncodeToString([]byte("dev:secret")), http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forwarded = nil
+			c := New("test-tunnel", "http://localhost:8080", strings.TrimPrefix(local.URL, "http://"), "")
+			defer c.cancel()
+			c.BasicAuth = &BasicAuth{Username: "dev", Password: "secret"}
+			c.Headers = map[string]string{"X-Environment": "staging"}
+
+			headers := map[string][]string{}
+			if tt.authorization != "" {
+				headers["Authorization"] = []string{tt.authorization}
+			}
+			c.processRequest(local.Client(), shared.Message{Type: "request", RequestID: "req-1", Method: "GET", Path: "/", Headers: headers})
+
+			resp := <-c.outgoingMessages
+			if resp.Status != tt.expectedStatus {
+				t.Fatalf("status = %d, want %d", resp.Status, tt.expectedStatus)
+			}
+			if tt.expectedStatus == http.StatusUnauthorized {
+				if forwarded != nil {
+					t.Error("unauthorized request must not reach the local service")
+				}
+				return
+			}
+			if forwarded.Get("Authorization") != "" {
+				t.Error("tunnel credentials must not be forwarded to the local service")
+			}
+			if forwarded.Get("X-Environment") != "staging" {
+				t.Errorf("X-Environment = %q, want %q", forwarded.Get("X-Environment"), "staging")
+			}
+		})
+	}
+}
@@ -0,0 +1,381 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// HeaderRules rewrite the headers of requests forwarded to the local service
+// and of the responses it sends back. values are templates over the fields of
+// HeaderValues, like {{.PublicHost}} or {{.ClientIP}}.
+type HeaderRules struct {
+	Request  HeaderRuleSet `json:"request,omitempty"`
+	Response HeaderRuleSet `json:"response,omitempty"`
+}
+
+// HeaderRuleSet removes headers, then sets and then adds them
+type HeaderRuleSet struct {
+	Remove []string          `json:"remove,omitempty" toml:"remove,omitempty"`
+	Set    map[string]string `json:"set,omitempty" toml:"set,omitempty"`
+	Add    map[string]string `json:"add,omitempty" toml:"add,omitempty"`
+}
+
+func (s HeaderRuleSet) empty() bool {
+	return len(s.Remove) == 0 && len(s.Set) == 0 && len(s.Add) == 0
+}
+
+// HeaderValues are what header rule templates can refer to
+type HeaderValues struct {
+	TunnelID string
+	// PublicURL is the scheme and host the visitor used, PublicHost its host
+	PublicURL  string
+	PublicHost string
+	ClientIP   string
+	LocalAddr  string
+}
+
+// ParseHeaderRules parses header rules given on the command line: "Name: value"
+// sets a header, "+Name: value" adds one and "-Name" removes it
+func ParseHeaderRules(request, response []string) (*HeaderRules, error) {
+	if len(request) == 0 && len(response) == 0 {
+		return nil, nil
+	}
+
+	rules := &HeaderRules{}
+	for _, spec := range request {
+		if err := parseHeaderRule(&rules.Request, spec); err != nil {
+			return nil, err
+		}
+	}
+	for _, spec := range response {
+		if err := parseHeaderRule(&rules.Response, spec); err != nil {
+			return nil, err
+		}
+	}
+	if err := rules.Validate(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+func parseHeaderRule(set *HeaderRuleSet, spec string) error {
+	if name, ok := strings.CutPrefix(spec, "-"); ok {
+		name = strings.TrimSpace(name)
+		if !validHeaderName(name) {
+			return fmt.Errorf("invalid header rule %q, expected -NAME", spec)
+		}
+		set.Remove = append(set.Remove, name)
+		return nil
+	}
+
+	add := strings.HasPrefix(spec, "+")
+	name, value, ok := strings.Cut(strings.TrimPrefix(spec, "+"), ":")
+	name = strings.TrimSpace(name)
+	if !ok || !validHeaderName(name) {
+		return fmt.Errorf("invalid header rule %q, expected NAME: VALUE", spec)
+	}
+
+	rules := &set.Set
+	if add {
+		rules = &set.Add
+	}
+	if *rules == nil {
+		*rules = make(map[string]string)
+	}
+	(*rules)[name] = strings.TrimSpace(value)
+	return nil
+}
+
+// Validate checks the header names and value templates of the rules
+func (r *HeaderRules) Validate() error {
+	_, err := newHeaderRewriter(r)
+	return err
+}
+
+// SetHeaderRules compiles the header rules applied to every request, nil
+// rules leave headers alone
+func (c *Client) SetHeaderRules(rules *HeaderRules) error {
+	rewriter, err := newHeaderRewriter(rules)
+	if err != nil {
+		return err
+	}
+	c.rewriter = rewriter
+	return nil
+}
+
+// headerRewriter applies compiled header rules
+type headerRewriter struct {
+	request  compiledRuleSet
+	response compiledRuleSet
+}
+
+type compiledRuleSet struct {
+	remove []string
+	set    []headerTemplate
+	add    []headerTemplate
+}
+
+type headerTemplate struct {
+	name  string
+	value *template.Template
+}
+
+// newHeaderRewriter compiles rules, nil when there are none
+func newHeaderRewriter(rules *HeaderRules) (*headerRewriter, error) {
+	if rules == nil || (rules.Request.empty() && rules.Response.empty()) {
+		return nil, nil
+	}
+
+	request, err := compileRuleSet(rules.Request)
+	if err != nil {
+		return nil, fmt.Errorf("request header rules: %w", err)
+	}
+	response, err := compileRuleSet(rules.Response)
+	if err != nil {
+		return nil, fmt.Errorf("response header rules: %w", err)
+	}
+	return &headerRewriter{request: request, response: response}, nil
+}
+
+func compileRuleSet(set HeaderRuleSet) (compiledRuleSet, error) {
+	var compiled compiledRuleSet
+	for _, name := range set.Remove {
+		if !validHeaderName(name) {
+			return compiled, fmt.Errorf("invalid header name %q", name)
+		}
+		compiled.remove = append(compiled.remove, http.CanonicalHeaderKey(name))
+	}
+
+	var err error
+	if compiled.set, err = compileTemplates(set.Set); err != nil {
+		return compiled, err
+	}
+	if compiled.add, err = compileTemplates(set.Add); err != nil {
+		return compiled, err
+	}
+	return compiled, nil
+}
+
+// compileTemplates parses header values in name order, so rules apply the same
+// way every time
+func compileTemplates(values map[string]string) ([]headerTemplate, error) {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	templates := make([]headerTemplate, 0, len(names))
+	for _, name := range names {
+		if !validHeaderName(name) {
+			return nil, fmt.Errorf("invalid header name %q", name)
+		}
+		value, err := template.New(name).Option("missingkey=error").Parse(values[name])
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for %s: %w", name, err)
+		}
+		compiled := headerTemplate{name: http.CanonicalHeaderKey(name), value: value}
+		// fields that do not exist only fail once a template runs
+		if _, err := compiled.render(HeaderValues{}); err != nil {
+			return nil, fmt.Errorf("invalid value for %s: %w", name, err)
+		}
+		templates = append(templates, compiled)
+	}
+	return templates, nil
+}
+
+// validHeaderName reports whether name is an http token
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if r >= 0x80 || r <= ' ' || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, r) || r == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+func (s compiledRuleSet) apply(header http.Header, values HeaderValues) error {
+	for _, name := range s.remove {
+		header.Del(name)
+	}
+	for _, rule := range s.set {
+		value, err := rule.render(values)
+		if err != nil {
+			return err
+		}
+		header.Set(rule.name, value)
+	}
+	for _, rule := range s.add {
+		value, err := rule.render(values)
+		if err != nil {
+			return err
+		}
+		header.Add(rule.name, value)
+	}
+	return nil
+}
+
+func (t headerTemplate) render(values HeaderValues) (string, error) {
+	var value strings.Builder
+	if err := t.value.Execute(&value, values); err != nil {
+		return "", fmt.Errorf("failed to render %s: %w", t.name, err)
+	}
+	// a value must not smuggle in another header
+	return strings.NewReplacer("\r", "", "\n", "").Replace(value.String()), nil
+}
+
+// headerValues returns what header rules can refer to for a request to the
+// local service at local, the public host being the one the visitor asked for
+func (c *Client) headerValues(headers map[string][]string, local string) HeaderValues {
+	values := HeaderValues{
+		TunnelID:  c.TunnelID,
+		ClientIP:  headerValue(headers, "X-Real-IP"),
+		LocalAddr: local,
+	}
+
+	scheme, host := "", headerValue(headers, "X-Forwarded-Host")
+	if public, err := url.Parse(c.PublicURL); err == nil && c.PublicURL != "" {
+		scheme = public.Scheme
+		if host == "" {
+			host = public.Host
+		}
+	}
+	if proto := headerValue(headers, "X-Forwarded-Proto"); proto == "http" || proto == "https" {
+		scheme = proto
+	}
+	if scheme == "" {
+		scheme = "https"
+	}
+
+	if host != "" {
+		values.PublicHost = host
+		values.PublicURL = scheme + "://" + host
+	}
+	return values
+}
+
+// headerValue looks up a header of a tunneled request, the server does not
+// always send canonical names
+func headerValue(headers map[string][]string, name string) string {
+	for key, values := range headers {
+		if strings.EqualFold(key, name) && len(values) > 0 {
+			return values[0]
+		}
+	}
+	return ""
+}
+
+// rewriteRequestHeaders applies the request header rules
+func (c *Client) rewriteRequestHeaders(header http.Header, headers map[string][]string, local string) error {
+	if c.rewriter == nil {
+		return nil
+	}
+	return c.rewriter.request.apply(header, c.headerValues(headers, local))
+}
+
+// rewriteResponseHeaders points redirects and cookies for the local service
+// at the public host the visitor used, then applies the response header rules
+func (c *Client) rewriteResponseHeaders(header http.Header, headers map[string][]string, local string) error {
+	values := c.headerValues(headers, local)
+	if values.PublicHost != "" {
+		for _, name := range []string{"Location", "Content-Location"} {
+			if location := header.Get(name); location != "" {
+				header.Set(name, c.publicLocation(location, values))
+			}
+		}
+		if cookies := header.Values("Set-Cookie"); len(cookies) > 0 {
+			rewritten := make([]string, len(cookies))
+			for i, cookie := range cookies {
+				rewritten[i] = c.publicCookie(cookie, values)
+			}
+			header["Set-Cookie"] = rewritten
+		}
+	}
+
+	if c.rewriter == nil {
+		return nil
+	}
+	return c.rewriter.response.apply(header, values)
+}
+
+// publicLocation rewrites an absolute url on a local service to the public
+// url, relative urls and other hosts are left alone
+func (c *Client) publicLocation(location string, values HeaderValues) string {
+	target, err := url.Parse(location)
+	if err != nil || target.Host == "" {
+		return location
+	}
+	prefix, ok := c.publicPrefix(target.Host)
+	if !ok {
+		return location
+	}
+	public, err := url.Parse(values.PublicURL)
+	if err != nil {
+		return location
+	}
+	target.Scheme = public.Scheme
+	target.Host = public.Host
+	if prefix != "" {
+		target.Path = prefix + target.Path
+		target.RawPath = ""
+	}
+	return target.String()
+}
+
+// publicCookie moves a cookie scoped to the local host over to the public host
+func (c *Client) publicCookie(cookie string, values HeaderValues) string {
+	publicHost := values.PublicHost
+	if host, _, err := net.SplitHostPort(publicHost); err == nil {
+		publicHost = host
+	}
+
+	parts := strings.Split(cookie, ";")
+	for i, part := range parts {
+		key, domain, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok || !strings.EqualFold(key, "domain") {
+			continue
+		}
+		if _, ok := c.publicPrefix(strings.TrimPrefix(strings.TrimSpace(domain), ".")); ok {
+			parts[i] = " Domain=" + publicHost
+		}
+	}
+	return strings.Join(parts, ";")
+}
+
+// isLocalHost reports whether host, with or without a port, names the local
+// service at local: its own address or a loopback name on the same port
+func isLocalHost(host, local string) bool {
+	if strings.EqualFold(host, local) {
+		return true
+	}
+
+	localHost, localPort, err := net.SplitHostPort(local)
+	if err != nil {
+		return false
+	}
+	hostname, port, err := net.SplitHostPort(host)
+	if err != nil {
+		// cookie domains carry no port
+		hostname, port = host, localPort
+	}
+	if port != localPort {
+		return false
+	}
+	return strings.EqualFold(hostname, localHost) || isLoopbackName(hostname)
+}
+
+func isLoopbackName(host string) bool {
+	if strings.EqualFold(host, "localhost") || host == "0.0.0.0" {
+		return true
+	}
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,172 @@
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/karol-broda/funnel/shared"
+)
+
+func TestParseHeaderRules(t *testing.T) {
+	rules, err := ParseHeaderRules(
+		[]string{"X-Forwarded-Prefix: /app", "-Cookie", "+Via: funnel"},
+		[]string{"X-Public: {{.PublicURL}}", "-Server"},
+	)
+	if err != nil {
+		t.Fatalf("ParseHeaderRules() error = %v", err)
+	}
+	expected := &HeaderRules{
+		Request: HeaderRuleSet{
+			Remove: []string{"Cookie"},
+			Set:    map[string]string{"X-Forwarded-Prefix": "/app"},
+			Add:    map[string]string{"Via": "funnel"},
+		},
+		Response: HeaderRuleSet{
+			Remove: []string{"Server"},
+			Set:    map[string]string{"X-Public": "{{.PublicURL}}"},
+		},
+	}
+	if !reflect.DeepEqual(rules, expected) {
+		t.Errorf("ParseHeaderRules() = %+v, want %+v", rules, expected)
+	}
+
+	if rules, err := ParseHeaderRules(nil, nil); rules != nil || err != nil {
+		t.Errorf("ParseHeaderRules(nil, nil) = %+v, %v, want no rules", rules, err)
+	}
+
+	for _, spec := range []string{"X-Missing-Colon", "Bad Name: value", "-", "X-Field: {{.Unknown}}", "X-Broken: {{.PublicHost"} {
+		if _, err := ParseHeaderRules([]string{spec}, nil); err == nil {
+			t.Errorf("ParseHeaderRules(%q) expected an error", spec)
+		}
+	}
+}
+
+func TestClient_setRequestHeaders_Rules(t *testing.T) {
+	c := New("test-tunnel", "http://localhost:8080", "localhost:3000", "")
+	defer c.cancel()
+	c.PublicURL = "https://test-tunnel.example.com"
+	err := c.SetHeaderRules(&HeaderRules{Request: HeaderRuleSet{
+		Remove: []string{"cookie"},
+		Set:    map[string]string{"X-Public-Host": "{{.PublicHost}}", "X-Visitor": "{{.ClientIP}}"},
+		Add:    map[string]string{"Via": "funnel {{.TunnelID}}"},
+	}})
+	if err != nil {
+		t.Fatalf("SetHeaderRules() error = %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost:3000/", nil)
+	c.setRequestHeaders(req, map[string][]string{
+		"Cookie":           {"session=abc"},
+		"Via":              {"1.1 proxy"},
+		"X-Real-IP":        {"203.0.113.7"},
+		"X-Forwarded-Host": {"app.example.org"},
+	})
+
+	if req.Header.Get("Cookie") != "" {
+		t.Errorf("Cookie = %q, want it removed", req.Header.Get("Cookie"))
+	}
+	if got := req.Header.Get("X-Public-Host"); got != "app.example.org" {
+		t.Errorf("X-Public-Host = %q, want the host the visitor used", got)
+	}
+	if got := req.Header.Get("X-Visitor"); got != "203.0.113.7" {
+		t.Errorf("X-Visitor = %q, want the client ip", got)
+	}
+	if got := req.Header.Values("Via"); !reflect.DeepEqual(got, []string{"1.1 proxy", "funnel test-tunnel"}) {
+		t.Errorf("Via = %v, want the rule added after the original", got)
+	}
+}
+
+func TestClient_rewriteResponseHeaders(t *testing.T) {
+	tests := []struct {
+		name     string
+		headers  map[string][]string
+		response http.Header
+		expected http.Header
+	}{
+		{
+			name:     "redirect to the local service",
+			response: http.Header{"Location": {"http://localhost:3000/login?next=%2F"}},
+			expected: http.Header{"Location": {"https://test-tunnel.example.com/login?next=%2F"}},
+		},
+		{
+			name:     "redirect to a loopback address",
+			headers:  map[string][]string{"X-Forwarded-Host": {"app.example.org"}, "X-Forwarded-Proto": {"http"}},
+			response: http.Header{"Location": {"http://127.0.0.1:3000/"}, "Content-Location": {"http://[::1]:3000/doc"}},
+			expected: http.Header{"Location": {"http://app.example.org/"}, "Content-Location": {"http://app.example.org/doc"}},
+		},
+		{
+			name:     "relative and foreign redirects stay",
+			response: http.Header{"Location": {"/login"}, "Content-Location": {"http://localhost:4000/"}},
+			expected: http.Header{"Location": {"/login"}, "Content-Location": {"http://localhost:4000/"}},
+		},
+		{
+			name: "cookie domains move to the public host",
+			response: http.Header{"Set-Cookie": {
+				"session=abc; Path=/; Domain=localhost; HttpOnly",
+				"theme=dark; domain=.127.0.0.1",
+				"tracking=1; Domain=example.net",
+				"plain=1",
+			}},
+			expected: http.Header{"Set-Cookie": {
+				"session=abc; Path=/; Domain=test-tunnel.example.com; HttpOnly",
+				"theme=dark; Domain=test-tunnel.example.com",
+				"tracking=1; Domain=example.net",
+				"plain=1",
+			}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Client{TunnelID: "test-tunnel", LocalAddr: "localhost:3000", PublicURL: "https://test-tunnel.example.com"}
+			if err := c.rewriteResponseHeaders(tt.response, tt.headers, c.LocalAddr); err != nil {
+				t.Fatalf("rewriteResponseHeaders() error = %v", err)
+			}
+			if !reflect.DeepEqual(tt.response, tt.expected) {
+				t.Errorf("headers = %v, want %v", tt.response, tt.expected)
+			}
+		})
+	}
+}
+
+func TestClient_processRequest_ResponseRules(t *testing.T) {
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "internal/1.2")
+		http.Redirect(w, r, "http://"+r.Host+"/login", http.StatusFound)
+	}))
+	defer local.Close()
+
+	c := New("test-tunnel", "http://localhost:8080", strings.TrimPrefix(local.URL, "http://"), "")
+	defer c.cancel()
+	c.PublicURL = "https://test-tunnel.example.com"
+	rules, err := ParseHeaderRules(nil, []string{"-Server", "X-Tunnel: {{.TunnelID}}"})
+	if err != nil {
+		t.Fatalf("ParseHeaderRules() error = %v", err)
+	}
+	if err := c.SetHeaderRules(rules); err != nil {
+		t.Fatalf("SetHeaderRules() error = %v", err)
+	}
+
+	httpClient := local.Client()
+	httpClient.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	go c.processRequest(httpClient, shared.Message{Type: "request", RequestID: "req-1", Method: "GET", Path: "/"})
+
+	var resp *shared.Message
+	select {
+	case resp = <-c.outgoingMessages:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the response")
+	}
+
+	headers := http.Header(resp.Headers)
+	if resp.Status != http.StatusFound || headers.Get("Location") != "https://test-tunnel.example.com/login" {
+		t.Errorf("response = %d to %q, want a redirect to the public url", resp.Status, headers.Get("Location"))
+	}
+	if headers.Get("Server") != "" || headers.Get("X-Tunnel") != "test-tunnel" {
+		t.Errorf("headers = %v, want Server removed and X-Tunnel set", headers)
+	}
+}
@@ -0,0 +1,131 @@
+package client
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Route sends the requests below a path prefix to another local service than
+// the tunnel's local address, which serves everything no route matches
+type Route struct {
+	// Prefix is a path like /api, a trailing /* is allowed
+	Prefix string `json:"prefix" toml:"prefix"`
+	Local  string `json:"local" toml:"local"`
+	// StripPrefix forwards /api/users as /users
+	StripPrefix bool `json:"strip_prefix,omitempty" toml:"strip_prefix,omitempty"`
+}
+
+// ParseRoutes parses routes given on the command line as PREFIX=LOCAL, or
+// PREFIX=LOCAL,strip to remove the prefix before forwarding
+func ParseRoutes(specs []string) ([]Route, error) {
+	if len(specs) == 0 {
+		return nil, nil
+	}
+
+	routes := make([]Route, 0, len(specs))
+	for _, spec := range specs {
+		prefix, local, ok := strings.Cut(spec, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid route %q, expected PREFIX=LOCAL", spec)
+		}
+		route := Route{Prefix: prefix, Local: local}
+		if local, ok := strings.CutSuffix(local, ",strip"); ok {
+			route.Local = local
+			route.StripPrefix = true
+		}
+		routes = append(routes, route)
+	}
+
+	if err := ValidateRoutes(routes); err != nil {
+		return nil, err
+	}
+	return normalizeRoutes(routes), nil
+}
+
+// ValidateRoutes checks that every route has an absolute prefix, a local
+// address and a prefix of its own
+func ValidateRoutes(routes []Route) error {
+	seen := make(map[string]bool, len(routes))
+	for _, route := range routes {
+		if !strings.HasPrefix(route.Prefix, "/") {
+			return fmt.Errorf("route prefix %q must start with /", route.Prefix)
+		}
+		if strings.ContainsAny(route.prefix(), "*?#") {
+			return fmt.Errorf("route prefix %q may only end with a wildcard", route.Prefix)
+		}
+		if route.Local == "" {
+			return fmt.Errorf("route %s has no local address", route.Prefix)
+		}
+		if seen[route.prefix()] {
+			return fmt.Errorf("route prefix %q is used twice", route.Prefix)
+		}
+		seen[route.prefix()] = true
+	}
+	return nil
+}
+
+// normalizeRoutes turns bare ports into localhost addresses
+func normalizeRoutes(routes []Route) []Route {
+	if len(routes) == 0 {
+		return nil
+	}
+	normalized := make([]Route, len(routes))
+	for i, route := range routes {
+		route.Local = NormalizeLocalAddr(route.Local)
+		normalized[i] = route
+	}
+	return normalized
+}
+
+// prefix is the path a route matches without the trailing wildcard or slash,
+// empty for the root
+func (r Route) prefix() string {
+	prefix := strings.TrimSuffix(r.Prefix, "*")
+	return strings.TrimSuffix(prefix, "/")
+}
+
+// matches reports whether path, which may carry a query, is below the prefix.
+// /api matches /api and /api/users but not /apis.
+func (r Route) matches(path string) bool {
+	prefix := r.prefix()
+	rest, ok := strings.CutPrefix(path, prefix)
+	return ok && (rest == "" || rest[0] == '/' || rest[0] == '?')
+}
+
+// route picks the local address for a request path, the longest matching
+// prefix wins, and the path to forward
+func (c *Client) route(path string) (string, string, *Route) {
+	var match *Route
+	for i := range c.Routes {
+		route := &c.Routes[i]
+		if route.matches(path) && (match == nil || len(route.prefix()) > len(match.prefix())) {
+			match = route
+		}
+	}
+	if match == nil {
+		return c.LocalAddr, path, nil
+	}
+
+	if match.StripPrefix {
+		path = strings.TrimPrefix(path, match.prefix())
+		if path == "" || path[0] != '/' {
+			path = "/" + path
+		}
+	}
+	return match.Local, path, match
+}
+
+// publicPrefix returns the public path prefix of the local service at host,
+// with or without a port, and whether host is one of the tunnel's local
+// services at all
+func (c *Client) publicPrefix(host string) (string, bool) {
+	for _, route := range c.Routes {
+		if isLocalHost(host, route.Local) {
+			if route.StripPrefix {
+				return route.prefix(), true
+			}
+			return "", true
+		}
+	}
+	return "", isLocalHost(host, c.LocalAddr)
+}
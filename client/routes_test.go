@@ -0,0 +1,125 @@
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/karol-broda/funnel/shared"
+)
+
+func TestParseRoutes(t *testing.T) {
+	routes, err := ParseRoutes([]string{"/api/*=8080,strip", "/admin=127.0.0.1:9000"})
+	if err != nil {
+		t.Fatalf("ParseRoutes() error = %v", err)
+	}
+	expected := []Route{
+		{Prefix: "/api/*", Local: "localhost:8080", StripPrefix: true},
+		{Prefix: "/admin", Local: "127.0.0.1:9000"},
+	}
+	if !reflect.DeepEqual(routes, expected) {
+		t.Errorf("ParseRoutes() = %+v, want %+v", routes, expected)
+	}
+
+	invalid := [][]string{
+		{"/api"},
+		{"api=8080"},
+		{"/api=,strip"},
+		{"/a*b=8080"},
+		{"/api=8080", "/api/*=9090"},
+	}
+	for _, specs := range invalid {
+		if _, err := ParseRoutes(specs); err == nil {
+			t.Errorf("ParseRoutes(%q) expected an error", specs)
+		}
+	}
+}
+
+func TestClient_route(t *testing.T) {
+	c := &Client{
+		LocalAddr: "localhost:3000",
+		Routes: []Route{
+			{Prefix: "/api/*", Local: "localhost:8080", StripPrefix: true},
+			{Prefix: "/api/admin", Local: "localhost:9000"},
+			{Prefix: "/docs/", Local: "localhost:4000"},
+		},
+	}
+
+	tests := []struct {
+		path          string
+		expectedLocal string
+		expectedPath  string
+	}{
+		{"/", "localhost:3000", "/"},
+		{"/apis", "localhost:3000", "/apis"},
+		{"/api", "localhost:8080", "/"},
+		{"/api?page=2", "localhost:8080", "/?page=2"},
+		{"/api/users/1", "localhost:8080", "/users/1"},
+		{"/api/admin/stats", "localhost:9000", "/api/admin/stats"},
+		{"/docs/intro", "localhost:4000", "/docs/intro"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			local, path, _ := c.route(tt.path)
+			if local != tt.expectedLocal || path != tt.expectedPath {
+				t.Errorf("route(%q) = %s%s, want %s%s", tt.path, local, path, tt.expectedLocal, tt.expectedPath)
+			}
+		})
+	}
+}
+
+func TestClient_processRequest_Routes(t *testing.T) {
+	frontend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("frontend " + r.URL.Path))
+	}))
+	defer frontend.Close()
+
+	var forwarded http.Header
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.Header.Clone()
+		if r.URL.Path == "/old" {
+			http.Redirect(w, r, "http://"+r.Host+"/new", http.StatusFound)
+			return
+		}
+		w.Write([]byte("api " + r.URL.Path))
+	}))
+	defer api.Close()
+
+	c := New("test-tunnel", "http://localhost:8080", strings.TrimPrefix(frontend.URL, "http://"), "")
+	defer c.cancel()
+	c.PublicURL = "https://test-tunnel.example.com"
+	c.Routes = []Route{{Prefix: "/api", Local: strings.TrimPrefix(api.URL, "http://"), StripPrefix: true}}
+
+	httpClient := frontend.Client()
+	httpClient.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	request := func(path string) *shared.Message {
+		t.Helper()
+		go c.processRequest(httpClient, shared.Message{Type: "request", RequestID: "req-" + path, Method: "GET", Path: path})
+		select {
+		case resp := <-c.outgoingMessages:
+			return resp
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for the response to %s", path)
+			return nil
+		}
+	}
+
+	if resp := request("/index.html"); string(resp.Body) != "frontend /index.html" {
+		t.Errorf("/index.html answered %q, want the frontend", resp.Body)
+	}
+	if resp := request("/api/users"); string(resp.Body) != "api /users" {
+		t.Errorf("/api/users answered %q, want the api without the prefix", resp.Body)
+	}
+	if prefix := forwarded.Get("X-Forwarded-Prefix"); prefix != "/api" {
+		t.Errorf("X-Forwarded-Prefix = %q, want /api", prefix)
+	}
+
+	// the api redirects to its own url, the visitor gets the public one
+	resp := request("/api/old")
+	if location := http.Header(resp.Headers).Get("Location"); location != "https://test-tunnel.example.com/api/new" {
+		t.Errorf("Location = %q, want the public url below the prefix", location)
+	}
+}
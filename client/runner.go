@@ -2,6 +2,8 @@ package client
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"math"
 	"net/url"
@@ -10,13 +12,84 @@ import (
 	"time"
 
 	"github.com/karol-broda/funnel/shared"
+	"github.com/rs/zerolog"
 )
 
 const maxReconnectDelay = 30 * time.Second
 
-func Run(tunnelID, serverURL, localAddr, token string, shutdown <-chan struct{}) {
+// Options describes the tunnel a runner keeps connected
+type Options struct {
+	TunnelID  string   `json:"id,omitempty"`
+	ServerURL string   `json:"server"`
+	LocalAddr string   `json:"local"`
+	Token     string   `json:"token,omitempty"`
+	Hostnames []string `json:"hostnames,omitempty"`
+	// Routes send the requests below some paths to other local services
+	Routes []Route `json:"routes,omitempty"`
+	// Pool shares the tunnel id with other clients using the same token, the
+	// server spreads requests across them with this strategy
+	Pool string `json:"pool,omitempty"`
+	// H2C talks http/2 without tls to the local service
+	H2C bool `json:"h2c,omitempty"`
+	// Timeouts asks the server for request timeouts other than its defaults,
+	// within the server's maximum
+	Timeouts *shared.TunnelTimeouts `json:"timeouts,omitempty"`
+	// BodyLimits asks the server for smaller body limits than its own
+	BodyLimits *shared.BodyLimits `json:"body_limits,omitempty"`
+	// ClientCertFile and ClientKeyFile authenticate the client with a certificate,
+	// they are read again on every reconnect so rotated files are picked up
+	ClientCertFile string `json:"client_cert,omitempty"`
+	ClientKeyFile  string `json:"client_key,omitempty"`
+	// BasicAuth, when set, is required on every request before it reaches the local service
+	BasicAuth *BasicAuth `json:"basic_auth,omitempty"`
+	// Headers are set on every request forwarded to the local service
+	Headers map[string]string `json:"headers,omitempty"`
+	// HeaderRules rewrite the headers of requests and responses
+	HeaderRules *HeaderRules `json:"header_rules,omitempty"`
+	// HealthCheck, when set, probes the local service and reports its health to the server
+	HealthCheck *HealthCheck `json:"health_check,omitempty"`
+	// OnStatus is called whenever the tunnel connects, disconnects or gives up
+	OnStatus func(Status) `json:"-"`
+	// Logger receives the logs of this tunnel, the global logger when nil
+	Logger *zerolog.Logger `json:"-"`
+}
+
+// Status describes the connection state of a runner
+type Status struct {
+	TunnelID  string
+	PublicURL string
+	Connected bool
+	// Err is set when the connection failed or the runner stopped because of an error
+	Err error
+}
+
+func (opts Options) reportStatus(status Status) {
+	if opts.OnStatus != nil {
+		opts.OnStatus(status)
+	}
+}
+
+func Run(opts Options, shutdown <-chan struct{}) {
+	tunnelID := opts.TunnelID
 	logger := shared.GetTunnelLogger("client.runner", tunnelID)
-	logger.Info().Str("local_addr", localAddr).Str("server_url", serverURL).Bool("has_token", token != "").Msg("starting tunnel client with reconnection logic")
+	if opts.Logger != nil {
+		logger = opts.Logger.With().Str("component", "client.runner").Str("tunnel_id", tunnelID).Logger()
+	}
+	logger.Info().
+		Str("local_addr", opts.LocalAddr).
+		Str("server_url", opts.ServerURL).
+		Bool("has_token", opts.Token != "").
+		Bool("has_client_cert", opts.ClientCertFile != "").
+		Strs("hostnames", opts.Hostnames).
+		Str("pool", opts.Pool).
+		Msg("starting tunnel client with reconnection logic")
+	for _, route := range opts.Routes {
+		logger.Info().
+			Str("prefix", route.Prefix).
+			Str("local_addr", route.Local).
+			Bool("strip_prefix", route.StripPrefix).
+			Msg("routing path to local service")
+	}
 
 	reconnectAttempts := 0
 
@@ -29,14 +102,48 @@ func Run(tunnelID, serverURL, localAddr, token string, shutdown <-chan struct{})
 			// continue
 		}
 
-		c := New(tunnelID, serverURL, localAddr, token)
+		c := New(tunnelID, opts.ServerURL, opts.LocalAddr, opts.Token)
+		c.Hostnames = opts.Hostnames
+		c.Routes = opts.Routes
+		c.Pool = opts.Pool
+		c.H2C = opts.H2C
+		c.Timeouts = opts.Timeouts
+		c.BodyLimits = opts.BodyLimits
+		c.BasicAuth = opts.BasicAuth
+		c.Headers = opts.Headers
+		c.HealthCheck = opts.HealthCheck
+		c.Logger = opts.Logger
+
+		if err := c.SetHeaderRules(opts.HeaderRules); err != nil {
+			logger.Error().Err(err).Msg("invalid header rules, not connecting")
+			opts.reportStatus(Status{TunnelID: tunnelID, Err: err})
+			return
+		}
+
+		if opts.ClientCertFile != "" {
+			cert, err := tls.LoadX509KeyPair(opts.ClientCertFile, opts.ClientKeyFile)
+			if err != nil {
+				logger.Error().Err(err).Str("client_cert", opts.ClientCertFile).Msg("failed to load client certificate, not connecting")
+				opts.reportStatus(Status{TunnelID: tunnelID, Err: err})
+				return
+			}
+			c.ClientCert = &cert
+		}
 
 		logger.Info().Int("attempt", reconnectAttempts+1).Msg("attempting to connect to server")
 		err := c.connect(c.ctx)
 
+		var rejected *RejectedError
+		if errors.As(err, &rejected) {
+			logger.Error().Str("reason", rejected.Reason).Msg("server rejected the tunnel, not reconnecting")
+			opts.reportStatus(Status{TunnelID: tunnelID, Err: err})
+			return
+		}
+
 		if err != nil {
 			errorCategory := categorizeConnectionError(err)
 			logger.Error().Err(err).Str("error_category", errorCategory).Msg("connection failed")
+			opts.reportStatus(Status{TunnelID: tunnelID, Err: err})
 
 			select {
 			case <-shutdown:
@@ -50,12 +157,22 @@ func Run(tunnelID, serverURL, localAddr, token string, shutdown <-chan struct{})
 		logger.Info().Msg("connected successfully")
 		reconnectAttempts = 0
 
-		if u, err := url.Parse(c.ServerURL); err != nil {
+		// keep the server-assigned id so reconnects land on the same url
+		tunnelID = c.TunnelID
+
+		publicURL := c.PublicURL
+		if publicURL != "" {
+			logger.Info().Str("public_url", publicURL).Msg("tunnel is available")
+			for _, hostname := range c.Hostnames {
+				logger.Info().Str("hostname", hostname).Msg("custom hostname is routed to this tunnel")
+			}
+		} else if u, err := url.Parse(c.ServerURL); err != nil {
 			logger.Error().Err(err).Msg("failed to parse server url for public url display")
 		} else {
-			publicURL := fmt.Sprintf("http://%s.%s", c.TunnelID, u.Host)
+			publicURL = fmt.Sprintf("http://%s.%s", c.TunnelID, u.Host)
 			logger.Info().Str("public_url", publicURL).Msg("tunnel is available")
 		}
+		opts.reportStatus(Status{TunnelID: tunnelID, PublicURL: publicURL, Connected: true})
 
 		var wg sync.WaitGroup
 		wg.Add(2)
@@ -80,6 +197,7 @@ func Run(tunnelID, serverURL, localAddr, token string, shutdown <-chan struct{})
 			c.Close()
 		case <-runCtx.Done():
 			logger.Warn().Msg("connection lost, will attempt to reconnect.")
+			opts.reportStatus(Status{TunnelID: tunnelID, PublicURL: publicURL, Err: errors.New("connection lost")})
 		}
 
 		wg.Wait()
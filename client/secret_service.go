@@ -0,0 +1,220 @@
+package client
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	secretServiceName       = "org.freedesktop.secrets"
+	secretServicePath       = dbus.ObjectPath("/org/freedesktop/secrets")
+	secretDefaultCollection = dbus.ObjectPath("/org/freedesktop/secrets/aliases/default")
+
+	secretServiceInterface    = "org.freedesktop.Secret.Service"
+	secretCollectionInterface = "org.freedesktop.Secret.Collection"
+	secretItemInterface       = "org.freedesktop.Secret.Item"
+	secretPromptInterface     = "org.freedesktop.Secret.Prompt"
+
+	secretPromptTimeout = 2 * time.Minute
+)
+
+// SecretService is the part of the freedesktop secret service api the
+// keyring backend uses. Lookup returns ErrSecretNotFound for missing items.
+type SecretService interface {
+	Lookup(attributes map[string]string) (string, error)
+	Store(label string, attributes map[string]string, secret string) error
+	Delete(attributes map[string]string) error
+}
+
+// dbusSecret mirrors the Secret struct of the secret service api
+type dbusSecret struct {
+	Session     dbus.ObjectPath
+	Parameters  []byte
+	Value       []byte
+	ContentType string
+}
+
+// DBusSecretService talks to gnome-keyring, kwallet or any other secret
+// service provider on the session bus
+type DBusSecretService struct{}
+
+func NewDBusSecretService() *DBusSecretService {
+	return &DBusSecretService{}
+}
+
+type secretSession struct {
+	conn    *dbus.Conn
+	service dbus.BusObject
+	path    dbus.ObjectPath
+}
+
+func openSecretSession() (*secretSession, error) {
+	conn, err := dbus.ConnectSessionBus()
+	if err != nil {
+		return nil, fmt.Errorf("keyring is not available: %w", err)
+	}
+
+	service := conn.Object(secretServiceName, secretServicePath)
+
+	var output dbus.Variant
+	var path dbus.ObjectPath
+	if err := service.Call(secretServiceInterface+".OpenSession", 0, "plain", dbus.MakeVariant("")).Store(&output, &path); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to open keyring session: %w", err)
+	}
+
+	return &secretSession{conn: conn, service: service, path: path}, nil
+}
+
+func (s *secretSession) close() {
+	s.conn.Object(secretServiceName, s.path).Call("org.freedesktop.Secret.Session.Close", 0)
+	s.conn.Close()
+}
+
+// search returns matching items, unlocking them if needed
+func (s *secretSession) search(attributes map[string]string) ([]dbus.ObjectPath, error) {
+	var unlocked, locked []dbus.ObjectPath
+	if err := s.service.Call(secretServiceInterface+".SearchItems", 0, attributes).Store(&unlocked, &locked); err != nil {
+		return nil, fmt.Errorf("failed to search keyring: %w", err)
+	}
+
+	if len(locked) > 0 {
+		if err := s.unlock(locked); err != nil {
+			return nil, err
+		}
+		unlocked = append(unlocked, locked...)
+	}
+	return unlocked, nil
+}
+
+func (s *secretSession) unlock(objects []dbus.ObjectPath) error {
+	var unlocked []dbus.ObjectPath
+	var prompt dbus.ObjectPath
+	if err := s.service.Call(secretServiceInterface+".Unlock", 0, objects).Store(&unlocked, &prompt); err != nil {
+		return fmt.Errorf("failed to unlock keyring: %w", err)
+	}
+	return s.prompt(prompt)
+}
+
+// prompt shows a keyring prompt and waits until the user answers it. "/" means
+// no prompt is needed.
+func (s *secretSession) prompt(path dbus.ObjectPath) error {
+	if path == "/" || path == "" {
+		return nil
+	}
+
+	if err := s.conn.AddMatchSignal(
+		dbus.WithMatchObjectPath(path),
+		dbus.WithMatchInterface(secretPromptInterface),
+		dbus.WithMatchMember("Completed"),
+	); err != nil {
+		return fmt.Errorf("failed to watch keyring prompt: %w", err)
+	}
+
+	signals := make(chan *dbus.Signal, 1)
+	s.conn.Signal(signals)
+	defer s.conn.RemoveSignal(signals)
+
+	if err := s.conn.Object(secretServiceName, path).Call(secretPromptInterface+".Prompt", 0, "").Err; err != nil {
+		return fmt.Errorf("failed to show keyring prompt: %w", err)
+	}
+
+	timeout := time.NewTimer(secretPromptTimeout)
+	defer timeout.Stop()
+
+	for {
+		select {
+		case signal := <-signals:
+			if signal.Path != path || len(signal.Body) == 0 {
+				continue
+			}
+			if dismissed, ok := signal.Body[0].(bool); ok && dismissed {
+				return fmt.Errorf("keyring prompt was dismissed")
+			}
+			return nil
+		case <-timeout.C:
+			return fmt.Errorf("timed out waiting for keyring prompt")
+		}
+	}
+}
+
+func (d *DBusSecretService) Lookup(attributes map[string]string) (string, error) {
+	session, err := openSecretSession()
+	if err != nil {
+		return "", err
+	}
+	defer session.close()
+
+	items, err := session.search(attributes)
+	if err != nil {
+		return "", err
+	}
+	if len(items) == 0 {
+		return "", ErrSecretNotFound
+	}
+
+	var secret dbusSecret
+	if err := session.conn.Object(secretServiceName, items[0]).Call(secretItemInterface+".GetSecret", 0, session.path).Store(&secret); err != nil {
+		return "", fmt.Errorf("failed to read keyring item: %w", err)
+	}
+	return string(secret.Value), nil
+}
+
+func (d *DBusSecretService) Store(label string, attributes map[string]string, value string) error {
+	session, err := openSecretSession()
+	if err != nil {
+		return err
+	}
+	defer session.close()
+
+	if err := session.unlock([]dbus.ObjectPath{secretDefaultCollection}); err != nil {
+		return err
+	}
+
+	properties := map[string]dbus.Variant{
+		secretItemInterface + ".Label":      dbus.MakeVariant(label),
+		secretItemInterface + ".Attributes": dbus.MakeVariant(attributes),
+	}
+	secret := dbusSecret{
+		Session:     session.path,
+		Parameters:  []byte{},
+		Value:       []byte(value),
+		ContentType: "text/plain; charset=utf8",
+	}
+
+	var item, prompt dbus.ObjectPath
+	collection := session.conn.Object(secretServiceName, secretDefaultCollection)
+	if err := collection.Call(secretCollectionInterface+".CreateItem", 0, properties, secret, true).Store(&item, &prompt); err != nil {
+		return fmt.Errorf("failed to store keyring item: %w", err)
+	}
+	return session.prompt(prompt)
+}
+
+func (d *DBusSecretService) Delete(attributes map[string]string) error {
+	session, err := openSecretSession()
+	if err != nil {
+		return err
+	}
+	defer session.close()
+
+	items, err := session.search(attributes)
+	if err != nil {
+		return err
+	}
+	if len(items) == 0 {
+		return ErrSecretNotFound
+	}
+
+	for _, item := range items {
+		var prompt dbus.ObjectPath
+		if err := session.conn.Object(secretServiceName, item).Call(secretItemInterface+".Delete", 0).Store(&prompt); err != nil {
+			return fmt.Errorf("failed to delete keyring item: %w", err)
+		}
+		if err := session.prompt(prompt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
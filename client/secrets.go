@@ -0,0 +1,309 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"filippo.io/age"
+)
+
+const (
+	SecretBackendPlain   = "plain"
+	SecretBackendKeyring = "keyring"
+	SecretBackendFile    = "file"
+
+	// SecretsPassphraseEnv holds the passphrase of the encrypted secrets file
+	SecretsPassphraseEnv = "FUNNEL_SECRETS_PASSPHRASE"
+
+	tokenCommandTimeout = 30 * time.Second
+)
+
+var ErrSecretNotFound = errors.New("secret not found")
+
+// SecretBackend stores tokens outside of the config file. the config only
+// keeps a reference of the form <backend>:<key>.
+type SecretBackend interface {
+	Name() string
+	Get(key string) (string, error)
+	Set(key, value string) error
+	Delete(key string) error
+}
+
+// SecretRef builds the value stored in Inlet.Token for a secret in backend
+func SecretRef(backend, key string) string {
+	return backend + ":" + key
+}
+
+// ParseSecretRef splits a token reference. plain tokens never contain a colon,
+// so anything without one is not a reference.
+func ParseSecretRef(value string) (backend, key string, ok bool) {
+	backend, key, ok = strings.Cut(value, ":")
+	if !ok || key == "" {
+		return "", "", false
+	}
+	switch backend {
+	case SecretBackendKeyring, SecretBackendFile:
+		return backend, key, true
+	}
+	return "", "", false
+}
+
+// KeyringBackend stores tokens in the os keyring through the freedesktop
+// secret service
+type KeyringBackend struct {
+	service SecretService
+}
+
+func NewKeyringBackend(service SecretService) *KeyringBackend {
+	return &KeyringBackend{service: service}
+}
+
+func (b *KeyringBackend) Name() string {
+	return SecretBackendKeyring
+}
+
+func (b *KeyringBackend) attributes(key string) map[string]string {
+	return map[string]string{
+		"application": "funnel",
+		"inlet":       key,
+	}
+}
+
+func (b *KeyringBackend) Get(key string) (string, error) {
+	return b.service.Lookup(b.attributes(key))
+}
+
+func (b *KeyringBackend) Set(key, value string) error {
+	return b.service.Store(fmt.Sprintf("funnel token for inlet %s", key), b.attributes(key), value)
+}
+
+func (b *KeyringBackend) Delete(key string) error {
+	return b.service.Delete(b.attributes(key))
+}
+
+// PassphraseFunc returns the passphrase of an encrypted secrets file. confirm
+// is set when the file is about to be created and the passphrase should be
+// asked twice.
+type PassphraseFunc func(confirm bool) (string, error)
+
+// EnvPassphrase reads the passphrase from FUNNEL_SECRETS_PASSPHRASE
+func EnvPassphrase(confirm bool) (string, error) {
+	passphrase := os.Getenv(SecretsPassphraseEnv)
+	if passphrase == "" {
+		return "", fmt.Errorf("%s is not set", SecretsPassphraseEnv)
+	}
+	return passphrase, nil
+}
+
+// EncryptedFileBackend keeps tokens in a single file encrypted with an age
+// passphrase
+type EncryptedFileBackend struct {
+	path       string
+	passphrase PassphraseFunc
+	workFactor int
+
+	mu     sync.Mutex
+	cached string
+}
+
+func NewEncryptedFileBackend(path string, passphrase PassphraseFunc) *EncryptedFileBackend {
+	if passphrase == nil {
+		passphrase = EnvPassphrase
+	}
+	return &EncryptedFileBackend{path: path, passphrase: passphrase}
+}
+
+func (b *EncryptedFileBackend) Name() string {
+	return SecretBackendFile
+}
+
+func (b *EncryptedFileBackend) Path() string {
+	return b.path
+}
+
+func (b *EncryptedFileBackend) Get(key string) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	secrets, err := b.load()
+	if err != nil {
+		return "", err
+	}
+
+	value, ok := secrets[key]
+	if !ok {
+		return "", ErrSecretNotFound
+	}
+	return value, nil
+}
+
+func (b *EncryptedFileBackend) Set(key, value string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	secrets, err := b.load()
+	if err != nil {
+		return err
+	}
+	if secrets == nil {
+		secrets = make(map[string]string)
+	}
+
+	secrets[key] = value
+	return b.save(secrets)
+}
+
+func (b *EncryptedFileBackend) Delete(key string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	secrets, err := b.load()
+	if err != nil {
+		return err
+	}
+	if _, ok := secrets[key]; !ok {
+		return ErrSecretNotFound
+	}
+
+	delete(secrets, key)
+	return b.save(secrets)
+}
+
+func (b *EncryptedFileBackend) getPassphrase(confirm bool) (string, error) {
+	if b.cached != "" {
+		return b.cached, nil
+	}
+
+	passphrase, err := b.passphrase(confirm)
+	if err != nil {
+		return "", fmt.Errorf("failed to get passphrase for %s: %w", b.path, err)
+	}
+	if passphrase == "" {
+		return "", fmt.Errorf("empty passphrase for %s", b.path)
+	}
+
+	b.cached = passphrase
+	return passphrase, nil
+}
+
+// load returns nil without asking for a passphrase when the file does not exist yet
+func (b *EncryptedFileBackend) load() (map[string]string, error) {
+	data, err := os.ReadFile(b.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read secrets file %s: %w", b.path, err)
+	}
+
+	passphrase, err := b.getPassphrase(false)
+	if err != nil {
+		return nil, err
+	}
+
+	identity, err := age.NewScryptIdentity(passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create identity: %w", err)
+	}
+
+	reader, err := age.Decrypt(bytes.NewReader(data), identity)
+	if err != nil {
+		b.cached = ""
+		return nil, fmt.Errorf("failed to decrypt secrets file %s: %w", b.path, err)
+	}
+	plaintext, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt secrets file %s: %w", b.path, err)
+	}
+
+	secrets := make(map[string]string)
+	if err := json.Unmarshal(plaintext, &secrets); err != nil {
+		return nil, fmt.Errorf("failed to parse secrets file %s: %w", b.path, err)
+	}
+	return secrets, nil
+}
+
+func (b *EncryptedFileBackend) save(secrets map[string]string) error {
+	_, statErr := os.Stat(b.path)
+	passphrase, err := b.getPassphrase(os.IsNotExist(statErr))
+	if err != nil {
+		return err
+	}
+
+	recipient, err := age.NewScryptRecipient(passphrase)
+	if err != nil {
+		return fmt.Errorf("failed to create recipient: %w", err)
+	}
+	if b.workFactor > 0 {
+		recipient.SetWorkFactor(b.workFactor)
+	}
+
+	plaintext, err := json.Marshal(secrets)
+	if err != nil {
+		return fmt.Errorf("failed to marshal secrets: %w", err)
+	}
+
+	var buf bytes.Buffer
+	writer, err := age.Encrypt(&buf, recipient)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt secrets: %w", err)
+	}
+	if _, err := writer.Write(plaintext); err != nil {
+		return fmt.Errorf("failed to encrypt secrets: %w", err)
+	}
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("failed to encrypt secrets: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(b.path), 0755); err != nil {
+		return fmt.Errorf("failed to create secrets directory: %w", err)
+	}
+
+	tmpPath := b.path + ".tmp"
+	if err := os.WriteFile(tmpPath, buf.Bytes(), 0600); err != nil {
+		return fmt.Errorf("failed to write secrets file %s: %w", b.path, err)
+	}
+	if err := os.Rename(tmpPath, b.path); err != nil {
+		return fmt.Errorf("failed to write secrets file %s: %w", b.path, err)
+	}
+	return nil
+}
+
+// runTokenCommand runs command through the shell and returns its trimmed
+// output, e.g. `pass show funnel/default`
+func runTokenCommand(command string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), tokenCommandTimeout)
+	defer cancel()
+
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", command)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", command)
+	}
+	// password managers may need the terminal to ask for their own passphrase
+	cmd.Stdin = os.Stdin
+	cmd.Stderr = os.Stderr
+
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("token command failed: %w", err)
+	}
+
+	token := strings.TrimSpace(string(output))
+	if token == "" {
+		return "", fmt.Errorf("token command returned no output")
+	}
+	return token, nil
+}
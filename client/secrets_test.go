@@ -0,0 +1,228 @@
+package client
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+type fakeSecretService struct {
+	items map[string]string
+}
+
+func (f *fakeSecretService) key(attributes map[string]string) string {
+	return attributes["application"] + "/" + attributes["inlet"]
+}
+
+func (f *fakeSecretService) Lookup(attributes map[string]string) (string, error) {
+	value, ok := f.items[f.key(attributes)]
+	if !ok {
+		return "", ErrSecretNotFound
+	}
+	return value, nil
+}
+
+func (f *fakeSecretService) Store(label string, attributes map[string]string, secret string) error {
+	f.items[f.key(attributes)] = secret
+	return nil
+}
+
+func (f *fakeSecretService) Delete(attributes map[string]string) error {
+	if _, ok := f.items[f.key(attributes)]; !ok {
+		return ErrSecretNotFound
+	}
+	delete(f.items, f.key(attributes))
+	return nil
+}
+
+func newTestConfigManager(t *testing.T) *ConfigManager {
+	t.Helper()
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	return NewConfigManager()
+}
+
+func newTestFileBackend(path, passphrase string) *EncryptedFileBackend {
+	backend := NewEncryptedFileBackend(path, func(bool) (string, error) { return passphrase, nil })
+	// keep scrypt cheap in tests
+	backend.workFactor = 10
+	return backend
+}
+
+func TestParseSecretRef(t *testing.T) {
+	tests := []struct {
+		value   string
+		backend string
+		key     string
+		ok      bool
+	}{
+		{"keyring:default", SecretBackendKeyring, "default", true},
+		{"file:production", SecretBackendFile, "production", true},
+		{"sk_abcdef", "", "", false},
+		{"keyring:", "", "", false},
+		{"vault:default", "", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			backend, key, ok := ParseSecretRef(tt.value)
+			if ok != tt.ok || backend != tt.backend || key != tt.key {
+				t.Errorf("ParseSecretRef(%q) = (%q, %q, %v), want (%q, %q, %v)", tt.value, backend, key, ok, tt.backend, tt.key, tt.ok)
+			}
+		})
+	}
+}
+
+func TestEncryptedFileBackend(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secrets.age")
+	backend := newTestFileBackend(path, "correct horse")
+
+	if _, err := backend.Get("default"); !errors.Is(err, ErrSecretNotFound) {
+		t.Fatalf("expected ErrSecretNotFound before the file exists, got %v", err)
+	}
+
+	if err := backend.Set("default", "sk_default"); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	if err := backend.Set("production", "sk_production"); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read secrets file: %v", err)
+	}
+	if strings.Contains(string(data), "sk_default") {
+		t.Fatal("secrets file must not contain the token in plain text")
+	}
+
+	reopened := newTestFileBackend(path, "correct horse")
+	token, err := reopened.Get("production")
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if token != "sk_production" {
+		t.Errorf("Get() = %q, want %q", token, "sk_production")
+	}
+
+	if _, err := newTestFileBackend(path, "wrong").Get("default"); err == nil {
+		t.Error("expected an error for a wrong passphrase")
+	}
+
+	if err := reopened.Delete("default"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if _, err := reopened.Get("default"); !errors.Is(err, ErrSecretNotFound) {
+		t.Errorf("expected ErrSecretNotFound after delete, got %v", err)
+	}
+}
+
+func TestConfigManager_SetTokenSecret(t *testing.T) {
+	cm := newTestConfigManager(t)
+	keyring := &fakeSecretService{items: make(map[string]string)}
+	cm.SetSecretBackend(NewKeyringBackend(keyring))
+	cm.SetSecretBackend(newTestFileBackend(cm.SecretsPath(), "passphrase"))
+
+	if err := cm.SetServer("default", "https://tunnel.example.com"); err != nil {
+		t.Fatalf("SetServer() error = %v", err)
+	}
+	if err := cm.SetTokenSecret("default", SecretBackendKeyring, "sk_secret"); err != nil {
+		t.Fatalf("SetTokenSecret() error = %v", err)
+	}
+
+	data, err := os.ReadFile(cm.GetConfigPath())
+	if err != nil {
+		t.Fatalf("failed to read config: %v", err)
+	}
+	if strings.Contains(string(data), "sk_secret") {
+		t.Fatal("config file must only contain a reference to the token")
+	}
+
+	inlet, err := cm.GetInlet("default")
+	if err != nil {
+		t.Fatalf("GetInlet() error = %v", err)
+	}
+	if inlet.Token != "keyring:default" {
+		t.Errorf("inlet token = %q, want %q", inlet.Token, "keyring:default")
+	}
+
+	token, err := cm.ResolveToken(inlet)
+	if err != nil {
+		t.Fatalf("ResolveToken() error = %v", err)
+	}
+	if token != "sk_secret" {
+		t.Errorf("ResolveToken() = %q, want %q", token, "sk_secret")
+	}
+
+	// moving the token to another backend removes it from the keyring
+	if err := cm.SetTokenSecret("default", SecretBackendFile, "sk_secret"); err != nil {
+		t.Fatalf("SetTokenSecret() error = %v", err)
+	}
+	if len(keyring.items) != 0 {
+		t.Errorf("expected the keyring entry to be removed, got %v", keyring.items)
+	}
+
+	inlet, _ = cm.GetInlet("default")
+	token, err = cm.ResolveToken(inlet)
+	if err != nil || token != "sk_secret" {
+		t.Errorf("ResolveToken() = (%q, %v), want sk_secret", token, err)
+	}
+
+	// a plain token replaces a token command and the stored secret
+	if err := cm.SetTokenCommand("default", "printf sk_from_command"); err != nil {
+		t.Fatalf("SetTokenCommand() error = %v", err)
+	}
+	if err := cm.SetTokenSecret("default", SecretBackendPlain, "sk_plain"); err != nil {
+		t.Fatalf("SetTokenSecret() error = %v", err)
+	}
+	inlet, _ = cm.GetInlet("default")
+	if inlet.Token != "sk_plain" || inlet.TokenCommand != "" {
+		t.Errorf("inlet token = %q, token command = %q, want only the plain token", inlet.Token, inlet.TokenCommand)
+	}
+	fileBackend, _ := cm.SecretBackend(SecretBackendFile)
+	if _, err := fileBackend.Get("default"); !errors.Is(err, ErrSecretNotFound) {
+		t.Errorf("expected the file secret to be removed, got %v", err)
+	}
+}
+
+func TestConfigManager_ResolveToken(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("token commands are run through sh")
+	}
+
+	cm := newTestConfigManager(t)
+
+	tests := []struct {
+		name        string
+		inlet       Inlet
+		expected    string
+		expectError bool
+	}{
+		{"plain token", Inlet{Token: "sk_plain"}, "sk_plain", false},
+		{"no token", Inlet{}, "", false},
+		{"token command", Inlet{Token: "sk_plain", TokenCommand: "printf 'sk_from_command\\n'"}, "sk_from_command", false},
+		{"failing token command", Inlet{TokenCommand: "exit 3"}, "", true},
+		{"empty token command output", Inlet{TokenCommand: "true"}, "", true},
+		{"missing secret", Inlet{Token: "file:default"}, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := cm.ResolveToken(&tt.inlet)
+			if tt.expectError {
+				if err == nil {
+					t.Errorf("expected an error, got token %q", token)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ResolveToken() error = %v", err)
+			}
+			if token != tt.expected {
+				t.Errorf("ResolveToken() = %q, want %q", token, tt.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,335 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/karol-broda/funnel/shared"
+)
+
+// queueTimeout bounds the wait for room in the outgoing queue of messages
+// that are not part of a stream
+const queueTimeout = 10 * time.Second
+
+// errResponseTooLarge ends a streamed response that outgrew the tunnel's limit
+var errResponseTooLarge = errors.New("response body too large")
+
+// streamBody is a request body the server sends in request_body chunks. chunks
+// are queued instead of written through a pipe, so a local service that reads
+// slowly does not hold up the messages of other requests. with flow control
+// the server sends no more than a stream window ahead of the reader.
+type streamBody struct {
+	mu     sync.Mutex
+	notify chan struct{}
+	chunks [][]byte
+	err    error
+	// consumed is told the credit of what the reader took
+	consumed func(cost int64)
+
+	// trailer is the request's Trailer map, the values received with the last
+	// chunk are copied into it by the reader once the body is drained
+	trailer         http.Header
+	pendingTrailers map[string][]string
+}
+
+func newStreamBody(trailers map[string][]string) *streamBody {
+	body := &streamBody{notify: make(chan struct{}, 1)}
+	if len(trailers) > 0 {
+		body.trailer = make(http.Header, len(trailers))
+		for name := range trailers {
+			body.trailer[http.CanonicalHeaderKey(name)] = nil
+		}
+	}
+	return body
+}
+
+func (b *streamBody) signal() {
+	select {
+	case b.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (b *streamBody) push(data []byte) {
+	b.mu.Lock()
+	if b.err == nil {
+		b.chunks = append(b.chunks, data)
+	}
+	b.mu.Unlock()
+	b.signal()
+}
+
+// finish ends the body after the queued chunks, with an error when the
+// visitor's upload broke off
+func (b *streamBody) finish(trailers map[string][]string, failure string) {
+	b.mu.Lock()
+	if b.err == nil {
+		if failure != "" {
+			b.err = errors.New(failure)
+		} else {
+			b.err = io.EOF
+			b.pendingTrailers = trailers
+		}
+	}
+	b.mu.Unlock()
+	b.signal()
+}
+
+func (b *streamBody) Read(p []byte) (int, error) {
+	for {
+		b.mu.Lock()
+		if len(b.chunks) > 0 {
+			n := copy(p, b.chunks[0])
+			cost := int64(n)
+			if n == len(b.chunks[0]) {
+				b.chunks = b.chunks[1:]
+				cost += shared.ChunkOverhead
+			} else {
+				b.chunks[0] = b.chunks[0][n:]
+			}
+			consumed := b.consumed
+			b.mu.Unlock()
+			if consumed != nil {
+				consumed(cost)
+			}
+			return n, nil
+		}
+		if b.err != nil {
+			err := b.err
+			if err == io.EOF && b.pendingTrailers != nil {
+				// the transport reads the trailer map after the body, on this goroutine
+				for name, values := range b.pendingTrailers {
+					b.trailer[http.CanonicalHeaderKey(name)] = values
+				}
+				b.pendingTrailers = nil
+			}
+			b.mu.Unlock()
+			return 0, err
+		}
+		b.mu.Unlock()
+		<-b.notify
+	}
+}
+
+func (b *streamBody) Close() error {
+	b.mu.Lock()
+	b.chunks = nil
+	if b.err == nil {
+		b.err = io.ErrClosedPipe
+	}
+	b.mu.Unlock()
+	b.signal()
+	return nil
+}
+
+func (c *Client) openRequestBody(requestID string, trailers map[string][]string) {
+	c.requestBodiesMu.Lock()
+	defer c.requestBodiesMu.Unlock()
+	if c.requestBodies == nil {
+		c.requestBodies = make(map[string]*streamBody)
+	}
+	body := newStreamBody(trailers)
+	body.consumed = func(cost int64) { c.credit.Consumed(requestID, cost) }
+	c.requestBodies[requestID] = body
+}
+
+func (c *Client) requestBody(requestID string) *streamBody {
+	c.requestBodiesMu.Lock()
+	defer c.requestBodiesMu.Unlock()
+	return c.requestBodies[requestID]
+}
+
+func (c *Client) closeRequestBody(requestID string) {
+	c.requestBodiesMu.Lock()
+	body := c.requestBodies[requestID]
+	delete(c.requestBodies, requestID)
+	c.requestBodiesMu.Unlock()
+
+	if body != nil {
+		body.Close()
+	}
+	c.credit.Forget(requestID)
+}
+
+// handleRequestBody queues a chunk of a streamed request body
+func (c *Client) handleRequestBody(msg *shared.Message) {
+	body := c.requestBody(msg.RequestID)
+	if body == nil {
+		return
+	}
+	if len(msg.Body) > 0 {
+		body.push(msg.Body)
+	}
+	if msg.End {
+		// processRequest removes the body once it is done with it
+		body.finish(msg.Trailers, msg.Error)
+	}
+}
+
+// newH2CClient returns a client like base that talks http/2 without tls, with
+// prior knowledge as grpc servers expect
+func newH2CClient(base *http.Client) *http.Client {
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	return &http.Client{
+		Timeout:       base.Timeout,
+		Transport:     &http.Transport{Protocols: protocols, IdleConnTimeout: 30 * time.Second, DialContext: dialLocal},
+		CheckRedirect: base.CheckRedirect,
+	}
+}
+
+func isGRPC(headers map[string][]string) bool {
+	return strings.HasPrefix(http.Header(headers).Get("Content-Type"), "application/grpc")
+}
+
+// streamsResponse reports whether a response is sent in chunks as the local
+// service produces it instead of read whole: when its size is unknown or
+// large, or when it announces trailers
+func (c *Client) streamsResponse(resp *http.Response) bool {
+	if !shared.HasFeature(c.features, shared.FeatureStreaming) {
+		return false
+	}
+	return resp.ContentLength < 0 || resp.ContentLength > shared.StreamChunkSize || len(resp.Trailer) > 0
+}
+
+// streamResponse sends a response in response_body chunks, ending with the
+// trailers the local service sent after the body. timedOut cancels the
+// request when the local service produces nothing for idleTimeout.
+func (c *Client) streamResponse(ctx context.Context, timedOut func(), idleTimeout time.Duration, requestID string, resp *http.Response) {
+	logger := c.requestLogger("client.handler", requestID)
+	defer c.flow.Close(requestID)
+
+	idle := time.AfterFunc(idleTimeout, timedOut)
+	defer idle.Stop()
+
+	announced := make(map[string][]string, len(resp.Trailer))
+	for name := range resp.Trailer {
+		announced[name] = nil
+	}
+	first := &shared.Message{
+		Type:      "response",
+		RequestID: requestID,
+		Status:    resp.StatusCode,
+		Headers:   c.responseHeaders(resp.Header),
+		Stream:    true,
+		Trailers:  announced,
+	}
+	if err := c.queueMessage(ctx, first); err != nil {
+		logger.Warn().Err(err).Msg("failed to queue streamed response")
+		return
+	}
+
+	maxBody := c.Limits.BodyLimits.MaxResponseBody
+	buf := make([]byte, shared.StreamChunkSize)
+	sent := 0
+	for {
+		n, err := resp.Body.Read(buf)
+		if maxBody > 0 && int64(sent+n) > maxBody {
+			err = errResponseTooLarge
+			n = 0
+		}
+		if n > 0 {
+			// waiting on a slow visitor is not the local service being idle
+			idle.Stop()
+			chunk := &shared.Message{
+				Type:      "response_body",
+				RequestID: requestID,
+				Body:      append([]byte(nil), buf[:n]...),
+			}
+			if queueErr := c.sendStreamMessage(ctx, chunk); queueErr != nil {
+				logger.Warn().Err(queueErr).Int("bytes_sent", sent).Msg("stopped streaming response")
+				return
+			}
+			sent += n
+			idle.Reset(idleTimeout)
+		}
+
+		if err == nil {
+			continue
+		}
+
+		if requestCanceled(ctx) {
+			logger.Info().Int("bytes_sent", sent).Msg("server canceled the request, stream abandoned")
+			return
+		}
+
+		end := &shared.Message{Type: "response_body", RequestID: requestID, End: true}
+		switch {
+		case err == io.EOF:
+			end.Trailers = resp.Trailer
+		case errors.Is(err, errResponseTooLarge):
+			logger.Warn().
+				Int("bytes_sent", sent).
+				Int64("max_response_body", maxBody).
+				Msg("streamed response body too large, aborting")
+			end.Error = "response body too large"
+		case errors.Is(context.Cause(ctx), errLocalTimeout):
+			logger.Warn().
+				Int("bytes_sent", sent).
+				Dur("idle_timeout", idleTimeout).
+				Msg("local service stream idle for too long, aborting")
+			end.Error = "response stream idle timeout"
+		default:
+			logger.Error().Err(err).Int("bytes_sent", sent).Msg("failed to read streamed response body")
+			end.Error = "failed to read response body"
+		}
+		// the request context is gone once the stream was canceled
+		if queueErr := c.sendStreamMessage(c.ctx, end); queueErr != nil {
+			logger.Warn().Err(queueErr).Msg("failed to end streamed response")
+			return
+		}
+
+		logger.Info().
+			Int("status_code", resp.StatusCode).
+			Int("response_size", sent).
+			Int("trailers", len(resp.Trailer)).
+			Msg("response streamed successfully")
+		return
+	}
+}
+
+// sendStreamMessage queues a body chunk once the server granted credit for
+// it, waiting for credit and for room in the queue until ctx is done
+func (c *Client) sendStreamMessage(ctx context.Context, msg *shared.Message) error {
+	if stalled, err := c.flow.Acquire(ctx, msg.RequestID, shared.ChunkCost(msg)); err != nil {
+		return err
+	} else if stalled {
+		logger := c.requestLogger("client.handler", msg.RequestID)
+		logger.Debug().Msg("waited for flow control credit")
+	}
+	return c.queueMessage(ctx, msg)
+}
+
+// sendMessage queues a message, waiting up to queueTimeout while the outgoing
+// queue is full
+func (c *Client) sendMessage(msg *shared.Message) error {
+	ctx, cancel := context.WithTimeout(c.ctx, queueTimeout)
+	defer cancel()
+	return c.queueMessage(ctx, msg)
+}
+
+// queueMessage waits for room in the outgoing queue until ctx is done
+func (c *Client) queueMessage(ctx context.Context, msg *shared.Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	select {
+	case c.outgoingMessages <- msg:
+		return nil
+	default:
+	}
+
+	atomic.AddInt64(&c.queueStalls, 1)
+	select {
+	case c.outgoingMessages <- msg:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
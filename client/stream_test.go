@@ -0,0 +1,201 @@
+package client
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/karol-broda/funnel/shared"
+)
+
+func TestClient_processRequest_StreamsGRPC(t *testing.T) {
+	type upstreamRequest struct {
+		proto   int
+		body    string
+		trailer string
+	}
+	received := make(chan upstreamRequest, 1)
+
+	local := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- upstreamRequest{proto: r.ProtoMajor, body: string(body), trailer: r.Trailer.Get("X-Checksum")}
+
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Write([]byte("reply"))
+		w.Header().Set("Grpc-Status", "0")
+	}))
+	local.Config.Protocols = new(http.Protocols)
+	local.Config.Protocols.SetUnencryptedHTTP2(true)
+	local.Start()
+	defer local.Close()
+
+	c := New("test-tunnel", "http://localhost:8080", strings.TrimPrefix(local.URL, "http://"), "")
+	defer c.cancel()
+	c.features = []string{shared.FeatureStreaming}
+	c.h2cClient = newH2CClient(http.DefaultClient)
+
+	msg := shared.Message{
+		Type:      "request",
+		RequestID: "req-1",
+		Method:    "POST",
+		Path:      "/echo.Echo/Say",
+		Headers:   map[string][]string{"Content-Type": {"application/grpc"}, "Te": {"trailers"}},
+		Stream:    true,
+		Trailers:  map[string][]string{"X-Checksum": nil},
+	}
+	c.openRequestBody(msg.RequestID, msg.Trailers)
+	go c.processRequest(http.DefaultClient, msg)
+
+	c.handleRequestBody(&shared.Message{Type: "request_body", RequestID: "req-1", Body: []byte("hello ")})
+	c.handleRequestBody(&shared.Message{Type: "request_body", RequestID: "req-1", Body: []byte("world")})
+	c.handleRequestBody(&shared.Message{
+		Type:      "request_body",
+		RequestID: "req-1",
+		End:       true,
+		Trailers:  map[string][]string{"X-Checksum": {"abc"}},
+	})
+
+	select {
+	case got := <-received:
+		if got.proto != 2 {
+			t.Errorf("upstream protocol = HTTP/%d, want HTTP/2", got.proto)
+		}
+		if got.body != "hello world" {
+			t.Errorf("upstream body = %q, want %q", got.body, "hello world")
+		}
+		if got.trailer != "abc" {
+			t.Errorf("upstream trailer X-Checksum = %q, want %q", got.trailer, "abc")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the upstream request")
+	}
+
+	var body strings.Builder
+	var end *shared.Message
+	for end == nil {
+		select {
+		case out := <-c.outgoingMessages:
+			switch {
+			case out.Type == "response":
+				if !out.Stream || out.Status != http.StatusOK {
+					t.Fatalf("response = status %d stream %v, want a streamed 200", out.Status, out.Stream)
+				}
+				if _, ok := out.Trailers["Grpc-Status"]; !ok {
+					t.Errorf("response announces trailers %v, want Grpc-Status", out.Trailers)
+				}
+			case out.Type == "response_body":
+				body.Write(out.Body)
+				if out.End {
+					end = out
+				}
+			default:
+				t.Fatalf("unexpected message %q", out.Type)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the streamed response")
+		}
+	}
+
+	if body.String() != "reply" {
+		t.Errorf("response body = %q, want %q", body.String(), "reply")
+	}
+	if end.Error != "" {
+		t.Errorf("stream ended with error %q", end.Error)
+	}
+	if got := http.Header(end.Trailers).Get("Grpc-Status"); got != "0" {
+		t.Errorf("trailer Grpc-Status = %q, want %q", got, "0")
+	}
+}
+
+func TestStreamBody_ReadAfterFinish(t *testing.T) {
+	body := newStreamBody(map[string][]string{"X-Checksum": nil})
+	body.push([]byte("abc"))
+	body.push([]byte("def"))
+	body.finish(map[string][]string{"X-Checksum": {"sum"}}, "")
+
+	data, err := io.ReadAll(body)
+	if err != nil || string(data) != "abcdef" {
+		t.Fatalf("ReadAll() = %q, %v, want %q", data, err, "abcdef")
+	}
+	if got := body.trailer.Get("X-Checksum"); got != "sum" {
+		t.Errorf("trailer = %q, want %q", got, "sum")
+	}
+
+	broken := newStreamBody(nil)
+	broken.push([]byte("partial"))
+	broken.finish(nil, "failed to read request body")
+	if _, err := io.ReadAll(broken); err == nil {
+		t.Error("a body that broke off must not read as complete")
+	}
+}
+
+func TestClient_processRequest_StreamsServerSentEvents(t *testing.T) {
+	next := make(chan struct{})
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: one\n\n"))
+		w.(http.Flusher).Flush()
+		<-next
+		w.Write([]byte("data: two\n\n"))
+		w.(http.Flusher).Flush()
+		// then goes quiet until the client gives up
+		<-r.Context().Done()
+	}))
+	defer local.Close()
+
+	c := New("test-tunnel", "http://localhost:8080", strings.TrimPrefix(local.URL, "http://"), "")
+	defer c.cancel()
+	c.features = []string{shared.FeatureStreaming}
+	c.Limits.Timeouts.IdleMs = 200
+
+	go c.processRequest(local.Client(), shared.Message{Type: "request", RequestID: "req-1", Method: "GET", Path: "/events"})
+
+	receive := func() *shared.Message {
+		t.Helper()
+		select {
+		case msg := <-c.outgoingMessages:
+			return msg
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for a message")
+			return nil
+		}
+	}
+
+	if resp := receive(); resp.Type != "response" || !resp.Stream {
+		t.Fatalf("first message = %q stream %v, want a streamed response", resp.Type, resp.Stream)
+	}
+	// each event is passed on as soon as the local service flushes it
+	if chunk := receive(); string(chunk.Body) != "data: one\n\n" {
+		t.Fatalf("first chunk = %q, want the first event", chunk.Body)
+	}
+	close(next)
+	if chunk := receive(); string(chunk.Body) != "data: two\n\n" {
+		t.Fatalf("second chunk = %q, want the second event", chunk.Body)
+	}
+
+	end := receive()
+	if !end.End || end.Error == "" {
+		t.Errorf("idle stream ended with end %v error %q, want an idle timeout error", end.End, end.Error)
+	}
+}
+
+func TestClient_processRequest_MissingStreamedBody(t *testing.T) {
+	c := New("test-tunnel", "http://localhost:8080", "127.0.0.1:1", "")
+	defer c.cancel()
+
+	// the body was never opened, e.g. it was dropped with its connection
+	c.processRequest(http.DefaultClient, shared.Message{Type: "request", RequestID: "req-1", Method: "POST", Path: "/upload", Stream: true})
+
+	select {
+	case msg := <-c.outgoingMessages:
+		if msg.Type != "response" || msg.RequestID != "req-1" || msg.Status != http.StatusBadGateway {
+			t.Errorf("sent %q for %q with status %d, want a 502 response for req-1", msg.Type, msg.RequestID, msg.Status)
+		}
+	default:
+		t.Error("no response sent, the visitor would wait for the server timeout")
+	}
+}
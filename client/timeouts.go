@@ -0,0 +1,118 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/karol-broda/funnel/shared"
+)
+
+// the timeouts of servers that do not announce them for the tunnel
+const (
+	defaultConnectTimeout    = 10 * time.Second
+	defaultRequestTimeout    = 30 * time.Second
+	defaultStreamIdleTimeout = 60 * time.Second
+)
+
+var defaultTimeouts = shared.Timeouts{
+	ConnectMs: defaultConnectTimeout.Milliseconds(),
+	TotalMs:   defaultRequestTimeout.Milliseconds(),
+	IdleMs:    defaultStreamIdleTimeout.Milliseconds(),
+}
+
+// errLocalTimeout cancels a request that ran out of time on the client, as
+// opposed to one the server canceled
+var errLocalTimeout = errors.New("local service timed out")
+
+// BuildTimeouts returns the timeouts a client asks the server for, nil when
+// every timeout is left to the server. paths maps a path prefix to the total
+// timeout of the requests below it.
+func BuildTimeouts(connect, header, idle, total time.Duration, paths map[string]time.Duration) (*shared.TunnelTimeouts, error) {
+	for name, timeout := range map[string]time.Duration{"connect": connect, "header": header, "idle": idle, "total": total} {
+		if timeout < 0 {
+			return nil, fmt.Errorf("%s timeout must not be negative", name)
+		}
+	}
+
+	timeouts := &shared.TunnelTimeouts{Timeouts: shared.Timeouts{
+		ConnectMs: connect.Milliseconds(),
+		HeaderMs:  header.Milliseconds(),
+		IdleMs:    idle.Milliseconds(),
+		TotalMs:   total.Milliseconds(),
+	}}
+
+	prefixes := make([]string, 0, len(paths))
+	for prefix := range paths {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	for _, prefix := range prefixes {
+		if !strings.HasPrefix(prefix, "/") {
+			return nil, fmt.Errorf("timeout path %q must start with /", prefix)
+		}
+		if paths[prefix] <= 0 {
+			return nil, fmt.Errorf("timeout for %s must be positive", prefix)
+		}
+		timeouts.Paths = append(timeouts.Paths, shared.PathTimeouts{
+			Prefix:   prefix,
+			Timeouts: shared.Timeouts{TotalMs: paths[prefix].Milliseconds()},
+		})
+	}
+
+	if timeouts.Timeouts == (shared.Timeouts{}) && len(timeouts.Paths) == 0 {
+		return nil, nil
+	}
+	return timeouts, nil
+}
+
+// ParsePathTimeouts parses PREFIX=DURATION overrides like /reports=10m
+func ParsePathTimeouts(specs []string) (map[string]time.Duration, error) {
+	if len(specs) == 0 {
+		return nil, nil
+	}
+
+	paths := make(map[string]time.Duration, len(specs))
+	for _, spec := range specs {
+		prefix, value, ok := strings.Cut(spec, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid path timeout %q, expected PREFIX=DURATION", spec)
+		}
+		timeout, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid path timeout %q: %w", spec, err)
+		}
+		paths[prefix] = timeout
+	}
+	return paths, nil
+}
+
+// requestTimeouts returns the timeouts of a request as the server announced
+// them for the tunnel
+func (c *Client) requestTimeouts(path string) shared.Timeouts {
+	return c.Limits.Timeouts.ForPath(path).Merge(defaultTimeouts)
+}
+
+type connectTimeoutKey struct{}
+
+// withConnectTimeout bounds connecting to the local service for a request
+func withConnectTimeout(ctx context.Context, timeout time.Duration) context.Context {
+	return context.WithValue(ctx, connectTimeoutKey{}, timeout)
+}
+
+// dialLocal connects to the local service within the connect timeout of the
+// request asking for the connection
+func dialLocal(ctx context.Context, network, addr string) (net.Conn, error) {
+	if timeout, ok := ctx.Value(connectTimeoutKey{}).(time.Duration); ok && timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, network, addr)
+}
@@ -0,0 +1,102 @@
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/karol-broda/funnel/shared"
+)
+
+func TestBuildTimeouts(t *testing.T) {
+	tests := []struct {
+		name     string
+		total    time.Duration
+		paths    []string
+		expected *shared.TunnelTimeouts
+		wantErr  bool
+	}{
+		{name: "nothing set", expected: nil},
+		{
+			name:     "total only",
+			total:    2 * time.Minute,
+			expected: &shared.TunnelTimeouts{Timeouts: shared.Timeouts{TotalMs: 120000}},
+		},
+		{
+			name:  "path overrides",
+			paths: []string{"/reports=10m", "/exports=1h"},
+			expected: &shared.TunnelTimeouts{Paths: []shared.PathTimeouts{
+				{Prefix: "/exports", Timeouts: shared.Timeouts{TotalMs: 3600000}},
+				{Prefix: "/reports", Timeouts: shared.Timeouts{TotalMs: 600000}},
+			}},
+		},
+		{name: "negative timeout", total: -time.Second, wantErr: true},
+		{name: "missing duration", paths: []string{"/reports"}, wantErr: true},
+		{name: "invalid duration", paths: []string{"/reports=soon"}, wantErr: true},
+		{name: "relative path", paths: []string{"reports=10m"}, wantErr: true},
+		{name: "zero path timeout", paths: []string{"/reports=0s"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			paths, err := ParsePathTimeouts(tt.paths)
+			var timeouts *shared.TunnelTimeouts
+			if err == nil {
+				timeouts, err = BuildTimeouts(0, 0, 0, tt.total, paths)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(timeouts, tt.expected) {
+				t.Errorf("timeouts = %+v, want %+v", timeouts, tt.expected)
+			}
+		})
+	}
+}
+
+func TestClient_processRequest_Timeouts(t *testing.T) {
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/reports") {
+			select {
+			case <-time.After(5 * time.Second):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer local.Close()
+
+	c := New("test-tunnel", "http://localhost:8080", strings.TrimPrefix(local.URL, "http://"), "")
+	defer c.cancel()
+	c.Limits.Timeouts = shared.TunnelTimeouts{
+		Timeouts: shared.Timeouts{TotalMs: 10000},
+		Paths:    []shared.PathTimeouts{{Prefix: "/reports", Timeouts: shared.Timeouts{TotalMs: 100}}},
+	}
+
+	tests := []struct {
+		path           string
+		expectedStatus int
+	}{
+		{"/status", http.StatusOK},
+		{"/reports/yearly", http.StatusGatewayTimeout},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			start := time.Now()
+			c.processRequest(local.Client(), shared.Message{Type: "request", RequestID: "req-1", Method: "GET", Path: tt.path})
+
+			resp := <-c.outgoingMessages
+			if resp.Status != tt.expectedStatus {
+				t.Errorf("status = %d, want %d", resp.Status, tt.expectedStatus)
+			}
+			if elapsed := time.Since(start); elapsed > 2*time.Second {
+				t.Errorf("request took %v, want the path timeout to apply", elapsed)
+			}
+		})
+	}
+}
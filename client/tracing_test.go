@@ -0,0 +1,76 @@
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/karol-broda/funnel/shared"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestClient_processRequest_Tracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	received := make(chan http.Header, 1)
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Clone()
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer local.Close()
+
+	c := New("test-tunnel", "http://localhost:8080", strings.TrimPrefix(local.URL, "http://"), "")
+	defer c.cancel()
+
+	// the server's tunnel span is the parent of the client's
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	c.processRequest(local.Client(), shared.Message{
+		Type:      "request",
+		RequestID: "req-1",
+		Method:    "GET",
+		Path:      "/orders",
+		Headers: map[string][]string{
+			"Traceparent":          {"00-" + traceID + "-00f067aa0ba902b7-01"},
+			shared.RequestIDHeader: {"edge-42"},
+		},
+	})
+
+	var headers http.Header
+	select {
+	case headers = <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("local service did not receive the request")
+	}
+	if headers.Get(shared.RequestIDHeader) != "edge-42" {
+		t.Errorf("X-Request-Id = %q, want it passed on", headers.Get(shared.RequestIDHeader))
+	}
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	clientSpan, upstreamSpan := spans["funnel.client"], spans["funnel.upstream"]
+	if clientSpan == nil || upstreamSpan == nil {
+		t.Fatalf("recorded spans %v, want funnel.client and funnel.upstream", spans)
+	}
+	if clientSpan.SpanContext().TraceID().String() != traceID || clientSpan.Parent().SpanID().String() != "00f067aa0ba902b7" {
+		t.Errorf("funnel.client is in trace %s under %s, want the server's span", clientSpan.SpanContext().TraceID(), clientSpan.Parent().SpanID())
+	}
+	if upstreamSpan.Parent().SpanID() != clientSpan.SpanContext().SpanID() {
+		t.Errorf("funnel.upstream parent = %s, want funnel.client", upstreamSpan.Parent().SpanID())
+	}
+	expected := "00-" + traceID + "-" + upstreamSpan.SpanContext().SpanID().String() + "-01"
+	if traceparent := headers.Get("Traceparent"); traceparent != expected {
+		t.Errorf("Traceparent = %q, want %q", traceparent, expected)
+	}
+	if upstreamSpan.Status().Code.String() != "Error" {
+		t.Errorf("funnel.upstream status = %v, want an error for a 500", upstreamSpan.Status())
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/karol-broda/funnel/client"
+	"github.com/karol-broda/funnel/shared"
+	"github.com/rs/zerolog"
+	"github.com/spf13/cobra"
+)
+
+const detachWaitTimeout = 10 * time.Second
+
+var (
+	daemonSocket string
+	logsFollow   bool
+	logsTail     int
+)
+
+var daemonCmd = &cobra.Command{
+	Use:   "daemon",
+	Short: "run the background process owning detached tunnels",
+	Long:  `run the background process owning tunnels started with funnel http --detach. it is controlled through a local unix socket by funnel ls, stop, logs and inspect`,
+	Args:  cobra.NoArgs,
+	Run:   runDaemon,
+}
+
+var lsCmd = &cobra.Command{
+	Use:   "ls",
+	Short: "list tunnels owned by the daemon",
+	Args:  cobra.NoArgs,
+	Run:   runLs,
+}
+
+var stopCmd = &cobra.Command{
+	Use:   "stop <name | id>...",
+	Short: "stop tunnels owned by the daemon",
+	Args:  cobra.MinimumNArgs(1),
+	Run:   runStop,
+}
+
+var logsCmd = &cobra.Command{
+	Use:   "logs <name | id>",
+	Short: "show logs of a tunnel owned by the daemon",
+	Args:  cobra.ExactArgs(1),
+	Run:   runLogs,
+}
+
+var inspectCmd = &cobra.Command{
+	Use:   "inspect <name | id>",
+	Short: "show details of a tunnel owned by the daemon as json",
+	Args:  cobra.ExactArgs(1),
+	Run:   runInspect,
+}
+
+func init() {
+	for _, cmd := range []*cobra.Command{daemonCmd, lsCmd, stopCmd, logsCmd, inspectCmd, httpCmd} {
+		cmd.Flags().StringVar(&daemonSocket, "socket", client.DefaultDaemonSocket(), "daemon control socket")
+	}
+
+	logsCmd.Flags().BoolVarP(&logsFollow, "follow", "f", false, "keep streaming new log lines")
+	logsCmd.Flags().IntVarP(&logsTail, "tail", "n", 100, "number of lines to show from the end of the logs")
+}
+
+func runDaemon(cmd *cobra.Command, args []string) {
+	shared.InitializeLogging(shared.DefaultLogConfig())
+	logger := shared.GetLogger("client.daemon")
+
+	stopTracing := startTracing(logger)
+	defer stopTracing()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	daemon := client.NewDaemon(zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: time.RFC3339})
+	if err := daemon.Serve(ctx, daemonSocket); err != nil {
+		logger.Fatal().Err(err).Msg("daemon failed")
+	}
+
+	logger.Info().Msg("daemon has shut down")
+}
+
+// startDetached hands a tunnel to the daemon and waits briefly for it to connect
+func startDetached(opts client.Options) {
+	// the daemon has its own working directory, relative paths would be
+	// resolved against it
+	for _, path := range []*string{&opts.ClientCertFile, &opts.ClientKeyFile} {
+		if *path == "" {
+			continue
+		}
+		absolute, err := filepath.Abs(*path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: invalid path %s: %v\n", *path, err)
+			os.Exit(1)
+		}
+		*path = absolute
+	}
+
+	daemonClient := client.NewDaemonClient(daemonSocket)
+
+	tunnel, err := daemonClient.Start(client.DaemonStartRequest{Name: tunnelName, Options: opts})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: failed to start tunnel: %v\n", err)
+		if errors.Is(err, client.ErrDaemonNotRunning) {
+			fmt.Fprintf(os.Stderr, "  start the daemon with: funnel daemon\n")
+		}
+		os.Exit(1)
+	}
+
+	deadline := time.Now().Add(detachWaitTimeout)
+	for tunnel.State == client.TunnelStateConnecting && tunnel.Error == "" && time.Now().Before(deadline) {
+		time.Sleep(200 * time.Millisecond)
+		if tunnel, err = daemonClient.Inspect(tunnel.Name); err != nil {
+			break
+		}
+	}
+
+	fmt.Printf("Tunnel %q started in the daemon\n", tunnel.Name)
+	if tunnel.PublicURL != "" {
+		fmt.Printf("  public url: %s\n", tunnel.PublicURL)
+	}
+	if tunnel.Error != "" {
+		fmt.Printf("  state:      %s (%s)\n", tunnel.State, tunnel.Error)
+	} else {
+		fmt.Printf("  state:      %s\n", tunnel.State)
+	}
+	fmt.Printf("\n  funnel logs %s    follow its logs\n", tunnel.Name)
+	fmt.Printf("  funnel stop %s    stop it\n", tunnel.Name)
+}
+
+func runLs(cmd *cobra.Command, args []string) {
+	tunnels, err := client.NewDaemonClient(daemonSocket).List()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if len(tunnels) == 0 {
+		fmt.Println("No tunnels running.")
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tID\tSTATE\tLOCAL\tPUBLIC URL\tUPTIME")
+	for _, tunnel := range tunnels {
+		state := tunnel.State
+		if tunnel.Error != "" {
+			state += " (" + tunnel.Error + ")"
+		}
+		uptime := time.Since(tunnel.StartedAt).Truncate(time.Second)
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", tunnel.Name, tunnel.TunnelID, state, tunnel.LocalAddr, tunnel.PublicURL, uptime)
+	}
+	w.Flush()
+}
+
+func runStop(cmd *cobra.Command, args []string) {
+	daemonClient := client.NewDaemonClient(daemonSocket)
+
+	failed := false
+	for _, ref := range args {
+		if err := daemonClient.Stop(ref); err != nil {
+			fmt.Fprintf(os.Stderr, "error: failed to stop %s: %v\n", ref, err)
+			failed = true
+			continue
+		}
+		fmt.Printf("Stopped %s\n", ref)
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func runLogs(cmd *cobra.Command, args []string) {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	output := zerolog.ConsoleWriter{Out: os.Stdout, TimeFormat: time.RFC3339}
+	if err := client.NewDaemonClient(daemonSocket).Logs(ctx, args[0], logsTail, logsFollow, output); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func runInspect(cmd *cobra.Command, args []string) {
+	tunnel, err := client.NewDaemonClient(daemonSocket).Inspect(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(tunnel)
+}
@@ -1,18 +1,22 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/karol-broda/funnel/client"
 	"github.com/karol-broda/funnel/shared"
 	"github.com/karol-broda/funnel/version"
 	"github.com/rs/zerolog"
 	"github.com/spf13/cobra"
+	"golang.org/x/term"
 )
 
 var (
@@ -21,6 +25,35 @@ var (
 	id     string
 	inlet  string
 	token  string
+
+	hostnames  []string
+	clientCert string
+	clientKey  string
+
+	pool string
+	h2c  bool
+
+	healthPath     string
+	healthInterval time.Duration
+
+	requestTimeout time.Duration
+	connectTimeout time.Duration
+	headerTimeout  time.Duration
+	idleTimeout    time.Duration
+	pathTimeouts   []string
+
+	maxRequestBody  string
+	maxResponseBody string
+
+	requestHeaders  []string
+	responseHeaders []string
+	routes          []string
+
+	detach     bool
+	tunnelName string
+
+	traceEndpoint    string
+	traceSampleRatio float64
 )
 
 var rootCmd = &cobra.Command{
@@ -53,10 +86,18 @@ var configCmd = &cobra.Command{
 var configSetTokenCmd = &cobra.Command{
 	Use:   "set-token <token>",
 	Short: "save authentication token to config file",
+	Long:  `save authentication token for an inlet. with --store keyring or --store file the token is kept in the os keyring or an encrypted file and the config only references it`,
 	Args:  cobra.ExactArgs(1),
 	Run:   runConfigSetToken,
 }
 
+var configSetTokenCommandCmd = &cobra.Command{
+	Use:   "set-token-command <command>",
+	Short: "get the token from a command, e.g. a password manager",
+	Args:  cobra.ExactArgs(1),
+	Run:   runConfigSetTokenCommand,
+}
+
 var configSetServerCmd = &cobra.Command{
 	Use:   "set-server <url>",
 	Short: "save server URL to config file",
@@ -64,6 +105,13 @@ var configSetServerCmd = &cobra.Command{
 	Run:   runConfigSetServer,
 }
 
+var configSetClientCertCmd = &cobra.Command{
+	Use:   "set-client-cert <cert-file> <key-file>",
+	Short: "save client certificate and key paths to config file",
+	Args:  cobra.ExactArgs(2),
+	Run:   runConfigSetClientCert,
+}
+
 var configShowCmd = &cobra.Command{
 	Use:   "show",
 	Short: "show current configuration",
@@ -76,20 +124,49 @@ var configPathCmd = &cobra.Command{
 	Run:   runConfigPath,
 }
 
-var configInlet string
+var (
+	configInlet string
+	tokenStore  string
+)
 
 func init() {
 	httpCmd.Flags().StringVarP(&server, "server", "s", "", "tunnel server url (overrides config)")
-	httpCmd.Flags().StringVarP(&id, "id", "i", "", "tunnel id (subdomain)")
+	httpCmd.Flags().StringVarP(&id, "id", "i", "", "tunnel id (subdomain), assigned by the server when omitted")
 	httpCmd.Flags().StringVarP(&inlet, "inlet", "", "default", "inlet configuration to use")
 	httpCmd.Flags().StringVarP(&token, "token", "t", "", "authentication token (overrides config)")
+	httpCmd.Flags().StringArrayVar(&hostnames, "hostname", nil, "custom hostname to route to the tunnel, must point at the server (repeatable)")
+	httpCmd.Flags().StringVar(&clientCert, "client-cert", "", "pem client certificate for servers that require one (overrides config)")
+	httpCmd.Flags().StringVar(&clientKey, "client-key", "", "pem private key for --client-cert")
+	httpCmd.MarkFlagsRequiredTogether("client-cert", "client-key")
+	httpCmd.Flags().StringVar(&pool, "pool", "", "share the tunnel id with other clients: round_robin, least_inflight, sticky_cookie or sticky_ip")
+	httpCmd.Flags().BoolVar(&h2c, "h2c", false, "talk http/2 without tls to the local service, grpc requests always do")
+	httpCmd.Flags().StringVar(&healthPath, "health-check", "", "path on the local service to probe, visitors get an offline page while it fails")
+	httpCmd.Flags().DurationVar(&healthInterval, "health-interval", 10*time.Second, "how often --health-check probes the local service")
+	httpCmd.Flags().DurationVar(&requestTimeout, "timeout", 0, "time a request has for its whole response (default: the server's, capped by its maximum)")
+	httpCmd.Flags().DurationVar(&connectTimeout, "connect-timeout", 0, "time to connect to the local service (default 10s)")
+	httpCmd.Flags().DurationVar(&headerTimeout, "header-timeout", 0, "time a request has for its response headers (default: --timeout)")
+	httpCmd.Flags().DurationVar(&idleTimeout, "idle-timeout", 0, "time a streamed response may send nothing before it is aborted (default: the server's)")
+	httpCmd.Flags().StringArrayVar(&pathTimeouts, "path-timeout", nil, "PREFIX=DURATION timeout for requests below a path, e.g. /reports=10m (repeatable)")
+	httpCmd.Flags().StringVar(&maxRequestBody, "max-request-body", "", "largest request body visitors may upload, like 10MB (default: the server's, which it never raises)")
+	httpCmd.Flags().StringVar(&maxResponseBody, "max-response-body", "", "largest response body the local service may send, like 100MB (default: the server's, which it never raises)")
+	httpCmd.Flags().StringArrayVar(&routes, "route", nil, "PREFIX=LOCAL sends the requests below a path to another local service, e.g. /api=8080, append ,strip to remove the prefix (repeatable)")
+	httpCmd.Flags().StringArrayVar(&requestHeaders, "request-header", nil, "rewrite a request header: 'Name: value' sets, '+Name: value' adds, '-Name' removes; values may use {{.PublicHost}}, {{.ClientIP}} and the like (repeatable)")
+	httpCmd.Flags().StringArrayVar(&responseHeaders, "response-header", nil, "rewrite a response header, same syntax as --request-header (repeatable)")
+	httpCmd.Flags().BoolVarP(&detach, "detach", "d", false, "run the tunnel in the daemon instead of the foreground")
+	httpCmd.Flags().StringVar(&tunnelName, "name", "", "name of the detached tunnel in the daemon (default: tunnel id)")
 
 	configCmd.PersistentFlags().StringVar(&configInlet, "inlet", "default", "inlet to configure")
-	configCmd.AddCommand(configSetTokenCmd, configSetServerCmd, configShowCmd, configPathCmd)
+	configSetTokenCmd.Flags().StringVar(&tokenStore, "store", client.SecretBackendPlain, "where to keep the token: plain, keyring or file")
+	configCmd.AddCommand(configSetTokenCmd, configSetTokenCommandCmd, configSetServerCmd, configSetClientCertCmd, configShowCmd, configPathCmd)
+
+	rootCmd.PersistentFlags().StringVar(&traceEndpoint, "trace-endpoint", os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"), "otlp/http collector url to export request traces to, like http://localhost:4318 (default off)")
+	rootCmd.PersistentFlags().Float64Var(&traceSampleRatio, "trace-sample-ratio", 1, "share of traces not started by the server that are recorded")
 
 	rootCmd.AddCommand(httpCmd)
 	rootCmd.AddCommand(versionCmd)
 	rootCmd.AddCommand(configCmd)
+	rootCmd.AddCommand(upCmd, downCmd, statusCmd)
+	rootCmd.AddCommand(daemonCmd, lsCmd, stopCmd, logsCmd, inspectCmd)
 }
 
 func runHTTPClient(cmd *cobra.Command, args []string) {
@@ -123,19 +200,75 @@ func runHTTPClient(cmd *cobra.Command, args []string) {
 
 	logger.Info().Str("server", finalServer).Bool("has_token", finalToken != "").Msg("using server configuration")
 
-	if id == "" {
-		generatedID, err := shared.GenerateDomainSafeID()
-		if err != nil {
-			logger.Fatal().Err(err).Msg("failed to generate tunnel ID")
+	finalCert, finalKey := resolveClientCertificate(logger)
+
+	if pool != "" {
+		if id == "" {
+			logger.Fatal().Msg("--pool needs --id, every client of the pool uses the same tunnel id")
+		}
+		if err := shared.ValidatePoolStrategy(pool); err != nil {
+			logger.Fatal().Err(err).Msg("invalid --pool")
 		}
-		id = generatedID
-		logger.Info().Str("generated_id", id).Msg("generated tunnel ID")
+	}
+
+	paths, err := client.ParsePathTimeouts(pathTimeouts)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("invalid --path-timeout")
+	}
+	timeouts, err := client.BuildTimeouts(connectTimeout, headerTimeout, idleTimeout, requestTimeout, paths)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("invalid timeouts")
+	}
+	bodyLimits, err := client.ParseBodyLimits(maxRequestBody, maxResponseBody)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("invalid body limits")
+	}
+	routeTable, err := client.ParseRoutes(routes)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("invalid --route")
+	}
+	headerRules, err := client.ParseHeaderRules(requestHeaders, responseHeaders)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("invalid header rules")
+	}
+
+	if id == "" {
+		logger.Info().Msg("no tunnel ID provided, the server will assign one")
 	} else {
 		logger.Info().Str("provided_id", id).Msg("using provided tunnel ID")
 	}
 
+	opts := client.Options{
+		TunnelID:  id,
+		ServerURL: finalServer,
+		LocalAddr: local,
+		Token:     finalToken,
+		Hostnames: hostnames,
+		Routes:    routeTable,
+		Pool:      pool,
+		H2C:       h2c,
+		Timeouts:  timeouts,
+
+		BodyLimits:     bodyLimits,
+		HeaderRules:    headerRules,
+		ClientCertFile: finalCert,
+		ClientKeyFile:  finalKey,
+	}
+
+	if healthPath != "" {
+		opts.HealthCheck = &client.HealthCheck{Path: healthPath, Interval: healthInterval}
+	}
+
+	if detach {
+		startDetached(opts)
+		return
+	}
+
 	logger.Info().Msg("client configuration validated, starting tunnel")
 
+	stopTracing := startTracing(logger)
+	defer stopTracing()
+
 	shutdownChan := make(chan struct{})
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
@@ -146,17 +279,41 @@ func runHTTPClient(cmd *cobra.Command, args []string) {
 		close(shutdownChan)
 	}()
 
-	client.Run(id, finalServer, local, finalToken, shutdownChan)
+	client.Run(opts, shutdownChan)
 
 	logger.Info().Msg("client has shut down")
 }
 
+// startTracing exports request traces when --trace-endpoint is set, the
+// returned function flushes the spans left
+func startTracing(logger zerolog.Logger) func() {
+	if traceEndpoint == "" {
+		return func() {}
+	}
+	shutdown, err := shared.InitTracing(shared.TracingConfig{
+		Endpoint:       traceEndpoint,
+		ServiceName:    "funnel",
+		ServiceVersion: version.GetVersion(),
+		SampleRatio:    traceSampleRatio,
+	})
+	if err != nil {
+		logger.Fatal().Err(err).Msg("failed to set up tracing")
+	}
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdown(ctx); err != nil {
+			logger.Warn().Err(err).Msg("failed to flush traces")
+		}
+	}
+}
+
 func resolveServerAndToken(logger zerolog.Logger) (string, string, error) {
 	var finalServer string
 	var finalToken string
 
 	// try to load configuration
-	configManager := client.NewConfigManager()
+	configManager := newConfigManager()
 	inletConfig, err := configManager.GetInlet(inlet)
 
 	// resolve server: command line flag takes precedence over config
@@ -179,33 +336,113 @@ func resolveServerAndToken(logger zerolog.Logger) (string, string, error) {
 	if token != "" {
 		finalToken = token
 		logger.Info().Msg("using token from command line flag")
-	} else if err == nil && inletConfig != nil && inletConfig.Token != "" {
-		finalToken = inletConfig.Token
+	} else if err == nil && inletConfig != nil && (inletConfig.Token != "" || inletConfig.TokenCommand != "") {
+		finalToken, err = configManager.ResolveToken(inletConfig)
+		if err != nil {
+			return "", "", fmt.Errorf("failed to resolve token for inlet %q: %w", inlet, err)
+		}
 		logger.Info().Str("inlet", inlet).Msg("using token from configuration")
 	}
 
 	return finalServer, finalToken, nil
 }
 
+// resolveClientCertificate picks the client certificate from flags, then the inlet
+func resolveClientCertificate(logger zerolog.Logger) (string, string) {
+	if clientCert != "" {
+		logger.Info().Str("client_cert", clientCert).Msg("using client certificate from command line flag")
+		return clientCert, clientKey
+	}
+
+	configManager := newConfigManager()
+	inletConfig, err := configManager.GetInlet(inlet)
+	if err == nil && inletConfig.ClientCert != "" {
+		logger.Info().Str("inlet", inlet).Str("client_cert", inletConfig.ClientCert).Msg("using client certificate from configuration")
+		return inletConfig.ClientCert, inletConfig.ClientKey
+	}
+
+	return "", ""
+}
+
 func runConfigSetToken(cmd *cobra.Command, args []string) {
 	tokenValue := args[0]
 
-	configManager := client.NewConfigManager()
-	if err := configManager.SetToken(configInlet, tokenValue); err != nil {
+	configManager := newConfigManager()
+	if err := configManager.SetTokenSecret(configInlet, tokenStore, tokenValue); err != nil {
 		fmt.Fprintf(os.Stderr, "error: failed to save token: %v\n", err)
 		os.Exit(1)
 	}
 
 	fmt.Printf("Token saved to inlet %q\n", configInlet)
 	fmt.Printf("  config file: %s\n", configManager.GetConfigPath())
-	fmt.Printf("\n  Warning: token is stored in plain text in the config file.\n")
-	fmt.Printf("  Ensure the file has appropriate permissions (chmod 600).\n")
+
+	switch tokenStore {
+	case client.SecretBackendKeyring:
+		fmt.Printf("  stored in:   os keyring\n")
+	case client.SecretBackendFile:
+		fmt.Printf("  stored in:   %s\n", configManager.SecretsPath())
+	default:
+		fmt.Printf("\n  Warning: token is stored in plain text in the config file.\n")
+		fmt.Printf("  Use --store keyring or --store file to keep it out of the config.\n")
+	}
+}
+
+func runConfigSetTokenCommand(cmd *cobra.Command, args []string) {
+	configManager := newConfigManager()
+	if err := configManager.SetTokenCommand(configInlet, args[0]); err != nil {
+		fmt.Fprintf(os.Stderr, "error: failed to save token command: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Token command saved to inlet %q\n", configInlet)
+	fmt.Printf("  config file: %s\n", configManager.GetConfigPath())
+}
+
+// newConfigManager returns a config manager that asks for the secrets file
+// passphrase on the terminal
+func newConfigManager() *client.ConfigManager {
+	configManager := client.NewConfigManager()
+	configManager.SetSecretBackend(client.NewEncryptedFileBackend(configManager.SecretsPath(), promptPassphrase))
+	return configManager
+}
+
+// promptPassphrase reads the secrets file passphrase from the environment or the terminal
+func promptPassphrase(confirm bool) (string, error) {
+	if passphrase := os.Getenv(client.SecretsPassphraseEnv); passphrase != "" {
+		return passphrase, nil
+	}
+
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return "", fmt.Errorf("%s is not set and stdin is not a terminal", client.SecretsPassphraseEnv)
+	}
+
+	fmt.Fprint(os.Stderr, "secrets passphrase: ")
+	passphrase, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+
+	if confirm {
+		fmt.Fprint(os.Stderr, "confirm passphrase: ")
+		again, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", err
+		}
+		if string(again) != string(passphrase) {
+			return "", fmt.Errorf("passphrases do not match")
+		}
+	}
+
+	return string(passphrase), nil
 }
 
 func runConfigSetServer(cmd *cobra.Command, args []string) {
 	serverValue := args[0]
 
-	configManager := client.NewConfigManager()
+	configManager := newConfigManager()
 	if err := configManager.SetServer(configInlet, serverValue); err != nil {
 		fmt.Fprintf(os.Stderr, "error: failed to save server: %v\n", err)
 		os.Exit(1)
@@ -215,8 +452,37 @@ func runConfigSetServer(cmd *cobra.Command, args []string) {
 	fmt.Printf("  config file: %s\n", configManager.GetConfigPath())
 }
 
+func runConfigSetClientCert(cmd *cobra.Command, args []string) {
+	certFile, err := filepath.Abs(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: invalid certificate path: %v\n", err)
+		os.Exit(1)
+	}
+	keyFile, err := filepath.Abs(args[1])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: invalid key path: %v\n", err)
+		os.Exit(1)
+	}
+
+	if _, err := tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+		fmt.Fprintf(os.Stderr, "error: failed to load client certificate: %v\n", err)
+		os.Exit(1)
+	}
+
+	configManager := newConfigManager()
+	if err := configManager.SetClientCertificate(configInlet, certFile, keyFile); err != nil {
+		fmt.Fprintf(os.Stderr, "error: failed to save client certificate: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Client certificate saved to inlet %q\n", configInlet)
+	fmt.Printf("  certificate: %s\n", certFile)
+	fmt.Printf("  key:         %s\n", keyFile)
+	fmt.Printf("  config file: %s\n", configManager.GetConfigPath())
+}
+
 func runConfigShow(cmd *cobra.Command, args []string) {
-	configManager := client.NewConfigManager()
+	configManager := newConfigManager()
 	config := configManager.GetConfig()
 
 	fmt.Printf("Config file: %s\n\n", configManager.GetConfigPath())
@@ -234,15 +500,23 @@ func runConfigShow(cmd *cobra.Command, args []string) {
 		if inlet.Domain != "" {
 			fmt.Printf("  domain: %s\n", inlet.Domain)
 		}
-		if inlet.Token != "" {
+		if inlet.TokenCommand != "" {
+			fmt.Printf("  token command: %s\n", inlet.TokenCommand)
+		} else if _, _, ok := client.ParseSecretRef(inlet.Token); ok {
+			fmt.Printf("  token:  %s\n", inlet.Token)
+		} else if inlet.Token != "" {
 			fmt.Printf("  token:  %s...\n", inlet.Token[:min(10, len(inlet.Token))])
 		}
+		if inlet.ClientCert != "" {
+			fmt.Printf("  client cert: %s\n", inlet.ClientCert)
+			fmt.Printf("  client key:  %s\n", inlet.ClientKey)
+		}
 		fmt.Println()
 	}
 }
 
 func runConfigPath(cmd *cobra.Command, args []string) {
-	configManager := client.NewConfigManager()
+	configManager := newConfigManager()
 	fmt.Println(configManager.GetConfigPath())
 }
 
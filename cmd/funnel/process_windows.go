@@ -0,0 +1,25 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+)
+
+func processAlive(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	process.Release()
+	return true
+}
+
+// terminateProcess kills the process, windows has no SIGTERM to shut down gracefully
+func terminateProcess(pid int) error {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	return process.Kill()
+}
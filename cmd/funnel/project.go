@@ -0,0 +1,264 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/karol-broda/funnel/client"
+	"github.com/karol-broda/funnel/shared"
+	"github.com/spf13/cobra"
+)
+
+const downTimeout = 10 * time.Second
+
+var projectFile string
+
+var upCmd = &cobra.Command{
+	Use:   "up [tunnel...]",
+	Short: "start the tunnels declared in funnel.toml",
+	Long:  `start the tunnels declared in funnel.toml, or only the named ones, in a single process`,
+	Run:   runUp,
+}
+
+var downCmd = &cobra.Command{
+	Use:   "down",
+	Short: "stop the tunnels started with funnel up",
+	Args:  cobra.NoArgs,
+	Run:   runDown,
+}
+
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "show the tunnels started with funnel up",
+	Args:  cobra.NoArgs,
+	Run:   runStatus,
+}
+
+func init() {
+	for _, cmd := range []*cobra.Command{upCmd, downCmd, statusCmd} {
+		cmd.Flags().StringVarP(&projectFile, "file", "f", "", "project file (default: funnel.toml in the current directory or its parents)")
+	}
+}
+
+// loadProject finds and loads the project file
+func loadProject() (*client.Project, error) {
+	path := projectFile
+	if path == "" {
+		found, err := client.FindProjectFile(".")
+		if err != nil {
+			return nil, err
+		}
+		path = found
+	}
+	return client.LoadProject(path)
+}
+
+// loadRunningState returns the state of a running project, or nil when it is
+// not running. stale state from a crashed process is removed.
+func loadRunningState(statePath string) (*client.ProjectState, error) {
+	state, err := client.LoadProjectState(statePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !processAlive(state.PID) {
+		os.Remove(statePath)
+		return nil, nil
+	}
+	return state, nil
+}
+
+func runUp(cmd *cobra.Command, args []string) {
+	shared.InitializeLogging(shared.DefaultLogConfig())
+	logger := shared.GetLogger("client.up")
+
+	project, err := loadProject()
+	if err != nil {
+		logger.Fatal().Err(err).Msg("failed to load project")
+	}
+
+	names, err := project.Select(args)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("failed to select tunnels")
+	}
+
+	statePath := client.ProjectStatePath(project.Path())
+	running, err := loadRunningState(statePath)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("failed to read project state")
+	}
+	if running != nil {
+		logger.Fatal().Int("pid", running.PID).Msg("tunnels of this project are already running, run funnel down first")
+	}
+
+	configManager := newConfigManager()
+	options := make(map[string]client.Options, len(names))
+	for _, name := range names {
+		opts, err := project.Options(configManager, name)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("failed to resolve tunnel")
+		}
+		options[name] = opts
+	}
+
+	state := &client.ProjectState{
+		PID:       os.Getpid(),
+		Project:   project.Path(),
+		StartedAt: time.Now(),
+		Tunnels:   make(map[string]client.TunnelState, len(names)),
+	}
+	for _, name := range names {
+		state.Tunnels[name] = client.TunnelState{
+			ID:        options[name].TunnelID,
+			Local:     options[name].LocalAddr,
+			UpdatedAt: state.StartedAt,
+		}
+	}
+
+	var stateMu sync.Mutex
+	saveState := func() {
+		if err := state.Save(statePath); err != nil {
+			logger.Error().Err(err).Msg("failed to save project state")
+		}
+	}
+	saveState()
+	defer os.Remove(statePath)
+
+	logger.Info().
+		Str("project", project.Path()).
+		Strs("tunnels", names).
+		Msg("starting tunnels")
+
+	stopTracing := startTracing(logger)
+	defer stopTracing()
+
+	shutdownChan := make(chan struct{})
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		<-sigChan
+		logger.Info().Msg("received shutdown signal, stopping tunnels")
+		close(shutdownChan)
+	}()
+
+	var wg sync.WaitGroup
+	for _, name := range names {
+		opts := options[name]
+		opts.OnStatus = func(status client.Status) {
+			stateMu.Lock()
+			defer stateMu.Unlock()
+
+			tunnel := state.Tunnels[name]
+			tunnel.ID = status.TunnelID
+			tunnel.Connected = status.Connected
+			if status.PublicURL != "" {
+				tunnel.PublicURL = status.PublicURL
+			}
+			tunnel.Error = ""
+			if status.Err != nil {
+				tunnel.Error = status.Err.Error()
+			}
+			tunnel.UpdatedAt = time.Now()
+			state.Tunnels[name] = tunnel
+
+			saveState()
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client.Run(opts, shutdownChan)
+			logger.Info().Str("tunnel", name).Msg("tunnel stopped")
+		}()
+	}
+
+	wg.Wait()
+	logger.Info().Msg("all tunnels have shut down")
+}
+
+func runDown(cmd *cobra.Command, args []string) {
+	project, err := loadProject()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+
+	statePath := client.ProjectStatePath(project.Path())
+	state, err := loadRunningState(statePath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	if state == nil {
+		fmt.Println("No tunnels running for this project.")
+		return
+	}
+
+	if err := terminateProcess(state.PID); err != nil {
+		fmt.Fprintf(os.Stderr, "error: failed to stop process %d: %v\n", state.PID, err)
+		os.Exit(1)
+	}
+
+	deadline := time.Now().Add(downTimeout)
+	for processAlive(state.PID) {
+		if time.Now().After(deadline) {
+			fmt.Fprintf(os.Stderr, "error: process %d did not stop within %s\n", state.PID, downTimeout)
+			os.Exit(1)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	os.Remove(statePath)
+
+	fmt.Printf("Stopped %d tunnel(s) (pid %d)\n", len(state.Tunnels), state.PID)
+}
+
+func runStatus(cmd *cobra.Command, args []string) {
+	project, err := loadProject()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+
+	state, err := loadRunningState(client.ProjectStatePath(project.Path()))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Project: %s\n", project.Path())
+	if state == nil {
+		fmt.Println("Not running.")
+		return
+	}
+	fmt.Printf("Running since %s (pid %d)\n\n", state.StartedAt.Format(time.RFC3339), state.PID)
+
+	names, _ := project.Select(nil)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TUNNEL\tSTATUS\tLOCAL\tPUBLIC URL")
+	for _, name := range names {
+		tunnel, ok := state.Tunnels[name]
+		if !ok {
+			continue
+		}
+
+		status := "connecting"
+		switch {
+		case tunnel.Connected:
+			status = "connected"
+		case tunnel.Error != "":
+			status = "error: " + tunnel.Error
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", name, status, tunnel.Local, tunnel.PublicURL)
+	}
+	w.Flush()
+}
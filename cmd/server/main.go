@@ -29,11 +29,17 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"runtime"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/karol-broda/funnel/server"
@@ -47,11 +53,55 @@ var (
 	tlsPort            int
 	host               string
 	enableTls          bool
+	tlsMode            string
+	tlsCertFiles       []string
+	tlsKeyFiles        []string
+	clientCertMode     string
+	clientCAFile       string
+	clientCertIdentity string
 	certDir            string
 	letsEncryptEmail   string
 	dnsProvidersConfig string
+	acmeDirectory      string
+	acmeChallenges     []string
 	tokenStorePath     string
 	requireAuth        bool
+	publicURL          string
+	generateIDs        bool
+	reservedNames      []string
+	blockedNames       []string
+	reservationPath    string
+	customDomains      bool
+	baseDomains        []string
+	offlinePagePath    string
+	offlineRetryAfter  time.Duration
+	offlinePageErrors  bool
+	clusterListen      string
+	clusterAdvertise   string
+	clusterNodeID      string
+	clusterPeers       []string
+	clusterSecretFile  string
+	clusterInterval    time.Duration
+	requestTimeout     time.Duration
+	headerTimeout      time.Duration
+	streamIdleTimeout  time.Duration
+	maxRequestTimeout  time.Duration
+	maxRequestBody     string
+	maxResponseBody    string
+
+	compress              bool
+	compressMinSize       int
+	compressTypes         []string
+	tunnelCompress        bool
+	tunnelCompressMinSize int
+
+	accessLog           string
+	accessLogFormat     string
+	accessLogMaxSize    string
+	accessLogMaxBackups int
+
+	traceEndpoint    string
+	traceSampleRatio float64
 )
 
 func getDefaultCertDir() string {
@@ -61,6 +111,13 @@ func getDefaultCertDir() string {
 	return "./certs"
 }
 
+func getDefaultReservationStorePath() string {
+	if runtime.GOOS == "linux" || runtime.GOOS == "darwin" || runtime.GOOS == "freebsd" {
+		return "/var/lib/funnel/reservations.json"
+	}
+	return "./reservations.json"
+}
+
 func getDefaultTokenStorePath() string {
 	if runtime.GOOS == "linux" || runtime.GOOS == "darwin" || runtime.GOOS == "freebsd" {
 		return "/var/lib/funnel/tokens.json"
@@ -109,19 +166,105 @@ func main() {
 	tokenRevokeCmd.Flags().StringVar(&tokenName, "name", "", "name of the token to revoke (required)")
 	tokenRevokeCmd.MarkFlagRequired("name")
 
-	tokenCmd.AddCommand(tokenCreateCmd, tokenListCmd, tokenRevokeCmd)
+	tokenLimitsCmd := &cobra.Command{
+		Use:   "limits",
+		Short: "set the body limits of a token's tunnels, overriding the server's",
+		Run:   runTokenLimits,
+	}
+	tokenLimitsCmd.Flags().StringVar(&tokenName, "name", "", "name of the token (required)")
+	tokenLimitsCmd.Flags().StringVar(&tokenMaxRequestBody, "max-request-body", "", "largest request body, like 500MB (defaults to the server's)")
+	tokenLimitsCmd.Flags().StringVar(&tokenMaxResponseBody, "max-response-body", "", "largest response body, like 1GB (defaults to the server's)")
+	tokenLimitsCmd.MarkFlagRequired("name")
+
+	tokenCmd.AddCommand(tokenCreateCmd, tokenListCmd, tokenRevokeCmd, tokenLimitsCmd)
 	tokenCmd.PersistentFlags().StringVar(&tokenStorePath, "token-store", getDefaultTokenStorePath(), "path to token store file")
 
+	reserveCmd := &cobra.Command{
+		Use:   "reserve",
+		Short: "manage tunnel id reservations",
+	}
+
+	reserveAddCmd := &cobra.Command{
+		Use:   "add",
+		Short: "reserve a tunnel id for a token",
+		Run:   runReserveAdd,
+	}
+	reserveAddCmd.Flags().StringVar(&reserveID, "id", "", "tunnel id to reserve (required)")
+	reserveAddCmd.Flags().StringVar(&tokenName, "token", "", "name of the token that owns the id")
+	reserveAddCmd.Flags().StringVar(&reserveIdentity, "cert-identity", "", "client certificate identity that owns the id, instead of a token")
+	reserveAddCmd.MarkFlagRequired("id")
+	reserveAddCmd.MarkFlagsOneRequired("token", "cert-identity")
+	reserveAddCmd.MarkFlagsMutuallyExclusive("token", "cert-identity")
+
+	reserveListCmd := &cobra.Command{
+		Use:   "list",
+		Short: "list all reserved tunnel ids",
+		Run:   runReserveList,
+	}
+
+	reserveRemoveCmd := &cobra.Command{
+		Use:   "remove",
+		Short: "remove a tunnel id reservation",
+		Run:   runReserveRemove,
+	}
+	reserveRemoveCmd.Flags().StringVar(&reserveID, "id", "", "tunnel id to release (required)")
+	reserveRemoveCmd.MarkFlagRequired("id")
+
+	reserveCmd.AddCommand(reserveAddCmd, reserveListCmd, reserveRemoveCmd)
+	reserveCmd.PersistentFlags().StringVar(&reservationPath, "reservation-store", getDefaultReservationStorePath(), "path to reservation store file")
+	reserveCmd.PersistentFlags().StringVar(&tokenStorePath, "token-store", getDefaultTokenStorePath(), "path to token store file")
+
 	rootCmd.PersistentFlags().IntVarP(&port, "port", "p", 8080, "port to listen on for http")
 	rootCmd.PersistentFlags().IntVar(&tlsPort, "tls-port", 8443, "port to listen on for https")
 	rootCmd.PersistentFlags().StringVar(&host, "host", "0.0.0.0", "host to listen on")
-	rootCmd.PersistentFlags().BoolVar(&enableTls, "enable-tls", false, "enable tls with let's encrypt")
+	rootCmd.PersistentFlags().BoolVar(&enableTls, "enable-tls", false, "enable tls")
+	rootCmd.PersistentFlags().StringVar(&tlsMode, "tls-mode", server.TLSModeACME, "where certificates come from: acme, static (--tls-cert/--tls-key files) or dev (local ca)")
+	rootCmd.PersistentFlags().StringArrayVar(&tlsCertFiles, "tls-cert", nil, "pem certificate chain for --tls-mode static, repeatable, paired with --tls-key by position")
+	rootCmd.PersistentFlags().StringArrayVar(&tlsKeyFiles, "tls-key", nil, "pem private key for --tls-mode static, repeatable")
+	rootCmd.PersistentFlags().StringVar(&clientCertMode, "client-cert-mode", "", "authenticate tunnel clients with certificates: optional (certificate or token) or require")
+	rootCmd.PersistentFlags().StringVar(&clientCAFile, "client-ca", "", "pem ca bundle client certificates must chain to")
+	rootCmd.PersistentFlags().StringVar(&clientCertIdentity, "client-cert-identity", server.ClientIdentityCN, "certificate field used as the client identity: cn, dns, email or uri")
 	rootCmd.PersistentFlags().StringVar(&certDir, "cert-dir", getDefaultCertDir(), "directory to store tls certificates")
 	rootCmd.PersistentFlags().StringVar(&letsEncryptEmail, "letsencrypt-email", "", "email address for let's encrypt")
-	rootCmd.PersistentFlags().StringVar(&dnsProvidersConfig, "dns-providers-config", "", "path to dns providers config file")
+	rootCmd.PersistentFlags().StringVar(&dnsProvidersConfig, "dns-providers-config", "", "path to dns providers config file (enables dns-01 and wildcard certificates)")
+	rootCmd.PersistentFlags().StringVar(&acmeDirectory, "acme-directory", server.DefaultCADirURL, "acme directory url, e.g. a local pebble instance for testing")
+	rootCmd.PersistentFlags().StringSliceVar(&acmeChallenges, "acme-challenges", []string{server.ChallengeHTTP01, server.ChallengeTLSALPN01}, "challenges for per-hostname certificates (http-01, tls-alpn-01)")
 	rootCmd.PersistentFlags().StringVar(&tokenStorePath, "token-store", getDefaultTokenStorePath(), "path to token store file")
 	rootCmd.PersistentFlags().BoolVar(&requireAuth, "require-auth", false, "require authentication for tunnel connections")
-	rootCmd.AddCommand(versionCmd, tokenCmd)
+	rootCmd.PersistentFlags().BoolVar(&generateIDs, "generate-ids", true, "assign a random tunnel id to clients that do not request one")
+	rootCmd.PersistentFlags().StringSliceVar(&reservedNames, "reserved-names", server.DefaultReservedNames, "tunnel ids no client may claim")
+	rootCmd.PersistentFlags().StringArrayVar(&blockedNames, "blocked-name-pattern", nil, "regular expression of tunnel ids to refuse (repeatable)")
+	rootCmd.PersistentFlags().StringVar(&reservationPath, "reservation-store", getDefaultReservationStorePath(), "path to reservation store file")
+	rootCmd.PersistentFlags().StringSliceVar(&baseDomains, "base-domain", nil, "domain tunnels are served under, repeatable (defaults to the --public-url host)")
+	rootCmd.PersistentFlags().BoolVar(&customDomains, "custom-domains", false, "allow clients to route verified custom hostnames to their tunnels")
+	rootCmd.PersistentFlags().StringVar(&offlinePagePath, "offline-page", "", "html/template file served while a tunnel's local service is unhealthy (defaults to a built-in page)")
+	rootCmd.PersistentFlags().DurationVar(&offlineRetryAfter, "offline-retry-after", 30*time.Second, "Retry-After sent with the offline page")
+	rootCmd.PersistentFlags().BoolVar(&offlinePageErrors, "offline-page-errors", false, "pass the raw health check error, which names local addresses, to --offline-page templates as .Error")
+	rootCmd.PersistentFlags().DurationVar(&requestTimeout, "request-timeout", 30*time.Second, "default time a request has for its whole response, clients may ask for another")
+	rootCmd.PersistentFlags().DurationVar(&headerTimeout, "header-timeout", 0, "default time a request has for its response headers (defaults to --request-timeout)")
+	rootCmd.PersistentFlags().DurationVar(&streamIdleTimeout, "stream-idle-timeout", time.Minute, "default time a streamed response may send nothing before it is aborted")
+	rootCmd.PersistentFlags().DurationVar(&maxRequestTimeout, "max-request-timeout", 10*time.Minute, "longest timeout a client may ask for")
+	rootCmd.PersistentFlags().StringVar(&maxRequestBody, "max-request-body", "", "largest request body a visitor may upload, like 10MB (default no limit)")
+	rootCmd.PersistentFlags().StringVar(&maxResponseBody, "max-response-body", "", "largest response body a local service may send, like 100MB (default no limit)")
+	rootCmd.PersistentFlags().BoolVar(&compress, "compress", false, "compress responses with brotli or gzip for visitors that accept it")
+	rootCmd.PersistentFlags().IntVar(&compressMinSize, "compress-min-size", 1024, "smallest response --compress compresses, in bytes")
+	rootCmd.PersistentFlags().StringSliceVar(&compressTypes, "compress-types", server.DefaultCompressibleTypes, "content types --compress compresses, an entry ending in / matches the whole type")
+	rootCmd.PersistentFlags().BoolVar(&tunnelCompress, "tunnel-compress", false, "gzip bodies between the server and clients that support it, for clients on slow links")
+	rootCmd.PersistentFlags().IntVar(&tunnelCompressMinSize, "tunnel-compress-min-size", shared.DefaultCompressionThreshold, "smallest body --tunnel-compress compresses, in bytes")
+	rootCmd.PersistentFlags().StringVar(&accessLog, "access-log", "", "write a line per tunnel request to stdout, stderr or a file (default off)")
+	rootCmd.PersistentFlags().StringVar(&accessLogFormat, "access-log-format", server.AccessLogCombined, "access log format: combined, json or a text/template like {{.Status}} {{.URI}}")
+	rootCmd.PersistentFlags().StringVar(&accessLogMaxSize, "access-log-max-size", "100MB", "size at which an --access-log file is rotated")
+	rootCmd.PersistentFlags().IntVar(&accessLogMaxBackups, "access-log-max-backups", 5, "rotated --access-log files kept")
+	rootCmd.PersistentFlags().StringVar(&traceEndpoint, "trace-endpoint", os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"), "otlp/http collector url to export request traces to, like http://localhost:4318 (default off)")
+	rootCmd.PersistentFlags().Float64Var(&traceSampleRatio, "trace-sample-ratio", 1, "share of traces not started by a sampled visitor trace that are recorded")
+	rootCmd.PersistentFlags().StringVar(&clusterListen, "cluster-listen", "", "internal address other cluster nodes connect to, e.g. :7946 (enables cluster mode)")
+	rootCmd.PersistentFlags().StringVar(&clusterAdvertise, "cluster-advertise", "", "url other nodes reach --cluster-listen at (defaults to http://<hostname>:<port>)")
+	rootCmd.PersistentFlags().StringVar(&clusterNodeID, "cluster-node-id", "", "unique name of this node (defaults to the hostname)")
+	rootCmd.PersistentFlags().StringSliceVar(&clusterPeers, "cluster-peers", nil, "internal urls of the other nodes, e.g. http://10.0.0.3:7946")
+	rootCmd.PersistentFlags().StringVar(&clusterSecretFile, "cluster-secret-file", "", "file holding the secret shared by all cluster nodes")
+	rootCmd.PersistentFlags().DurationVar(&clusterInterval, "cluster-gossip-interval", time.Second, "how often nodes exchange their tunnels")
+	rootCmd.PersistentFlags().StringVar(&publicURL, "public-url", "", "public base url announced to clients, e.g. https://tunnel.example.com (defaults to the host clients connect to)")
+	rootCmd.AddCommand(versionCmd, tokenCmd, reserveCmd)
 
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Println(err)
@@ -129,7 +272,127 @@ func main() {
 	}
 }
 
-var tokenName string
+// visitorProtocols enables http/2 next to http/1.1 for visitors, over tls or
+// as h2c with prior knowledge on plain http, which grpc clients need
+func visitorProtocols(plaintext bool) *http.Protocols {
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	if plaintext {
+		protocols.SetUnencryptedHTTP2(true)
+	} else {
+		protocols.SetHTTP2(true)
+	}
+	return protocols
+}
+
+// startCluster joins the cluster and serves the internal listener other nodes
+// forward requests and gossip to
+func startCluster(s *server.Server, tunnelRouter *server.TunnelRouter) {
+	logger := shared.GetLogger("server.main")
+
+	if clusterSecretFile == "" {
+		logger.Fatal().Msg("--cluster-secret-file must be set when --cluster-listen is used")
+	}
+	secretData, err := os.ReadFile(clusterSecretFile)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("failed to read --cluster-secret-file")
+	}
+	secret := strings.TrimSpace(string(secretData))
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	if clusterNodeID == "" {
+		clusterNodeID = hostname
+	}
+	if clusterAdvertise == "" {
+		_, listenPort, err := net.SplitHostPort(clusterListen)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("invalid --cluster-listen")
+		}
+		clusterAdvertise = "http://" + net.JoinHostPort(hostname, listenPort)
+	}
+
+	self := server.ClusterNode{ID: clusterNodeID, Addr: clusterAdvertise}
+	registry, err := server.NewGossipRegistry(self, clusterPeers, secret, clusterInterval)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("invalid --cluster-peers")
+	}
+	cluster, err := server.NewCluster(self, secret, registry)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("invalid cluster configuration")
+	}
+	s.SetCluster(cluster)
+
+	internalServer := &http.Server{
+		Addr:    clusterListen,
+		Handler: cluster.Handler(tunnelRouter),
+	}
+	logger.Info().
+		Str("address", clusterListen).
+		Str("advertise", clusterAdvertise).
+		Str("node_id", clusterNodeID).
+		Msg("starting cluster listener")
+	go func() {
+		if err := internalServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logger.Fatal().Err(err).Msg("cluster listener failed")
+		}
+	}()
+	go cluster.Run(context.Background())
+}
+
+var (
+	tokenName       string
+	reserveID       string
+	reserveIdentity string
+
+	tokenMaxRequestBody  string
+	tokenMaxResponseBody string
+)
+
+// startTracing exports request traces, the returned function flushes the
+// spans left on shutdown
+func startTracing() func() {
+	logger := shared.GetLogger("server.main")
+
+	shutdown, err := shared.InitTracing(shared.TracingConfig{
+		Endpoint:       traceEndpoint,
+		ServiceName:    "funnel-server",
+		ServiceVersion: version.GetVersion(),
+		SampleRatio:    traceSampleRatio,
+	})
+	if err != nil {
+		logger.Fatal().Err(err).Msg("failed to set up tracing")
+	}
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdown(ctx); err != nil {
+			logger.Warn().Err(err).Msg("failed to flush traces")
+		}
+	}
+}
+
+// parseBodyLimits parses the sizes given to the body limit flags, an empty
+// size is no limit
+func parseBodyLimits(request, response string) (shared.BodyLimits, error) {
+	var limits shared.BodyLimits
+	for _, limit := range []struct {
+		size  string
+		value *int64
+	}{{request, &limits.MaxRequestBody}, {response, &limits.MaxResponseBody}} {
+		if limit.size == "" {
+			continue
+		}
+		size, err := shared.ParseByteSize(limit.size)
+		if err != nil {
+			return limits, err
+		}
+		*limit.value = size
+	}
+	return limits, nil
+}
 
 func runTokenCreate(cmd *cobra.Command, args []string) {
 	shared.InitializeLogging(shared.DefaultLogConfig())
@@ -169,15 +432,54 @@ func runTokenList(cmd *cobra.Command, args []string) {
 		return
 	}
 
-	fmt.Printf("\n%-20s %-12s %s\n", "NAME", "PREFIX", "CREATED")
-	fmt.Printf("%-20s %-12s %s\n", "----", "------", "-------")
+	fmt.Printf("\n%-20s %-12s %-14s %s\n", "NAME", "PREFIX", "CREATED", "BODY LIMITS")
+	fmt.Printf("%-20s %-12s %-14s %s\n", "----", "------", "-------", "-----------")
 	for _, t := range tokens {
 		age := formatAge(t.CreatedAt)
-		fmt.Printf("%-20s %-12s %s\n", t.Name, t.Prefix+"...", age)
+		fmt.Printf("%-20s %-12s %-14s %s\n", t.Name, t.Prefix+"...", age, formatBodyLimits(t.BodyLimits))
 	}
 	fmt.Println()
 }
 
+// formatBodyLimits describes the body limits of a token for token list
+func formatBodyLimits(limits *shared.BodyLimits) string {
+	if limits == nil {
+		return "server default"
+	}
+	format := func(size int64) string {
+		if size == 0 {
+			return "default"
+		}
+		return shared.FormatByteSize(size)
+	}
+	return "request " + format(limits.MaxRequestBody) + ", response " + format(limits.MaxResponseBody)
+}
+
+func runTokenLimits(cmd *cobra.Command, args []string) {
+	shared.InitializeLogging(shared.DefaultLogConfig())
+
+	limits, err := parseBodyLimits(tokenMaxRequestBody, tokenMaxResponseBody)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+
+	storePath := cmd.Flag("token-store").Value.String()
+	tokenStore, err := server.NewTokenStore(storePath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: failed to load token store: %v\n", err)
+		os.Exit(1)
+	}
+
+	if err := tokenStore.SetBodyLimits(tokenName, limits); err != nil {
+		fmt.Fprintf(os.Stderr, "error: failed to set body limits: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Body limits of token %q set to %s.\n", tokenName, formatBodyLimits(tokenStore.BodyLimits(tokenName)))
+	fmt.Printf("  They apply to tunnels connecting after the server is restarted.\n")
+}
+
 func runTokenRevoke(cmd *cobra.Command, args []string) {
 	shared.InitializeLogging(shared.DefaultLogConfig())
 
@@ -196,6 +498,86 @@ func runTokenRevoke(cmd *cobra.Command, args []string) {
 	fmt.Printf("Token %q revoked.\n", tokenName)
 }
 
+func runReserveAdd(cmd *cobra.Command, args []string) {
+	shared.InitializeLogging(shared.DefaultLogConfig())
+
+	// certificate identities share the token namespace but are not stored anywhere
+	owner, kind := reserveIdentity, "client certificate"
+	if tokenName != "" {
+		tokenStore, err := server.NewTokenStore(cmd.Flag("token-store").Value.String())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: failed to load token store: %v\n", err)
+			os.Exit(1)
+		}
+
+		tokenExists := false
+		for _, t := range tokenStore.List() {
+			if t.Name == tokenName {
+				tokenExists = true
+				break
+			}
+		}
+		if !tokenExists {
+			fmt.Fprintf(os.Stderr, "error: no active token named %q\n", tokenName)
+			os.Exit(1)
+		}
+		owner, kind = tokenName, "token"
+	}
+
+	reservations, err := server.NewReservationStore(cmd.Flag("reservation-store").Value.String())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: failed to load reservation store: %v\n", err)
+		os.Exit(1)
+	}
+
+	if err := reservations.Add(reserveID, owner); err != nil {
+		fmt.Fprintf(os.Stderr, "error: failed to reserve tunnel id: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Tunnel id %q reserved for %s %q.\n", reserveID, kind, owner)
+}
+
+func runReserveList(cmd *cobra.Command, args []string) {
+	shared.InitializeLogging(shared.DefaultLogConfig())
+
+	reservations, err := server.NewReservationStore(cmd.Flag("reservation-store").Value.String())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: failed to load reservation store: %v\n", err)
+		os.Exit(1)
+	}
+
+	list := reservations.List()
+	if len(list) == 0 {
+		fmt.Println("No reserved tunnel ids found.")
+		return
+	}
+
+	fmt.Printf("\n%-24s %-20s %s\n", "ID", "TOKEN", "CREATED")
+	fmt.Printf("%-24s %-20s %s\n", "--", "-----", "-------")
+	for _, r := range list {
+		fmt.Printf("%-24s %-20s %s\n", r.ID, r.TokenName, formatAge(r.CreatedAt))
+	}
+	fmt.Println()
+}
+
+func runReserveRemove(cmd *cobra.Command, args []string) {
+	shared.InitializeLogging(shared.DefaultLogConfig())
+
+	reservations, err := server.NewReservationStore(cmd.Flag("reservation-store").Value.String())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: failed to load reservation store: %v\n", err)
+		os.Exit(1)
+	}
+
+	if err := reservations.Remove(reserveID); err != nil {
+		fmt.Fprintf(os.Stderr, "error: failed to remove reservation: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Reservation for tunnel id %q removed.\n", reserveID)
+}
+
 func formatAge(t time.Time) string {
 	d := time.Since(t)
 	switch {
@@ -219,10 +601,128 @@ func runServer(cmd *cobra.Command, args []string) {
 	tunnelRouter := server.NewTunnelRouter(s)
 	s.SetRouter(tunnelRouter)
 
+	if publicURL != "" {
+		if err := s.SetPublicBaseURL(publicURL); err != nil {
+			logger.Fatal().Err(err).Msg("invalid --public-url")
+		}
+	}
+
+	if len(baseDomains) == 0 && publicURL != "" {
+		if u, err := url.Parse(publicURL); err == nil {
+			baseDomains = []string{u.Hostname()}
+		}
+	}
+	if len(baseDomains) > 0 {
+		if err := s.SetBaseDomains(baseDomains); err != nil {
+			logger.Fatal().Err(err).Msg("invalid --base-domain")
+		}
+	} else {
+		logger.Info().Msg("no base domain configured, inferring it from each request host")
+	}
+
 	// Initialize API handler
 	apiHandler := server.NewAPIHandler(s, tunnelRouter)
 	tunnelRouter.SetAPIHandler(apiHandler)
 
+	namePolicy, err := server.NewNamePolicy(reservedNames, blockedNames)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("invalid tunnel name policy")
+	}
+	s.SetNamePolicy(namePolicy)
+	s.SetGenerateIDs(generateIDs)
+
+	offlinePage, err := server.NewOfflinePage(offlinePagePath, offlineRetryAfter)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("invalid --offline-page")
+	}
+	offlinePage.SetExposeErrors(offlinePageErrors)
+	s.SetOfflinePage(offlinePage)
+
+	timeouts := shared.Timeouts{
+		HeaderMs: headerTimeout.Milliseconds(),
+		IdleMs:   streamIdleTimeout.Milliseconds(),
+		TotalMs:  requestTimeout.Milliseconds(),
+	}
+	if err := s.SetRequestTimeouts(timeouts, maxRequestTimeout); err != nil {
+		logger.Fatal().Err(err).Msg("invalid request timeouts")
+	}
+
+	bodyLimits, err := parseBodyLimits(maxRequestBody, maxResponseBody)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("invalid body limits")
+	}
+	if err := s.SetBodyLimits(bodyLimits); err != nil {
+		logger.Fatal().Err(err).Msg("invalid body limits")
+	}
+
+	compression := server.Compression{Edge: compress, MinSize: compressMinSize, Types: compressTypes}
+	if tunnelCompress {
+		if tunnelCompressMinSize <= 0 {
+			logger.Fatal().Msg("--tunnel-compress-min-size must be positive")
+		}
+		compression.TunnelMinSize = tunnelCompressMinSize
+	}
+	if err := s.SetCompression(compression); err != nil {
+		logger.Fatal().Err(err).Msg("invalid compression settings")
+	}
+
+	stopTracing := func() {}
+	if traceEndpoint != "" {
+		stopTracing = startTracing()
+	}
+
+	var accessLogFile *server.RotatingFile
+	if accessLog != "" {
+		maxSize, err := shared.ParseByteSize(accessLogMaxSize)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("invalid --access-log-max-size")
+		}
+		out, err := server.OpenAccessLogOutput(accessLog, maxSize, accessLogMaxBackups)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("failed to open access log")
+		}
+		if file, ok := out.(*server.RotatingFile); ok {
+			accessLogFile = file
+		}
+		requestLog, err := server.NewAccessLog(out, accessLogFormat)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("invalid access log format")
+		}
+		s.SetAccessLog(requestLog)
+		logger.Info().
+			Str("destination", accessLog).
+			Str("format", accessLogFormat).
+			Msg("access log enabled")
+	}
+
+	if clusterListen != "" {
+		startCluster(s, tunnelRouter)
+	}
+
+	if customDomains {
+		s.SetDomainVerifier(server.NewDomainVerifier(nil))
+		logger.Info().Msg("custom hostnames enabled")
+	}
+
+	var httpServers []*http.Server
+
+	var clientCertAuth *server.ClientCertAuth
+	if clientCertMode != "" {
+		if !enableTls {
+			logger.Fatal().Msg("--client-cert-mode needs --enable-tls, client certificates are checked during the tls handshake")
+		}
+		clientCertAuth, err = server.NewClientCertAuth(clientCertMode, clientCAFile, clientCertIdentity)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("invalid client certificate configuration")
+		}
+		s.SetClientCertAuth(clientCertAuth)
+		logger.Info().
+			Str("mode", clientCertMode).
+			Str("client_ca", clientCAFile).
+			Str("identity", clientCertIdentity).
+			Msg("client certificate authentication enabled")
+	}
+
 	// Initialize token store if authentication is enabled
 	if requireAuth {
 		tokenStore, err := server.NewTokenStore(tokenStorePath)
@@ -234,22 +734,60 @@ func runServer(cmd *cobra.Command, args []string) {
 		if tokenStore.Count() == 0 {
 			logger.Warn().Msg("authentication enabled but no tokens exist - run 'server token create --name <name>' to create one")
 		}
-	} else {
-		logger.Warn().Msg("authentication disabled - anyone can create tunnels. use --require-auth to enable")
+	}
+
+	if requireAuth || clientCertAuth != nil {
+		reservations, err := server.NewReservationStore(reservationPath)
+		if err != nil {
+			logger.Fatal().Err(err).Str("path", reservationPath).Msg("failed to initialize reservation store")
+		}
+		s.SetReservationStore(reservations)
+	}
+
+	if !requireAuth && (clientCertAuth == nil || !clientCertAuth.Required()) {
+		logger.Warn().Msg("authentication disabled - anyone can create tunnels. use --require-auth or --client-cert-mode require to enable")
 	}
 
 	if enableTls {
-		if letsEncryptEmail == "" || dnsProvidersConfig == "" {
-			logger.Fatal().Msg("--letsencrypt-email and --dns-providers-config must be set when --enable-tls is true")
+		staticCerts, err := server.ParseCertificateFiles(tlsCertFiles, tlsKeyFiles)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("invalid --tls-cert/--tls-key")
+		}
+
+		switch tlsMode {
+		case server.TLSModeACME:
+			if letsEncryptEmail == "" {
+				logger.Fatal().Msg("--letsencrypt-email must be set when --enable-tls is used with --tls-mode acme")
+			}
+			if dnsProvidersConfig == "" && len(s.BaseDomains()) == 0 {
+				logger.Fatal().Msg("--base-domain or --public-url must be set when --enable-tls is used without --dns-providers-config")
+			}
+		case server.TLSModeDev:
+			if len(s.BaseDomains()) == 0 {
+				logger.Fatal().Msg("--base-domain or --public-url must be set when --tls-mode is dev")
+			}
 		}
 
 		logger.Info().
+			Str("tls_mode", tlsMode).
 			Str("email", letsEncryptEmail).
 			Str("cert_dir", certDir).
 			Str("dns_config", dnsProvidersConfig).
+			Str("acme_directory", acmeDirectory).
+			Strs("acme_challenges", acmeChallenges).
+			Int("static_certificates", len(staticCerts)).
 			Msg("tls is enabled, initializing certificate manager")
 
-		certManager, err := server.NewCertificateManager(letsEncryptEmail, certDir, dnsProvidersConfig)
+		certManager, err := server.NewCertificateManager(server.CertificateConfig{
+			Mode:               tlsMode,
+			Email:              letsEncryptEmail,
+			CertDir:            certDir,
+			DNSProvidersConfig: dnsProvidersConfig,
+			CADirURL:           acmeDirectory,
+			Challenges:         acmeChallenges,
+			StaticCertificates: staticCerts,
+			BaseDomains:        s.BaseDomains(),
+		})
 		if err != nil {
 			logger.Fatal().Err(err).Msg("failed to initialize certificate manager")
 		}
@@ -258,9 +796,17 @@ func runServer(cmd *cobra.Command, args []string) {
 			logger.Fatal().Err(err).Msg("failed to preload certificates")
 		}
 
+		certManager.SetHostnamePolicy(tunnelRouter.ServesHost)
+		certManager.StartRenewal(context.Background())
+		apiHandler.SetCertificateManager(certManager)
+
 		tlsConfig := &tls.Config{
 			GetCertificate: certManager.GetCertificate,
 			MinVersion:     tls.VersionTLS12,
+			NextProtos:     server.TLSNextProtos(),
+		}
+		if clientCertAuth != nil {
+			clientCertAuth.ConfigureTLS(tlsConfig, s.IsServerHost)
 		}
 
 		httpsAddr := fmt.Sprintf("%s:%d", host, tlsPort)
@@ -268,8 +814,10 @@ func runServer(cmd *cobra.Command, args []string) {
 			Addr:      httpsAddr,
 			Handler:   tunnelRouter,
 			TLSConfig: tlsConfig,
+			Protocols: visitorProtocols(false),
 		}
 
+		httpServers = append(httpServers, httpsServer)
 		logger.Info().Str("address", httpsAddr).Msg("starting https server")
 		go func() {
 			if err := httpsServer.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
@@ -280,10 +828,11 @@ func runServer(cmd *cobra.Command, args []string) {
 		httpAddr := fmt.Sprintf("%s:%d", host, port)
 		httpServer := &http.Server{
 			Addr: httpAddr,
-			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			Handler: certManager.HTTPChallengeHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 				http.Redirect(w, r, "https://"+r.Host+r.URL.String(), http.StatusMovedPermanently)
-			}),
+			})),
 		}
+		httpServers = append(httpServers, httpServer)
 		logger.Info().Str("address", httpAddr).Msg("starting http to https redirect server")
 		go func() {
 			if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
@@ -294,9 +843,11 @@ func runServer(cmd *cobra.Command, args []string) {
 	} else {
 		httpAddr := fmt.Sprintf("%s:%d", host, port)
 		httpServer := &http.Server{
-			Addr:    httpAddr,
-			Handler: tunnelRouter,
+			Addr:      httpAddr,
+			Handler:   tunnelRouter,
+			Protocols: visitorProtocols(true),
 		}
+		httpServers = append(httpServers, httpServer)
 		logger.Info().Str("address", httpAddr).Msg("starting http server")
 		go func() {
 			if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
@@ -305,6 +856,25 @@ func runServer(cmd *cobra.Command, args []string) {
 		}()
 	}
 
-	// wait indefinitely
-	select {}
+	// run until stopped, then let the requests in flight finish before the
+	// access log and traces are flushed
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	received := <-signals
+	logger.Info().Str("signal", received.String()).Msg("shutting down")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, httpServer := range httpServers {
+		if err := httpServer.Shutdown(ctx); err != nil {
+			logger.Warn().Err(err).Str("address", httpServer.Addr).Msg("failed to shut down server")
+		}
+	}
+
+	stopTracing()
+	if accessLogFile != nil {
+		if err := accessLogFile.Close(); err != nil {
+			logger.Warn().Err(err).Msg("failed to close access log")
+		}
+	}
 }
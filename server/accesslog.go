@@ -0,0 +1,296 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/karol-broda/funnel/shared"
+)
+
+const (
+	AccessLogCombined = "combined"
+	AccessLogJSON     = "json"
+)
+
+const (
+	defaultAccessLogMaxSize    = 100 << 20
+	defaultAccessLogMaxBackups = 5
+)
+
+// AccessLogEntry is one request through a tunnel, custom access log templates
+// can use its fields
+type AccessLogEntry struct {
+	Time      time.Time     `json:"time"`
+	RequestID string        `json:"request_id"`
+	TunnelID  string        `json:"tunnel_id"`
+	TokenName string        `json:"token_name,omitempty"`
+	ClientIP  string        `json:"client_ip"`
+	Method    string        `json:"method"`
+	Host      string        `json:"host"`
+	URI       string        `json:"uri"`
+	Proto     string        `json:"proto"`
+	Status    int           `json:"status"`
+	Bytes     int64         `json:"bytes"`
+	Duration  time.Duration `json:"-"`
+	Referer   string        `json:"referer,omitempty"`
+	UserAgent string        `json:"user_agent,omitempty"`
+}
+
+// DurationMs is the time the request took in milliseconds
+func (e AccessLogEntry) DurationMs() float64 {
+	return float64(e.Duration.Microseconds()) / 1000
+}
+
+// AccessLog writes one line per request through a tunnel, apart from the
+// application log
+type AccessLog struct {
+	out      io.Writer
+	format   string
+	template *template.Template
+	mu       sync.Mutex
+}
+
+// NewAccessLog writes entries to out in the combined log format, as json, or
+// through a text/template for any other format
+func NewAccessLog(out io.Writer, format string) (*AccessLog, error) {
+	l := &AccessLog{out: out, format: format}
+	switch format {
+	case "", AccessLogCombined:
+		l.format = AccessLogCombined
+	case AccessLogJSON:
+	default:
+		tmpl, err := template.New("access_log").Parse(format)
+		if err != nil {
+			return nil, fmt.Errorf("invalid access log template: %w", err)
+		}
+		l.template = tmpl
+	}
+	return l, nil
+}
+
+// Log writes entry as one line
+func (l *AccessLog) Log(entry AccessLogEntry) {
+	var buf bytes.Buffer
+	switch {
+	case l.template != nil:
+		if err := l.template.Execute(&buf, entry); err != nil {
+			logger := shared.GetLogger("server.accesslog")
+			logger.Error().Err(err).Str("request_id", entry.RequestID).Msg("failed to render access log entry")
+			return
+		}
+		if !bytes.HasSuffix(buf.Bytes(), []byte("\n")) {
+			buf.WriteByte('\n')
+		}
+	case l.format == AccessLogJSON:
+		json.NewEncoder(&buf).Encode(struct {
+			AccessLogEntry
+			DurationMs float64 `json:"duration_ms"`
+		}{entry, entry.DurationMs()})
+	default:
+		writeCombined(&buf, entry)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.out.Write(buf.Bytes()); err != nil {
+		logger := shared.GetLogger("server.accesslog")
+		logger.Error().Err(err).Msg("failed to write access log entry")
+	}
+}
+
+// writeCombined writes entry in the combined log format followed by the
+// tunnel id, token name, request id and duration in milliseconds
+func writeCombined(buf *bytes.Buffer, e AccessLogEntry) {
+	size := "-"
+	if e.Bytes > 0 {
+		size = strconv.FormatInt(e.Bytes, 10)
+	}
+	fmt.Fprintf(buf, "%s - - [%s] %s %d %s %s %s %s %s %s %.3f\n",
+		orDash(e.ClientIP),
+		e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		strconv.Quote(e.Method+" "+e.URI+" "+e.Proto),
+		e.Status,
+		size,
+		strconv.Quote(orDash(e.Referer)),
+		strconv.Quote(orDash(e.UserAgent)),
+		strconv.Quote(e.TunnelID),
+		strconv.Quote(orDash(e.TokenName)),
+		e.RequestID,
+		e.DurationMs(),
+	)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// RotatingFile is an append-only file that is rotated once it grows past
+// maxSize, keeping maxBackups old files as path.1, path.2 and so on
+type RotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	file *os.File
+	size int64
+	mu   sync.Mutex
+}
+
+// OpenRotatingFile opens path for appending, a maxSize or maxBackups of zero
+// takes the default
+func OpenRotatingFile(path string, maxSize int64, maxBackups int) (*RotatingFile, error) {
+	if maxSize <= 0 {
+		maxSize = defaultAccessLogMaxSize
+	}
+	if maxBackups <= 0 {
+		maxBackups = defaultAccessLogMaxBackups
+	}
+
+	f := &RotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *RotatingFile) open() error {
+	file, size, err := openAppend(f.path)
+	if err != nil {
+		return err
+	}
+	f.file = file
+	f.size = size
+	return nil
+}
+
+func openAppend(path string) (*os.File, int64, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, fmt.Errorf("failed to stat %s: %w", path, err)
+	}
+	return file, info.Size(), nil
+}
+
+// Write appends p, rotating first when it would grow the file past maxSize. a
+// failed rotation is reported but p still goes to the current file.
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var rotateErr error
+	if f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		rotateErr = f.rotate()
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	if err != nil {
+		return n, err
+	}
+	return n, rotateErr
+}
+
+// rotate shifts the old files up by one, dropping the oldest, and starts a
+// new file at path. the file is closed before it is renamed, which windows
+// needs, so when the rotation fails it is reopened wherever it ended up.
+func (f *RotatingFile) rotate() error {
+	// a failed close leaves nothing to write to either way
+	f.file.Close()
+
+	for i := f.maxBackups - 1; i > 0; i-- {
+		os.Rename(f.backupPath(i), f.backupPath(i+1))
+	}
+
+	current := f.path
+	err := os.Rename(f.path, f.backupPath(1))
+	if err == nil {
+		file, size, openErr := openAppend(f.path)
+		if openErr == nil {
+			f.file, f.size = file, size
+			return nil
+		}
+		current, err = f.backupPath(1), openErr
+	}
+
+	if file, size, reopenErr := openAppend(current); reopenErr == nil {
+		f.file, f.size = file, size
+	}
+	return fmt.Errorf("failed to rotate %s: %w", f.path, err)
+}
+
+func (f *RotatingFile) backupPath(n int) string {
+	return f.path + "." + strconv.Itoa(n)
+}
+
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Close()
+}
+
+// OpenAccessLogOutput opens where the access log goes: stdout, stderr or a
+// rotated file
+func OpenAccessLogOutput(destination string, maxSize int64, maxBackups int) (io.Writer, error) {
+	switch strings.ToLower(destination) {
+	case "stdout", "-":
+		return os.Stdout, nil
+	case "stderr":
+		return os.Stderr, nil
+	}
+	return OpenRotatingFile(destination, maxSize, maxBackups)
+}
+
+// responseRecorder records the status and body size of a response on its
+// way to the visitor, for the access log and the request's span
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *responseRecorder) WriteHeader(status int) {
+	// informational responses come before the final one
+	if w.status == 0 && status >= 200 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseRecorder) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// statusCode is the status sent, 200 when the handler wrote nothing
+func (w *responseRecorder) statusCode() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+// Unwrap lets http.ResponseController reach the flushing and deadlines of the
+// underlying writer
+func (w *responseRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,216 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/karol-broda/funnel/shared"
+)
+
+func TestAccessLog_Formats(t *testing.T) {
+	entry := AccessLogEntry{
+		Time:      time.Date(2025, 3, 14, 9, 26, 53, 0, time.UTC),
+		RequestID: "req-1",
+		TunnelID:  "app",
+		TokenName: "ci",
+		ClientIP:  "203.0.113.7",
+		Method:    "GET",
+		Host:      "app.tunnel.example.com",
+		URI:       "/search?q=funnel",
+		Proto:     "HTTP/1.1",
+		Status:    200,
+		Bytes:     512,
+		Duration:  1500 * time.Microsecond,
+		UserAgent: "curl/8.5.0",
+	}
+
+	tests := []struct {
+		name     string
+		format   string
+		expected string
+	}{
+		{
+			"combined",
+			AccessLogCombined,
+			`203.0.113.7 - - [14/Mar/2025:09:26:53 +0000] "GET /search?q=funnel HTTP/1.1" 200 512 "-" "curl/8.5.0" "app" "ci" req-1 1.500` + "\n",
+		},
+		{
+			"template",
+			"{{.TunnelID}} {{.Status}} {{.Bytes}} {{.DurationMs}}",
+			"app 200 512 1.5\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			accessLog, err := NewAccessLog(&buf, tt.format)
+			if err != nil {
+				t.Fatalf("NewAccessLog() error = %v", err)
+			}
+			accessLog.Log(entry)
+			if buf.String() != tt.expected {
+				t.Errorf("Log() wrote %q, want %q", buf.String(), tt.expected)
+			}
+		})
+	}
+
+	var buf bytes.Buffer
+	accessLog, _ := NewAccessLog(&buf, AccessLogJSON)
+	accessLog.Log(entry)
+	var decoded map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatalf("json entry %q does not parse: %v", buf.String(), err)
+	}
+	if decoded["token_name"] != "ci" || decoded["status"] != float64(200) || decoded["duration_ms"] != 1.5 {
+		t.Errorf("json entry = %v", decoded)
+	}
+
+	if _, err := NewAccessLog(&buf, "{{.Status"); err == nil {
+		t.Error("expected an error for an invalid template")
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	f, err := OpenRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatalf("OpenRotatingFile() error = %v", err)
+	}
+	defer f.Close()
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+	}
+
+	// every line overflows the limit, and only two old files are kept
+	expected := map[string]string{path: "fourth\n", path + ".1": "third\n", path + ".2": "second\n"}
+	for name, content := range expected {
+		data, err := os.ReadFile(name)
+		if err != nil || string(data) != content {
+			t.Errorf("%s = %q (%v), want %q", filepath.Base(name), data, err, content)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Error("expected the oldest file to be dropped")
+	}
+}
+
+func TestRotatingFile_FailedRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	f, err := OpenRotatingFile(path, 10, 1)
+	if err != nil {
+		t.Fatalf("OpenRotatingFile() error = %v", err)
+	}
+	defer f.Close()
+
+	// a directory that is not empty cannot be replaced by the log file
+	if err := os.MkdirAll(filepath.Join(path+".1", "busy"), 0o755); err != nil {
+		t.Fatalf("failed to block the backup path: %v", err)
+	}
+
+	f.Write([]byte("first\n"))
+	if _, err := f.Write([]byte("second\n")); err == nil {
+		t.Error("expected the failed rotation to be reported")
+	}
+	if _, err := f.Write([]byte("third\n")); err == nil {
+		t.Error("expected the failed rotation to be reported")
+	}
+	data, _ := os.ReadFile(path)
+	if string(data) != "first\nsecond\nthird\n" {
+		t.Errorf("log = %q, want every line kept in the current file", data)
+	}
+
+	// once the way is clear rotation works again
+	os.RemoveAll(path + ".1")
+	if _, err := f.Write([]byte("fourth\n")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	data, _ = os.ReadFile(path)
+	if string(data) != "fourth\n" {
+		t.Errorf("log after rotating = %q, want %q", data, "fourth\n")
+	}
+}
+
+// signalBuffer signals every write, so the test reads it only once written
+type signalBuffer struct {
+	bytes.Buffer
+	done chan struct{}
+}
+
+func (b *signalBuffer) Write(p []byte) (int, error) {
+	n, err := b.Buffer.Write(p)
+	b.done <- struct{}{}
+	return n, err
+}
+
+func TestTunnelRouter_AccessLog(t *testing.T) {
+	s, _, ts := newPoolTestServer(t)
+	store, err := NewTokenStore(filepath.Join(t.TempDir(), "tokens.json"))
+	if err != nil {
+		t.Fatalf("failed to create token store: %v", err)
+	}
+	token, _ := store.Create("ci")
+	s.SetTokenStore(store)
+
+	out := &signalBuffer{done: make(chan struct{}, 1)}
+	accessLog, _ := NewAccessLog(out, AccessLogJSON)
+	s.SetAccessLog(accessLog)
+
+	joinTestTunnel(t, ts, "app&token="+token, compressionFeatures, func(conn *websocket.Conn, msg *shared.Message) {
+		if msg.Type == "request" {
+			conn.WriteJSON(&shared.Message{Type: "response", RequestID: msg.RequestID, Status: http.StatusCreated, Body: []byte("created")})
+		}
+	})
+
+	req, _ := http.NewRequest(http.MethodPost, ts.URL+"/items?draft=1", strings.NewReader("{}"))
+	req.Host = "app.tunnel.example.com"
+	req.Header.Set("X-Forwarded-For", "198.51.100.4")
+	req.Header.Set(shared.RequestIDHeader, "edge-42")
+	resp, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+
+	select {
+	case <-out.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no access log entry written")
+	}
+
+	var entry AccessLogEntry
+	if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+		t.Fatalf("access log entry %q does not parse: %v", out.String(), err)
+	}
+	if entry.TunnelID != "app" || entry.TokenName != "ci" || entry.ClientIP != "198.51.100.4" {
+		t.Errorf("entry names tunnel %q token %q client %q", entry.TunnelID, entry.TokenName, entry.ClientIP)
+	}
+	if entry.Method != http.MethodPost || entry.URI != "/items?draft=1" || entry.Status != http.StatusCreated || entry.Bytes != 7 {
+		t.Errorf("entry = %+v, want POST /items?draft=1 answered 201 with 7 bytes", entry)
+	}
+	if entry.RequestID != "edge-42" {
+		t.Errorf("RequestID = %q, want the one the request came with", entry.RequestID)
+	}
+
+	// requests that reach no tunnel are not tunnel traffic
+	req, _ = http.NewRequest(http.MethodGet, ts.URL+"/", nil)
+	req.Host = "missing.tunnel.example.com"
+	if resp, err := ts.Client().Do(req); err == nil {
+		resp.Body.Close()
+	}
+	select {
+	case <-out.done:
+		t.Error("logged a request for an unknown tunnel")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -29,6 +29,10 @@ type TunnelInfo struct {
 	BytesSent        int64     `json:"bytes_sent" example:"98765"`                                // Total bytes sent to client
 	Uptime           string    `json:"uptime" example:"1h15m30s"`                                 // Tunnel connection uptime
 	Status           string    `json:"status" example:"connected" enums:"connected,disconnected"` // Current tunnel status
+	UpstreamStatus   string    `json:"upstream_status" example:"healthy"`                         // Local service health reported by the client: healthy, unhealthy or unknown
+	UpstreamError    string    `json:"upstream_error,omitempty" example:"connection refused"`     // Last health check error while unhealthy
+	PoolStrategy     string    `json:"pool_strategy,omitempty" example:"round_robin"`             // How requests are spread when several clients serve the tunnel
+	PoolMembers      int       `json:"pool_members,omitempty" example:"3"`                        // Number of clients serving a pooled tunnel
 }
 
 // ServerStats represents server-wide statistics
@@ -59,6 +63,7 @@ type TunnelStats struct {
 	BytesReceived    int64                  `json:"bytes_received" example:"12543"`            // Bytes received total
 	BytesSent        int64                  `json:"bytes_sent" example:"98765"`                // Bytes sent total
 	Status           string                 `json:"status" example:"connected"`                // Connection status
+	UpstreamStatus   string                 `json:"upstream_status" example:"healthy"`         // Health of the local service
 	ConnectionInfo   map[string]interface{} `json:"connection_info"`                           // Connection details
 }
 
@@ -86,6 +91,15 @@ type DetailedTunnelMetrics struct {
 	TimeoutCount         int64   `json:"timeout_count" example:"5"`                    // Number of timeouts
 	ConnectionErrors     int64   `json:"connection_errors" example:"2"`                // Connection errors
 	DataErrors           int64   `json:"data_errors" example:"1"`                      // Data errors
+	CancelledCount       int64   `json:"cancelled_count" example:"3"`                  // Requests canceled on the client
+	OversizedBodies      int64   `json:"oversized_bodies" example:"1"`                 // Bodies refused for exceeding the body limits
+	QueueStalls          int64   `json:"queue_stalls" example:"4"`                     // Messages that waited for room in a tunnel queue
+	FlowControlStalls    int64   `json:"flow_control_stalls" example:"7"`              // Body chunks that waited for flow control credit
+	IncomingQueueDepth   int     `json:"incoming_queue_depth" example:"0"`             // Messages from the client waiting to be routed
+	OutgoingQueueDepth   int     `json:"outgoing_queue_depth" example:"2"`             // Messages waiting to be sent to the client
+	CompressedResponses  int64   `json:"compressed_responses" example:"312"`           // Responses compressed for visitors
+	EdgeBytesSaved       int64   `json:"edge_bytes_saved" example:"4821330"`           // Bytes compression saved visitors
+	TunnelBytesSaved     int64   `json:"tunnel_bytes_saved" example:"1203344"`         // Bytes compression saved on the tunnel hop
 	ClientIP             string  `json:"client_ip" example:"192.168.1.100:52341"`      // Client IP address
 	UserAgent            string  `json:"user_agent" example:"FunnelClient/1.0"`        // Client user agent
 	LastActivity         string  `json:"last_activity" example:"2025-08-08T20:30:00Z"` // Last activity time
@@ -118,9 +132,10 @@ type ServerMetricsResponse struct {
 
 // APIHandler handles REST API requests
 type APIHandler struct {
-	server    *Server
-	router    *TunnelRouter
-	startTime time.Time
+	server      *Server
+	router      *TunnelRouter
+	certManager *CertificateManager
+	startTime   time.Time
 }
 
 // NewAPIHandler creates a new API handler
@@ -132,6 +147,11 @@ func NewAPIHandler(server *Server, router *TunnelRouter) *APIHandler {
 	}
 }
 
+// SetCertificateManager exposes certificate status through /api/certificates
+func (api *APIHandler) SetCertificateManager(cm *CertificateManager) {
+	api.certManager = cm
+}
+
 // HandleAPIRequest routes API requests to appropriate handlers
 func (api *APIHandler) HandleAPIRequest(w http.ResponseWriter, r *http.Request) {
 	logger := shared.GetLogger("server.api")
@@ -170,6 +190,8 @@ func (api *APIHandler) HandleAPIRequest(w http.ResponseWriter, r *http.Request)
 		api.handleMetrics(w, r)
 	case path == "/metrics/historical":
 		api.handleHistoricalMetrics(w, r)
+	case path == "/certificates":
+		api.handleCertificates(w, r)
 
 	case path == "/swagger/doc.json":
 		api.ServeSwaggerJSON(w, r)
@@ -236,6 +258,30 @@ func (api *APIHandler) handleServerStats(w http.ResponseWriter, r *http.Request)
 	api.writeSuccessResponse(w, stats)
 }
 
+// handleCertificates returns the status of managed tls certificates
+//
+// @Summary      List tls certificates
+// @Description  Returns the certificates currently served by the server with their expiry, renewal and ocsp stapling status, soonest expiry first
+// @Tags         Server
+// @Accept       json
+// @Produce      json
+// @Success      200  {object}  APIResponse{data=[]CertificateStatus}  "Certificate status"
+// @Failure      404  {object}  APIResponse                            "TLS is not enabled"
+// @Router       /certificates [get]
+func (api *APIHandler) handleCertificates(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		api.writeErrorResponse(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if api.certManager == nil {
+		api.writeErrorResponse(w, "tls is not enabled", http.StatusNotFound)
+		return
+	}
+
+	api.writeSuccessResponse(w, api.certManager.Status())
+}
+
 // handleTunnels handles requests to /api/tunnels
 func (api *APIHandler) handleTunnels(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
@@ -400,6 +446,7 @@ func (api *APIHandler) handleGetTunnelStats(w http.ResponseWriter, r *http.Reque
 		"bytes_received":    tunnel.bytesReceived,
 		"bytes_sent":        tunnel.bytesSent,
 		"status":            "connected",
+		"upstream_status":   tunnel.UpstreamStatus(),
 		"connection_info": map[string]interface{}{
 			"remote_addr": tunnel.getRemoteAddr(),
 		},
@@ -410,7 +457,7 @@ func (api *APIHandler) handleGetTunnelStats(w http.ResponseWriter, r *http.Reque
 
 // getTunnelInfo converts a Tunnel to TunnelInfo for API responses
 func (api *APIHandler) getTunnelInfo(tunnel *Tunnel) TunnelInfo {
-	return TunnelInfo{
+	info := TunnelInfo{
 		ID:               tunnel.ID,
 		CreatedAt:        tunnel.createdAt,
 		MessagesReceived: tunnel.messagesReceived,
@@ -419,7 +466,25 @@ func (api *APIHandler) getTunnelInfo(tunnel *Tunnel) TunnelInfo {
 		BytesSent:        tunnel.bytesSent,
 		Uptime:           time.Since(tunnel.createdAt).String(),
 		Status:           "connected",
+		UpstreamStatus:   tunnel.UpstreamStatus(),
+		UpstreamError:    upstreamError(tunnel),
+	}
+	if tunnel.pool != nil {
+		info.PoolStrategy = tunnel.pool.Strategy
+		info.PoolMembers = len(tunnel.pool.Members())
+	}
+	return info
+}
+
+func upstreamError(tunnel *Tunnel) string {
+	health, _ := tunnel.UpstreamHealth()
+	if health == nil || health.Healthy {
+		return ""
+	}
+	if health.Error == "" && health.Status != 0 {
+		return fmt.Sprintf("health check returned status %d", health.Status)
 	}
+	return health.Error
 }
 
 // writeSuccessResponse writes a successful API response
@@ -632,6 +697,15 @@ func (api *APIHandler) handleGetTunnelMetrics(w http.ResponseWriter, r *http.Req
 		TimeoutCount:         stats.TimeoutCount,
 		ConnectionErrors:     stats.ConnectionErrors,
 		DataErrors:           stats.DataErrors,
+		CancelledCount:       stats.CancelledCount,
+		OversizedBodies:      stats.OversizedBodies,
+		QueueStalls:          stats.QueueStalls,
+		FlowControlStalls:    stats.FlowControlStalls,
+		IncomingQueueDepth:   len(tunnel.incomingMessages),
+		OutgoingQueueDepth:   len(tunnel.outgoingMessages),
+		CompressedResponses:  stats.CompressedResponses,
+		EdgeBytesSaved:       stats.EdgeBytesSaved,
+		TunnelBytesSaved:     stats.TunnelBytesSaved,
 		ClientIP:             stats.ClientIP,
 		UserAgent:            stats.UserAgent,
 		LastActivity:         stats.LastActivity.Format(time.RFC3339),
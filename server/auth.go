@@ -22,6 +22,8 @@ type TokenRecord struct {
 	Prefix    string    `json:"prefix"`
 	CreatedAt time.Time `json:"created_at"`
 	Revoked   bool      `json:"revoked,omitempty"`
+	// BodyLimits override the server's body limits for the token's tunnels
+	BodyLimits *shared.BodyLimits `json:"body_limits,omitempty"`
 }
 
 type TokenStore struct {
@@ -200,6 +202,63 @@ func (ts *TokenStore) Revoke(name string) error {
 	return nil
 }
 
+// SetBodyLimits sets the body limits of a token's tunnels, zero limits fall
+// back to the server's
+func (ts *TokenStore) SetBodyLimits(name string, limits shared.BodyLimits) error {
+	logger := shared.GetLogger("server.auth")
+
+	if limits.MaxRequestBody < 0 || limits.MaxResponseBody < 0 {
+		return fmt.Errorf("body limits must not be negative")
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	var record *TokenRecord
+	for i := range ts.records {
+		if ts.records[i].Name == name && !ts.records[i].Revoked {
+			record = &ts.records[i]
+			break
+		}
+	}
+	if record == nil {
+		return fmt.Errorf("token %q not found", name)
+	}
+
+	record.BodyLimits = nil
+	if limits != (shared.BodyLimits{}) {
+		record.BodyLimits = &limits
+	}
+	if err := ts.save(); err != nil {
+		return fmt.Errorf("failed to save token store: %w", err)
+	}
+
+	logger.Info().
+		Str("name", name).
+		Int64("max_request_body", limits.MaxRequestBody).
+		Int64("max_response_body", limits.MaxResponseBody).
+		Msg("token body limits set")
+	return nil
+}
+
+// BodyLimits returns the body limits of a token, nil when it has none
+func (ts *TokenStore) BodyLimits(name string) *shared.BodyLimits {
+	if name == "" {
+		return nil
+	}
+
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+
+	for _, r := range ts.records {
+		if r.Name == name && !r.Revoked && r.BodyLimits != nil {
+			limits := *r.BodyLimits
+			return &limits
+		}
+	}
+	return nil
+}
+
 func (ts *TokenStore) List() []TokenRecord {
 	ts.mu.RLock()
 	defer ts.mu.RUnlock()
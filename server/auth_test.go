@@ -4,6 +4,8 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+
+	"github.com/karol-broda/funnel/shared"
 )
 
 func TestTokenStore_CreateAndValidate(t *testing.T) {
@@ -286,3 +288,42 @@ func TestTokenStore_FilePermissions(t *testing.T) {
 		t.Fatalf("expected file permissions 0600, got: %o", perm)
 	}
 }
+
+func TestTokenStore_BodyLimits(t *testing.T) {
+	storePath := filepath.Join(t.TempDir(), "tokens.json")
+
+	store, err := NewTokenStore(storePath)
+	if err != nil {
+		t.Fatalf("failed to create token store: %v", err)
+	}
+	if _, err := store.Create("uploads"); err != nil {
+		t.Fatalf("failed to create token: %v", err)
+	}
+
+	if store.BodyLimits("uploads") != nil {
+		t.Error("expected a new token to have no body limits")
+	}
+	if err := store.SetBodyLimits("missing", shared.BodyLimits{MaxRequestBody: 1}); err == nil {
+		t.Error("expected an error for an unknown token")
+	}
+
+	limits := shared.BodyLimits{MaxRequestBody: 500 << 20}
+	if err := store.SetBodyLimits("uploads", limits); err != nil {
+		t.Fatalf("SetBodyLimits() error = %v", err)
+	}
+
+	reloaded, err := NewTokenStore(storePath)
+	if err != nil {
+		t.Fatalf("failed to reload token store: %v", err)
+	}
+	if got := reloaded.BodyLimits("uploads"); got == nil || *got != limits {
+		t.Errorf("BodyLimits() after reload = %v, want %+v", got, limits)
+	}
+
+	if err := reloaded.SetBodyLimits("uploads", shared.BodyLimits{}); err != nil {
+		t.Fatalf("SetBodyLimits() error = %v", err)
+	}
+	if reloaded.BodyLimits("uploads") != nil {
+		t.Error("expected zero limits to clear the token's limits")
+	}
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"context"
 	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
@@ -10,11 +11,12 @@ import (
 	"encoding/json"
 	"encoding/pem"
 	"fmt"
+	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
-	"time"
 
 	"github.com/go-acme/lego/v4/certcrypto"
 	"github.com/go-acme/lego/v4/certificate"
@@ -25,6 +27,7 @@ import (
 	lru "github.com/hashicorp/golang-lru/v2"
 	"github.com/karol-broda/funnel/shared"
 	"github.com/rs/zerolog"
+	"golang.org/x/crypto/ocsp"
 )
 
 type ProviderConfig struct {
@@ -215,35 +218,171 @@ func (m *ProviderMux) findProvider(domain string) (challenge.Provider, error) {
 type CertificateManager struct {
 	user           *User
 	client         *lego.Client
+	hostnameClient *lego.Client
+	challenges     *ChallengeSolver
+	hostnamePolicy func(host string) bool
 	providerMux    *ProviderMux
 	certificates   *lru.Cache[string, *tls.Certificate]
-	certMutex      sync.Mutex
+	domainLocks    sync.Map // map[string]*sync.Mutex
 	certDir        string
 	logger         zerolog.Logger
 	providerConfig *ProviderConfig
+
+	// static and devCA replace the acme clients in TLSModeStatic and TLSModeDev
+	static         *StaticCertificateStore
+	devCA          *DevCA
+	devBaseDomains []string
+
+	// obtain and fetchOCSP are replaced in tests to avoid talking to an acme server
+	obtain    func(key string) (*tls.Certificate, error)
+	fetchOCSP func(bundle []byte) ([]byte, *ocsp.Response, error)
+
+	renewals   map[string]*renewalState
+	renewalsMu sync.Mutex
+	renewalCtx context.Context
+}
+
+const (
+	ChallengeHTTP01    = "http-01"
+	ChallengeTLSALPN01 = "tls-alpn-01"
+
+	DefaultCADirURL = lego.LEDirectoryProduction
+
+	// TLSModeACME obtains certificates from an acme server like let's encrypt
+	TLSModeACME = "acme"
+	// TLSModeStatic serves certificate and key files, e.g. from an internal pki
+	TLSModeStatic = "static"
+	// TLSModeDev issues certificates from a local ca kept in the cert dir
+	TLSModeDev = "dev"
+)
+
+// CertificateConfig configures where the CertificateManager gets certificates from
+type CertificateConfig struct {
+	// Mode is TLSModeACME, TLSModeStatic or TLSModeDev, acme when empty
+	Mode    string
+	Email   string
+	CertDir string
+	// DNSProvidersConfig enables dns-01 and wildcard certificates for the domains it lists
+	DNSProvidersConfig string
+	// CADirURL is the acme directory, let's encrypt production when empty
+	CADirURL string
+	// Challenges used for per-hostname certificates, http-01 and tls-alpn-01 when nil
+	Challenges []string
+	// StaticCertificates are served in TLSModeStatic
+	StaticCertificates []CertificateFiles
+	// BaseDomains get a wildcard certificate from the local ca in TLSModeDev
+	BaseDomains []string
+}
+
+func (c *CertificateConfig) validate() error {
+	if c.CertDir == "" && c.Mode != TLSModeStatic {
+		return fmt.Errorf("a certificate directory is required")
+	}
+
+	switch c.Mode {
+	case "", TLSModeACME:
+		c.Mode = TLSModeACME
+	case TLSModeStatic:
+		if len(c.StaticCertificates) == 0 {
+			return fmt.Errorf("static tls mode needs at least one certificate and key file")
+		}
+		return nil
+	case TLSModeDev:
+		if len(c.BaseDomains) == 0 {
+			return fmt.Errorf("dev tls mode needs at least one base domain")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported tls mode %q, expected %s, %s or %s", c.Mode, TLSModeACME, TLSModeStatic, TLSModeDev)
+	}
+
+	if c.Email == "" {
+		return fmt.Errorf("an acme account email is required")
+	}
+	if c.CADirURL == "" {
+		c.CADirURL = DefaultCADirURL
+	}
+	if c.Challenges == nil {
+		c.Challenges = []string{ChallengeHTTP01, ChallengeTLSALPN01}
+	}
+	for _, name := range c.Challenges {
+		if name != ChallengeHTTP01 && name != ChallengeTLSALPN01 {
+			return fmt.Errorf("unsupported acme challenge %q, expected %s or %s", name, ChallengeHTTP01, ChallengeTLSALPN01)
+		}
+	}
+	if c.DNSProvidersConfig == "" && len(c.Challenges) == 0 {
+		return fmt.Errorf("either a dns provider config or an http-01/tls-alpn-01 challenge is required")
+	}
+	return nil
 }
 
-func NewCertificateManager(email, certDir, configPath string) (*CertificateManager, error) {
+// accountFileName keeps registrations for different acme servers apart
+func accountFileName(caDirURL string) string {
+	if caDirURL == DefaultCADirURL {
+		return "account.json"
+	}
+
+	u, err := url.Parse(caDirURL)
+	if err != nil || u.Host == "" {
+		return "account.json"
+	}
+
+	name := strings.NewReplacer(":", "_", "/", "_").Replace(u.Host)
+	return "account-" + name + ".json"
+}
+
+func newCertificateCache() (*lru.Cache[string, *tls.Certificate], error) {
 	const lruCacheSize = 512
-	logger := shared.GetLogger("certs.manager")
 
-	config, err := loadProviderConfig(configPath)
+	certCache, err := lru.New[string, *tls.Certificate](lruCacheSize)
 	if err != nil {
-		return nil, fmt.Errorf("failed to load provider config: %w", err)
+		return nil, fmt.Errorf("failed to create lru cache: %w", err)
 	}
+	return certCache, nil
+}
 
-	providerMux, err := NewProviderMux(config)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create provider multiplexer: %w", err)
+func NewCertificateManager(certConfig CertificateConfig) (*CertificateManager, error) {
+	logger := shared.GetLogger("certs.manager")
+
+	if err := certConfig.validate(); err != nil {
+		return nil, err
+	}
+
+	switch certConfig.Mode {
+	case TLSModeStatic:
+		return newStaticCertificateManager(certConfig)
+	case TLSModeDev:
+		return newDevCertificateManager(certConfig)
+	}
+
+	email := certConfig.Email
+	certDir := certConfig.CertDir
+
+	var config *ProviderConfig
+	var providerMux *ProviderMux
+	if certConfig.DNSProvidersConfig != "" {
+		var err error
+		config, err = loadProviderConfig(certConfig.DNSProvidersConfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load provider config: %w", err)
+		}
+
+		providerMux, err = NewProviderMux(config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create provider multiplexer: %w", err)
+		}
+	} else {
+		config = &ProviderConfig{}
+		logger.Info().Msg("no dns provider config, certificates are issued per hostname")
 	}
 
 	if err := os.MkdirAll(certDir, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create certificate directory: %w", err)
 	}
 
-	certCache, err := lru.New[string, *tls.Certificate](lruCacheSize)
+	certCache, err := newCertificateCache()
 	if err != nil {
-		return nil, fmt.Errorf("failed to create lru cache: %w", err)
+		return nil, err
 	}
 
 	keyPath := filepath.Join(certDir, "account.key")
@@ -284,13 +423,13 @@ func NewCertificateManager(email, certDir, configPath string) (*CertificateManag
 
 	acmeUser := &User{Email: email, key: privateKey}
 
-	regPath := filepath.Join(certDir, "account.json")
+	regPath := filepath.Join(certDir, accountFileName(certConfig.CADirURL))
 	regBytes, err := os.ReadFile(regPath)
 	if err != nil {
 		if os.IsNotExist(err) {
 			logger.Info().Msg("no registration found, creating new one")
 			tempConfig := lego.NewConfig(acmeUser)
-			tempConfig.CADirURL = lego.LEDirectoryProduction
+			tempConfig.CADirURL = certConfig.CADirURL
 			tempConfig.Certificate.KeyType = certcrypto.EC256
 			tempClient, err := lego.NewClient(tempConfig)
 			if err != nil {
@@ -325,32 +464,65 @@ func NewCertificateManager(email, certDir, configPath string) (*CertificateManag
 
 	finalConfig := lego.NewConfig(acmeUser)
 	finalConfig.Certificate.KeyType = certcrypto.EC256
-	finalConfig.CADirURL = lego.LEDirectoryProduction
+	finalConfig.CADirURL = certConfig.CADirURL
 
 	client, err := lego.NewClient(finalConfig)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create lego client: %w", err)
 	}
 
-	err = client.Challenge.SetDNS01Provider(providerMux)
-	if err != nil {
-		return nil, fmt.Errorf("failed to set dns-01 provider: %w", err)
+	if providerMux != nil {
+		if err := client.Challenge.SetDNS01Provider(providerMux); err != nil {
+			return nil, fmt.Errorf("failed to set dns-01 provider: %w", err)
+		}
+	}
+
+	// hosts without a dns provider, like custom hostnames or setups without a
+	// supported dns api, are validated over http-01 or tls-alpn-01 instead
+	challenges := NewChallengeSolver()
+
+	var hostnameClient *lego.Client
+	if len(certConfig.Challenges) > 0 {
+		hostnameClient, err = lego.NewClient(finalConfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create lego client for hostname certificates: %w", err)
+		}
+
+		for _, name := range certConfig.Challenges {
+			switch name {
+			case ChallengeHTTP01:
+				err = hostnameClient.Challenge.SetHTTP01Provider(challenges.HTTP01Provider())
+			case ChallengeTLSALPN01:
+				err = hostnameClient.Challenge.SetTLSALPN01Provider(challenges.TLSALPN01Provider())
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to set %s provider: %w", name, err)
+			}
+		}
 	}
 
 	cm := &CertificateManager{
+		renewals:       make(map[string]*renewalState),
+		renewalCtx:     context.Background(),
+		fetchOCSP:      client.Certificate.GetOCSP,
 		user:           acmeUser,
 		client:         client,
+		hostnameClient: hostnameClient,
+		challenges:     challenges,
 		providerMux:    providerMux,
 		certificates:   certCache,
 		certDir:        certDir,
 		logger:         logger,
 		providerConfig: config,
 	}
+	cm.obtain = cm.obtainForKey
 
 	logger.Info().
 		Str("email", email).
 		Str("cert_dir", certDir).
 		Str("ca_url", finalConfig.CADirURL).
+		Bool("dns01", providerMux != nil).
+		Strs("challenges", certConfig.Challenges).
 		Msg("certificate manager initialized")
 
 	return cm, nil
@@ -363,32 +535,99 @@ func (cm *CertificateManager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.C
 		return nil, nil
 	}
 
-	baseDomain, ok := cm.providerMux.FindManagedDomain(domain)
+	if cert, ok := cm.challenges.ALPNCertificate(hello); ok {
+		cm.logger.Debug().Str("domain", domain).Msg("serving tls-alpn-01 challenge certificate")
+		return cert, nil
+	}
+
+	if cm.static != nil {
+		return cm.static.Certificate(domain), nil
+	}
+
+	baseDomain, ok := cm.findManagedDomain(domain)
 	if !ok {
+		if (cm.hostnameClient != nil || cm.devCA != nil) && cm.hostnamePolicy != nil && cm.hostnamePolicy(domain) {
+			return cm.getCertificate(domain)
+		}
 		return nil, fmt.Errorf("domain %q is not configured for management", domain)
 	}
 	cm.logger.Debug().Str("domain", domain).Str("base_domain", baseDomain).Msg("certificate requested")
 
-	cert, ok := cm.certificates.Get(baseDomain)
-	if ok && cm.isCertificateValid(cert) {
-		cm.logger.Debug().Str("domain", domain).Msg("using cached certificate (in-memory)")
+	return cm.getCertificate(baseDomain)
+}
+
+// getCertificate returns a usable certificate for key from memory, disk or
+// the acme server. certificates close to expiry are still served while a
+// background renewal replaces them, so handshakes only block without one.
+func (cm *CertificateManager) getCertificate(key string) (*tls.Certificate, error) {
+	cert, ok := cm.certificates.Get(key)
+	if ok && cm.isCertificateUsable(cert) {
+		cm.logger.Debug().Str("domain", key).Msg("using cached certificate (in-memory)")
+		if cm.needsRenewal(cert) {
+			cm.renewInBackground(key)
+		}
 		return cert, nil
 	}
 
-	cert, err := cm.loadCertificateFromDisk(baseDomain)
-	if err == nil && cm.isCertificateValid(cert) {
-		cm.logger.Info().Str("base_domain", baseDomain).Msg("loaded valid certificate from disk")
-		cm.certificates.Add(baseDomain, cert)
+	cert, err := cm.loadCertificateFromDisk(key)
+	if err == nil && cm.isCertificateUsable(cert) {
+		cm.logger.Info().Str("domain", key).Msg("loaded valid certificate from disk")
+		cm.stapleOCSP(key, cert)
+		cm.certificates.Add(key, cert)
+		if cm.needsRenewal(cert) {
+			cm.renewInBackground(key)
+		}
 		return cert, nil
 	}
 
-	cm.logger.Info().Str("domain", domain).Msg("no valid certificate found in cache or on disk, obtaining new one")
-	return cm.obtainCertificate(baseDomain)
+	cm.logger.Info().Str("domain", key).Msg("no valid certificate found in cache or on disk, obtaining new one")
+	return cm.obtain(key)
+}
+
+func (cm *CertificateManager) findManagedDomain(domain string) (string, bool) {
+	if cm.devCA != nil {
+		return findDevManagedDomain(cm.devBaseDomains, domain)
+	}
+	if cm.providerMux == nil {
+		return "", false
+	}
+	return cm.providerMux.FindManagedDomain(domain)
+}
+
+// SetHostnamePolicy sets which hosts outside the dns managed domains may get a
+// certificate of their own on demand, e.g. active tunnels and custom hostnames
+func (cm *CertificateManager) SetHostnamePolicy(allowed func(host string) bool) {
+	cm.hostnamePolicy = allowed
 }
 
-func (cm *CertificateManager) obtainCertificate(baseDomain string) (*tls.Certificate, error) {
-	cm.certMutex.Lock()
-	defer cm.certMutex.Unlock()
+// HTTPChallengeHandler wraps next so pending http-01 challenges are answered
+func (cm *CertificateManager) HTTPChallengeHandler(next http.Handler) http.Handler {
+	return cm.challenges.HTTPHandler(next)
+}
+
+// obtainForKey picks the dns-01 client for managed domains and the
+// http-01/tls-alpn-01 client for everything else
+func (cm *CertificateManager) obtainForKey(key string) (*tls.Certificate, error) {
+	if managed, ok := cm.findManagedDomain(key); ok && managed == key {
+		return cm.obtainCertificateWith(cm.client, key)
+	}
+	if cm.hostnameClient == nil {
+		return nil, fmt.Errorf("no acme challenge configured for %q", key)
+	}
+	return cm.obtainCertificateWith(cm.hostnameClient, key)
+}
+
+// lockDomain serializes acme orders per domain without blocking other domains
+func (cm *CertificateManager) lockDomain(domain string) func() {
+	value, _ := cm.domainLocks.LoadOrStore(domain, &sync.Mutex{})
+	mu := value.(*sync.Mutex)
+	mu.Lock()
+	return mu.Unlock
+}
+
+func (cm *CertificateManager) obtainCertificateWith(client *lego.Client, baseDomain string) (*tls.Certificate, error) {
+	unlock := cm.lockDomain(baseDomain)
+	defer unlock()
 
 	if cert, ok := cm.certificates.Get(baseDomain); ok && cm.isCertificateValid(cert) {
 		cm.logger.Debug().Str("domain", baseDomain).Msg("certificate was obtained by another goroutine while waiting for lock")
@@ -402,18 +641,23 @@ func (cm *CertificateManager) obtainCertificate(baseDomain string) (*tls.Certifi
 		domains = []string{baseDomain}
 	}
 
-	cm.logger.Info().Strs("domains", domains).Msg("requesting new certificate from let's encrypt")
+	cm.logger.Info().Strs("domains", domains).Msg("requesting new certificate from acme server")
 
 	request := certificate.ObtainRequest{
 		Domains: domains,
 		Bundle:  true,
 	}
 
-	resource, err := cm.client.Certificate.Obtain(request)
+	resource, err := client.Certificate.Obtain(request)
 	if err != nil {
 		return nil, fmt.Errorf("failed to obtain certificate: %w", err)
 	}
 
+	return cm.storeCertificate(baseDomain, resource)
+}
+
+// storeCertificate persists a freshly issued certificate and starts serving it
+func (cm *CertificateManager) storeCertificate(baseDomain string, resource *certificate.Resource) (*tls.Certificate, error) {
 	cm.saveCertificateToDisk(baseDomain, resource)
 
 	tlsCert, err := tls.X509KeyPair(resource.Certificate, resource.PrivateKey)
@@ -429,6 +673,7 @@ func (cm *CertificateManager) obtainCertificate(baseDomain string) (*tls.Certifi
 		tlsCert.Leaf = x509Cert
 	}
 
+	cm.stapleOCSP(baseDomain, &tlsCert)
 	cm.certificates.Add(baseDomain, &tlsCert)
 
 	cm.logger.Info().Str("domain", baseDomain).Time("expiry", tlsCert.Leaf.NotAfter).Msg("successfully obtained and cached certificate")
@@ -456,30 +701,9 @@ func (cm *CertificateManager) saveCertificateToDisk(baseDomain string, resource
 		Msg("certificate saved to disk")
 }
 
+// isCertificateValid reports whether cert is usable and not yet due for renewal
 func (cm *CertificateManager) isCertificateValid(cert *tls.Certificate) bool {
-	if len(cert.Certificate) == 0 {
-		return false
-	}
-
-	x509Cert, err := x509.ParseCertificate(cert.Certificate[0])
-	if err != nil {
-		cm.logger.Error().Err(err).Msg("failed to parse certificate")
-		return false
-	}
-
-	expirationThreshold := time.Now().Add(30 * 24 * time.Hour)
-
-	if time.Now().After(x509Cert.NotAfter) {
-		cm.logger.Debug().Time("expiry", x509Cert.NotAfter).Msg("certificate is expired")
-		return false
-	}
-
-	if x509Cert.NotAfter.Before(expirationThreshold) {
-		cm.logger.Debug().Time("expiry", x509Cert.NotAfter).Msg("certificate expires soon")
-		return false
-	}
-
-	return true
+	return cm.isCertificateUsable(cert) && !cm.needsRenewal(cert)
 }
 
 func (cm *CertificateManager) PreloadCertificates() error {
@@ -491,6 +715,9 @@ func (cm *CertificateManager) PreloadCertificates() error {
 			managedDomains[strings.ToLower(strings.TrimSpace(d))] = struct{}{}
 		}
 	}
+	for _, d := range cm.devBaseDomains {
+		managedDomains["*."+d] = struct{}{}
+	}
 
 	for domain := range managedDomains {
 		cm.logger.Info().Str("domain", domain).Msg("checking certificate during preload")
@@ -509,7 +736,7 @@ func (cm *CertificateManager) PreloadCertificates() error {
 		}
 
 		cm.logger.Info().Str("domain", domain).Msg("no valid certificate on disk, obtaining new one")
-		_, err = cm.obtainCertificate(domain)
+		_, err = cm.obtain(domain)
 		if err != nil {
 			cm.logger.Error().Err(err).Str("domain", domain).Msg("failed to obtain certificate during preload")
 			return fmt.Errorf("failed to obtain certificate for %s: %w", domain, err)
@@ -1,10 +1,13 @@
 package server
 
 import (
+	"crypto/tls"
 	"fmt"
 	"testing"
 
 	"github.com/go-acme/lego/v4/challenge"
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/karol-broda/funnel/shared"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -174,3 +177,108 @@ func TestProviderMux_FindProvider(t *testing.T) {
 		})
 	}
 }
+
+func TestCertificateConfig_validate(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    CertificateConfig
+		expectErr bool
+	}{
+		{
+			name:   "defaults without dns provider",
+			config: CertificateConfig{Email: "ops@example.com", CertDir: "/tmp/certs"},
+		},
+		{
+			name:   "dns only",
+			config: CertificateConfig{Email: "ops@example.com", CertDir: "/tmp/certs", DNSProvidersConfig: "dns.json", Challenges: []string{}},
+		},
+		{
+			name:      "missing email",
+			config:    CertificateConfig{CertDir: "/tmp/certs"},
+			expectErr: true,
+		},
+		{
+			name:      "unknown challenge",
+			config:    CertificateConfig{Email: "ops@example.com", CertDir: "/tmp/certs", Challenges: []string{"dns-02"}},
+			expectErr: true,
+		},
+		{
+			name:      "no way to validate",
+			config:    CertificateConfig{Email: "ops@example.com", CertDir: "/tmp/certs", Challenges: []string{}},
+			expectErr: true,
+		},
+		{
+			name:   "static without email",
+			config: CertificateConfig{Mode: TLSModeStatic, StaticCertificates: []CertificateFiles{{CertFile: "a.crt", KeyFile: "a.key"}}},
+		},
+		{
+			name:      "static without files",
+			config:    CertificateConfig{Mode: TLSModeStatic},
+			expectErr: true,
+		},
+		{
+			name:   "dev without email",
+			config: CertificateConfig{Mode: TLSModeDev, CertDir: "/tmp/certs", BaseDomains: []string{"tunnel.test"}},
+		},
+		{
+			name:      "dev without base domain",
+			config:    CertificateConfig{Mode: TLSModeDev, CertDir: "/tmp/certs"},
+			expectErr: true,
+		},
+		{
+			name:      "unknown mode",
+			config:    CertificateConfig{Mode: "vault", CertDir: "/tmp/certs"},
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.validate()
+			if tt.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			if tt.config.Mode == TLSModeACME {
+				assert.NotEmpty(t, tt.config.CADirURL)
+			}
+		})
+	}
+
+	config := CertificateConfig{Email: "ops@example.com", CertDir: "/tmp/certs"}
+	require.NoError(t, config.validate())
+	assert.Equal(t, []string{ChallengeHTTP01, ChallengeTLSALPN01}, config.Challenges)
+}
+
+func TestAccountFileName(t *testing.T) {
+	assert.Equal(t, "account.json", accountFileName("https://acme-v02.api.letsencrypt.org/directory"))
+	assert.Equal(t, "account-localhost_14000.json", accountFileName("https://localhost:14000/dir"))
+	assert.Equal(t, "account-acme-staging-v02.api.letsencrypt.org.json", accountFileName("https://acme-staging-v02.api.letsencrypt.org/directory"))
+}
+
+func TestCertificateManager_GetCertificateWithoutDNS(t *testing.T) {
+	certCache, err := lru.New[string, *tls.Certificate](8)
+	require.NoError(t, err)
+
+	solver := NewChallengeSolver()
+	cm := &CertificateManager{
+		challenges:     solver,
+		certificates:   certCache,
+		certDir:        t.TempDir(),
+		hostnamePolicy: func(host string) bool { return false },
+		logger:         shared.GetLogger("certs.test"),
+	}
+
+	require.NoError(t, solver.TLSALPN01Provider().Present("demo.tunnel.example.com", "token", "token.keyauth"))
+
+	cert, err := cm.GetCertificate(&tls.ClientHelloInfo{
+		ServerName:      "demo.tunnel.example.com",
+		SupportedProtos: []string{ACMETLSProtocol},
+	})
+	require.NoError(t, err)
+	assert.NotNil(t, cert, "expected tls-alpn-01 challenge certificate")
+
+	_, err = cm.GetCertificate(&tls.ClientHelloInfo{ServerName: "unknown.example.com"})
+	assert.Error(t, err, "hosts rejected by the policy must not get a certificate")
+}
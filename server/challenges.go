@@ -0,0 +1,142 @@
+package server
+
+import (
+	"crypto/tls"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/go-acme/lego/v4/challenge/http01"
+	"github.com/go-acme/lego/v4/challenge/tlsalpn01"
+	"github.com/karol-broda/funnel/shared"
+)
+
+// ACMETLSProtocol is the alpn protocol tls listeners must offer for tls-alpn-01
+const ACMETLSProtocol = tlsalpn01.ACMETLS1Protocol
+
+// TLSNextProtos are the alpn protocols of the visitor tls listener. they are
+// listed in full since http.Server adds the http ones only to its own copy of
+// the config, which configs cloned for a client never see.
+func TLSNextProtos() []string {
+	return []string{"h2", "http/1.1", ACMETLSProtocol}
+}
+
+// ChallengeSolver answers HTTP-01 and TLS-ALPN-01 challenges from the servers
+// funnel already runs instead of binding its own listeners like lego's providers
+type ChallengeSolver struct {
+	httpTokens map[string]string           // token -> key authorization
+	alpnCerts  map[string]*tls.Certificate // domain -> challenge certificate
+	mu         sync.RWMutex
+}
+
+func NewChallengeSolver() *ChallengeSolver {
+	return &ChallengeSolver{
+		httpTokens: make(map[string]string),
+		alpnCerts:  make(map[string]*tls.Certificate),
+	}
+}
+
+// HTTP01Provider returns a lego provider backed by this solver
+func (cs *ChallengeSolver) HTTP01Provider() *HTTP01Provider {
+	return &HTTP01Provider{solver: cs}
+}
+
+// TLSALPN01Provider returns a lego provider backed by this solver
+func (cs *ChallengeSolver) TLSALPN01Provider() *TLSALPN01Provider {
+	return &TLSALPN01Provider{solver: cs}
+}
+
+// HTTPHandler serves pending HTTP-01 tokens and passes everything else to next
+func (cs *ChallengeSolver) HTTPHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		prefix := http01.ChallengePath("")
+		if !strings.HasPrefix(r.URL.Path, prefix) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		token := strings.TrimPrefix(r.URL.Path, prefix)
+
+		cs.mu.RLock()
+		keyAuth, ok := cs.httpTokens[token]
+		cs.mu.RUnlock()
+
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		logger := shared.GetLogger("certs.challenges")
+		logger.Debug().Str("host", r.Host).Msg("answering http-01 challenge")
+
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(keyAuth))
+	})
+}
+
+// ALPNCertificate returns the challenge certificate for an acme-tls/1 handshake
+func (cs *ChallengeSolver) ALPNCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, bool) {
+	if !isACMEALPNHello(hello) {
+		return nil, false
+	}
+
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+
+	cert, ok := cs.alpnCerts[strings.ToLower(hello.ServerName)]
+	return cert, ok
+}
+
+func isACMEALPNHello(hello *tls.ClientHelloInfo) bool {
+	for _, proto := range hello.SupportedProtos {
+		if proto == tlsalpn01.ACMETLS1Protocol {
+			return true
+		}
+	}
+	return false
+}
+
+type HTTP01Provider struct {
+	solver *ChallengeSolver
+}
+
+func (p *HTTP01Provider) Present(domain, token, keyAuth string) error {
+	p.solver.mu.Lock()
+	defer p.solver.mu.Unlock()
+
+	p.solver.httpTokens[token] = keyAuth
+	return nil
+}
+
+func (p *HTTP01Provider) CleanUp(domain, token, keyAuth string) error {
+	p.solver.mu.Lock()
+	defer p.solver.mu.Unlock()
+
+	delete(p.solver.httpTokens, token)
+	return nil
+}
+
+type TLSALPN01Provider struct {
+	solver *ChallengeSolver
+}
+
+func (p *TLSALPN01Provider) Present(domain, token, keyAuth string) error {
+	cert, err := tlsalpn01.ChallengeCert(domain, keyAuth)
+	if err != nil {
+		return err
+	}
+
+	p.solver.mu.Lock()
+	defer p.solver.mu.Unlock()
+
+	p.solver.alpnCerts[strings.ToLower(domain)] = cert
+	return nil
+}
+
+func (p *TLSALPN01Provider) CleanUp(domain, token, keyAuth string) error {
+	p.solver.mu.Lock()
+	defer p.solver.mu.Unlock()
+
+	delete(p.solver.alpnCerts, strings.ToLower(domain))
+	return nil
+}
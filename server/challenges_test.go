@@ -0,0 +1,69 @@
+package server
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestChallengeSolver_HTTP01(t *testing.T) {
+	solver := NewChallengeSolver()
+	provider := solver.HTTP01Provider()
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	handler := solver.HTTPHandler(next)
+
+	if err := provider.Present("demo.customer.com", "token123", "token123.keyauth"); err != nil {
+		t.Fatalf("failed to present challenge: %v", err)
+	}
+
+	req := httptest.NewRequest("GET", "http://demo.customer.com/.well-known/acme-challenge/token123", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || w.Body.String() != "token123.keyauth" {
+		t.Errorf("expected key authorization, got %d %q", w.Code, w.Body.String())
+	}
+
+	req = httptest.NewRequest("GET", "http://demo.customer.com/other", nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusTeapot {
+		t.Errorf("expected non-challenge request to reach next handler, got %d", w.Code)
+	}
+
+	provider.CleanUp("demo.customer.com", "token123", "token123.keyauth")
+
+	req = httptest.NewRequest("GET", "http://demo.customer.com/.well-known/acme-challenge/token123", nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 after cleanup, got %d", w.Code)
+	}
+}
+
+func TestChallengeSolver_TLSALPN01(t *testing.T) {
+	solver := NewChallengeSolver()
+	provider := solver.TLSALPN01Provider()
+
+	if err := provider.Present("demo.customer.com", "token123", "token123.keyauth"); err != nil {
+		t.Fatalf("failed to present challenge: %v", err)
+	}
+
+	hello := &tls.ClientHelloInfo{ServerName: "demo.customer.com", SupportedProtos: []string{ACMETLSProtocol}}
+	if cert, ok := solver.ALPNCertificate(hello); !ok || cert == nil {
+		t.Error("expected challenge certificate for acme-tls/1 hello")
+	}
+
+	regular := &tls.ClientHelloInfo{ServerName: "demo.customer.com", SupportedProtos: []string{"h2", "http/1.1"}}
+	if _, ok := solver.ALPNCertificate(regular); ok {
+		t.Error("regular handshakes must not receive the challenge certificate")
+	}
+
+	provider.CleanUp("demo.customer.com", "token123", "token123.keyauth")
+	if _, ok := solver.ALPNCertificate(hello); ok {
+		t.Error("expected no challenge certificate after cleanup")
+	}
+}
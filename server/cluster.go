@@ -0,0 +1,333 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/karol-broda/funnel/shared"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// headers of requests between cluster nodes, stripped before anything reaches a tunnel
+const (
+	clusterAuthHeader     = "X-Funnel-Cluster-Auth"
+	clusterTunnelHeader   = "X-Funnel-Cluster-Tunnel"
+	clusterURIHeader      = "X-Funnel-Cluster-Uri"
+	clusterHostHeader     = "X-Funnel-Cluster-Host"
+	clusterRemoteHeader   = "X-Funnel-Cluster-Remote"
+	clusterSubrouteHeader = "X-Funnel-Cluster-Subroute"
+	clusterRequestHeader  = "X-Funnel-Cluster-Request"
+	clusterNodeHeader     = "X-Funnel-Cluster-Node"
+)
+
+const (
+	clusterForwardPath = "/cluster/forward"
+	clusterGossipPath  = "/cluster/gossip"
+)
+
+var ErrClusterAuth = errors.New("invalid cluster secret")
+
+// ClusterNode is one funnel server of a cluster. Addr is the base url of its
+// internal listener, e.g. http://10.0.0.2:7946
+type ClusterNode struct {
+	ID   string `json:"id"`
+	Addr string `json:"addr"`
+}
+
+// ClusterTunnel is a tunnel id held by a node with the custom hostnames routed to it
+type ClusterTunnel struct {
+	ID        string   `json:"id"`
+	Hostnames []string `json:"hostnames,omitempty"`
+}
+
+// ClusterRegistry shares which node holds which tunnel. implementations only
+// need to be eventually consistent, a node that misses an update answers a
+// forwarded request with 404 like any unknown tunnel.
+type ClusterRegistry interface {
+	// Run keeps the registry in sync with the other nodes until ctx is done
+	Run(ctx context.Context) error
+	// Announce replaces the tunnels this node holds
+	Announce(tunnels []ClusterTunnel)
+	// Lookup returns the other node holding a tunnel id
+	Lookup(tunnelID string) (ClusterNode, bool)
+	// LookupHostname returns the other node and the tunnel a custom hostname is routed to
+	LookupHostname(host string) (ClusterNode, string, bool)
+}
+
+// Cluster lets several servers behind one load balancer share their tunnels.
+// every node registers the tunnels connected to it and forwards visitor
+// requests for tunnels held elsewhere to the owning node over its internal
+// listener, authenticated with a secret shared by all nodes.
+type Cluster struct {
+	self      ClusterNode
+	secret    string
+	registry  ClusterRegistry
+	server    *Server
+	transport http.RoundTripper
+}
+
+func NewCluster(self ClusterNode, secret string, registry ClusterRegistry) (*Cluster, error) {
+	if self.ID == "" {
+		return nil, fmt.Errorf("cluster node id is required")
+	}
+	if _, err := parseNodeAddr(self.Addr); err != nil {
+		return nil, err
+	}
+	if secret == "" {
+		return nil, fmt.Errorf("cluster secret is required")
+	}
+
+	return &Cluster{
+		self:      self,
+		secret:    secret,
+		registry:  registry,
+		transport: http.DefaultTransport,
+	}, nil
+}
+
+// SetCluster joins the server to a cluster
+func (s *Server) SetCluster(cluster *Cluster) {
+	logger := shared.GetLogger("server.cluster")
+
+	cluster.server = s
+	s.cluster = cluster
+	logger.Info().
+		Str("node_id", cluster.self.ID).
+		Str("addr", cluster.self.Addr).
+		Msg("cluster mode enabled")
+}
+
+// Self returns this node
+func (c *Cluster) Self() ClusterNode {
+	return c.self
+}
+
+// Run syncs the registry until ctx is done
+func (c *Cluster) Run(ctx context.Context) error {
+	c.announce()
+	return c.registry.Run(ctx)
+}
+
+// announce publishes the tunnels currently connected to this node
+func (c *Cluster) announce() {
+	s := c.server
+
+	s.hostnamesMu.RLock()
+	hostnames := make(map[string][]string)
+	for hostname, tunnelID := range s.hostnames {
+		hostnames[tunnelID] = append(hostnames[tunnelID], hostname)
+	}
+	s.hostnamesMu.RUnlock()
+
+	s.TunnelsMu.RLock()
+	tunnels := make([]ClusterTunnel, 0, len(s.Tunnels))
+	for id := range s.Tunnels {
+		sort.Strings(hostnames[id])
+		tunnels = append(tunnels, ClusterTunnel{ID: id, Hostnames: hostnames[id]})
+	}
+	s.TunnelsMu.RUnlock()
+
+	sort.Slice(tunnels, func(i, j int) bool { return tunnels[i].ID < tunnels[j].ID })
+	c.registry.Announce(tunnels)
+}
+
+// clusterChanged tells the other nodes that the tunnels held here changed
+func (s *Server) clusterChanged() {
+	if s.cluster != nil {
+		s.cluster.announce()
+	}
+}
+
+// clusterOwner returns the other node holding a tunnel id, if any
+func (s *Server) clusterOwner(tunnelID string) (ClusterNode, bool) {
+	if s.cluster == nil {
+		return ClusterNode{}, false
+	}
+	return s.cluster.registry.Lookup(tunnelID)
+}
+
+// clusterHostnameOwner returns the other node and tunnel a custom hostname is routed to
+func (s *Server) clusterHostnameOwner(host string) (ClusterNode, string, bool) {
+	if s.cluster == nil {
+		return ClusterNode{}, "", false
+	}
+	return s.cluster.registry.LookupHostname(shared.NormalizeHostname(host))
+}
+
+// authorize checks the shared secret of a request from another node
+func (c *Cluster) authorize(r *http.Request) error {
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get(clusterAuthHeader)), []byte(c.secret)) != 1 {
+		return ErrClusterAuth
+	}
+	return nil
+}
+
+// Handler serves the internal listener other nodes talk to. it must not be
+// reachable by visitors, although every request needs the cluster secret.
+func (c *Cluster) Handler(router *TunnelRouter) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(clusterForwardPath, func(w http.ResponseWriter, r *http.Request) {
+		c.handleForward(w, r, router)
+	})
+	if handler, ok := c.registry.(http.Handler); ok {
+		mux.Handle(clusterGossipPath, handler)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := c.authorize(r); err != nil {
+			logger := shared.GetLogger("server.cluster")
+			logger.Warn().
+				Str("remote_addr", r.RemoteAddr).
+				Str("path", r.URL.Path).
+				Msg("cluster request rejected - invalid secret")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// forward proxies a visitor request to the node holding its tunnel
+func (c *Cluster) forward(w http.ResponseWriter, r *http.Request, node ClusterNode, tunnelID, subroute, requestID string) {
+	logger := shared.GetRequestLogger("server.cluster", tunnelID, requestID)
+
+	target, err := parseNodeAddr(node.Addr)
+	if err != nil {
+		logger.Error().Err(err).Str("node_id", node.ID).Msg("cannot forward to cluster node")
+		http.Error(w, "tunnel node unreachable", http.StatusBadGateway)
+		return
+	}
+
+	logger.Debug().
+		Str("node_id", node.ID).
+		Str("node_addr", node.Addr).
+		Msg("forwarding request to the node holding the tunnel")
+
+	proxy := &httputil.ReverseProxy{
+		Transport: c.transport,
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.Out.URL.Scheme = target.Scheme
+			pr.Out.URL.Host = target.Host
+			pr.Out.URL.Path = clusterForwardPath
+			pr.Out.URL.RawPath = ""
+			pr.Out.URL.RawQuery = ""
+			pr.Out.Host = target.Host
+
+			// the owning node adds the forwarding headers as if the visitor
+			// had connected to it, keep what the visitor sent
+			for _, header := range []string{"X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto"} {
+				if values := pr.In.Header.Values(header); len(values) > 0 {
+					pr.Out.Header[header] = values
+				}
+			}
+			if pr.In.Header.Get("X-Forwarded-Proto") == "" {
+				proto := "http"
+				if pr.In.TLS != nil {
+					proto = "https"
+				}
+				pr.Out.Header.Set("X-Forwarded-Proto", proto)
+			}
+
+			pr.Out.Header.Set(clusterAuthHeader, c.secret)
+			pr.Out.Header.Set(clusterNodeHeader, c.self.ID)
+			pr.Out.Header.Set(clusterTunnelHeader, tunnelID)
+			pr.Out.Header.Set(clusterURIHeader, pr.In.URL.RequestURI())
+			pr.Out.Header.Set(clusterHostHeader, pr.In.Host)
+			pr.Out.Header.Set(clusterRemoteHeader, pr.In.RemoteAddr)
+			pr.Out.Header.Set(clusterSubrouteHeader, subroute)
+			pr.Out.Header.Set(clusterRequestHeader, requestID)
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			logger.Error().Err(err).
+				Str("node_id", node.ID).
+				Str("node_addr", node.Addr).
+				Msg("failed to forward request to cluster node")
+			http.Error(w, "tunnel node unreachable", http.StatusBadGateway)
+		},
+	}
+	proxy.ServeHTTP(w, r)
+}
+
+// handleForward serves a visitor request another node forwarded here. it is
+// never forwarded again, so nodes with a stale registry cannot loop.
+func (c *Cluster) handleForward(w http.ResponseWriter, r *http.Request, router *TunnelRouter) {
+	requestStart := time.Now()
+
+	tunnelID := r.Header.Get(clusterTunnelHeader)
+	requestID := r.Header.Get(clusterRequestHeader)
+	if requestID == "" {
+		requestID = uuid.NewString()
+	}
+	logger := shared.GetRequestLogger("server.cluster", tunnelID, requestID)
+
+	uri := r.Header.Get(clusterURIHeader)
+	target, err := url.ParseRequestURI(uri)
+	if tunnelID == "" || err != nil {
+		logger.Warn().Str("uri", uri).Msg("malformed forwarded request")
+		http.Error(w, "malformed forwarded request", http.StatusBadRequest)
+		return
+	}
+
+	fromNode := r.Header.Get(clusterNodeHeader)
+	subroute := r.Header.Get(clusterSubrouteHeader)
+	r.URL = target
+	r.RequestURI = uri
+	r.Host = r.Header.Get(clusterHostHeader)
+	r.RemoteAddr = r.Header.Get(clusterRemoteHeader)
+	for header := range r.Header {
+		if strings.HasPrefix(header, "X-Funnel-Cluster-") {
+			r.Header.Del(header)
+		}
+	}
+
+	logger.Debug().
+		Str("from_node", fromNode).
+		Str("method", r.Method).
+		Str("path", r.URL.Path).
+		Msg("handling request forwarded by another node")
+
+	tunnel, exists := c.server.GetTunnel(tunnelID)
+	if !exists {
+		logger.Warn().
+			Str("from_node", fromNode).
+			Msg("forwarded request for a tunnel not held by this node")
+		http.Error(w, "tunnel not found", http.StatusNotFound)
+		return
+	}
+
+	// the forwarding node set the id the visitor knows the request by and
+	// passed on its trace, the node holding the tunnel logs the access
+	visitorID := visitorRequestID(r, requestID)
+	recorder := &responseRecorder{ResponseWriter: w}
+	w = recorder
+	r, span := startRequestSpan(r, "funnel.cluster.forward", visitorID)
+	span.SetAttributes(attribute.String("funnel.tunnel_id", tunnel.ID), attribute.String("funnel.from_node", fromNode))
+	defer endRequestSpan(span, recorder)
+	if c.server.accessLog != nil {
+		defer router.logAccess(r, tunnel, recorder, visitorID, requestStart)
+	}
+
+	if tunnelOffline(tunnel) {
+		c.server.offlinePage.serve(w, r, tunnel)
+		return
+	}
+
+	router.handleTunnelRequest(w, r, tunnel, subroute, requestID, requestStart)
+}
+
+func parseNodeAddr(addr string) (*url.URL, error) {
+	u, err := url.Parse(addr)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid cluster node address %q, expected http(s)://host:port", addr)
+	}
+	return u, nil
+}
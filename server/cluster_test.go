@@ -0,0 +1,222 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/karol-broda/funnel/shared"
+)
+
+const testClusterSecret = "cluster-secret"
+
+type clusterTestNode struct {
+	server   *Server
+	router   *TunnelRouter
+	public   *httptest.Server
+	internal *httptest.Server
+	registry *GossipRegistry
+	stop     context.CancelFunc
+}
+
+// newClusterTestNodes starts count nodes on localhost that gossip with each other
+func newClusterTestNodes(t *testing.T, count int) []*clusterTestNode {
+	t.Helper()
+
+	var addrs []string
+	nodes := make([]*clusterTestNode, count)
+	for i := range nodes {
+		internal := httptest.NewUnstartedServer(nil)
+		addrs = append(addrs, "http://"+internal.Listener.Addr().String())
+		nodes[i] = &clusterTestNode{internal: internal}
+	}
+
+	for i, node := range nodes {
+		node.server, node.router, node.public = newPoolTestServer(t)
+
+		self := ClusterNode{ID: fmt.Sprintf("node-%d", i+1), Addr: addrs[i]}
+		registry, err := NewGossipRegistry(self, addrs, testClusterSecret, 20*time.Millisecond)
+		if err != nil {
+			t.Fatalf("NewGossipRegistry() error = %v", err)
+		}
+		cluster, err := NewCluster(self, testClusterSecret, registry)
+		if err != nil {
+			t.Fatalf("NewCluster() error = %v", err)
+		}
+		node.server.SetCluster(cluster)
+		node.registry = registry
+
+		node.internal.Config.Handler = cluster.Handler(node.router)
+		node.internal.Start()
+		t.Cleanup(node.internal.Close)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		node.stop = cancel
+		// runs before the listeners close
+		t.Cleanup(cancel)
+		go cluster.Run(ctx)
+	}
+
+	for _, node := range nodes {
+		waitFor(t, "every node to join", func() bool { return len(node.registry.Nodes()) == count })
+	}
+	return nodes
+}
+
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCluster_ForwardsToOwningNode(t *testing.T) {
+	nodes := newClusterTestNodes(t, 3)
+	owner, other := nodes[0], nodes[2]
+
+	client := joinTestPool(t, owner.public, "app", "", "", func(conn *websocket.Conn, msg *shared.Message) {
+		var leaked []string
+		for header := range msg.Headers {
+			if strings.HasPrefix(header, "X-Funnel-Cluster-") {
+				leaked = append(leaked, header)
+			}
+		}
+		body := fmt.Sprintf("%s %s xff=%s leaked=%v", msg.Method, msg.Path, msg.Headers["X-Forwarded-For"], leaked)
+		conn.WriteJSON(&shared.Message{
+			Type:      "response",
+			TunnelID:  msg.TunnelID,
+			RequestID: msg.RequestID,
+			Status:    http.StatusOK,
+			Body:      []byte(body),
+		})
+	})
+	waitFor(t, "the tunnel to reach the other node", func() bool {
+		_, ok := other.registry.Lookup("app")
+		return ok
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "http://app.tunnel.example.com/items?page=2", nil)
+	req.RemoteAddr = "203.0.113.7:4711"
+	rec := httptest.NewRecorder()
+	other.router.ServeHTTP(rec, req)
+
+	expected := "GET /items?page=2 xff=[203.0.113.7] leaked=[]"
+	if rec.Code != http.StatusOK || rec.Body.String() != expected {
+		t.Fatalf("forwarded request = %d %q, want 200 %q", rec.Code, rec.Body.String(), expected)
+	}
+	if !other.router.ServesHost("app.tunnel.example.com") {
+		t.Error("ServesHost() should accept hosts of tunnels held by other nodes")
+	}
+
+	// the id is taken cluster wide
+	wsURL := "ws" + strings.TrimPrefix(other.public.URL, "http") + "/?id=app"
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusConflict {
+		t.Errorf("connecting with an id held by another node: err = %v, want 409", err)
+	}
+
+	client.Close()
+	waitFor(t, "the tunnel to leave the cluster", func() bool {
+		_, ok := other.registry.Lookup("app")
+		return !ok
+	})
+	if rec := poolRequest(other.router, http.MethodGet); rec.Code != http.StatusNotFound {
+		t.Errorf("status after disconnect = %d, want 404", rec.Code)
+	}
+}
+
+func TestCluster_InternalListenerRequiresSecret(t *testing.T) {
+	nodes := newClusterTestNodes(t, 2)
+	joinTestPool(t, nodes[0].public, "app", "", "secret-data", nil)
+
+	for _, path := range []string{clusterForwardPath, clusterGossipPath} {
+		req, _ := http.NewRequest(http.MethodPost, nodes[0].internal.URL+path, strings.NewReader("{}"))
+		req.Header.Set(clusterTunnelHeader, "app")
+		req.Header.Set(clusterURIHeader, "/")
+		req.Header.Set(clusterAuthHeader, "guessed")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%s with a wrong secret = %d, want 401", path, resp.StatusCode)
+		}
+	}
+}
+
+func TestCluster_NodeGoneStopsRouting(t *testing.T) {
+	nodes := newClusterTestNodes(t, 2)
+	joinTestPool(t, nodes[0].public, "app", "", "first", nil)
+	waitFor(t, "the tunnel to reach the other node", func() bool {
+		_, ok := nodes[1].registry.Lookup("app")
+		return ok
+	})
+
+	// the owner vanishes without saying goodbye
+	nodes[0].stop()
+	nodes[0].internal.Close()
+	waitFor(t, "the node to expire", func() bool {
+		_, ok := nodes[1].registry.Lookup("app")
+		return !ok
+	})
+}
+
+func TestGossipRegistry_merge(t *testing.T) {
+	self := ClusterNode{ID: "self", Addr: "http://127.0.0.1:7946"}
+	registry, err := NewGossipRegistry(self, nil, testClusterSecret, time.Second)
+	if err != nil {
+		t.Fatalf("NewGossipRegistry() error = %v", err)
+	}
+
+	peer := ClusterNode{ID: "peer", Addr: "http://127.0.0.1:7947"}
+	state := func(incarnation int64, heartbeat uint64, tunnels ...ClusterTunnel) *gossipState {
+		return &gossipState{Node: peer, Incarnation: incarnation, Heartbeat: heartbeat, Tunnels: tunnels}
+	}
+
+	registry.merge([]*gossipState{state(1, 5, ClusterTunnel{ID: "app", Hostnames: []string{"app.example.org"}})})
+	if node, ok := registry.Lookup("app"); !ok || node != peer {
+		t.Fatalf("Lookup() = %v, %v, want the peer", node, ok)
+	}
+	if _, tunnelID, ok := registry.LookupHostname("app.example.org"); !ok || tunnelID != "app" {
+		t.Errorf("LookupHostname() = %q, %v, want app", tunnelID, ok)
+	}
+
+	// an older heartbeat relayed late does not roll the state back
+	registry.merge([]*gossipState{state(1, 4)})
+	if _, ok := registry.Lookup("app"); !ok {
+		t.Error("a stale state replaced a newer one")
+	}
+
+	// an expired node is not revived by a copy of its last state
+	registry.states["peer"].updatedAt = time.Now().Add(-time.Hour)
+	registry.merge([]*gossipState{state(1, 5, ClusterTunnel{ID: "app"})})
+	if _, ok := registry.Lookup("app"); ok {
+		t.Error("an expired node was revived by a relayed copy")
+	}
+
+	// a restarted node starts counting again in a new incarnation
+	registry.merge([]*gossipState{state(2, 1, ClusterTunnel{ID: "api"})})
+	if _, ok := registry.Lookup("api"); !ok {
+		t.Error("the restarted node was ignored")
+	}
+	if _, ok := registry.Lookup("app"); ok {
+		t.Error("tunnels of the previous incarnation are still routed")
+	}
+
+	// this node's own tunnels are served locally and never looked up
+	registry.Announce([]ClusterTunnel{{ID: "local"}})
+	if _, ok := registry.Lookup("local"); ok {
+		t.Error("Lookup() returned this node")
+	}
+}
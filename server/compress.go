@@ -0,0 +1,230 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/karol-broda/funnel/shared"
+)
+
+const defaultCompressionMinSize = 1024
+
+// DefaultCompressibleTypes are the content types compressed at the edge
+// unless configured otherwise, an entry ending in / matches the whole type
+var DefaultCompressibleTypes = []string{
+	"text/",
+	"application/javascript",
+	"application/json",
+	"application/manifest+json",
+	"application/xml",
+	"application/xhtml+xml",
+	"application/rss+xml",
+	"application/atom+xml",
+	"application/wasm",
+	"image/svg+xml",
+}
+
+// Compression configures compressing response bodies for visitors at the edge
+// and on the tunnel hop, each on its own
+type Compression struct {
+	// Edge compresses responses with brotli or gzip when the visitor accepts it
+	Edge bool
+	// MinSize is the smallest response compressed at the edge, in bytes
+	MinSize int
+	// Types are the content types compressed at the edge
+	Types []string
+	// TunnelMinSize is the smallest body compressed between the server and
+	// clients that support it, zero leaves the tunnel hop uncompressed
+	TunnelMinSize int
+}
+
+// SetCompression configures response compression, a zero MinSize and empty
+// Types keep their defaults
+func (s *Server) SetCompression(compression Compression) error {
+	logger := shared.GetLogger("server")
+
+	if compression.MinSize < 0 || compression.TunnelMinSize < 0 {
+		return fmt.Errorf("compression sizes must not be negative")
+	}
+	if compression.MinSize == 0 {
+		compression.MinSize = defaultCompressionMinSize
+	}
+	types := compression.Types
+	if len(types) == 0 {
+		types = DefaultCompressibleTypes
+	}
+	compression.Types = make([]string, len(types))
+	for i, contentType := range types {
+		compression.Types[i] = strings.ToLower(strings.TrimSpace(contentType))
+	}
+
+	s.compression = compression
+	logger.Info().
+		Bool("edge_compression", compression.Edge).
+		Int("min_size", compression.MinSize).
+		Strs("types", compression.Types).
+		Int("tunnel_min_size", compression.TunnelMinSize).
+		Msg("response compression configured")
+	return nil
+}
+
+// features returns the protocol features this server negotiates
+func (s *Server) features() []string {
+	if s.compression.TunnelMinSize == 0 {
+		return serverFeatures
+	}
+	return append(serverFeatures[:len(serverFeatures):len(serverFeatures)], shared.FeatureCompression)
+}
+
+// responseEncoding returns the content-encoding a response to r gets at the
+// edge, empty to send it as it is. size is the body size, -1 when unknown.
+func (c Compression) responseEncoding(r *http.Request, status int, header http.Header, size int) string {
+	if !c.Edge || r.Method == http.MethodHead {
+		return ""
+	}
+	if status < http.StatusOK || status == http.StatusNoContent || status == http.StatusNotModified || status == http.StatusPartialContent {
+		return ""
+	}
+	if header.Get("Content-Encoding") != "" || header.Get("Content-Range") != "" {
+		return ""
+	}
+	if strings.Contains(strings.ToLower(header.Get("Cache-Control")), "no-transform") {
+		return ""
+	}
+	if size < 0 {
+		if length, err := strconv.Atoi(header.Get("Content-Length")); err == nil {
+			size = length
+		}
+	}
+	if size >= 0 && size < c.MinSize {
+		return ""
+	}
+	if !c.compressible(header.Get("Content-Type")) {
+		return ""
+	}
+
+	// the response depends on accept-encoding from here, whatever the visitor sent
+	header.Add("Vary", "Accept-Encoding")
+	return negotiateEncoding(r.Header.Get("Accept-Encoding"))
+}
+
+func (c Compression) compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, compressible := range c.Types {
+		if mediaType == compressible || (strings.HasSuffix(compressible, "/") && strings.HasPrefix(mediaType, compressible)) {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiateEncoding picks br or gzip from an accept-encoding header, the one
+// with the higher quality and br when they tie
+func negotiateEncoding(acceptEncoding string) string {
+	qualities := map[string]float64{}
+	wildcard := -1.0
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		quality := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+			quality = parsed
+		}
+		if coding == "*" {
+			wildcard = quality
+		} else {
+			qualities[coding] = quality
+		}
+	}
+
+	best, bestQuality := "", 0.0
+	for _, coding := range []string{"br", "gzip"} {
+		quality, ok := qualities[coding]
+		if !ok {
+			quality = wildcard
+		}
+		if quality > bestQuality {
+			best, bestQuality = coding, quality
+		}
+	}
+	return best
+}
+
+// compressor is what the gzip and brotli writers have in common
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+	Reset(io.Writer)
+}
+
+var compressors = map[string]*sync.Pool{
+	"br": {New: func() any {
+		return brotli.NewWriterLevel(nil, 4)
+	}},
+	"gzip": {New: func() any {
+		w, _ := gzip.NewWriterLevel(nil, gzip.DefaultCompression)
+		return w
+	}},
+}
+
+func getCompressor(encoding string, w io.Writer) compressor {
+	c := compressors[encoding].Get().(compressor)
+	c.Reset(w)
+	return c
+}
+
+func putCompressor(encoding string, c compressor) {
+	compressors[encoding].Put(c)
+}
+
+// prepareEncodedHeader updates the headers of a response for its encoding
+func prepareEncodedHeader(header http.Header, encoding string) {
+	header.Set("Content-Encoding", encoding)
+	header.Del("Content-Length")
+	// the bytes differ from what the local service sent
+	if etag := header.Get("Etag"); strings.HasPrefix(etag, `"`) {
+		header.Set("Etag", "W/"+etag)
+	}
+}
+
+// compressBody compresses a whole response body
+func compressBody(encoding string, body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	c := getCompressor(encoding, &buf)
+	defer putCompressor(encoding, c)
+
+	if _, err := c.Write(body); err != nil {
+		return nil, err
+	}
+	if err := c.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,218 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/gorilla/websocket"
+	"github.com/karol-broda/funnel/shared"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		acceptEncoding string
+		expected       string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"gzip", "gzip"},
+		{"gzip, deflate, br", "br"},
+		{"br;q=0.5, gzip", "gzip"},
+		{"br;q=0, gzip;q=0", ""},
+		{"*", "br"},
+		{"*;q=0.5, gzip", "gzip"},
+		{"GZIP", "gzip"},
+	}
+	for _, tt := range tests {
+		if got := negotiateEncoding(tt.acceptEncoding); got != tt.expected {
+			t.Errorf("negotiateEncoding(%q) = %q, want %q", tt.acceptEncoding, got, tt.expected)
+		}
+	}
+}
+
+func TestCompression_responseEncoding(t *testing.T) {
+	compression := Compression{Edge: true, MinSize: 1024, Types: DefaultCompressibleTypes}
+
+	tests := []struct {
+		name        string
+		compression Compression
+		method      string
+		status      int
+		header      http.Header
+		size        int
+		expected    string
+	}{
+		{"html", compression, "GET", 200, http.Header{"Content-Type": {"text/html; charset=utf-8"}}, 4096, "gzip"},
+		{"json of unknown size", compression, "GET", 200, http.Header{"Content-Type": {"application/json"}}, -1, "gzip"},
+		{"edge compression off", Compression{MinSize: 1024, Types: DefaultCompressibleTypes}, "GET", 200, http.Header{"Content-Type": {"text/html"}}, 4096, ""},
+		{"too small", compression, "GET", 200, http.Header{"Content-Type": {"text/html"}}, 100, ""},
+		{"too small by content length", compression, "GET", 200, http.Header{"Content-Type": {"text/html"}, "Content-Length": {"100"}}, -1, ""},
+		{"image", compression, "GET", 200, http.Header{"Content-Type": {"image/png"}}, 4096, ""},
+		{"grpc", compression, "POST", 200, http.Header{"Content-Type": {"application/grpc"}}, -1, ""},
+		{"already encoded", compression, "GET", 200, http.Header{"Content-Type": {"text/html"}, "Content-Encoding": {"br"}}, 4096, ""},
+		{"no transform", compression, "GET", 200, http.Header{"Content-Type": {"text/html"}, "Cache-Control": {"no-transform"}}, 4096, ""},
+		{"partial content", compression, "GET", 206, http.Header{"Content-Type": {"text/html"}}, 4096, ""},
+		{"not modified", compression, "GET", 304, http.Header{"Content-Type": {"text/html"}}, 4096, ""},
+		{"head", compression, "HEAD", 200, http.Header{"Content-Type": {"text/html"}}, 4096, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "http://app.tunnel.example.com/", nil)
+			r.Header.Set("Accept-Encoding", "gzip")
+			got := tt.compression.responseEncoding(r, tt.status, tt.header, tt.size)
+			if got != tt.expected {
+				t.Errorf("responseEncoding() = %q, want %q", got, tt.expected)
+			}
+			if got != "" && tt.header.Get("Vary") != "Accept-Encoding" {
+				t.Errorf("Vary = %q, want Accept-Encoding", tt.header.Get("Vary"))
+			}
+		})
+	}
+}
+
+var compressionFeatures = []string{shared.FeatureStreaming, shared.FeatureCompression}
+
+func TestTunnelRouter_CompressesResponses(t *testing.T) {
+	s, router, ts := newPoolTestServer(t)
+	if err := s.SetCompression(Compression{Edge: true}); err != nil {
+		t.Fatalf("SetCompression() error = %v", err)
+	}
+
+	page := bytes.Repeat([]byte(`{"message":"hello from the local service"}`), 100)
+	joinTestTunnel(t, ts, "app", compressionFeatures, func(conn *websocket.Conn, msg *shared.Message) {
+		if msg.Type != "request" {
+			return
+		}
+		headers := map[string][]string{"Content-Type": {"application/json"}, "Etag": {`"v1"`}}
+		if !strings.HasSuffix(msg.Path, "/events") {
+			conn.WriteJSON(&shared.Message{Type: "response", RequestID: msg.RequestID, Status: http.StatusOK, Headers: headers, Body: page})
+			return
+		}
+		headers["Content-Type"] = []string{"text/event-stream"}
+		conn.WriteJSON(&shared.Message{Type: "response", RequestID: msg.RequestID, Status: http.StatusOK, Headers: headers, Stream: true})
+		for i := 0; i < 3; i++ {
+			conn.WriteJSON(&shared.Message{Type: "response_body", RequestID: msg.RequestID, Body: page})
+		}
+		conn.WriteJSON(&shared.Message{Type: "response_body", RequestID: msg.RequestID, End: true})
+	})
+
+	decoders := map[string]func(io.Reader) (io.Reader, error){
+		"":     func(r io.Reader) (io.Reader, error) { return r, nil },
+		"gzip": func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+		"br":   func(r io.Reader) (io.Reader, error) { return brotli.NewReader(r), nil },
+	}
+
+	tests := []struct {
+		name           string
+		path           string
+		acceptEncoding string
+		expected       []byte
+	}{
+		{"gzip", "/", "gzip", page},
+		{"brotli", "/", "gzip, br", page},
+		{"identity", "/", "", page},
+		{"streamed brotli", "/events", "br", bytes.Repeat(page, 3)},
+		{"streamed identity", "/events", "", bytes.Repeat(page, 3)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://app.tunnel.example.com"+tt.path, nil)
+			if tt.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+
+			encoding := rec.Header().Get("Content-Encoding")
+			if want := negotiateEncoding(tt.acceptEncoding); encoding != want {
+				t.Fatalf("Content-Encoding = %q, want %q", encoding, want)
+			}
+			if rec.Header().Get("Vary") != "Accept-Encoding" {
+				t.Errorf("Vary = %q, want Accept-Encoding", rec.Header().Get("Vary"))
+			}
+			if encoding != "" && rec.Header().Get("Etag") != `W/"v1"` {
+				t.Errorf("Etag = %q, want it weakened", rec.Header().Get("Etag"))
+			}
+
+			reader, err := decoders[encoding](rec.Body)
+			if err != nil {
+				t.Fatalf("failed to decode %s body: %v", encoding, err)
+			}
+			body, err := io.ReadAll(reader)
+			if err != nil || !bytes.Equal(body, tt.expected) {
+				t.Errorf("decoded body has %d bytes (%v), want %d", len(body), err, len(tt.expected))
+			}
+		})
+	}
+
+	tunnel, _ := s.GetTunnel("app")
+	stats := tunnel.statistics.GetSnapshot()
+	if stats.CompressedResponses != 3 || stats.EdgeBytesSaved <= 0 {
+		t.Errorf("compressed %d responses saving %d bytes, want 3 saving some", stats.CompressedResponses, stats.EdgeBytesSaved)
+	}
+}
+
+func TestTunnel_CompressesTunnelHop(t *testing.T) {
+	s, router, ts := newPoolTestServer(t)
+	if err := s.SetCompression(Compression{TunnelMinSize: 512}); err != nil {
+		t.Fatalf("SetCompression() error = %v", err)
+	}
+
+	upload := []byte(strings.Repeat("a request body worth compressing ", 100))
+	received := make(chan *shared.Message, 1)
+	_, welcome := joinTestTunnel(t, ts, "app", compressionFeatures, func(conn *websocket.Conn, msg *shared.Message) {
+		if msg.Type != "request" {
+			return
+		}
+		received <- msg
+		reply, _ := shared.CompressBody(&shared.Message{
+			Type:      "response",
+			RequestID: msg.RequestID,
+			Status:    http.StatusOK,
+			Headers:   map[string][]string{"Content-Type": {"text/plain"}},
+			Body:      upload,
+		}, 512)
+		conn.WriteJSON(reply)
+	})
+	if !shared.HasFeature(welcome.Features, shared.FeatureCompression) || welcome.Limits.CompressionThreshold != 512 {
+		t.Fatalf("welcome features %v threshold %d, want compression above 512 bytes", welcome.Features, welcome.Limits.CompressionThreshold)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "http://app.tunnel.example.com/upload", bytes.NewReader(upload))
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	select {
+	case msg := <-received:
+		if !msg.Compressed || len(msg.Body) >= len(upload) {
+			t.Errorf("request body sent with %d bytes, compressed %v, want it compressed", len(msg.Body), msg.Compressed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("client did not receive the request")
+	}
+	if rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), upload) {
+		t.Errorf("response %d with %d bytes, want the decompressed body", rec.Code, rec.Body.Len())
+	}
+
+	tunnel, _ := s.GetTunnel("app")
+	if saved := tunnel.statistics.GetSnapshot().TunnelBytesSaved; saved <= 0 {
+		t.Errorf("TunnelBytesSaved = %d, want the savings of both directions", saved)
+	}
+}
+
+func TestServer_TunnelCompressionOff(t *testing.T) {
+	_, _, ts := newPoolTestServer(t)
+	_, welcome := joinTestTunnel(t, ts, "app", compressionFeatures, func(*websocket.Conn, *shared.Message) {})
+	if shared.HasFeature(welcome.Features, shared.FeatureCompression) {
+		t.Error("compression negotiated without tunnel compression configured")
+	}
+}
@@ -0,0 +1,250 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-acme/lego/v4/certificate"
+	"github.com/karol-broda/funnel/shared"
+)
+
+const (
+	devCACertFile = "dev-ca.crt"
+	devCAKeyFile  = "dev-ca.key"
+
+	devCAValidity   = 10 * 365 * 24 * time.Hour
+	devCertValidity = 90 * 24 * time.Hour
+)
+
+// DevCA is a local certificate authority for development and air-gapped setups.
+// it is created once in the cert dir and reused, so clients only have to trust
+// dev-ca.crt a single time.
+type DevCA struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	certPath string
+}
+
+// LoadOrCreateDevCA loads the ca from certDir or mints a new one
+func LoadOrCreateDevCA(certDir string) (*DevCA, error) {
+	certPath := filepath.Join(certDir, devCACertFile)
+	keyPath := filepath.Join(certDir, devCAKeyFile)
+
+	pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err == nil {
+		cert, err := x509.ParseCertificate(pair.Certificate[0])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse dev ca certificate: %w", err)
+		}
+		key, ok := pair.PrivateKey.(*ecdsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("dev ca key in %s is not an ecdsa key", keyPath)
+		}
+		return &DevCA{cert: cert, key: key, certPath: certPath}, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to load dev ca: %w", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate dev ca key: %w", err)
+	}
+
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "funnel development ca", Organization: []string{"funnel"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(devCAValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create dev ca certificate: %w", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse dev ca certificate: %w", err)
+	}
+
+	keyPEM, err := encodeECKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		return nil, fmt.Errorf("failed to save dev ca key: %w", err)
+	}
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return nil, fmt.Errorf("failed to save dev ca certificate: %w", err)
+	}
+
+	return &DevCA{cert: cert, key: key, certPath: certPath}, nil
+}
+
+// CertPath is the file clients need to trust
+func (ca *DevCA) CertPath() string {
+	return ca.certPath
+}
+
+// Issue signs a new certificate for key, a hostname or a wildcard which also
+// covers its parent domain
+func (ca *DevCA) Issue(key string) (*certificate.Resource, error) {
+	names := []string{key}
+	if strings.HasPrefix(key, "*.") {
+		names = append(names, strings.TrimPrefix(key, "*."))
+	}
+
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate certificate key: %w", err)
+	}
+
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(devCertValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &leafKey.PublicKey, ca.key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign certificate for %s: %w", key, err)
+	}
+
+	keyPEM, err := encodeECKey(leafKey)
+	if err != nil {
+		return nil, err
+	}
+
+	chain := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})...)
+
+	return &certificate.Resource{
+		Domain:      key,
+		Certificate: chain,
+		PrivateKey:  keyPEM,
+	}, nil
+}
+
+func encodeECKey(key *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal private key: %w", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
+
+func randomSerial() (*big.Int, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate serial number: %w", err)
+	}
+	return serial, nil
+}
+
+func newDevCertificateManager(certConfig CertificateConfig) (*CertificateManager, error) {
+	logger := shared.GetLogger("certs.manager")
+
+	if err := os.MkdirAll(certConfig.CertDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create certificate directory: %w", err)
+	}
+
+	ca, err := LoadOrCreateDevCA(certConfig.CertDir)
+	if err != nil {
+		return nil, err
+	}
+
+	certCache, err := newCertificateCache()
+	if err != nil {
+		return nil, err
+	}
+
+	baseDomains := make([]string, 0, len(certConfig.BaseDomains))
+	for _, domain := range certConfig.BaseDomains {
+		baseDomains = append(baseDomains, shared.NormalizeHostname(domain))
+	}
+
+	cm := &CertificateManager{
+		devCA:          ca,
+		devBaseDomains: baseDomains,
+		challenges:     NewChallengeSolver(),
+		certificates:   certCache,
+		certDir:        certConfig.CertDir,
+		renewals:       make(map[string]*renewalState),
+		renewalCtx:     context.Background(),
+		logger:         logger,
+		providerConfig: &ProviderConfig{},
+	}
+	cm.obtain = cm.issueDevCertificate
+
+	logger.Warn().
+		Str("ca_cert", ca.CertPath()).
+		Strs("base_domains", baseDomains).
+		Msg("certificates are issued by a local development ca, clients must trust it explicitly")
+
+	return cm, nil
+}
+
+// findDevManagedDomain maps a base domain and its direct subdomains to the
+// base domain's wildcard certificate
+func findDevManagedDomain(baseDomains []string, domain string) (string, bool) {
+	for _, base := range baseDomains {
+		if domain == base {
+			return "*." + base, true
+		}
+		label, ok := strings.CutSuffix(domain, "."+base)
+		if ok && label != "" && !strings.Contains(label, ".") {
+			return "*." + base, true
+		}
+	}
+	return "", false
+}
+
+func (cm *CertificateManager) issueDevCertificate(key string) (*tls.Certificate, error) {
+	unlock := cm.lockDomain(key)
+	defer unlock()
+
+	if cert, ok := cm.certificates.Get(key); ok && cm.isCertificateValid(cert) {
+		return cert, nil
+	}
+
+	cm.logger.Info().Str("domain", key).Msg("issuing certificate from development ca")
+
+	resource, err := cm.devCA.Issue(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cm.storeCertificate(key, resource)
+}
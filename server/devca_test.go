@@ -0,0 +1,81 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadOrCreateDevCA_Reuse(t *testing.T) {
+	dir := t.TempDir()
+
+	first, err := LoadOrCreateDevCA(dir)
+	require.NoError(t, err)
+	assert.FileExists(t, filepath.Join(dir, devCACertFile))
+
+	second, err := LoadOrCreateDevCA(dir)
+	require.NoError(t, err)
+	assert.True(t, first.cert.Equal(second.cert), "the ca must survive restarts so clients keep trusting it")
+}
+
+func TestFindDevManagedDomain(t *testing.T) {
+	baseDomains := []string{"tunnel.test", "dev.example.com"}
+
+	tests := []struct {
+		domain   string
+		expected string
+		ok       bool
+	}{
+		{"tunnel.test", "*.tunnel.test", true},
+		{"demo.tunnel.test", "*.tunnel.test", true},
+		{"api.dev.example.com", "*.dev.example.com", true},
+		{"a.b.tunnel.test", "", false},
+		{"eviltunnel.test", "", false},
+		{"example.com", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.domain, func(t *testing.T) {
+			managed, ok := findDevManagedDomain(baseDomains, tt.domain)
+			assert.Equal(t, tt.ok, ok)
+			assert.Equal(t, tt.expected, managed)
+		})
+	}
+}
+
+func TestCertificateManager_DevMode(t *testing.T) {
+	dir := t.TempDir()
+	cm, err := NewCertificateManager(CertificateConfig{
+		Mode:        TLSModeDev,
+		CertDir:     dir,
+		BaseDomains: []string{"tunnel.test"},
+	})
+	require.NoError(t, err)
+	cm.SetHostnamePolicy(func(host string) bool { return host == "a.b.tunnel.test" })
+
+	require.NoError(t, cm.PreloadCertificates())
+	assert.FileExists(t, filepath.Join(dir, "*.tunnel.test.crt"))
+
+	caPEM, err := os.ReadFile(filepath.Join(dir, devCACertFile))
+	require.NoError(t, err)
+	roots := x509.NewCertPool()
+	require.True(t, roots.AppendCertsFromPEM(caPEM))
+
+	for _, host := range []string{"demo.tunnel.test", "tunnel.test", "a.b.tunnel.test"} {
+		t.Run(host, func(t *testing.T) {
+			cert, err := cm.GetCertificate(&tls.ClientHelloInfo{ServerName: host})
+			require.NoError(t, err)
+
+			_, err = cert.Leaf.Verify(x509.VerifyOptions{DNSName: host, Roots: roots})
+			assert.NoError(t, err, "certificate must chain to the dev ca")
+		})
+	}
+
+	_, err = cm.GetCertificate(&tls.ClientHelloInfo{ServerName: "other.example.com"})
+	assert.Error(t, err)
+}
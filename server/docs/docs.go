@@ -22,6 +22,50 @@ const docTemplate = `{
     "host": "{{.Host}}",
     "basePath": "{{.BasePath}}",
     "paths": {
+        "/certificates": {
+            "get": {
+                "description": "Returns the certificates currently served by the server with their expiry, renewal and ocsp stapling status, soonest expiry first",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Server"
+                ],
+                "summary": "List tls certificates",
+                "responses": {
+                    "200": {
+                        "description": "Certificate status",
+                        "schema": {
+                            "allOf": [
+                                {
+                                    "$ref": "#/definitions/server.APIResponse"
+                                },
+                                {
+                                    "type": "object",
+                                    "properties": {
+                                        "data": {
+                                            "type": "array",
+                                            "items": {
+                                                "$ref": "#/definitions/server.CertificateStatus"
+                                            }
+                                        }
+                                    }
+                                }
+                            ]
+                        }
+                    },
+                    "404": {
+                        "description": "TLS is not enabled",
+                        "schema": {
+                            "$ref": "#/definitions/server.APIResponse"
+                        }
+                    }
+                }
+            }
+        },
         "/health": {
             "get": {
                 "description": "Returns the health status of the server",
@@ -543,6 +587,75 @@ const docTemplate = `{
                 }
             }
         },
+        "server.CertificateStatus": {
+            "type": "object",
+            "properties": {
+                "dns_names": {
+                    "description": "Names the certificate is valid for",
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "domain": {
+                    "description": "Certificate key, a hostname or wildcard",
+                    "type": "string",
+                    "example": "*.tunnel.example.com"
+                },
+                "issuer": {
+                    "description": "Issuing CA common name",
+                    "type": "string",
+                    "example": "R11"
+                },
+                "last_renewal_attempt": {
+                    "description": "Time of the last renewal attempt",
+                    "type": "string"
+                },
+                "last_renewal_error": {
+                    "description": "Error of the last failed renewal",
+                    "type": "string"
+                },
+                "next_renewal_attempt": {
+                    "description": "Earliest time of the next retry",
+                    "type": "string"
+                },
+                "not_after": {
+                    "description": "End of validity",
+                    "type": "string",
+                    "example": "2025-11-06T18:30:00Z"
+                },
+                "not_before": {
+                    "description": "Start of validity",
+                    "type": "string",
+                    "example": "2025-08-08T18:30:00Z"
+                },
+                "ocsp_next_update": {
+                    "description": "When the stapled response expires",
+                    "type": "string",
+                    "example": "2025-08-15T18:30:00Z"
+                },
+                "ocsp_stapled": {
+                    "description": "Whether an OCSP response is stapled",
+                    "type": "boolean",
+                    "example": true
+                },
+                "renew_at": {
+                    "description": "When background renewal starts",
+                    "type": "string",
+                    "example": "2025-10-07T18:30:00Z"
+                },
+                "renewal_failures": {
+                    "description": "Consecutive failed renewal attempts",
+                    "type": "integer",
+                    "example": 0
+                },
+                "static": {
+                    "description": "Loaded from a file, never renewed by the server",
+                    "type": "boolean",
+                    "example": false
+                }
+            }
+        },
         "server.DetailedTunnelMetrics": {
             "type": "object",
             "properties": {
@@ -551,11 +664,21 @@ const docTemplate = `{
                     "type": "number",
                     "example": 25.5
                 },
+                "cancelled_count": {
+                    "description": "Requests canceled on the client",
+                    "type": "integer",
+                    "example": 3
+                },
                 "client_ip": {
                     "description": "Client IP address",
                     "type": "string",
                     "example": "192.168.1.100:52341"
                 },
+                "compressed_responses": {
+                    "description": "Responses compressed for visitors",
+                    "type": "integer",
+                    "example": 312
+                },
                 "connection_errors": {
                     "description": "Connection errors",
                     "type": "integer",
@@ -581,6 +704,21 @@ const docTemplate = `{
                     "type": "integer",
                     "example": 1
                 },
+                "edge_bytes_saved": {
+                    "description": "Bytes compression saved visitors",
+                    "type": "integer",
+                    "example": 4821330
+                },
+                "flow_control_stalls": {
+                    "description": "Body chunks that waited for flow control credit",
+                    "type": "integer",
+                    "example": 7
+                },
+                "incoming_queue_depth": {
+                    "description": "Messages from the client waiting to be routed",
+                    "type": "integer",
+                    "example": 0
+                },
                 "last_activity": {
                     "description": "Last activity time",
                     "type": "string",
@@ -596,6 +734,21 @@ const docTemplate = `{
                     "type": "number",
                     "example": 5.2
                 },
+                "outgoing_queue_depth": {
+                    "description": "Messages waiting to be sent to the client",
+                    "type": "integer",
+                    "example": 2
+                },
+                "oversized_bodies": {
+                    "description": "Bodies refused for exceeding the body limits",
+                    "type": "integer",
+                    "example": 1
+                },
+                "queue_stalls": {
+                    "description": "Messages that waited for room in a tunnel queue",
+                    "type": "integer",
+                    "example": 4
+                },
                 "reconnect_count": {
                     "description": "Number of reconnections",
                     "type": "integer",
@@ -636,6 +789,11 @@ const docTemplate = `{
                     "type": "integer",
                     "example": 1498
                 },
+                "tunnel_bytes_saved": {
+                    "description": "Bytes compression saved on the tunnel hop",
+                    "type": "integer",
+                    "example": 1203344
+                },
                 "tunnel_id": {
                     "description": "Tunnel identifier",
                     "type": "string",
@@ -874,6 +1032,16 @@ const docTemplate = `{
                     "type": "integer",
                     "example": 45
                 },
+                "pool_members": {
+                    "description": "Number of clients serving a pooled tunnel",
+                    "type": "integer",
+                    "example": 3
+                },
+                "pool_strategy": {
+                    "description": "How requests are spread when several clients serve the tunnel",
+                    "type": "string",
+                    "example": "round_robin"
+                },
                 "status": {
                     "description": "Current tunnel status",
                     "type": "string",
@@ -883,6 +1051,16 @@ const docTemplate = `{
                     ],
                     "example": "connected"
                 },
+                "upstream_error": {
+                    "description": "Last health check error while unhealthy",
+                    "type": "string",
+                    "example": "connection refused"
+                },
+                "upstream_status": {
+                    "description": "Local service health reported by the client: healthy, unhealthy or unknown",
+                    "type": "string",
+                    "example": "healthy"
+                },
                 "uptime": {
                     "description": "Tunnel connection uptime",
                     "type": "string",
@@ -933,6 +1111,11 @@ const docTemplate = `{
                     "type": "string",
                     "example": "my-tunnel"
                 },
+                "upstream_status": {
+                    "description": "Health of the local service",
+                    "type": "string",
+                    "example": "healthy"
+                },
                 "uptime": {
                     "description": "Connection uptime",
                     "type": "string",
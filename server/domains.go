@@ -0,0 +1,168 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/karol-broda/funnel/shared"
+)
+
+const (
+	// hostnameVerifyPrefix is prepended to a custom hostname to find its verification txt record
+	hostnameVerifyPrefix = "_funnel."
+	// hostnameVerifyValue prefixes the tunnel id inside the verification txt record
+	hostnameVerifyValue = "funnel-verify="
+
+	domainVerifyTimeout = 5 * time.Second
+	maxCustomHostnames  = 8
+)
+
+var (
+	ErrHostnameNotVerified = errors.New("hostname ownership could not be verified")
+	ErrHostnameInUse       = errors.New("hostname is already in use by another tunnel")
+)
+
+// Resolver is the subset of net.Resolver used to verify custom hostnames
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupCNAME(ctx context.Context, host string) (string, error)
+}
+
+// DomainVerifier checks that whoever controls a custom hostname pointed it at a tunnel.
+// a hostname is accepted when it is a cname for the tunnel's own host, or when
+// _funnel.<hostname> has a txt record "funnel-verify=<tunnel id>".
+type DomainVerifier struct {
+	resolver Resolver
+	timeout  time.Duration
+}
+
+func NewDomainVerifier(resolver Resolver) *DomainVerifier {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	return &DomainVerifier{
+		resolver: resolver,
+		timeout:  domainVerifyTimeout,
+	}
+}
+
+// Verify returns nil if hostname may be routed to tunnelID, whose public host is tunnelHost
+func (v *DomainVerifier) Verify(ctx context.Context, hostname, tunnelID, tunnelHost string) error {
+	logger := shared.GetTunnelLogger("server.domains", tunnelID)
+
+	ctx, cancel := context.WithTimeout(ctx, v.timeout)
+	defer cancel()
+
+	cname, err := v.resolver.LookupCNAME(ctx, hostname)
+	if err == nil && tunnelHost != "" && shared.NormalizeHostname(cname) == tunnelHost {
+		logger.Debug().Str("hostname", hostname).Str("cname", cname).Msg("hostname verified by cname")
+		return nil
+	}
+
+	records, err := v.resolver.LookupTXT(ctx, hostnameVerifyPrefix+hostname)
+	if err != nil {
+		logger.Debug().Err(err).Str("hostname", hostname).Msg("verification txt lookup failed")
+		return fmt.Errorf("%w: %s", ErrHostnameNotVerified, hostname)
+	}
+
+	expected := hostnameVerifyValue + tunnelID
+	for _, record := range records {
+		if strings.TrimSpace(record) == expected {
+			logger.Debug().Str("hostname", hostname).Msg("hostname verified by txt record")
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: %s", ErrHostnameNotVerified, hostname)
+}
+
+// SetDomainVerifier enables custom hostnames, nil disables them
+func (s *Server) SetDomainVerifier(verifier *DomainVerifier) {
+	s.domainVerifier = verifier
+}
+
+// verifyHostnames validates and verifies the hostnames requested in a hello
+func (s *Server) verifyHostnames(ctx context.Context, requested []string, tunnelID, tunnelHost string) ([]string, error) {
+	if len(requested) == 0 {
+		return nil, nil
+	}
+
+	if s.domainVerifier == nil {
+		return nil, errors.New("custom hostnames are not enabled on this server")
+	}
+
+	if len(requested) > maxCustomHostnames {
+		return nil, fmt.Errorf("at most %d custom hostnames may be requested", maxCustomHostnames)
+	}
+
+	hostnames := make([]string, 0, len(requested))
+	for _, raw := range requested {
+		hostname := shared.NormalizeHostname(raw)
+		if err := shared.ValidateHostname(hostname); err != nil {
+			return nil, fmt.Errorf("invalid hostname %q: %w", raw, err)
+		}
+		if hostname == tunnelHost {
+			continue
+		}
+		if err := s.domainVerifier.Verify(ctx, hostname, tunnelID, tunnelHost); err != nil {
+			return nil, err
+		}
+		hostnames = append(hostnames, hostname)
+	}
+
+	return hostnames, nil
+}
+
+// claimHostnames routes hostnames to tunnelID, all or nothing
+func (s *Server) claimHostnames(tunnelID string, hostnames []string) error {
+	for _, hostname := range hostnames {
+		if _, owner, ok := s.clusterHostnameOwner(hostname); ok && owner != tunnelID {
+			return fmt.Errorf("%w: %s", ErrHostnameInUse, hostname)
+		}
+	}
+
+	s.hostnamesMu.Lock()
+	defer s.hostnamesMu.Unlock()
+
+	for _, hostname := range hostnames {
+		if owner, ok := s.hostnames[hostname]; ok && owner != tunnelID {
+			return fmt.Errorf("%w: %s", ErrHostnameInUse, hostname)
+		}
+	}
+
+	for _, hostname := range hostnames {
+		s.hostnames[hostname] = tunnelID
+	}
+
+	return nil
+}
+
+func (s *Server) releaseHostnames(tunnelID string) {
+	s.hostnamesMu.Lock()
+	defer s.hostnamesMu.Unlock()
+
+	for hostname, owner := range s.hostnames {
+		if owner == tunnelID {
+			delete(s.hostnames, hostname)
+		}
+	}
+}
+
+// TunnelIDForHostname returns the tunnel a custom hostname is routed to
+func (s *Server) TunnelIDForHostname(host string) (string, bool) {
+	s.hostnamesMu.RLock()
+	defer s.hostnamesMu.RUnlock()
+
+	tunnelID, ok := s.hostnames[shared.NormalizeHostname(host)]
+	return tunnelID, ok
+}
+
+// IsCustomHostname reports whether host is currently claimed by a tunnel
+func (s *Server) IsCustomHostname(host string) bool {
+	_, ok := s.TunnelIDForHostname(host)
+	return ok
+}
@@ -0,0 +1,189 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/karol-broda/funnel/shared"
+)
+
+type fakeResolver struct {
+	txt   map[string][]string
+	cname map[string]string
+}
+
+func (f *fakeResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	records, ok := f.txt[name]
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+	return records, nil
+}
+
+func (f *fakeResolver) LookupCNAME(ctx context.Context, host string) (string, error) {
+	cname, ok := f.cname[host]
+	if !ok {
+		return host + ".", nil
+	}
+	return cname, nil
+}
+
+func TestDomainVerifier_Verify(t *testing.T) {
+	resolver := &fakeResolver{
+		txt: map[string][]string{
+			"_funnel.txt.customer.com":   {"v=spf1 -all", "funnel-verify=demo"},
+			"_funnel.other.customer.com": {"funnel-verify=someone-else"},
+		},
+		cname: map[string]string{
+			"cname.customer.com": "demo.tunnel.example.com.",
+			"wrong.customer.com": "other.tunnel.example.com.",
+		},
+	}
+	verifier := NewDomainVerifier(resolver)
+
+	tests := []struct {
+		name     string
+		hostname string
+		verified bool
+	}{
+		{name: "txt record", hostname: "txt.customer.com", verified: true},
+		{name: "cname to tunnel host", hostname: "cname.customer.com", verified: true},
+		{name: "txt for another tunnel", hostname: "other.customer.com", verified: false},
+		{name: "cname to another tunnel", hostname: "wrong.customer.com", verified: false},
+		{name: "no records", hostname: "missing.customer.com", verified: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifier.Verify(context.Background(), tt.hostname, "demo", "demo.tunnel.example.com")
+			if tt.verified && err != nil {
+				t.Errorf("expected %s to verify, got %v", tt.hostname, err)
+			}
+			if !tt.verified && !errors.Is(err, ErrHostnameNotVerified) {
+				t.Errorf("expected ErrHostnameNotVerified for %s, got %v", tt.hostname, err)
+			}
+		})
+	}
+}
+
+func TestServer_verifyHostnames(t *testing.T) {
+	s := NewServer()
+
+	if _, err := s.verifyHostnames(context.Background(), []string{"demo.customer.com"}, "demo", "demo.tunnel.example.com"); err == nil {
+		t.Error("expected error when custom hostnames are disabled")
+	}
+
+	s.SetDomainVerifier(NewDomainVerifier(&fakeResolver{
+		txt: map[string][]string{"_funnel.demo.customer.com": {"funnel-verify=demo"}},
+	}))
+
+	hostnames, err := s.verifyHostnames(context.Background(), []string{"Demo.Customer.com.", "demo.tunnel.example.com"}, "demo", "demo.tunnel.example.com")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(hostnames) != 1 || hostnames[0] != "demo.customer.com" {
+		t.Errorf("expected [demo.customer.com], got %v", hostnames)
+	}
+
+	if _, err := s.verifyHostnames(context.Background(), []string{"*.customer.com"}, "demo", "demo.tunnel.example.com"); err == nil {
+		t.Error("expected error for invalid hostname")
+	}
+}
+
+func TestServer_claimHostnames(t *testing.T) {
+	s := NewServer()
+	s.AddTunnel("first", nil, nil)
+	s.AddTunnel("second", nil, nil)
+	defer s.RemoveTunnel("second")
+
+	if err := s.claimHostnames("first", []string{"a.customer.com", "b.customer.com"}); err != nil {
+		t.Fatalf("failed to claim hostnames: %v", err)
+	}
+
+	err := s.claimHostnames("second", []string{"c.customer.com", "b.customer.com"})
+	if !errors.Is(err, ErrHostnameInUse) {
+		t.Fatalf("expected ErrHostnameInUse, got %v", err)
+	}
+	if s.IsCustomHostname("c.customer.com") {
+		t.Error("failed claim should not route any hostname")
+	}
+
+	if tunnelID, ok := s.TunnelIDForHostname("A.customer.com:443"); !ok || tunnelID != "first" {
+		t.Errorf("expected a.customer.com to route to first, got %q", tunnelID)
+	}
+
+	s.RemoveTunnel("first")
+	if s.IsCustomHostname("a.customer.com") {
+		t.Error("hostnames should be released when the tunnel is removed")
+	}
+}
+
+func TestHandshakeCustomHostnames(t *testing.T) {
+	s := NewServer()
+	s.SetDomainVerifier(NewDomainVerifier(&fakeResolver{
+		txt: map[string][]string{"_funnel.demo.customer.com": {"funnel-verify=custom-tunnel"}},
+	}))
+	ts := httptest.NewServer(http.HandlerFunc(s.HandleWebSocket))
+	defer ts.Close()
+
+	conn := dialTestServer(t, ts, "custom-tunnel")
+	defer conn.Close()
+
+	reply := sendHello(t, conn, &shared.Hello{
+		ProtocolVersion: shared.ProtocolVersion,
+		Hostnames:       []string{"demo.customer.com"},
+	})
+	if reply.Type != "welcome" {
+		t.Fatalf("expected welcome, got %q (error: %s)", reply.Type, reply.Error)
+	}
+	if len(reply.Welcome.Hostnames) != 1 || reply.Welcome.Hostnames[0] != "demo.customer.com" {
+		t.Errorf("expected hostname to be accepted, got %v", reply.Welcome.Hostnames)
+	}
+	if tunnelID, ok := s.TunnelIDForHostname("demo.customer.com"); !ok || tunnelID != "custom-tunnel" {
+		t.Errorf("expected demo.customer.com to route to custom-tunnel, got %q", tunnelID)
+	}
+
+	unverified := dialTestServer(t, ts, "other-tunnel")
+	defer unverified.Close()
+
+	reply = sendHello(t, unverified, &shared.Hello{
+		ProtocolVersion: shared.ProtocolVersion,
+		Hostnames:       []string{"evil.customer.com"},
+	})
+	if reply.Type != "rejected" {
+		t.Errorf("expected unverified hostname to be rejected, got %q", reply.Type)
+	}
+	if s.TunnelExists("other-tunnel") {
+		t.Error("rejected client should not register a tunnel")
+	}
+}
+
+func TestRouterCustomHostname(t *testing.T) {
+	s := NewServer()
+	router := NewTunnelRouter(s)
+	s.SetRouter(router)
+
+	s.AddTunnel("my-tunnel", nil, nil)
+	defer s.RemoveTunnel("my-tunnel")
+
+	req := httptest.NewRequest("GET", "http://demo.customer.com/", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 before the hostname is claimed, got %d", w.Code)
+	}
+
+	if err := s.claimHostnames("my-tunnel", []string{"demo.customer.com"}); err != nil {
+		t.Fatalf("failed to claim hostname: %v", err)
+	}
+
+	// the tunnel has no client connection, so reaching it fails with a gateway error
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code == http.StatusNotFound {
+		t.Errorf("expected request to be routed to my-tunnel, got 404")
+	}
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/karol-broda/funnel/shared"
+)
+
+var flowControlFeatures = []string{shared.FeatureStreaming, shared.FeatureFlowControl}
+
+func TestTunnelRouter_RequestBodyWaitsForCredit(t *testing.T) {
+	s, router, ts := newPoolTestServer(t)
+
+	var mu sync.Mutex
+	var client *websocket.Conn
+	var requestID string
+	granting := false
+	inFlight := int64(0)
+	received := 0
+	ended := make(chan struct{})
+
+	// grant hands credit back to the stream and the tunnel, callers hold mu
+	grant := func(credit int64) {
+		client.WriteJSON(&shared.Message{Type: "window_update", RequestID: requestID, Credit: credit})
+		client.WriteJSON(&shared.Message{Type: "window_update", Credit: credit})
+	}
+
+	_, welcome := joinTestTunnel(t, ts, "app", flowControlFeatures, func(conn *websocket.Conn, msg *shared.Message) {
+		if msg.Type != "request_body" {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		client, requestID = conn, msg.RequestID
+		received += len(msg.Body)
+		if granting {
+			grant(shared.ChunkCost(msg))
+		} else {
+			inFlight += shared.ChunkCost(msg)
+		}
+		if msg.End {
+			conn.WriteJSON(&shared.Message{Type: "response", RequestID: msg.RequestID, Status: http.StatusOK, Body: []byte("ok")})
+			close(ended)
+		}
+	})
+	if welcome.Limits.StreamWindow != shared.DefaultStreamWindow {
+		t.Fatalf("stream window = %d, want %d", welcome.Limits.StreamWindow, shared.DefaultStreamWindow)
+	}
+
+	body := bytes.Repeat([]byte("x"), 1024*1024)
+	req := httptest.NewRequest(http.MethodPost, "http://app.tunnel.example.com/upload", bytes.NewReader(body))
+	rec := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		router.ServeHTTP(rec, req)
+	}()
+
+	// without credit the server stops once a stream window is in flight
+	time.Sleep(200 * time.Millisecond)
+	mu.Lock()
+	if received == 0 || received >= len(body) {
+		mu.Unlock()
+		t.Fatalf("received %d of %d bytes before granting credit, want the upload to stall", received, len(body))
+	}
+	if inFlight > shared.DefaultStreamWindow {
+		t.Errorf("%d bytes of credit in flight, more than the stream window", inFlight)
+	}
+	granting = true
+	grant(inFlight)
+	mu.Unlock()
+
+	select {
+	case <-ended:
+	case <-time.After(5 * time.Second):
+		t.Fatal("upload did not finish after credit was granted")
+	}
+	<-done
+
+	if rec.Code != http.StatusOK {
+		t.Errorf("status = %d, want 200", rec.Code)
+	}
+	mu.Lock()
+	if received != len(body) {
+		t.Errorf("received %d bytes, want %d", received, len(body))
+	}
+	mu.Unlock()
+
+	tunnel, _ := s.GetTunnel("app")
+	if stats := tunnel.statistics.GetSnapshot(); stats.FlowControlStalls == 0 {
+		t.Error("the stall was not counted")
+	}
+}
+
+func TestTunnelRouter_GrantsCreditAsVisitorReads(t *testing.T) {
+	_, router, ts := newPoolTestServer(t)
+
+	const chunks = 5
+	updates := make(chan *shared.Message, 16)
+	granted := make(chan *shared.Message, 1)
+	joinTestTunnel(t, ts, "app", flowControlFeatures, func(conn *websocket.Conn, msg *shared.Message) {
+		switch msg.Type {
+		case "request":
+			go func() {
+				conn.WriteJSON(&shared.Message{Type: "response", RequestID: msg.RequestID, Status: http.StatusOK, Stream: true})
+				chunk := bytes.Repeat([]byte("y"), shared.StreamChunkSize)
+				for i := 0; i < chunks; i++ {
+					conn.WriteJSON(&shared.Message{Type: "response_body", RequestID: msg.RequestID, Body: chunk})
+				}
+				// more than half the stream window was sent, the visitor's
+				// reads earn it back before the stream ends
+				select {
+				case update := <-updates:
+					granted <- update
+				case <-time.After(5 * time.Second):
+				}
+				conn.WriteJSON(&shared.Message{Type: "response_body", RequestID: msg.RequestID, End: true})
+			}()
+		case "window_update":
+			updates <- msg
+		}
+	})
+
+	visitors := httptest.NewServer(router)
+	defer visitors.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, visitors.URL+"/download", nil)
+	req.Host = "app.tunnel.example.com"
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	data, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if len(data) != chunks*shared.StreamChunkSize {
+		t.Fatalf("received %d bytes, want %d", len(data), chunks*shared.StreamChunkSize)
+	}
+
+	select {
+	case update := <-granted:
+		if update.RequestID == "" || update.Credit < shared.DefaultStreamWindow/2 {
+			t.Errorf("window_update for %q with %d credit, want at least half a stream window", update.RequestID, update.Credit)
+		}
+	default:
+		t.Fatal("no credit was granted for the consumed chunks")
+	}
+}
@@ -0,0 +1,319 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/karol-broda/funnel/shared"
+)
+
+const (
+	defaultGossipInterval = time.Second
+	// a node whose heartbeat stopped advancing for this many rounds is
+	// considered gone and its tunnels are no longer routed to it
+	gossipExpiryRounds = 5
+	maxGossipBody      = 8 << 20
+)
+
+// gossipState is what a node knows about another: its tunnels and a heartbeat
+// that the node increments every round. states are relayed between peers, so
+// a node hears about the others even when it cannot reach them directly.
+type gossipState struct {
+	Node        ClusterNode     `json:"node"`
+	Incarnation int64           `json:"incarnation"`
+	Heartbeat   uint64          `json:"heartbeat"`
+	Tunnels     []ClusterTunnel `json:"tunnels"`
+
+	updatedAt time.Time
+	tunnels   map[string]bool
+	hostnames map[string]string
+}
+
+// newer reports whether other supersedes s. a restarted node starts a new
+// incarnation, so its heartbeat starting over is not mistaken for an old state.
+func (s *gossipState) newer(other *gossipState) bool {
+	if other.Incarnation != s.Incarnation {
+		return other.Incarnation > s.Incarnation
+	}
+	return other.Heartbeat > s.Heartbeat
+}
+
+func (s *gossipState) index() {
+	s.tunnels = make(map[string]bool, len(s.Tunnels))
+	s.hostnames = make(map[string]string)
+	for _, tunnel := range s.Tunnels {
+		s.tunnels[tunnel.ID] = true
+		for _, hostname := range tunnel.Hostnames {
+			s.hostnames[hostname] = tunnel.ID
+		}
+	}
+}
+
+type gossipMessage struct {
+	States []*gossipState `json:"states"`
+}
+
+// GossipRegistry is a ClusterRegistry over a static list of peers. every round
+// a node exchanges everything it knows with each peer, and the newest state
+// of every node wins.
+type GossipRegistry struct {
+	self     ClusterNode
+	peers    []string
+	secret   string
+	interval time.Duration
+	client   *http.Client
+
+	states  map[string]*gossipState
+	mu      sync.RWMutex
+	changed chan struct{}
+}
+
+// NewGossipRegistry creates a registry exchanging state with peers, the
+// internal listener urls of the other nodes
+func NewGossipRegistry(self ClusterNode, peers []string, secret string, interval time.Duration) (*GossipRegistry, error) {
+	if interval <= 0 {
+		interval = defaultGossipInterval
+	}
+
+	var cleaned []string
+	for _, peer := range peers {
+		peer = strings.TrimSuffix(strings.TrimSpace(peer), "/")
+		if peer == "" || peer == strings.TrimSuffix(self.Addr, "/") {
+			continue
+		}
+		if _, err := parseNodeAddr(peer); err != nil {
+			return nil, err
+		}
+		cleaned = append(cleaned, peer)
+	}
+
+	own := &gossipState{Node: self, Incarnation: time.Now().UnixNano()}
+	own.index()
+
+	return &GossipRegistry{
+		self:     self,
+		peers:    cleaned,
+		secret:   secret,
+		interval: interval,
+		client:   &http.Client{Timeout: interval * gossipExpiryRounds / 2},
+		states:   map[string]*gossipState{self.ID: own},
+		changed:  make(chan struct{}, 1),
+	}, nil
+}
+
+func (g *GossipRegistry) Run(ctx context.Context) error {
+	logger := shared.GetLogger("server.cluster")
+	logger.Info().
+		Strs("peers", g.peers).
+		Dur("interval", g.interval).
+		Msg("gossiping with cluster peers")
+
+	ticker := time.NewTicker(g.interval)
+	defer ticker.Stop()
+
+	for {
+		g.round(ctx)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		case <-g.changed:
+		}
+	}
+}
+
+func (g *GossipRegistry) Announce(tunnels []ClusterTunnel) {
+	g.mu.Lock()
+	own := g.states[g.self.ID]
+	own.Tunnels = tunnels
+	own.Heartbeat++
+	own.index()
+	g.mu.Unlock()
+
+	select {
+	case g.changed <- struct{}{}:
+	default:
+	}
+}
+
+func (g *GossipRegistry) Lookup(tunnelID string) (ClusterNode, bool) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	expiry := time.Now().Add(-g.interval * gossipExpiryRounds)
+	for id, state := range g.states {
+		if id == g.self.ID || state.updatedAt.Before(expiry) {
+			continue
+		}
+		if state.tunnels[tunnelID] {
+			return state.Node, true
+		}
+	}
+	return ClusterNode{}, false
+}
+
+func (g *GossipRegistry) LookupHostname(host string) (ClusterNode, string, bool) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	expiry := time.Now().Add(-g.interval * gossipExpiryRounds)
+	for id, state := range g.states {
+		if id == g.self.ID || state.updatedAt.Before(expiry) {
+			continue
+		}
+		if tunnelID, ok := state.hostnames[host]; ok {
+			return state.Node, tunnelID, true
+		}
+	}
+	return ClusterNode{}, "", false
+}
+
+// Nodes returns the nodes currently alive, this one included
+func (g *GossipRegistry) Nodes() []ClusterNode {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	var nodes []ClusterNode
+	for _, state := range g.snapshot() {
+		nodes = append(nodes, state.Node)
+	}
+	return nodes
+}
+
+// round bumps this node's heartbeat and exchanges state with every peer
+func (g *GossipRegistry) round(ctx context.Context) {
+	g.mu.Lock()
+	g.states[g.self.ID].Heartbeat++
+	g.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, peer := range g.peers {
+		wg.Add(1)
+		go func(peer string) {
+			defer wg.Done()
+			if err := g.exchange(ctx, peer); err != nil && ctx.Err() == nil {
+				logger := shared.GetLogger("server.cluster")
+				logger.Debug().Err(err).Str("peer", peer).Msg("gossip exchange failed")
+			}
+		}(peer)
+	}
+	wg.Wait()
+}
+
+func (g *GossipRegistry) exchange(ctx context.Context, peer string) error {
+	g.mu.RLock()
+	body, err := json.Marshal(&gossipMessage{States: g.snapshot()})
+	g.mu.RUnlock()
+	if err != nil {
+		return fmt.Errorf("failed to encode gossip: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, peer+clusterGossipPath, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(clusterAuthHeader, g.secret)
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("peer answered %s", resp.Status)
+	}
+
+	var reply gossipMessage
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxGossipBody)).Decode(&reply); err != nil {
+		return fmt.Errorf("failed to decode gossip reply: %w", err)
+	}
+	g.merge(reply.States)
+	return nil
+}
+
+// ServeHTTP answers a peer's exchange with everything this node knows
+func (g *GossipRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var msg gossipMessage
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxGossipBody)).Decode(&msg); err != nil {
+		http.Error(w, "invalid gossip message", http.StatusBadRequest)
+		return
+	}
+	g.merge(msg.States)
+
+	g.mu.RLock()
+	reply := &gossipMessage{States: g.snapshot()}
+	body, err := json.Marshal(reply)
+	g.mu.RUnlock()
+	if err != nil {
+		http.Error(w, "failed to encode gossip", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// snapshot returns the states worth relaying, expired nodes are left out so
+// they fade from the cluster. callers hold mu.
+func (g *GossipRegistry) snapshot() []*gossipState {
+	expiry := time.Now().Add(-g.interval * gossipExpiryRounds)
+	states := make([]*gossipState, 0, len(g.states))
+	for id, state := range g.states {
+		if id != g.self.ID && state.updatedAt.Before(expiry) {
+			continue
+		}
+		states = append(states, state)
+	}
+	return states
+}
+
+func (g *GossipRegistry) merge(states []*gossipState) {
+	logger := shared.GetLogger("server.cluster")
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+	for _, state := range states {
+		if state == nil || state.Node.ID == "" || state.Node.ID == g.self.ID {
+			continue
+		}
+
+		// an expired node keeps its entry, so a stale copy relayed by a peer
+		// that has not expired it yet does not bring it back
+		current, known := g.states[state.Node.ID]
+		if known && !current.newer(state) {
+			continue
+		}
+		if _, err := parseNodeAddr(state.Node.Addr); err != nil {
+			continue
+		}
+
+		state.updatedAt = now
+		state.index()
+		g.states[state.Node.ID] = state
+
+		if !known || current.Incarnation != state.Incarnation {
+			logger.Info().
+				Str("node_id", state.Node.ID).
+				Str("addr", state.Node.Addr).
+				Int("tunnels", len(state.Tunnels)).
+				Msg("cluster node joined")
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/karol-broda/funnel/shared"
+	"github.com/karol-broda/funnel/version"
+)
+
+// maxCloseReasonSize is the largest close reason that fits in a control frame
+const maxCloseReasonSize = 123
+
+func (s *Server) readHello(conn *websocket.Conn) (*shared.Hello, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(handshakeTimeout)); err != nil {
+		return nil, fmt.Errorf("failed to set handshake deadline: %w", err)
+	}
+
+	var msg shared.Message
+	if err := conn.ReadJSON(&msg); err != nil {
+		return nil, fmt.Errorf("no hello received, this client is too old for this server - please upgrade funnel: %w", err)
+	}
+
+	if msg.Type != "hello" || msg.Hello == nil {
+		return nil, fmt.Errorf("expected hello message, got %q - please upgrade funnel", msg.Type)
+	}
+
+	if err := shared.CheckProtocolVersion(msg.Hello.ProtocolVersion); err != nil {
+		return nil, fmt.Errorf("client %s is incompatible with server %s: %w", msg.Hello.ClientVersion, version.GetVersion(), err)
+	}
+
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, fmt.Errorf("failed to clear handshake deadline: %w", err)
+	}
+
+	return msg.Hello, nil
+}
+
+func (s *Server) buildWelcome(r *http.Request, tunnel *Tunnel, hostnames []string) *shared.Welcome {
+	return &shared.Welcome{
+		TunnelID:        tunnel.ID,
+		PublicURL:       s.PublicURL(r, tunnel.ID),
+		ServerVersion:   version.GetVersion(),
+		ProtocolVersion: shared.ProtocolVersion,
+		Features:        tunnel.features,
+		Hostnames:       hostnames,
+		Limits:          s.Limits(tunnel.timeouts, tunnel.bodyLimits),
+	}
+}
+
+// rejectConnection tells the client why it was refused, both as a message for
+// clients that understand the handshake and as the websocket close reason
+func (s *Server) rejectConnection(conn *websocket.Conn, reason string) {
+	logger := shared.GetLogger("server.handshake")
+
+	deadline := time.Now().Add(5 * time.Second)
+	if err := conn.SetWriteDeadline(deadline); err != nil {
+		logger.Debug().Err(err).Msg("failed to set write deadline for rejection")
+	}
+
+	if err := conn.WriteJSON(&shared.Message{Type: "rejected", Error: reason}); err != nil {
+		logger.Debug().Err(err).Msg("failed to send rejection message")
+	}
+
+	closeReason := reason
+	if len(closeReason) > maxCloseReasonSize {
+		closeReason = closeReason[:maxCloseReasonSize]
+	}
+
+	closeMsg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, closeReason)
+	if err := conn.WriteControl(websocket.CloseMessage, closeMsg, deadline); err != nil && !errors.Is(err, websocket.ErrCloseSent) {
+		logger.Debug().Err(err).Msg("failed to send close frame for rejection")
+	}
+
+	conn.Close()
+}
@@ -0,0 +1,287 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/karol-broda/funnel/shared"
+)
+
+func dialTestServer(t *testing.T, ts *httptest.Server, tunnelID string) *websocket.Conn {
+	t.Helper()
+
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http") + "/?id=" + tunnelID
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("failed to dial test server: %v", err)
+	}
+	return conn
+}
+
+func sendHello(t *testing.T, conn *websocket.Conn, hello *shared.Hello) *shared.Message {
+	t.Helper()
+
+	if err := conn.WriteJSON(&shared.Message{Type: "hello", Hello: hello}); err != nil {
+		t.Fatalf("failed to send hello: %v", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var reply shared.Message
+	if err := conn.ReadJSON(&reply); err != nil {
+		t.Fatalf("failed to read handshake reply: %v", err)
+	}
+	return &reply
+}
+
+// joinTestTunnel connects a fake client offering features and hands every
+// message it receives to handle. id may carry more query parameters, like
+// "app&pool=round_robin".
+func joinTestTunnel(t *testing.T, ts *httptest.Server, id string, features []string, handle func(*websocket.Conn, *shared.Message)) (*websocket.Conn, *shared.Welcome) {
+	t.Helper()
+
+	conn := dialTestServer(t, ts, id)
+	t.Cleanup(func() { conn.Close() })
+
+	reply := sendHello(t, conn, &shared.Hello{
+		ClientVersion:   "test",
+		ProtocolVersion: shared.ProtocolVersion,
+		Features:        features,
+	})
+	if reply.Type != "welcome" {
+		t.Fatalf("expected welcome, got %q (error: %s)", reply.Type, reply.Error)
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	go func() {
+		for {
+			var msg shared.Message
+			if err := conn.ReadJSON(&msg); err != nil {
+				return
+			}
+			handle(conn, &msg)
+		}
+	}()
+	return conn, reply.Welcome
+}
+
+func TestHandshakeWelcome(t *testing.T) {
+	s := NewServer()
+	ts := httptest.NewServer(http.HandlerFunc(s.HandleWebSocket))
+	defer ts.Close()
+
+	conn := dialTestServer(t, ts, "hello-tunnel")
+	defer conn.Close()
+
+	reply := sendHello(t, conn, &shared.Hello{
+		ClientVersion:   "1.2.3",
+		ProtocolVersion: shared.ProtocolVersion,
+		Features:        []string{shared.FeatureBinaryFraming, "teleportation"},
+	})
+
+	if reply.Type != "welcome" {
+		t.Fatalf("expected welcome, got %q (error: %s)", reply.Type, reply.Error)
+	}
+	if reply.Welcome == nil {
+		t.Fatal("welcome payload missing")
+	}
+
+	welcome := reply.Welcome
+	if welcome.TunnelID != "hello-tunnel" {
+		t.Errorf("expected tunnel id hello-tunnel, got %s", welcome.TunnelID)
+	}
+	if welcome.ProtocolVersion != shared.ProtocolVersion {
+		t.Errorf("expected protocol version %d, got %d", shared.ProtocolVersion, welcome.ProtocolVersion)
+	}
+	if len(welcome.Features) != 1 || welcome.Features[0] != shared.FeatureBinaryFraming {
+		t.Errorf("expected only binary framing to be negotiated, got %v", welcome.Features)
+	}
+	if welcome.Limits.RequestTimeoutMs != defaultRequestTimeout.Milliseconds() {
+		t.Errorf("expected request timeout %d, got %d", defaultRequestTimeout.Milliseconds(), welcome.Limits.RequestTimeoutMs)
+	}
+	if welcome.Limits.Timeouts.IdleMs != defaultStreamIdleTimeout.Milliseconds() {
+		t.Errorf("expected stream idle timeout %d, got %d", defaultStreamIdleTimeout.Milliseconds(), welcome.Limits.Timeouts.IdleMs)
+	}
+
+	expectedURL := "http://hello-tunnel." + strings.TrimPrefix(ts.URL, "http://")
+	if welcome.PublicURL != expectedURL {
+		t.Errorf("expected public url %s, got %s", expectedURL, welcome.PublicURL)
+	}
+
+	tunnel, exists := s.GetTunnel("hello-tunnel")
+	if !exists {
+		t.Fatal("expected tunnel to be registered after handshake")
+	}
+	if tunnel.clientVersion != "1.2.3" {
+		t.Errorf("expected client version 1.2.3, got %s", tunnel.clientVersion)
+	}
+	if !tunnel.binaryFraming {
+		t.Error("expected binary framing to be enabled")
+	}
+}
+
+func TestHandshakeNegotiatesTimeouts(t *testing.T) {
+	s := NewServer()
+	if err := s.SetRequestTimeouts(shared.Timeouts{TotalMs: 20000}, 5*time.Minute); err != nil {
+		t.Fatalf("SetRequestTimeouts() error = %v", err)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(s.HandleWebSocket))
+	defer ts.Close()
+
+	conn := dialTestServer(t, ts, "slow-reports")
+	defer conn.Close()
+
+	reply := sendHello(t, conn, &shared.Hello{
+		ClientVersion:   "1.2.3",
+		ProtocolVersion: shared.ProtocolVersion,
+		Timeouts: &shared.TunnelTimeouts{
+			Timeouts: shared.Timeouts{ConnectMs: 2000, TotalMs: 120000},
+			Paths: []shared.PathTimeouts{
+				{Prefix: "/reports", Timeouts: shared.Timeouts{TotalMs: time.Hour.Milliseconds()}},
+				{Prefix: "relative", Timeouts: shared.Timeouts{TotalMs: 1000}},
+			},
+		},
+	})
+	if reply.Type != "welcome" {
+		t.Fatalf("expected welcome, got %q (error: %s)", reply.Type, reply.Error)
+	}
+
+	expected := shared.TunnelTimeouts{
+		Timeouts: shared.Timeouts{ConnectMs: 2000, TotalMs: 120000, IdleMs: defaultStreamIdleTimeout.Milliseconds()},
+		Paths: []shared.PathTimeouts{
+			{Prefix: "/reports", Timeouts: shared.Timeouts{TotalMs: (5 * time.Minute).Milliseconds()}},
+		},
+	}
+	limits := reply.Welcome.Limits
+	if limits.RequestTimeoutMs != 120000 {
+		t.Errorf("expected request timeout 120000, got %d", limits.RequestTimeoutMs)
+	}
+	if len(limits.Timeouts.Paths) != 1 || limits.Timeouts.Timeouts != expected.Timeouts || limits.Timeouts.Paths[0] != expected.Paths[0] {
+		t.Errorf("expected timeouts %+v, got %+v", expected, limits.Timeouts)
+	}
+}
+
+func TestSetRequestTimeoutsValidation(t *testing.T) {
+	s := NewServer()
+	if err := s.SetRequestTimeouts(shared.Timeouts{TotalMs: -1}, 0); err == nil {
+		t.Error("expected an error for a negative timeout")
+	}
+	if err := s.SetRequestTimeouts(shared.Timeouts{TotalMs: time.Hour.Milliseconds()}, time.Minute); err == nil {
+		t.Error("expected an error for a default above the maximum")
+	}
+}
+
+func TestHandshakeRejectsIncompatibleVersion(t *testing.T) {
+	s := NewServer()
+	ts := httptest.NewServer(http.HandlerFunc(s.HandleWebSocket))
+	defer ts.Close()
+
+	conn := dialTestServer(t, ts, "old-tunnel")
+	defer conn.Close()
+
+	reply := sendHello(t, conn, &shared.Hello{
+		ClientVersion:   "0.0.1",
+		ProtocolVersion: shared.MinProtocolVersion - 1,
+	})
+
+	if reply.Type != "rejected" {
+		t.Fatalf("expected rejected, got %q", reply.Type)
+	}
+	if !strings.Contains(reply.Error, "upgrade") {
+		t.Errorf("expected rejection to tell the user to upgrade, got %q", reply.Error)
+	}
+
+	_, _, err := conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Errorf("expected policy violation close, got %v", err)
+	}
+
+	if s.TunnelExists("old-tunnel") {
+		t.Error("rejected client should not register a tunnel")
+	}
+}
+
+func TestHandshakeRejectsMissingHello(t *testing.T) {
+	s := NewServer()
+	ts := httptest.NewServer(http.HandlerFunc(s.HandleWebSocket))
+	defer ts.Close()
+
+	conn := dialTestServer(t, ts, "no-hello")
+	defer conn.Close()
+
+	if err := conn.WriteJSON(&shared.Message{Type: "ping"}); err != nil {
+		t.Fatalf("failed to write message: %v", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var reply shared.Message
+	if err := conn.ReadJSON(&reply); err != nil {
+		t.Fatalf("failed to read reply: %v", err)
+	}
+
+	if reply.Type != "rejected" {
+		t.Errorf("expected rejected, got %q", reply.Type)
+	}
+}
+
+func TestPublicURL(t *testing.T) {
+	tests := []struct {
+		name     string
+		baseURL  string
+		host     string
+		proto    string
+		expected string
+	}{
+		{
+			name:     "derived from request host",
+			host:     "tunnel.example.com:8080",
+			expected: "http://demo.tunnel.example.com:8080",
+		},
+		{
+			name:     "forwarded proto is honored",
+			host:     "tunnel.example.com",
+			proto:    "https",
+			expected: "https://demo.tunnel.example.com",
+		},
+		{
+			name:     "configured base url wins",
+			baseURL:  "https://funnel.example.org",
+			host:     "10.0.0.5:8080",
+			expected: "https://demo.funnel.example.org",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer()
+			if tt.baseURL != "" {
+				if err := s.SetPublicBaseURL(tt.baseURL); err != nil {
+					t.Fatalf("failed to set public url: %v", err)
+				}
+			}
+
+			req := httptest.NewRequest("GET", "http://"+tt.host+"/", nil)
+			req.Host = tt.host
+			if tt.proto != "" {
+				req.Header.Set("X-Forwarded-Proto", tt.proto)
+			}
+
+			if got := s.PublicURL(req, "demo"); got != tt.expected {
+				t.Errorf("expected %s, got %s", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestSetPublicBaseURLValidation(t *testing.T) {
+	s := NewServer()
+
+	for _, raw := range []string{"ftp://example.com", "https://", "://bad"} {
+		if err := s.SetPublicBaseURL(raw); err == nil {
+			t.Errorf("expected error for %q", raw)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+
+	"github.com/karol-broda/funnel/shared"
+)
+
+const (
+	// ClientCertOptional authenticates clients by certificate when they present
+	// one and falls back to tokens otherwise
+	ClientCertOptional = "optional"
+	// ClientCertRequired only lets clients with a verified certificate open a tunnel
+	ClientCertRequired = "require"
+
+	ClientIdentityCN    = "cn"
+	ClientIdentityDNS   = "dns"
+	ClientIdentityEmail = "email"
+	ClientIdentityURI   = "uri"
+)
+
+var ErrClientCertRequired = errors.New("client certificate required")
+
+// ClientCertAuth authenticates tunnel clients with certificates signed by a
+// configured ca. the identity taken from the certificate is scoped exactly like
+// a token name, so reservations for that name apply to the certificate too.
+type ClientCertAuth struct {
+	mode         string
+	identityFrom string
+	roots        *x509.CertPool
+}
+
+func NewClientCertAuth(mode, caFile, identityFrom string) (*ClientCertAuth, error) {
+	if mode != ClientCertOptional && mode != ClientCertRequired {
+		return nil, fmt.Errorf("unsupported client certificate mode %q, expected %s or %s", mode, ClientCertOptional, ClientCertRequired)
+	}
+
+	switch identityFrom {
+	case ClientIdentityCN, ClientIdentityDNS, ClientIdentityEmail, ClientIdentityURI:
+	default:
+		return nil, fmt.Errorf("unsupported client certificate identity %q, expected cn, dns, email or uri", identityFrom)
+	}
+
+	caPEM, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client ca: %w", err)
+	}
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificates found in client ca %s", caFile)
+	}
+
+	return &ClientCertAuth{
+		mode:         mode,
+		identityFrom: identityFrom,
+		roots:        roots,
+	}, nil
+}
+
+func (a *ClientCertAuth) Required() bool {
+	return a.mode == ClientCertRequired
+}
+
+// ConfigureTLS asks for client certificates on handshakes for which
+// requestFor returns true. tunnel hosts are usually left out so browsers
+// visiting a tunnel never see a certificate prompt. config should list every
+// alpn protocol, see TLSNextProtos, http/1.1 is added when it does not.
+func (a *ClientCertAuth) ConfigureTLS(config *tls.Config, requestFor func(serverName string) bool) {
+	nextProtos := config.NextProtos
+	if !slices.Contains(nextProtos, "http/1.1") {
+		nextProtos = append(slices.Clone(nextProtos), "http/1.1")
+	}
+
+	config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if !requestFor(shared.NormalizeHostname(hello.ServerName)) {
+			return nil, nil
+		}
+
+		clientConfig := config.Clone()
+		clientConfig.GetConfigForClient = nil
+		clientConfig.NextProtos = nextProtos
+		clientConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		clientConfig.ClientCAs = a.roots
+		return clientConfig, nil
+	}
+}
+
+// Identity returns the identity of a verified client certificate
+func (a *ClientCertAuth) Identity(state *tls.ConnectionState) (string, bool, error) {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return "", false, nil
+	}
+
+	identity, err := certificateIdentity(state.VerifiedChains[0][0], a.identityFrom)
+	if err != nil {
+		return "", false, err
+	}
+	return identity, true, nil
+}
+
+func certificateIdentity(cert *x509.Certificate, from string) (string, error) {
+	var identity string
+	switch from {
+	case ClientIdentityCN:
+		identity = cert.Subject.CommonName
+	case ClientIdentityDNS:
+		if len(cert.DNSNames) > 0 {
+			identity = cert.DNSNames[0]
+		}
+	case ClientIdentityEmail:
+		if len(cert.EmailAddresses) > 0 {
+			identity = cert.EmailAddresses[0]
+		}
+	case ClientIdentityURI:
+		if len(cert.URIs) > 0 {
+			identity = cert.URIs[0].String()
+		}
+	}
+
+	if identity == "" {
+		return "", fmt.Errorf("client certificate has no %s to use as identity", from)
+	}
+	return identity, nil
+}
+
+// SetClientCertAuth enables client certificate authentication, nil disables it
+func (s *Server) SetClientCertAuth(auth *ClientCertAuth) {
+	s.clientCertAuth = auth
+}
+
+// IsServerHost reports whether host addresses the server itself rather than a
+// tunnel, i.e. a configured base domain or an ip address
+func (s *Server) IsServerHost(host string) bool {
+	if host == "" || net.ParseIP(host) != nil || len(s.baseDomains) == 0 {
+		return true
+	}
+
+	for _, domain := range s.baseDomains {
+		if host == domain {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticate identifies a tunnel client by certificate or token. the returned
+// identity is empty when authentication is disabled.
+func (s *Server) authenticate(r *http.Request) (identity string, method string, err error) {
+	if s.clientCertAuth != nil {
+		identity, ok, err := s.clientCertAuth.Identity(r.TLS)
+		if err != nil {
+			return "", "", err
+		}
+		if ok {
+			return identity, "client_certificate", nil
+		}
+		if s.clientCertAuth.Required() {
+			return "", "", ErrClientCertRequired
+		}
+	}
+
+	tokenRecord, valid := s.ValidateToken(extractToken(r))
+	if !valid {
+		return "", "", errors.New("invalid or missing token")
+	}
+	if tokenRecord == nil {
+		return "", "", nil
+	}
+	return tokenRecord.Name, "token", nil
+}
@@ -0,0 +1,261 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/karol-broda/funnel/shared"
+)
+
+type testClientCA struct {
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	caFile string
+}
+
+func newTestClientCA(t *testing.T) *testClientCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate ca key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test client ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create ca: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+
+	caFile := filepath.Join(t.TempDir(), "client-ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatalf("failed to write ca: %v", err)
+	}
+
+	return &testClientCA{cert: cert, key: key, caFile: caFile}
+}
+
+func (ca *testClientCA) issue(t *testing.T, template *x509.Certificate) tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate client key: %v", err)
+	}
+	template.SerialNumber = big.NewInt(2)
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("failed to issue client certificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestCertificateIdentity(t *testing.T) {
+	spiffe, _ := url.Parse("spiffe://example.com/ci")
+	cert := &x509.Certificate{
+		Subject:        pkix.Name{CommonName: "ci-runner"},
+		DNSNames:       []string{"runner.example.com"},
+		EmailAddresses: []string{"ci@example.com"},
+		URIs:           []*url.URL{spiffe},
+	}
+
+	tests := []struct {
+		from     string
+		expected string
+	}{
+		{ClientIdentityCN, "ci-runner"},
+		{ClientIdentityDNS, "runner.example.com"},
+		{ClientIdentityEmail, "ci@example.com"},
+		{ClientIdentityURI, "spiffe://example.com/ci"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.from, func(t *testing.T) {
+			identity, err := certificateIdentity(cert, tt.from)
+			if err != nil {
+				t.Fatalf("certificateIdentity() error = %v", err)
+			}
+			if identity != tt.expected {
+				t.Errorf("certificateIdentity() = %q, want %q", identity, tt.expected)
+			}
+		})
+	}
+
+	if _, err := certificateIdentity(&x509.Certificate{}, ClientIdentityEmail); err == nil {
+		t.Error("expected an error for a certificate without the identity field")
+	}
+}
+
+func TestNewClientCertAuth_Invalid(t *testing.T) {
+	ca := newTestClientCA(t)
+
+	if _, err := NewClientCertAuth("sometimes", ca.caFile, ClientIdentityCN); err == nil {
+		t.Error("expected an error for an unknown mode")
+	}
+	if _, err := NewClientCertAuth(ClientCertRequired, ca.caFile, "serial"); err == nil {
+		t.Error("expected an error for an unknown identity field")
+	}
+	if _, err := NewClientCertAuth(ClientCertRequired, filepath.Join(t.TempDir(), "missing.pem"), ClientIdentityCN); err == nil {
+		t.Error("expected an error for a missing ca file")
+	}
+}
+
+func TestWebSocketClientCertificate(t *testing.T) {
+	ca := newTestClientCA(t)
+	clientCert := ca.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "ci-runner"}})
+
+	tests := []struct {
+		name       string
+		mode       string
+		request    bool
+		clientCert *tls.Certificate
+		tunnelID   string
+		expectOK   bool
+	}{
+		{"required with certificate", ClientCertRequired, true, &clientCert, "ci-tunnel", true},
+		{"required without certificate", ClientCertRequired, true, nil, "ci-tunnel", false},
+		{"required on a host that does not ask", ClientCertRequired, false, &clientCert, "ci-tunnel", false},
+		{"optional without certificate", ClientCertOptional, true, nil, "anon-tunnel", true},
+		{"reserved id owned by the certificate identity", ClientCertRequired, true, &clientCert, "owned", true},
+		{"reserved id owned by someone else", ClientCertRequired, true, &clientCert, "taken", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth, err := NewClientCertAuth(tt.mode, ca.caFile, ClientIdentityCN)
+			if err != nil {
+				t.Fatalf("NewClientCertAuth() error = %v", err)
+			}
+
+			reservations, err := NewReservationStore(filepath.Join(t.TempDir(), "reservations.json"))
+			if err != nil {
+				t.Fatalf("failed to create reservation store: %v", err)
+			}
+			reservations.Add("owned", "ci-runner")
+			reservations.Add("taken", "someone-else")
+
+			s := NewServer()
+			s.SetClientCertAuth(auth)
+			s.SetReservationStore(reservations)
+
+			ts := httptest.NewUnstartedServer(http.HandlerFunc(s.HandleWebSocket))
+			ts.TLS = &tls.Config{Certificates: []tls.Certificate{*testCertificate(t, "example.com", time.Now().Add(time.Hour))}}
+			auth.ConfigureTLS(ts.TLS, func(string) bool { return tt.request })
+			ts.StartTLS()
+			defer ts.Close()
+
+			clientTLS := &tls.Config{InsecureSkipVerify: true}
+			if tt.clientCert != nil {
+				clientTLS.Certificates = []tls.Certificate{*tt.clientCert}
+			}
+			dialer := websocket.Dialer{TLSClientConfig: clientTLS}
+
+			wsURL := "wss" + strings.TrimPrefix(ts.URL, "https") + "/?id=" + tt.tunnelID
+			conn, resp, err := dialer.Dial(wsURL, nil)
+			if !tt.expectOK {
+				if err == nil {
+					conn.Close()
+					t.Fatal("expected the upgrade to be refused")
+				}
+				if resp == nil {
+					t.Fatalf("expected an http error response, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to dial: %v", err)
+			}
+			defer conn.Close()
+
+			reply := sendHello(t, conn, &shared.Hello{ProtocolVersion: shared.ProtocolVersion})
+			if reply.Type != "welcome" {
+				t.Fatalf("expected welcome, got %q (error: %s)", reply.Type, reply.Error)
+			}
+		})
+	}
+}
+
+func TestClientCertAuth_ALPN(t *testing.T) {
+	ca := newTestClientCA(t)
+	auth, err := NewClientCertAuth(ClientCertOptional, ca.caFile, ClientIdentityCN)
+	if err != nil {
+		t.Fatalf("NewClientCertAuth() error = %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		serverProto []string
+		clientProto []string
+		expected    string
+	}{
+		{"browser", TLSNextProtos(), []string{"h2", "http/1.1"}, "h2"},
+		{"http/1.1 only", TLSNextProtos(), []string{"http/1.1"}, "http/1.1"},
+		{"no alpn", TLSNextProtos(), nil, ""},
+		{"server lists only acme", []string{ACMETLSProtocol}, []string{"h2", "http/1.1"}, "http/1.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("failed to listen: %v", err)
+			}
+			tlsConfig := &tls.Config{
+				Certificates: []tls.Certificate{*testCertificate(t, "example.com", time.Now().Add(time.Hour))},
+				NextProtos:   tt.serverProto,
+			}
+			auth.ConfigureTLS(tlsConfig, func(string) bool { return true })
+
+			// the http server adds the http protocols to its own copy of the
+			// config, which is not the one client configs are cloned from
+			httpServer := &http.Server{
+				Handler:   http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+				TLSConfig: tlsConfig,
+			}
+			go httpServer.ServeTLS(listener, "", "")
+			defer httpServer.Close()
+
+			conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{
+				InsecureSkipVerify: true,
+				ServerName:         "example.com",
+				NextProtos:         tt.clientProto,
+			})
+			if err != nil {
+				t.Fatalf("handshake failed: %v", err)
+			}
+			defer conn.Close()
+
+			if got := conn.ConnectionState().NegotiatedProtocol; got != tt.expected {
+				t.Errorf("negotiated %q, want %q", got, tt.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/karol-broda/funnel/shared"
+)
+
+var (
+	ErrTunnelIDReserved = errors.New("tunnel id is reserved")
+	ErrTunnelIDBlocked  = errors.New("tunnel id is not allowed")
+)
+
+// DefaultReservedNames are subdomains that commonly belong to the operator's own services
+var DefaultReservedNames = []string{
+	"www", "api", "admin", "app", "auth", "login", "mail", "smtp", "imap", "pop",
+	"ftp", "ns1", "ns2", "dns", "status", "dashboard", "console", "static", "cdn",
+	"assets", "support", "help", "docs", "blog", "billing", "funnel", "tunnel",
+}
+
+const maxGenerateAttempts = 16
+
+// NamePolicy decides which tunnel ids clients may claim
+type NamePolicy struct {
+	reserved map[string]struct{}
+	blocked  []*regexp.Regexp
+}
+
+func NewNamePolicy(reserved []string, blockedPatterns []string) (*NamePolicy, error) {
+	logger := shared.GetLogger("server.names")
+
+	policy := &NamePolicy{
+		reserved: make(map[string]struct{}, len(reserved)),
+		blocked:  make([]*regexp.Regexp, 0, len(blockedPatterns)),
+	}
+
+	for _, name := range reserved {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		policy.reserved[name] = struct{}{}
+	}
+
+	for _, pattern := range blockedPatterns {
+		if strings.TrimSpace(pattern) == "" {
+			continue
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid blocked name pattern %q: %w", pattern, err)
+		}
+		policy.blocked = append(policy.blocked, re)
+	}
+
+	logger.Info().
+		Int("reserved_names", len(policy.reserved)).
+		Int("blocked_patterns", len(policy.blocked)).
+		Msg("tunnel name policy configured")
+
+	return policy, nil
+}
+
+// Check returns ErrTunnelIDReserved or ErrTunnelIDBlocked if the id may not be claimed
+func (p *NamePolicy) Check(id string) error {
+	if p == nil {
+		return nil
+	}
+
+	if _, ok := p.reserved[id]; ok {
+		return ErrTunnelIDReserved
+	}
+
+	for _, re := range p.blocked {
+		if re.MatchString(id) {
+			return ErrTunnelIDBlocked
+		}
+	}
+
+	return nil
+}
+
+// checkTunnelID applies the name policy and reservations to a requested id.
+// an explicit reservation for the token overrides the reserved name list.
+func (s *Server) checkTunnelID(id, tokenName string) error {
+	if s.reservations != nil {
+		if owner, ok := s.reservations.Owner(id); ok {
+			if tokenName != "" && owner == tokenName {
+				return nil
+			}
+			return ErrTunnelIDReserved
+		}
+	}
+
+	return s.namePolicy.Check(id)
+}
+
+// generateTunnelID picks a random id that is free and allowed for the token
+func (s *Server) generateTunnelID(tokenName string) (string, error) {
+	for attempt := 0; attempt < maxGenerateAttempts; attempt++ {
+		id, err := shared.GenerateDomainSafeID()
+		if err != nil {
+			return "", err
+		}
+		if s.checkTunnelID(id, tokenName) != nil {
+			continue
+		}
+		if s.TunnelExists(id) {
+			continue
+		}
+		if _, owned := s.clusterOwner(id); owned {
+			continue
+		}
+		return id, nil
+	}
+	return "", fmt.Errorf("failed to generate a free tunnel id after %d attempts", maxGenerateAttempts)
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/karol-broda/funnel/shared"
+)
+
+func TestNamePolicy_Check(t *testing.T) {
+	policy, err := NewNamePolicy([]string{"www", " Admin "}, []string{"^paypal", "bank$"})
+	if err != nil {
+		t.Fatalf("failed to create name policy: %v", err)
+	}
+
+	tests := []struct {
+		id       string
+		expected error
+	}{
+		{id: "my-app", expected: nil},
+		{id: "www", expected: ErrTunnelIDReserved},
+		{id: "admin", expected: ErrTunnelIDReserved},
+		{id: "paypal-login", expected: ErrTunnelIDBlocked},
+		{id: "my-bank", expected: ErrTunnelIDBlocked},
+		{id: "bankrupt", expected: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.id, func(t *testing.T) {
+			if err := policy.Check(tt.id); !errors.Is(err, tt.expected) {
+				t.Errorf("Check(%q) = %v, want %v", tt.id, err, tt.expected)
+			}
+		})
+	}
+}
+
+func TestNewNamePolicy_InvalidPattern(t *testing.T) {
+	if _, err := NewNamePolicy(nil, []string{"("}); err == nil {
+		t.Error("expected error for invalid pattern")
+	}
+}
+
+func TestServer_checkTunnelID(t *testing.T) {
+	s := NewServer()
+
+	policy, err := NewNamePolicy([]string{"api"}, nil)
+	if err != nil {
+		t.Fatalf("failed to create name policy: %v", err)
+	}
+	s.SetNamePolicy(policy)
+
+	reservations, err := NewReservationStore("")
+	if err != nil {
+		t.Fatalf("failed to create reservation store: %v", err)
+	}
+	reservations.Add("demo", "team-a")
+	reservations.Add("api", "platform")
+	s.SetReservationStore(reservations)
+
+	tests := []struct {
+		name      string
+		id        string
+		tokenName string
+		expected  error
+	}{
+		{name: "unreserved id", id: "free", tokenName: "team-a", expected: nil},
+		{name: "owner claims reservation", id: "demo", tokenName: "team-a", expected: nil},
+		{name: "other token", id: "demo", tokenName: "team-b", expected: ErrTunnelIDReserved},
+		{name: "anonymous client", id: "demo", tokenName: "", expected: ErrTunnelIDReserved},
+		{name: "reservation overrides reserved name", id: "api", tokenName: "platform", expected: nil},
+		{name: "reserved name", id: "api", tokenName: "team-a", expected: ErrTunnelIDReserved},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := s.checkTunnelID(tt.id, tt.tokenName); !errors.Is(err, tt.expected) {
+				t.Errorf("checkTunnelID(%q, %q) = %v, want %v", tt.id, tt.tokenName, err, tt.expected)
+			}
+		})
+	}
+}
+
+func TestWebSocketGeneratedTunnelID(t *testing.T) {
+	s := NewServer()
+	s.SetGenerateIDs(true)
+	ts := httptest.NewServer(http.HandlerFunc(s.HandleWebSocket))
+	defer ts.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http") + "/"
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("failed to dial test server: %v", err)
+	}
+	defer conn.Close()
+
+	reply := sendHello(t, conn, &shared.Hello{ProtocolVersion: shared.ProtocolVersion})
+	if reply.Type != "welcome" {
+		t.Fatalf("expected welcome, got %q (error: %s)", reply.Type, reply.Error)
+	}
+
+	id := reply.Welcome.TunnelID
+	if err := shared.ValidateTunnelID(id); err != nil {
+		t.Errorf("server assigned invalid tunnel id %q: %v", id, err)
+	}
+	if !s.TunnelExists(id) {
+		t.Errorf("expected tunnel %q to be registered", id)
+	}
+	if !strings.HasPrefix(reply.Welcome.PublicURL, "http://"+id+".") {
+		t.Errorf("public url %s does not use assigned id", reply.Welcome.PublicURL)
+	}
+}
+
+func TestWebSocketReservedTunnelID(t *testing.T) {
+	s := NewServer()
+
+	policy, err := NewNamePolicy(DefaultReservedNames, nil)
+	if err != nil {
+		t.Fatalf("failed to create name policy: %v", err)
+	}
+	s.SetNamePolicy(policy)
+
+	req := httptest.NewRequest("GET", "/?id=admin", nil)
+	req.Header.Set("Connection", "upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+
+	w := httptest.NewRecorder()
+	s.HandleWebSocket(w, req)
+
+	if w.Code != http.StatusForbidden {
+		t.Errorf("HandleWebSocket() status = %v, want %v", w.Code, http.StatusForbidden)
+	}
+	if !strings.Contains(w.Body.String(), "reserved") {
+		t.Errorf("HandleWebSocket() body = %q, want to mention reservation", w.Body.String())
+	}
+}
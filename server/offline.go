@@ -0,0 +1,178 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/karol-broda/funnel/shared"
+)
+
+const defaultOfflineRetryAfter = 30 * time.Second
+
+const (
+	UpstreamHealthy   = "healthy"
+	UpstreamUnhealthy = "unhealthy"
+	UpstreamUnknown   = "unknown"
+)
+
+const defaultOfflineTemplate = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta http-equiv="refresh" content="{{.RetryAfter}}">
+<title>{{.Host}} is offline</title>
+<style>
+body { font-family: system-ui, sans-serif; background: #0b0b0f; color: #e4e4e7; display: flex; min-height: 100vh; margin: 0; align-items: center; justify-content: center; }
+main { max-width: 32rem; padding: 2rem; }
+h1 { font-size: 1.5rem; margin: 0 0 1rem; }
+p { color: #a1a1aa; line-height: 1.5; }
+code { color: #e4e4e7; }
+footer { margin-top: 2rem; font-size: 0.8rem; color: #52525b; }
+</style>
+</head>
+<body>
+<main>
+<h1>{{.Host}} is offline</h1>
+<p>the service behind this tunnel is not responding right now. this page will reload in {{.RetryAfter}} seconds.</p>
+{{if .Status}}<p>last health check returned <code>{{.Status}}</code>.</p>{{else}}<p>last health check could not reach it.</p>{{end}}
+<footer>funnel</footer>
+</main>
+</body>
+</html>
+`
+
+// OfflinePage is served instead of forwarding requests to a tunnel whose local
+// service is reported unhealthy by the client
+type OfflinePage struct {
+	template     *template.Template
+	retryAfter   time.Duration
+	exposeErrors bool
+}
+
+// offlinePageData is what custom offline page templates can use. Error names
+// the tunnel owner's local addresses and is empty unless errors are exposed.
+type offlinePageData struct {
+	TunnelID   string
+	Host       string
+	Status     int
+	Error      string
+	Since      time.Time
+	RetryAfter int
+}
+
+// NewOfflinePage parses an html/template offline page, the built-in page is
+// used when templatePath is empty
+func NewOfflinePage(templatePath string, retryAfter time.Duration) (*OfflinePage, error) {
+	if retryAfter <= 0 {
+		retryAfter = defaultOfflineRetryAfter
+	}
+
+	source := defaultOfflineTemplate
+	if templatePath != "" {
+		data, err := os.ReadFile(templatePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read offline page %s: %w", templatePath, err)
+		}
+		source = string(data)
+	}
+
+	tmpl, err := template.New("offline").Parse(source)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse offline page: %w", err)
+	}
+
+	return &OfflinePage{template: tmpl, retryAfter: retryAfter}, nil
+}
+
+// SetExposeErrors passes the error of the last health check, like a refused
+// connection to a local address, to the template as .Error. the built-in page
+// never shows it.
+func (p *OfflinePage) SetExposeErrors(expose bool) {
+	p.exposeErrors = expose
+}
+
+func defaultOfflinePage() *OfflinePage {
+	page, err := NewOfflinePage("", defaultOfflineRetryAfter)
+	if err != nil {
+		panic(err)
+	}
+	return page
+}
+
+// serve writes a 503 with Retry-After, as html for browsers and plain text otherwise
+func (p *OfflinePage) serve(w http.ResponseWriter, r *http.Request, tunnel *Tunnel) {
+	health, since := tunnel.UpstreamHealth()
+	retryAfter := int(p.retryAfter.Round(time.Second) / time.Second)
+
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	w.Header().Set("Cache-Control", "no-store")
+
+	if !strings.Contains(r.Header.Get("Accept"), "text/html") {
+		http.Error(w, "tunnel "+tunnel.ID+" is offline: the local service is unhealthy", http.StatusServiceUnavailable)
+		return
+	}
+
+	data := offlinePageData{
+		TunnelID:   tunnel.ID,
+		Host:       r.Host,
+		Since:      since,
+		RetryAfter: retryAfter,
+	}
+	if health != nil {
+		data.Status = health.Status
+		if p.exposeErrors {
+			data.Error = health.Error
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := p.template.Execute(&buf, data); err != nil {
+		logger := shared.GetTunnelLogger("server.offline", tunnel.ID)
+		logger.Error().Err(err).Msg("failed to render offline page")
+		http.Error(w, "tunnel "+tunnel.ID+" is offline", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write(buf.Bytes())
+}
+
+// setUpstreamHealth records the health of the local service reported by the client
+func (t *Tunnel) setUpstreamHealth(health *shared.Health) {
+	t.healthMu.Lock()
+	defer t.healthMu.Unlock()
+
+	if t.health == nil || t.health.Healthy != health.Healthy {
+		t.healthChangedAt = time.Now()
+	}
+	t.health = health
+}
+
+// UpstreamHealth returns the last reported health of the local service and
+// when it last changed, nil when the client never reported one
+func (t *Tunnel) UpstreamHealth() (*shared.Health, time.Time) {
+	t.healthMu.RLock()
+	defer t.healthMu.RUnlock()
+	return t.health, t.healthChangedAt
+}
+
+// UpstreamStatus is healthy, unhealthy or unknown when the client does not check health
+func (t *Tunnel) UpstreamStatus() string {
+	health, _ := t.UpstreamHealth()
+	switch {
+	case health == nil:
+		return UpstreamUnknown
+	case health.Healthy:
+		return UpstreamHealthy
+	default:
+		return UpstreamUnhealthy
+	}
+}
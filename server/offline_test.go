@@ -0,0 +1,182 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/karol-broda/funnel/shared"
+)
+
+func TestTunnelRouter_OfflinePage(t *testing.T) {
+	tests := []struct {
+		name           string
+		health         *shared.Health
+		accept         string
+		expectedStatus int
+		expectedType   string
+		expectedBody   string
+	}{
+		{
+			name:           "unknown health is forwarded",
+			health:         nil,
+			accept:         "text/html",
+			expectedStatus: http.StatusBadGateway,
+		},
+		{
+			name:           "healthy is forwarded",
+			health:         &shared.Health{Healthy: true, Status: 200},
+			accept:         "text/html",
+			expectedStatus: http.StatusBadGateway,
+		},
+		{
+			name:           "unhealthy browser gets the html page",
+			health:         &shared.Health{Status: 500},
+			accept:         "text/html,application/xhtml+xml",
+			expectedStatus: http.StatusServiceUnavailable,
+			expectedType:   "text/html; charset=utf-8",
+			expectedBody:   "myapp.tunnel.example.com is offline",
+		},
+		{
+			name:           "unhealthy api client gets plain text",
+			health:         &shared.Health{Error: "connection refused"},
+			accept:         "application/json",
+			expectedStatus: http.StatusServiceUnavailable,
+			expectedType:   "text/plain; charset=utf-8",
+			expectedBody:   "tunnel myapp is offline",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := NewServer()
+			if err := server.SetBaseDomains([]string{"tunnel.example.com"}); err != nil {
+				t.Fatalf("SetBaseDomains() error = %v", err)
+			}
+			router := NewTunnelRouter(server)
+
+			// a tunnel without a connection fails fast with 502 once forwarded
+			tunnel := server.AddTunnel("myapp", nil, nil)
+			if tt.health != nil {
+				tunnel.setUpstreamHealth(tt.health)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "http://myapp.tunnel.example.com/", nil)
+			req.Header.Set("Accept", tt.accept)
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+
+			if rec.Code != tt.expectedStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.expectedStatus)
+			}
+			if tt.expectedStatus != http.StatusServiceUnavailable {
+				return
+			}
+			if got := rec.Header().Get("Retry-After"); got != "30" {
+				t.Errorf("Retry-After = %q, want 30", got)
+			}
+			if got := rec.Header().Get("Content-Type"); got != tt.expectedType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.expectedType)
+			}
+			if !strings.Contains(rec.Body.String(), tt.expectedBody) {
+				t.Errorf("body %q does not contain %q", rec.Body.String(), tt.expectedBody)
+			}
+		})
+	}
+}
+
+func TestNewOfflinePage_Custom(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "offline.html")
+	template := `<h1>{{.TunnelID}} is down for maintenance</h1><p>status {{.Status}}, back in {{.RetryAfter}}s</p>`
+	if err := os.WriteFile(path, []byte(template), 0644); err != nil {
+		t.Fatalf("failed to write template: %v", err)
+	}
+
+	page, err := NewOfflinePage(path, 2*time.Minute)
+	if err != nil {
+		t.Fatalf("NewOfflinePage() error = %v", err)
+	}
+
+	tunnel := &Tunnel{ID: "myapp"}
+	tunnel.setUpstreamHealth(&shared.Health{Status: 502})
+
+	req := httptest.NewRequest(http.MethodGet, "http://myapp.tunnel.example.com/", nil)
+	req.Header.Set("Accept", "text/html")
+	rec := httptest.NewRecorder()
+	page.serve(rec, req, tunnel)
+
+	expected := "<h1>myapp is down for maintenance</h1><p>status 502, back in 120s</p>"
+	if rec.Body.String() != expected {
+		t.Errorf("body = %q, want %q", rec.Body.String(), expected)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "120" {
+		t.Errorf("Retry-After = %q, want 120", got)
+	}
+
+	if _, err := NewOfflinePage(filepath.Join(t.TempDir(), "missing.html"), 0); err == nil {
+		t.Error("expected an error for a missing template")
+	}
+}
+
+func TestOfflinePage_HealthErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "offline.html")
+	if err := os.WriteFile(path, []byte(`error: {{.Error}}`), 0644); err != nil {
+		t.Fatalf("failed to write template: %v", err)
+	}
+	custom, err := NewOfflinePage(path, 0)
+	if err != nil {
+		t.Fatalf("NewOfflinePage() error = %v", err)
+	}
+
+	tunnel := &Tunnel{ID: "myapp"}
+	tunnel.setUpstreamHealth(&shared.Health{Error: "dial tcp 127.0.0.1:3000: connect: connection refused"})
+
+	render := func(page *OfflinePage) string {
+		req := httptest.NewRequest(http.MethodGet, "http://myapp.tunnel.example.com/", nil)
+		req.Header.Set("Accept", "text/html")
+		rec := httptest.NewRecorder()
+		page.serve(rec, req, tunnel)
+		return rec.Body.String()
+	}
+
+	// the probe error names the owner's local addresses
+	if body := render(defaultOfflinePage()); strings.Contains(body, "127.0.0.1") {
+		t.Errorf("built-in page shows the health check error: %q", body)
+	}
+	if body := render(custom); body != "error: " {
+		t.Errorf("custom page got the error without it being exposed: %q", body)
+	}
+
+	custom.SetExposeErrors(true)
+	if body := render(custom); !strings.Contains(body, "127.0.0.1:3000") {
+		t.Errorf("custom page = %q, want the exposed error", body)
+	}
+}
+
+func TestTunnel_UpstreamStatus(t *testing.T) {
+	tunnel := &Tunnel{ID: "myapp"}
+	if got := tunnel.UpstreamStatus(); got != UpstreamUnknown {
+		t.Errorf("UpstreamStatus() = %q, want %q", got, UpstreamUnknown)
+	}
+
+	tunnel.setUpstreamHealth(&shared.Health{Error: "connection refused"})
+	_, unhealthySince := tunnel.UpstreamHealth()
+	if got := tunnel.UpstreamStatus(); got != UpstreamUnhealthy {
+		t.Errorf("UpstreamStatus() = %q, want %q", got, UpstreamUnhealthy)
+	}
+
+	// repeated reports of the same state keep the time it changed
+	tunnel.setUpstreamHealth(&shared.Health{Error: "timeout"})
+	if _, since := tunnel.UpstreamHealth(); !since.Equal(unhealthySince) {
+		t.Errorf("changed at moved from %v to %v without a state change", unhealthySince, since)
+	}
+
+	tunnel.setUpstreamHealth(&shared.Health{Healthy: true, Status: 204})
+	if got := tunnel.UpstreamStatus(); got != UpstreamHealthy {
+		t.Errorf("UpstreamStatus() = %q, want %q", got, UpstreamHealthy)
+	}
+}
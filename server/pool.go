@@ -0,0 +1,252 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+	"github.com/karol-broda/funnel/shared"
+)
+
+// poolCookie pins a visitor to one member of a sticky_cookie pool
+const poolCookie = "funnel_pool"
+
+var (
+	ErrTunnelIDInUse = errors.New("tunnel id already in use")
+	ErrPoolOwner     = errors.New("tunnel pool belongs to another token")
+	ErrPoolStrategy  = errors.New("tunnel pool uses a different strategy")
+)
+
+// idempotentMethods can be sent to another pool member after the member that
+// received them disconnected without answering
+var idempotentMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+	http.MethodTrace:   true,
+	http.MethodPut:     true,
+	http.MethodDelete:  true,
+}
+
+// TunnelPool is a tunnel id served by several clients, e.g. replicas of one
+// service. members join with the same id and token, requests are spread
+// across them and a member leaves when its client disconnects.
+type TunnelPool struct {
+	ID       string
+	Strategy string
+	owner    string
+
+	members []*Tunnel
+	next    uint64
+	mu      sync.RWMutex
+}
+
+// Members returns the connected members in join order
+func (p *TunnelPool) Members() []*Tunnel {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return append([]*Tunnel(nil), p.members...)
+}
+
+func (p *TunnelPool) accepts(owner, strategy string) error {
+	if owner != p.owner {
+		return ErrPoolOwner
+	}
+	if strategy != p.Strategy {
+		return fmt.Errorf("%w: %s", ErrPoolStrategy, p.Strategy)
+	}
+	return nil
+}
+
+func (p *TunnelPool) add(tunnel *Tunnel) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.members = append(p.members, tunnel)
+	return len(p.members)
+}
+
+// remove drops a member and returns how many are left
+func (p *TunnelPool) remove(tunnel *Tunnel) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, member := range p.members {
+		if member == tunnel {
+			p.members = append(p.members[:i], p.members[i+1:]...)
+			break
+		}
+	}
+	return len(p.members)
+}
+
+// unhealthy reports whether every member's local service is unhealthy
+func (p *TunnelPool) unhealthy() bool {
+	members := p.Members()
+	if len(members) == 0 {
+		return false
+	}
+	for _, member := range members {
+		if member.UpstreamStatus() != UpstreamUnhealthy {
+			return false
+		}
+	}
+	return true
+}
+
+// candidates returns the members not in exclude, only the healthy ones while
+// any are left
+func (p *TunnelPool) candidates(exclude []*Tunnel) []*Tunnel {
+	var all, healthy []*Tunnel
+	for _, member := range p.Members() {
+		excluded := false
+		for _, tried := range exclude {
+			if member == tried {
+				excluded = true
+				break
+			}
+		}
+		if excluded {
+			continue
+		}
+		all = append(all, member)
+		if member.UpstreamStatus() != UpstreamUnhealthy {
+			healthy = append(healthy, member)
+		}
+	}
+	if len(healthy) > 0 {
+		return healthy
+	}
+	return all
+}
+
+// pick chooses the member serving a request, nil when none is left
+func (p *TunnelPool) pick(r *http.Request, clientIP string, exclude []*Tunnel) *Tunnel {
+	candidates := p.candidates(exclude)
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	switch p.Strategy {
+	case shared.PoolStickyCookie:
+		if cookie, err := r.Cookie(poolCookie); err == nil {
+			for _, member := range candidates {
+				if member.memberID == cookie.Value {
+					return member
+				}
+			}
+		}
+	case shared.PoolStickyIP:
+		// stable while the members do not change
+		hash := fnv.New32a()
+		hash.Write([]byte(clientIP))
+		return candidates[hash.Sum32()%uint32(len(candidates))]
+	case shared.PoolLeastInFlight:
+		start := int(atomic.AddUint64(&p.next, 1) % uint64(len(candidates)))
+		best := candidates[start]
+		for i := 1; i < len(candidates); i++ {
+			member := candidates[(start+i)%len(candidates)]
+			if atomic.LoadInt64(&member.inflight) < atomic.LoadInt64(&best.inflight) {
+				best = member
+			}
+		}
+		return best
+	}
+
+	return candidates[atomic.AddUint64(&p.next, 1)%uint64(len(candidates))]
+}
+
+// pin sets the cookie bringing a sticky_cookie visitor back to member
+func (p *TunnelPool) pin(w http.ResponseWriter, r *http.Request, member *Tunnel) {
+	if p.Strategy != shared.PoolStickyCookie {
+		return
+	}
+	if cookie, err := r.Cookie(poolCookie); err == nil && cookie.Value == member.memberID {
+		return
+	}
+
+	// a failed over request replaces the cookie set for the previous member
+	w.Header().Del("Set-Cookie")
+	http.SetCookie(w, &http.Cookie{
+		Name:     poolCookie,
+		Value:    member.memberID,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// checkTunnelAvailable reports whether a client may open id, either because
+// it is free or because the client can join the pool serving it
+func (s *Server) checkTunnelAvailable(id, owner, strategy string) error {
+	s.TunnelsMu.RLock()
+	existing, exists := s.Tunnels[id]
+	s.TunnelsMu.RUnlock()
+
+	if !exists {
+		if node, owned := s.clusterOwner(id); owned {
+			return fmt.Errorf("%w on node %s", ErrTunnelIDInUse, node.ID)
+		}
+		return nil
+	}
+	if existing.pool == nil || strategy == "" {
+		return ErrTunnelIDInUse
+	}
+	return existing.pool.accepts(owner, strategy)
+}
+
+// JoinPool adds a connection to the pool serving id, creating the pool when it
+// is the first member
+func (s *Server) JoinPool(id string, conn *websocket.Conn, owner, strategy string) (*Tunnel, error) {
+	tunnel := s.newTunnel(id, conn)
+	if err := s.joinPool(tunnel, owner, strategy); err != nil {
+		return nil, err
+	}
+	return tunnel, nil
+}
+
+// joinPool adds a fully set up tunnel to the pool serving its id, checking
+// again that the pool takes it
+func (s *Server) joinPool(tunnel *Tunnel, owner, strategy string) error {
+	logger := shared.GetTunnelLogger("server.pool", tunnel.ID)
+
+	memberID, err := shared.GenerateDomainSafeID(12)
+	if err != nil {
+		return fmt.Errorf("failed to generate pool member id: %w", err)
+	}
+
+	s.TunnelsMu.Lock()
+	defer s.TunnelsMu.Unlock()
+
+	existing, exists := s.Tunnels[tunnel.ID]
+	var pool *TunnelPool
+	if exists {
+		if existing.pool == nil {
+			return ErrTunnelIDInUse
+		}
+		if err := existing.pool.accepts(owner, strategy); err != nil {
+			return err
+		}
+		pool = existing.pool
+	} else {
+		pool = &TunnelPool{ID: tunnel.ID, Strategy: strategy, owner: owner}
+	}
+
+	tunnel.pool = pool
+	tunnel.memberID = memberID
+	members := pool.add(tunnel)
+	if !exists {
+		s.Tunnels[tunnel.ID] = tunnel
+	}
+
+	logger.Info().
+		Str("member_id", memberID).
+		Str("strategy", strategy).
+		Int("members", members).
+		Msg("client joined tunnel pool")
+
+	return nil
+}
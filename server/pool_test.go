@@ -0,0 +1,281 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/karol-broda/funnel/shared"
+)
+
+// joinTestPool connects a client that answers every request with its name, or
+// hands the request to handle when given. it joins a pool unless strategy is empty.
+func joinTestPool(t *testing.T, ts *httptest.Server, id, strategy, name string, handle func(*websocket.Conn, *shared.Message)) *websocket.Conn {
+	t.Helper()
+
+	if strategy != "" {
+		id += "&pool=" + strategy
+	}
+	conn, _ := joinTestTunnel(t, ts, id, nil, func(conn *websocket.Conn, msg *shared.Message) {
+		if msg.Type != "request" {
+			return
+		}
+		if handle != nil {
+			handle(conn, msg)
+			return
+		}
+		conn.WriteJSON(&shared.Message{
+			Type:      "response",
+			TunnelID:  msg.TunnelID,
+			RequestID: msg.RequestID,
+			Status:    http.StatusOK,
+			Body:      []byte(name),
+		})
+	})
+	return conn
+}
+
+func newPoolTestServer(t *testing.T) (*Server, *TunnelRouter, *httptest.Server) {
+	t.Helper()
+
+	s := NewServer()
+	if err := s.SetBaseDomains([]string{"tunnel.example.com"}); err != nil {
+		t.Fatalf("SetBaseDomains() error = %v", err)
+	}
+	router := NewTunnelRouter(s)
+	s.SetRouter(router)
+	ts := httptest.NewServer(router)
+	t.Cleanup(ts.Close)
+	return s, router, ts
+}
+
+func poolRequest(router *TunnelRouter, method string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "http://app.tunnel.example.com/", nil)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	return rec
+}
+
+func waitForPoolMembers(t *testing.T, s *Server, id string, count int) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		tunnel, exists := s.GetTunnel(id)
+		if exists && tunnel.pool != nil && len(tunnel.pool.Members()) == count {
+			return
+		}
+		if count == 0 && !exists {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("pool %s did not reach %d members", id, count)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTunnelPool_RoundRobinAndLeave(t *testing.T) {
+	s, router, ts := newPoolTestServer(t)
+
+	first := joinTestPool(t, ts, "app", shared.PoolRoundRobin, "first", nil)
+	joinTestPool(t, ts, "app", shared.PoolRoundRobin, "second", nil)
+	waitForPoolMembers(t, s, "app", 2)
+
+	served := map[string]int{}
+	for i := 0; i < 4; i++ {
+		rec := poolRequest(router, http.MethodGet)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status = %d, want 200", rec.Code)
+		}
+		served[rec.Body.String()]++
+	}
+	if served["first"] != 2 || served["second"] != 2 {
+		t.Errorf("requests were not spread evenly: %v", served)
+	}
+
+	first.Close()
+	waitForPoolMembers(t, s, "app", 1)
+
+	for i := 0; i < 3; i++ {
+		if rec := poolRequest(router, http.MethodGet); rec.Body.String() != "second" {
+			t.Errorf("request served by %q after the first member left", rec.Body.String())
+		}
+	}
+}
+
+func TestTunnelPool_Failover(t *testing.T) {
+	s, router, ts := newPoolTestServer(t)
+
+	// the flaky member drops its connection as soon as it gets a request
+	joinTestPool(t, ts, "app", shared.PoolLeastInFlight, "flaky", func(conn *websocket.Conn, msg *shared.Message) {
+		conn.Close()
+	})
+	waitForPoolMembers(t, s, "app", 1)
+	joinTestPool(t, ts, "app", shared.PoolLeastInFlight, "stable", nil)
+	waitForPoolMembers(t, s, "app", 2)
+
+	// make the flaky member the least loaded one so it is picked first
+	tunnel, _ := s.GetTunnel("app")
+	tunnel.pool.Members()[1].inflight = 5
+
+	rec := poolRequest(router, http.MethodGet)
+	if rec.Code != http.StatusOK || rec.Body.String() != "stable" {
+		t.Errorf("GET = %d %q, want 200 from the stable member", rec.Code, rec.Body.String())
+	}
+}
+
+func TestTunnelPool_NoFailoverForUnsafeMethods(t *testing.T) {
+	s, router, ts := newPoolTestServer(t)
+
+	joinTestPool(t, ts, "app", shared.PoolRoundRobin, "flaky", func(conn *websocket.Conn, msg *shared.Message) {
+		conn.Close()
+	})
+	waitForPoolMembers(t, s, "app", 1)
+
+	served := make(chan struct{}, 1)
+	joinTestPool(t, ts, "app", shared.PoolRoundRobin, "stable", func(conn *websocket.Conn, msg *shared.Message) {
+		served <- struct{}{}
+	})
+	waitForPoolMembers(t, s, "app", 2)
+
+	// round robin advances before picking, point it at the flaky member
+	tunnel, _ := s.GetTunnel("app")
+	tunnel.pool.next = 1
+
+	rec := poolRequest(router, http.MethodPost)
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("POST status = %d, want 502", rec.Code)
+	}
+	select {
+	case <-served:
+		t.Error("a POST that may have been processed must not be retried")
+	default:
+	}
+}
+
+func TestServer_JoinPool(t *testing.T) {
+	s := NewServer()
+
+	first, err := s.JoinPool("app", nil, "team", shared.PoolRoundRobin)
+	if err != nil {
+		t.Fatalf("JoinPool() error = %v", err)
+	}
+	second, err := s.JoinPool("app", nil, "team", shared.PoolRoundRobin)
+	if err != nil {
+		t.Fatalf("JoinPool() second member error = %v", err)
+	}
+	if first.memberID == "" || first.memberID == second.memberID {
+		t.Errorf("members need distinct ids, got %q and %q", first.memberID, second.memberID)
+	}
+
+	tests := []struct {
+		name     string
+		owner    string
+		strategy string
+		expected error
+	}{
+		{"other token", "intruder", shared.PoolRoundRobin, ErrPoolOwner},
+		{"other strategy", "team", shared.PoolStickyIP, ErrPoolStrategy},
+		{"without pool", "team", "", ErrTunnelIDInUse},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := s.checkTunnelAvailable("app", tt.owner, tt.strategy); !errors.Is(err, tt.expected) {
+				t.Errorf("checkTunnelAvailable() = %v, want %v", err, tt.expected)
+			}
+		})
+	}
+
+	s.AddTunnel("single", nil, nil)
+	if _, err := s.JoinPool("single", nil, "team", shared.PoolRoundRobin); !errors.Is(err, ErrTunnelIDInUse) {
+		t.Errorf("joining a tunnel that is not a pool: %v, want ErrTunnelIDInUse", err)
+	}
+
+	// the id stays routed while any member is connected
+	s.removeTunnel(first)
+	current, exists := s.GetTunnel("app")
+	if !exists || current != second {
+		t.Fatal("the remaining member should serve the tunnel")
+	}
+	s.removeTunnel(second)
+	if s.TunnelExists("app") {
+		t.Error("the pool should be gone with its last member")
+	}
+}
+
+func TestTunnelPool_pick(t *testing.T) {
+	newPool := func(strategy string) (*TunnelPool, []*Tunnel) {
+		pool := &TunnelPool{ID: "app", Strategy: strategy}
+		var members []*Tunnel
+		for _, id := range []string{"m1", "m2", "m3"} {
+			member := &Tunnel{ID: "app", pool: pool, memberID: id}
+			pool.add(member)
+			members = append(members, member)
+		}
+		return pool, members
+	}
+	request := func(cookie string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "http://app.tunnel.example.com/", nil)
+		if cookie != "" {
+			req.AddCookie(&http.Cookie{Name: poolCookie, Value: cookie})
+		}
+		return req
+	}
+
+	t.Run("least inflight", func(t *testing.T) {
+		pool, members := newPool(shared.PoolLeastInFlight)
+		members[0].inflight = 3
+		members[1].inflight = 1
+		members[2].inflight = 2
+		for i := 0; i < 3; i++ {
+			if got := pool.pick(request(""), "", nil); got != members[1] {
+				t.Errorf("picked %s, want m2", got.memberID)
+			}
+		}
+	})
+
+	t.Run("sticky cookie", func(t *testing.T) {
+		pool, members := newPool(shared.PoolStickyCookie)
+		for i := 0; i < 3; i++ {
+			if got := pool.pick(request("m3"), "", nil); got != members[2] {
+				t.Errorf("picked %s, want the pinned m3", got.memberID)
+			}
+		}
+
+		// a visitor pinned to a member that left is moved and re-pinned
+		got := pool.pick(request("gone"), "", nil)
+		rec := httptest.NewRecorder()
+		pool.pin(rec, request("gone"), got)
+		if cookie := rec.Header().Get("Set-Cookie"); !strings.Contains(cookie, poolCookie+"="+got.memberID) {
+			t.Errorf("Set-Cookie = %q, want a pin to %s", cookie, got.memberID)
+		}
+	})
+
+	t.Run("sticky ip", func(t *testing.T) {
+		pool, _ := newPool(shared.PoolStickyIP)
+		first := pool.pick(request(""), "203.0.113.7", nil)
+		for i := 0; i < 5; i++ {
+			if got := pool.pick(request(""), "203.0.113.7", nil); got != first {
+				t.Errorf("picked %s, want %s for the same ip", got.memberID, first.memberID)
+			}
+		}
+	})
+
+	t.Run("skips excluded and unhealthy members", func(t *testing.T) {
+		pool, members := newPool(shared.PoolRoundRobin)
+		members[1].setUpstreamHealth(&shared.Health{Error: "connection refused"})
+		for i := 0; i < 4; i++ {
+			if got := pool.pick(request(""), "", []*Tunnel{members[0]}); got != members[2] {
+				t.Errorf("picked %s, want m3", got.memberID)
+			}
+		}
+		if got := pool.pick(request(""), "", members); got != nil {
+			t.Errorf("picked %s with every member excluded", got.memberID)
+		}
+	})
+}
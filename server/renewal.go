@@ -0,0 +1,331 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"math/rand/v2"
+	"sort"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+const (
+	// renewBefore is how long before expiry a certificate is renewed
+	renewBefore           = 30 * 24 * time.Hour
+	renewalCheckInterval  = time.Hour
+	renewalRetryBase      = 5 * time.Minute
+	renewalRetryMax       = 6 * time.Hour
+	renewalAlertThreshold = 3
+	// ocspRefreshBefore is how long before the staple's next update it is refetched
+	ocspRefreshBefore = 24 * time.Hour
+)
+
+var errNoCertificate = errors.New("certificate chain is empty")
+
+type renewalState struct {
+	failures       int
+	lastAttempt    time.Time
+	lastError      string
+	nextAttempt    time.Time
+	inProgress     bool
+	ocspNextUpdate time.Time
+}
+
+// CertificateStatus describes a managed certificate for the api
+type CertificateStatus struct {
+	Domain             string     `json:"domain" example:"*.tunnel.example.com"`                     // Certificate key, a hostname or wildcard
+	DNSNames           []string   `json:"dns_names"`                                                 // Names the certificate is valid for
+	Issuer             string     `json:"issuer" example:"R11"`                                      // Issuing CA common name
+	NotBefore          time.Time  `json:"not_before" example:"2025-08-08T18:30:00Z"`                 // Start of validity
+	NotAfter           time.Time  `json:"not_after" example:"2025-11-06T18:30:00Z"`                  // End of validity
+	RenewAt            *time.Time `json:"renew_at,omitempty" example:"2025-10-07T18:30:00Z"`         // When background renewal starts
+	Static             bool       `json:"static" example:"false"`                                    // Loaded from a file, never renewed by the server
+	OCSPStapled        bool       `json:"ocsp_stapled" example:"true"`                               // Whether an OCSP response is stapled
+	OCSPNextUpdate     *time.Time `json:"ocsp_next_update,omitempty" example:"2025-08-15T18:30:00Z"` // When the stapled response expires
+	RenewalFailures    int        `json:"renewal_failures" example:"0"`                              // Consecutive failed renewal attempts
+	LastRenewalAttempt *time.Time `json:"last_renewal_attempt,omitempty"`                            // Time of the last renewal attempt
+	LastRenewalError   string     `json:"last_renewal_error,omitempty"`                              // Error of the last failed renewal
+	NextRenewalAttempt *time.Time `json:"next_renewal_attempt,omitempty"`                            // Earliest time of the next retry
+}
+
+func certificateLeaf(cert *tls.Certificate) (*x509.Certificate, error) {
+	if cert.Leaf != nil {
+		return cert.Leaf, nil
+	}
+	if len(cert.Certificate) == 0 {
+		return nil, errNoCertificate
+	}
+	return x509.ParseCertificate(cert.Certificate[0])
+}
+
+// isCertificateUsable reports whether cert can still be served
+func (cm *CertificateManager) isCertificateUsable(cert *tls.Certificate) bool {
+	leaf, err := certificateLeaf(cert)
+	if err != nil {
+		cm.logger.Error().Err(err).Msg("failed to parse certificate")
+		return false
+	}
+
+	if time.Now().After(leaf.NotAfter) {
+		cm.logger.Debug().Time("expiry", leaf.NotAfter).Msg("certificate is expired")
+		return false
+	}
+
+	return true
+}
+
+func (cm *CertificateManager) needsRenewal(cert *tls.Certificate) bool {
+	leaf, err := certificateLeaf(cert)
+	if err != nil {
+		return true
+	}
+	return time.Until(leaf.NotAfter) < renewBefore
+}
+
+// StartRenewal renews certificates ahead of expiry and refreshes ocsp staples
+// until ctx is done. static certificates are reloaded when their files change instead.
+func (cm *CertificateManager) StartRenewal(ctx context.Context) {
+	if cm.static != nil {
+		if err := cm.static.Watch(ctx); err != nil {
+			cm.logger.Error().Err(err).Msg("failed to watch static certificates, changes need a restart")
+		}
+		return
+	}
+
+	cm.renewalsMu.Lock()
+	cm.renewalCtx = ctx
+	cm.renewalsMu.Unlock()
+
+	cm.logger.Info().
+		Dur("check_interval", renewalCheckInterval).
+		Dur("renew_before", renewBefore).
+		Msg("certificate renewal scheduler started")
+
+	go func() {
+		ticker := time.NewTicker(renewalCheckInterval)
+		defer ticker.Stop()
+
+		for {
+			cm.checkRenewals()
+
+			select {
+			case <-ctx.Done():
+				cm.logger.Info().Msg("certificate renewal scheduler stopped")
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (cm *CertificateManager) checkRenewals() {
+	for _, key := range cm.certificates.Keys() {
+		cert, ok := cm.certificates.Peek(key)
+		if !ok {
+			continue
+		}
+
+		if cm.needsRenewal(cert) {
+			cm.renewInBackground(key)
+			continue
+		}
+
+		cm.renewalsMu.Lock()
+		state := cm.renewalStateLocked(key)
+		ocspDue := !state.ocspNextUpdate.IsZero() && time.Until(state.ocspNextUpdate) < ocspRefreshBefore
+		cm.renewalsMu.Unlock()
+
+		if ocspDue {
+			// staple a copy so handshakes never see a half-updated certificate
+			updated := *cert
+			cm.stapleOCSP(key, &updated)
+			cm.certificates.Add(key, &updated)
+		}
+	}
+}
+
+func (cm *CertificateManager) renewalStateLocked(key string) *renewalState {
+	if cm.renewals == nil {
+		cm.renewals = make(map[string]*renewalState)
+	}
+	state, ok := cm.renewals[key]
+	if !ok {
+		state = &renewalState{}
+		cm.renewals[key] = state
+	}
+	return state
+}
+
+// renewInBackground starts a renewal for key unless one is running or backing off
+func (cm *CertificateManager) renewInBackground(key string) {
+	cm.renewalsMu.Lock()
+	state := cm.renewalStateLocked(key)
+	if state.inProgress || time.Now().Before(state.nextAttempt) {
+		cm.renewalsMu.Unlock()
+		return
+	}
+	state.inProgress = true
+	state.lastAttempt = time.Now()
+	cm.renewalsMu.Unlock()
+
+	go cm.renew(key)
+}
+
+func (cm *CertificateManager) renew(key string) {
+	cm.logger.Info().Str("domain", key).Msg("renewing certificate in background")
+
+	_, err := cm.obtain(key)
+
+	cm.renewalsMu.Lock()
+	state := cm.renewalStateLocked(key)
+	state.inProgress = false
+	ctx := cm.renewalCtx
+
+	if err == nil {
+		state.failures = 0
+		state.lastError = ""
+		state.nextAttempt = time.Time{}
+		cm.renewalsMu.Unlock()
+		cm.logger.Info().Str("domain", key).Msg("certificate renewed")
+		return
+	}
+
+	state.failures++
+	state.lastError = err.Error()
+	delay := renewalRetryDelay(state.failures)
+	state.nextAttempt = time.Now().Add(delay)
+	failures := state.failures
+	cm.renewalsMu.Unlock()
+
+	event := cm.logger.Warn()
+	if failures >= renewalAlertThreshold {
+		event = cm.logger.Error().Str("alert", "certificate_renewal_failing")
+	}
+	event.Err(err).
+		Str("domain", key).
+		Int("consecutive_failures", failures).
+		Dur("retry_in", delay).
+		Msg("certificate renewal failed")
+
+	time.AfterFunc(delay, func() {
+		if ctx != nil && ctx.Err() != nil {
+			return
+		}
+		cm.renewInBackground(key)
+	})
+}
+
+// renewalRetryDelay backs off exponentially with up to 20% jitter so many
+// failing domains do not retry in lockstep
+func renewalRetryDelay(failures int) time.Duration {
+	delay := renewalRetryBase
+	for i := 1; i < failures && delay < renewalRetryMax; i++ {
+		delay *= 2
+	}
+	if delay > renewalRetryMax {
+		delay = renewalRetryMax
+	}
+
+	jitter := time.Duration(rand.Int64N(int64(delay) / 5))
+	return delay - delay/10 + jitter
+}
+
+// stapleOCSP fetches a fresh ocsp response for cert and staples it. failures
+// are logged only, a certificate without a staple is still served.
+func (cm *CertificateManager) stapleOCSP(key string, cert *tls.Certificate) {
+	if cm.fetchOCSP == nil || len(cert.Certificate) == 0 {
+		return
+	}
+
+	bundle := make([]byte, 0, 2048*len(cert.Certificate))
+	for _, der := range cert.Certificate {
+		bundle = append(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+
+	raw, resp, err := cm.fetchOCSP(bundle)
+	if err != nil {
+		cm.logger.Debug().Err(err).Str("domain", key).Msg("no ocsp response to staple")
+		return
+	}
+
+	if resp == nil || resp.Status != ocsp.Good {
+		cm.logger.Warn().Str("domain", key).Msg("ocsp responder did not report the certificate as good, not stapling")
+		return
+	}
+
+	cert.OCSPStaple = raw
+
+	cm.renewalsMu.Lock()
+	cm.renewalStateLocked(key).ocspNextUpdate = resp.NextUpdate
+	cm.renewalsMu.Unlock()
+
+	cm.logger.Debug().Str("domain", key).Time("next_update", resp.NextUpdate).Msg("ocsp response stapled")
+}
+
+// Status lists the cached certificates with their renewal state, soonest expiry first
+func (cm *CertificateManager) Status() []CertificateStatus {
+	statuses := make([]CertificateStatus, 0, cm.certificates.Len())
+
+	if cm.static != nil {
+		for _, cert := range cm.static.Certificates() {
+			statuses = append(statuses, CertificateStatus{
+				Domain:    cert.Leaf.Subject.CommonName,
+				DNSNames:  cert.Leaf.DNSNames,
+				Issuer:    cert.Leaf.Issuer.CommonName,
+				NotBefore: cert.Leaf.NotBefore,
+				NotAfter:  cert.Leaf.NotAfter,
+				Static:    true,
+			})
+		}
+	}
+
+	for _, key := range cm.certificates.Keys() {
+		cert, ok := cm.certificates.Peek(key)
+		if !ok {
+			continue
+		}
+		leaf, err := certificateLeaf(cert)
+		if err != nil {
+			continue
+		}
+
+		status := CertificateStatus{
+			Domain:      key,
+			DNSNames:    leaf.DNSNames,
+			Issuer:      leaf.Issuer.CommonName,
+			NotBefore:   leaf.NotBefore,
+			NotAfter:    leaf.NotAfter,
+			RenewAt:     optionalTime(leaf.NotAfter.Add(-renewBefore)),
+			OCSPStapled: len(cert.OCSPStaple) > 0,
+		}
+
+		cm.renewalsMu.Lock()
+		if state, ok := cm.renewals[key]; ok {
+			status.RenewalFailures = state.failures
+			status.LastRenewalError = state.lastError
+			status.OCSPNextUpdate = optionalTime(state.ocspNextUpdate)
+			status.LastRenewalAttempt = optionalTime(state.lastAttempt)
+			status.NextRenewalAttempt = optionalTime(state.nextAttempt)
+		}
+		cm.renewalsMu.Unlock()
+
+		statuses = append(statuses, status)
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].NotAfter.Before(statuses[j].NotAfter)
+	})
+
+	return statuses
+}
+
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
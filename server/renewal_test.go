@@ -0,0 +1,179 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/karol-broda/funnel/shared"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ocsp"
+)
+
+func testCertificate(t *testing.T, domain string, notAfter time.Time) *tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: domain},
+		Issuer:       pkix.Name{CommonName: "test ca"},
+		DNSNames:     []string{domain},
+		NotBefore:    notAfter.Add(-90 * 24 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	leaf, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func newTestRenewalManager(t *testing.T) *CertificateManager {
+	t.Helper()
+
+	certCache, err := lru.New[string, *tls.Certificate](8)
+	require.NoError(t, err)
+
+	return &CertificateManager{
+		certificates: certCache,
+		certDir:      t.TempDir(),
+		renewals:     make(map[string]*renewalState),
+		logger:       shared.GetLogger("certs.test"),
+	}
+}
+
+func TestCertificateManager_RenewsInBackground(t *testing.T) {
+	cm := newTestRenewalManager(t)
+
+	domain := "*.tunnel.example.com"
+	expiring := testCertificate(t, domain, time.Now().Add(10*24*time.Hour))
+	fresh := testCertificate(t, domain, time.Now().Add(90*24*time.Hour))
+	cm.certificates.Add(domain, expiring)
+
+	release := make(chan struct{})
+	var calls atomic.Int32
+	cm.obtain = func(key string) (*tls.Certificate, error) {
+		calls.Add(1)
+		<-release
+		cm.certificates.Add(key, fresh)
+		return fresh, nil
+	}
+
+	for range 3 {
+		cert, err := cm.getCertificate(domain)
+		require.NoError(t, err)
+		assert.Same(t, expiring, cert, "the expiring certificate must be served while renewal runs")
+	}
+
+	close(release)
+
+	require.Eventually(t, func() bool {
+		cert, _ := cm.certificates.Peek(domain)
+		return cert == fresh
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, int32(1), calls.Load(), "concurrent lookups must share one renewal")
+
+	require.Eventually(t, func() bool {
+		cm.renewalsMu.Lock()
+		defer cm.renewalsMu.Unlock()
+		return !cm.renewals[domain].inProgress
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestCertificateManager_RenewalBackoff(t *testing.T) {
+	cm := newTestRenewalManager(t)
+
+	domain := "demo.example.com"
+	cm.certificates.Add(domain, testCertificate(t, domain, time.Now().Add(5*24*time.Hour)))
+
+	var calls atomic.Int32
+	cm.obtain = func(key string) (*tls.Certificate, error) {
+		calls.Add(1)
+		return nil, errors.New("acme server unavailable")
+	}
+
+	cm.renewInBackground(domain)
+
+	require.Eventually(t, func() bool {
+		cm.renewalsMu.Lock()
+		defer cm.renewalsMu.Unlock()
+		return cm.renewals[domain].failures == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// a retry before the backoff elapsed is skipped
+	cm.checkRenewals()
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, int32(1), calls.Load())
+
+	statuses := cm.Status()
+	require.Len(t, statuses, 1)
+	assert.Equal(t, 1, statuses[0].RenewalFailures)
+	assert.Equal(t, "acme server unavailable", statuses[0].LastRenewalError)
+	require.NotNil(t, statuses[0].NextRenewalAttempt)
+	assert.True(t, statuses[0].NextRenewalAttempt.After(time.Now()))
+}
+
+func TestRenewalRetryDelay(t *testing.T) {
+	tests := []struct {
+		failures int
+		base     time.Duration
+	}{
+		{1, renewalRetryBase},
+		{2, 2 * renewalRetryBase},
+		{3, 4 * renewalRetryBase},
+		{20, renewalRetryMax},
+	}
+
+	for _, tt := range tests {
+		delay := renewalRetryDelay(tt.failures)
+		assert.GreaterOrEqual(t, delay, tt.base-tt.base/10, "failures=%d", tt.failures)
+		assert.LessOrEqual(t, delay, tt.base+tt.base/10, "failures=%d", tt.failures)
+	}
+}
+
+func TestCertificateManager_stapleOCSP(t *testing.T) {
+	tests := []struct {
+		name    string
+		resp    *ocsp.Response
+		err     error
+		stapled bool
+	}{
+		{"good", &ocsp.Response{Status: ocsp.Good, NextUpdate: time.Now().Add(72 * time.Hour)}, nil, true},
+		{"revoked", &ocsp.Response{Status: ocsp.Revoked}, nil, false},
+		{"responder error", nil, errors.New("no ocsp server"), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cm := newTestRenewalManager(t)
+			cm.fetchOCSP = func(bundle []byte) ([]byte, *ocsp.Response, error) {
+				assert.Contains(t, string(bundle), "BEGIN CERTIFICATE")
+				return []byte("staple"), tt.resp, tt.err
+			}
+
+			cert := testCertificate(t, "demo.example.com", time.Now().Add(60*24*time.Hour))
+			cm.stapleOCSP("demo.example.com", cert)
+			cm.certificates.Add("demo.example.com", cert)
+
+			statuses := cm.Status()
+			require.Len(t, statuses, 1)
+			assert.Equal(t, tt.stapled, statuses[0].OCSPStapled)
+			assert.Equal(t, tt.stapled, statuses[0].OCSPNextUpdate != nil)
+		})
+	}
+}
@@ -0,0 +1,174 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/karol-broda/funnel/shared"
+)
+
+// Reservation binds a tunnel id to a token so only that token can claim it
+type Reservation struct {
+	ID        string    `json:"id"`
+	TokenName string    `json:"token_name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type ReservationStore struct {
+	path         string
+	reservations map[string]Reservation
+	mu           sync.RWMutex
+}
+
+func NewReservationStore(path string) (*ReservationStore, error) {
+	logger := shared.GetLogger("server.reservations")
+
+	rs := &ReservationStore{
+		path:         path,
+		reservations: make(map[string]Reservation),
+	}
+
+	if path == "" {
+		logger.Info().Msg("reservation store disabled - no path configured")
+		return rs, nil
+	}
+
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create reservation store directory: %w", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			logger.Info().Str("path", path).Msg("reservation store file not found, starting with empty store")
+			return rs, nil
+		}
+		return nil, fmt.Errorf("failed to read reservation store: %w", err)
+	}
+
+	var records []Reservation
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, fmt.Errorf("failed to parse reservation store: %w", err)
+	}
+
+	for _, r := range records {
+		rs.reservations[r.ID] = r
+	}
+
+	logger.Info().
+		Str("path", path).
+		Int("reservations", len(rs.reservations)).
+		Msg("reservation store loaded")
+
+	return rs, nil
+}
+
+func (rs *ReservationStore) save() error {
+	if rs.path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(rs.sorted(), "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal reservations: %w", err)
+	}
+
+	tmpPath := rs.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return fmt.Errorf("failed to write reservation store: %w", err)
+	}
+
+	if err := os.Rename(tmpPath, rs.path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to rename reservation store: %w", err)
+	}
+
+	return nil
+}
+
+func (rs *ReservationStore) sorted() []Reservation {
+	result := make([]Reservation, 0, len(rs.reservations))
+	for _, r := range rs.reservations {
+		result = append(result, r)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID < result[j].ID
+	})
+	return result
+}
+
+func (rs *ReservationStore) Add(id, tokenName string) error {
+	logger := shared.GetLogger("server.reservations")
+
+	if err := shared.ValidateTunnelID(id); err != nil {
+		return fmt.Errorf("invalid tunnel id: %w", err)
+	}
+	if tokenName == "" {
+		return fmt.Errorf("token name is required")
+	}
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if existing, ok := rs.reservations[id]; ok {
+		return fmt.Errorf("tunnel id %q is already reserved for token %q", id, existing.TokenName)
+	}
+
+	rs.reservations[id] = Reservation{
+		ID:        id,
+		TokenName: tokenName,
+		CreatedAt: time.Now(),
+	}
+
+	if err := rs.save(); err != nil {
+		delete(rs.reservations, id)
+		return fmt.Errorf("failed to save reservation: %w", err)
+	}
+
+	logger.Info().Str("tunnel_id", id).Str("token_name", tokenName).Msg("tunnel id reserved")
+	return nil
+}
+
+func (rs *ReservationStore) Remove(id string) error {
+	logger := shared.GetLogger("server.reservations")
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	existing, ok := rs.reservations[id]
+	if !ok {
+		return fmt.Errorf("tunnel id %q is not reserved", id)
+	}
+
+	delete(rs.reservations, id)
+
+	if err := rs.save(); err != nil {
+		rs.reservations[id] = existing
+		return fmt.Errorf("failed to save reservation store: %w", err)
+	}
+
+	logger.Info().Str("tunnel_id", id).Msg("tunnel id reservation removed")
+	return nil
+}
+
+// Owner returns the token name that reserved the id
+func (rs *ReservationStore) Owner(id string) (string, bool) {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+
+	r, ok := rs.reservations[id]
+	return r.TokenName, ok
+}
+
+func (rs *ReservationStore) List() []Reservation {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+
+	return rs.sorted()
+}
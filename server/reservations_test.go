@@ -0,0 +1,77 @@
+package server
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestReservationStore_AddAndOwner(t *testing.T) {
+	store, err := NewReservationStore(filepath.Join(t.TempDir(), "reservations.json"))
+	if err != nil {
+		t.Fatalf("failed to create reservation store: %v", err)
+	}
+
+	if err := store.Add("demo", "team-a"); err != nil {
+		t.Fatalf("failed to add reservation: %v", err)
+	}
+
+	owner, ok := store.Owner("demo")
+	if !ok {
+		t.Fatal("expected demo to be reserved")
+	}
+	if owner != "team-a" {
+		t.Errorf("expected owner team-a, got %s", owner)
+	}
+
+	if err := store.Add("demo", "team-b"); err == nil {
+		t.Error("expected error when reserving an id twice")
+	}
+}
+
+func TestReservationStore_InvalidInput(t *testing.T) {
+	store, err := NewReservationStore("")
+	if err != nil {
+		t.Fatalf("failed to create reservation store: %v", err)
+	}
+
+	if err := store.Add("Bad_ID", "team-a"); err == nil {
+		t.Error("expected error for invalid tunnel id")
+	}
+	if err := store.Add("demo", ""); err == nil {
+		t.Error("expected error for missing token name")
+	}
+	if err := store.Remove("missing"); err == nil {
+		t.Error("expected error when removing an unknown reservation")
+	}
+}
+
+func TestReservationStore_Persistence(t *testing.T) {
+	storePath := filepath.Join(t.TempDir(), "reservations.json")
+
+	store1, err := NewReservationStore(storePath)
+	if err != nil {
+		t.Fatalf("failed to create reservation store: %v", err)
+	}
+	if err := store1.Add("demo", "team-a"); err != nil {
+		t.Fatalf("failed to add reservation: %v", err)
+	}
+	if err := store1.Add("staging", "team-b"); err != nil {
+		t.Fatalf("failed to add reservation: %v", err)
+	}
+	if err := store1.Remove("staging"); err != nil {
+		t.Fatalf("failed to remove reservation: %v", err)
+	}
+
+	store2, err := NewReservationStore(storePath)
+	if err != nil {
+		t.Fatalf("failed to reload reservation store: %v", err)
+	}
+
+	list := store2.List()
+	if len(list) != 1 {
+		t.Fatalf("expected 1 reservation after reload, got %d", len(list))
+	}
+	if list[0].ID != "demo" || list[0].TokenName != "team-a" {
+		t.Errorf("unexpected reservation after reload: %+v", list[0])
+	}
+}
@@ -1,6 +1,8 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -11,12 +13,24 @@ import (
 
 	"github.com/google/uuid"
 	"github.com/karol-broda/funnel/shared"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// subrouteHeader carries the labels left of the tunnel id, e.g. "/v2" for v2.myapp.<base domain>
+const subrouteHeader = "X-Funnel-Subroute"
+
+// hostRoute is where a request host points: a tunnel and an optional sub-route
+type hostRoute struct {
+	tunnelID string
+	subroute string
+}
+
 type TunnelRouter struct {
 	server *Server
 
-	hostCache sync.Map // map[string]string (host -> subdomain)
+	hostCache sync.Map // map[string]hostRoute
 
 	requests    int64
 	cacheHits   int64
@@ -94,8 +108,30 @@ func (tr *TunnelRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// the id and trace context go along to the local service, and to the node
+	// holding the tunnel in a cluster
+	visitorID := visitorRequestID(r, requestID)
+	r.Header.Set(shared.RequestIDHeader, visitorID)
+	if visitorID != requestID {
+		logger.Debug().Str("request_id", requestID).Str("visitor_request_id", visitorID).Msg("keeping the request id of the visitor")
+	}
+	recorder := &responseRecorder{ResponseWriter: w}
+	w = recorder
+	r, span := startRequestSpan(r, "funnel.router", visitorID)
+	defer endRequestSpan(span, recorder)
+
 	subdomainStart := time.Now()
-	subdomain := tr.getSubdomain(r.Host)
+	var route hostRoute
+	tunnelID, customHost := tr.server.TunnelIDForHostname(r.Host)
+	if customHost {
+		route = hostRoute{tunnelID: tunnelID}
+	} else if node, remoteID, ok := tr.server.clusterHostnameOwner(r.Host); ok {
+		tr.server.cluster.forward(w, r, node, remoteID, "", requestID)
+		return
+	} else {
+		route = tr.resolveHost(r.Host)
+	}
+	subdomain := route.tunnelID
 	subdomainDuration := time.Since(subdomainStart)
 
 	if subdomain == "" {
@@ -112,11 +148,18 @@ func (tr *TunnelRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	logger.Debug().
 		Str("request_id", requestID).
 		Str("subdomain", subdomain).
+		Str("subroute", route.subroute).
+		Bool("custom_hostname", customHost).
 		Dur("subdomain_extraction_time", subdomainDuration).
 		Msg("extracted subdomain from host")
 
 	tunnel, exists := tr.server.GetTunnel(subdomain)
 	if !exists {
+		if node, owned := tr.server.clusterOwner(subdomain); owned {
+			tr.server.cluster.forward(w, r, node, subdomain, route.subroute, requestID)
+			return
+		}
+
 		processingDuration := time.Since(requestStart)
 		logger.Warn().
 			Str("request_id", requestID).
@@ -127,26 +170,67 @@ func (tr *TunnelRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	span.SetAttributes(attribute.String("funnel.tunnel_id", tunnel.ID))
+	if tr.server.accessLog != nil {
+		defer tr.logAccess(r, tunnel, recorder, visitorID, requestStart)
+	}
+
+	if tunnelOffline(tunnel) {
+		logger.Info().
+			Str("request_id", requestID).
+			Str("tunnel_id", subdomain).
+			Dur("processing_time", time.Since(requestStart)).
+			Msg("local service is unhealthy, serving offline page")
+		tr.server.offlinePage.serve(w, r, tunnel)
+		return
+	}
+
 	logger.Debug().
 		Str("request_id", requestID).
 		Str("tunnel_id", subdomain).
 		Msg("found active tunnel, routing request")
 
-	tr.handleTunnelRequest(w, r, tunnel, requestID, requestStart)
+	tr.handleTunnelRequest(w, r, tunnel, route.subroute, requestID, requestStart)
+}
+
+// logAccess writes the access log entry of a request once it is answered,
+// including those aborted halfway through a streamed response
+func (tr *TunnelRouter) logAccess(r *http.Request, tunnel *Tunnel, recorder *responseRecorder, requestID string, requestStart time.Time) {
+	tr.server.accessLog.Log(AccessLogEntry{
+		Time:      requestStart,
+		RequestID: requestID,
+		TunnelID:  tunnel.ID,
+		TokenName: tunnel.tokenName,
+		ClientIP:  tr.getClientIP(r),
+		Method:    r.Method,
+		Host:      r.Host,
+		URI:       r.RequestURI,
+		Proto:     r.Proto,
+		Status:    recorder.statusCode(),
+		Bytes:     recorder.bytes,
+		Duration:  time.Since(requestStart),
+		Referer:   r.Referer(),
+		UserAgent: r.UserAgent(),
+	})
 }
 
 func (tr *TunnelRouter) getSubdomain(host string) string {
+	return tr.resolveHost(host).tunnelID
+}
+
+func (tr *TunnelRouter) resolveHost(host string) hostRoute {
 	logger := shared.GetLogger("server.router")
 
 	if cached, ok := tr.hostCache.Load(host); ok {
 		atomic.AddInt64(&tr.cacheHits, 1)
 		hits := atomic.LoadInt64(&tr.cacheHits)
+		route := cached.(hostRoute)
 		logger.Debug().
 			Str("host", host).
-			Str("cached_subdomain", cached.(string)).
+			Str("cached_subdomain", route.tunnelID).
 			Int64("total_cache_hits", hits).
 			Msg("subdomain cache hit")
-		return cached.(string)
+		return route
 	}
 
 	atomic.AddInt64(&tr.cacheMisses, 1)
@@ -157,13 +241,14 @@ func (tr *TunnelRouter) getSubdomain(host string) string {
 		Int64("total_cache_misses", misses).
 		Msg("subdomain cache miss")
 
-	subdomain := tr.extractSubdomain(host)
+	route := tr.extractSubdomain(host)
 
-	if subdomain != "" {
-		tr.hostCache.Store(host, subdomain)
+	if route.tunnelID != "" {
+		tr.hostCache.Store(host, route)
 		logger.Debug().
 			Str("host", host).
-			Str("extracted_subdomain", subdomain).
+			Str("extracted_subdomain", route.tunnelID).
+			Str("subroute", route.subroute).
 			Msg("subdomain cached")
 	} else {
 		logger.Debug().
@@ -171,12 +256,14 @@ func (tr *TunnelRouter) getSubdomain(host string) string {
 			Msg("no valid subdomain found")
 	}
 
-	return subdomain
+	return route
 }
 
-func (tr *TunnelRouter) extractSubdomain(host string) string {
+// extractSubdomain splits host into the tunnel id directly left of the
+// longest matching base domain and any further labels as a sub-route
+func (tr *TunnelRouter) extractSubdomain(host string) hostRoute {
 	if len(host) == 0 {
-		return ""
+		return hostRoute{}
 	}
 
 	hostLen := len(host)
@@ -190,25 +277,202 @@ func (tr *TunnelRouter) extractSubdomain(host string) string {
 		}
 	}
 
-	for i := 0; i < len(host); i++ {
-		if host[i] == '.' {
-			if i == 0 {
-				return ""
+	baseDomain, ok := tr.server.matchBaseDomain(strings.ToLower(host))
+	if !ok || len(host) <= len(baseDomain)+1 {
+		return hostRoute{}
+	}
+
+	labels := strings.Split(host[:len(host)-len(baseDomain)-1], ".")
+	for _, label := range labels {
+		if label == "" {
+			return hostRoute{}
+		}
+	}
+
+	route := hostRoute{tunnelID: labels[len(labels)-1]}
+	for i := len(labels) - 2; i >= 0; i-- {
+		route.subroute += "/" + labels[i]
+	}
+
+	return route
+}
+
+// ServesHost reports whether host is one this server answers for: a configured
+// base domain, a verified custom hostname, or the host of an active tunnel on
+// this or another cluster node.
+// it guards on-demand certificate issuance against arbitrary names.
+func (tr *TunnelRouter) ServesHost(host string) bool {
+	host = shared.NormalizeHostname(host)
+
+	if tr.server.IsCustomHostname(host) {
+		return true
+	}
+	if _, _, ok := tr.server.clusterHostnameOwner(host); ok {
+		return true
+	}
+
+	for _, domain := range tr.server.BaseDomains() {
+		if host == domain {
+			return true
+		}
+	}
+
+	route := tr.extractSubdomain(host)
+	if route.tunnelID == "" {
+		return false
+	}
+	if tr.server.TunnelExists(route.tunnelID) {
+		return true
+	}
+	_, owned := tr.server.clusterOwner(route.tunnelID)
+	return owned
+}
+
+func (tr *TunnelRouter) handleTunnelRequest(w http.ResponseWriter, r *http.Request, tunnel *Tunnel, subroute string, requestID string, requestStart time.Time) {
+	logger := shared.GetRequestLogger("server.router", tunnel.ID, requestID)
+
+	headers := tr.prepareForwardingHeaders(r)
+	delete(headers, subrouteHeader)
+	if subroute != "" {
+		headers[subrouteHeader] = []string{subroute}
+	}
+
+	msg := &shared.Message{
+		Type:      "request",
+		TunnelID:  tunnel.ID,
+		RequestID: requestID,
+		Method:    r.Method,
+		Path:      r.URL.String(),
+		Headers:   headers,
+	}
+
+	// clients that support it get large or open ended bodies in chunks as the
+	// visitor sends them, everything else is read up front
+	streamable := streamableRequest(r)
+
+	if tunnel.pool == nil {
+		if !tr.limitRequestBody(w, r, tunnel, requestID) {
+			return
+		}
+		stream := streamable && tunnel.streaming
+		if !stream && !tr.bufferBody(w, r, tunnel, msg, requestStart) {
+			return
+		}
+		if _, lost := tr.forwardRequest(w, r, tunnel, msg, stream, requestStart); lost {
+			http.Error(w, "tunnel connection lost", http.StatusBadGateway)
+		}
+		return
+	}
+
+	// a request that never reached a member, or one that is safe to repeat,
+	// fails over to the next member when its member disconnects
+	clientIP := tr.getClientIP(r)
+	bodyLimited, bodyBuffered := false, false
+	var tried []*Tunnel
+	for {
+		member := tunnel.pool.pick(r, clientIP, tried)
+		if member == nil {
+			logger.Error().
+				Int("tried_members", len(tried)).
+				Dur("total_processing_time", time.Since(requestStart)).
+				Msg("no pool member left to serve the request")
+			http.Error(w, "tunnel connection lost", http.StatusBadGateway)
+			return
+		}
+		tunnel.pool.pin(w, r, member)
+
+		// the body is read once, within the limit of the member it goes to first
+		if !bodyLimited {
+			if !tr.limitRequestBody(w, r, member, requestID) {
+				return
 			}
-			return host[:i]
+			bodyLimited = true
+		}
+		stream := streamable && member.streaming && !bodyBuffered
+		if !stream && !bodyBuffered {
+			if !tr.bufferBody(w, r, member, msg, requestStart) {
+				return
+			}
+			bodyBuffered = true
+		}
+
+		sent, lost := tr.forwardRequest(w, r, member, msg, stream, requestStart)
+		if !lost {
+			return
 		}
+		tried = append(tried, member)
+
+		// a streamed body is gone once sent, whatever the method
+		if sent && (stream || !idempotentMethods[r.Method]) {
+			logger.Warn().
+				Str("member_id", member.memberID).
+				Str("method", r.Method).
+				Bool("streamed", stream).
+				Msg("pool member lost while handling a request that cannot be repeated, not retrying")
+			http.Error(w, "tunnel connection lost", http.StatusBadGateway)
+			return
+		}
+		logger.Warn().
+			Str("member_id", member.memberID).
+			Bool("request_sent", sent).
+			Msg("pool member lost, failing over to another member")
+	}
+}
+
+// limitRequestBody caps what is read of the request body at the tunnel's
+// limit, answering 413 right away when the visitor announced a larger body
+func (tr *TunnelRouter) limitRequestBody(w http.ResponseWriter, r *http.Request, tunnel *Tunnel, requestID string) bool {
+	maxBody := tunnel.bodyLimits.MaxRequestBody
+	if maxBody <= 0 || r.Body == nil || r.Body == http.NoBody {
+		return true
 	}
+	if r.ContentLength > maxBody {
+		tr.rejectOversizedRequest(w, tunnel, requestID, r.ContentLength)
+		return false
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxBody)
+	return true
+}
 
-	return ""
+// rejectOversizedRequest answers a request whose body exceeds the tunnel's
+// limit, size is the announced body size or -1 when the visitor announced none
+func (tr *TunnelRouter) rejectOversizedRequest(w http.ResponseWriter, tunnel *Tunnel, requestID string, size int64) {
+	logger := shared.GetRequestLogger("server.router", tunnel.ID, requestID)
+	event := logger.Warn().Int64("max_request_body", tunnel.bodyLimits.MaxRequestBody)
+	if size >= 0 {
+		event = event.Int64("body_size", size)
+	}
+	event.Msg("request body too large")
+	tunnel.recordError("oversized")
+	http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
 }
 
-func (tr *TunnelRouter) handleTunnelRequest(w http.ResponseWriter, r *http.Request, tunnel *Tunnel, requestID string, requestStart time.Time) {
+// rejectOversizedResponse answers 502 in place of a response whose body
+// exceeds the tunnel's limit
+func (tr *TunnelRouter) rejectOversizedResponse(w http.ResponseWriter, tunnel *Tunnel, requestID string, size int64) {
 	logger := shared.GetRequestLogger("server.router", tunnel.ID, requestID)
+	logger.Warn().
+		Int64("body_size", size).
+		Int64("max_response_body", tunnel.bodyLimits.MaxResponseBody).
+		Msg("response body too large")
+	tunnel.recordError("oversized")
+	http.Error(w, "response body too large", http.StatusBadGateway)
+}
+
+// bufferBody reads the whole request body into msg, answering 413 when it
+// exceeds the tunnel's limit and 500 when reading fails
+func (tr *TunnelRouter) bufferBody(w http.ResponseWriter, r *http.Request, tunnel *Tunnel, msg *shared.Message, requestStart time.Time) bool {
+	logger := shared.GetRequestLogger("server.router", msg.TunnelID, msg.RequestID)
 
 	bodyReadStart := time.Now()
 	body, err := tr.readBody(r)
 	bodyReadDuration := time.Since(bodyReadStart)
 
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		tr.rejectOversizedRequest(w, tunnel, msg.RequestID, -1)
+		return false
+	}
 	if err != nil {
 		processingDuration := time.Since(requestStart)
 		logger.Error().Err(err).
@@ -216,7 +480,7 @@ func (tr *TunnelRouter) handleTunnelRequest(w http.ResponseWriter, r *http.Reque
 			Dur("total_processing_time", processingDuration).
 			Msg("failed to read request body")
 		http.Error(w, "failed to read body", http.StatusInternalServerError)
-		return
+		return false
 	}
 
 	logger.Debug().
@@ -224,23 +488,48 @@ func (tr *TunnelRouter) handleTunnelRequest(w http.ResponseWriter, r *http.Reque
 		Dur("body_read_time", bodyReadDuration).
 		Msg("request body read successfully")
 
-	headers := tr.prepareForwardingHeaders(r)
+	msg.Body = body
+	return true
+}
 
-	msg := &shared.Message{
-		Type:      "request",
-		TunnelID:  tunnel.ID,
-		RequestID: requestID,
-		Method:    r.Method,
-		Path:      r.URL.String(),
-		Headers:   headers,
-		Body:      body,
+// forwardRequest sends a request to one tunnel connection and writes its
+// response, streaming the request body when stream is set. lost is set, with
+// nothing written, when the connection went away before answering; sent tells
+// whether the client may have received the request.
+func (tr *TunnelRouter) forwardRequest(w http.ResponseWriter, r *http.Request, tunnel *Tunnel, msg *shared.Message, stream bool, requestStart time.Time) (sent, lost bool) {
+	requestID := msg.RequestID
+	logger := shared.GetRequestLogger("server.router", tunnel.ID, requestID)
+
+	atomic.AddInt64(&tunnel.inflight, 1)
+	defer atomic.AddInt64(&tunnel.inflight, -1)
+
+	// a span per attempt, so failovers in a pool show as separate hops
+	ctx, span := tracer.Start(r.Context(), "funnel.tunnel",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("funnel.tunnel_id", tunnel.ID), attribute.Bool("funnel.streamed_body", stream)),
+	)
+	if tunnel.memberID != "" {
+		span.SetAttributes(attribute.String("funnel.member_id", tunnel.memberID))
 	}
+	defer func() {
+		if lost {
+			span.SetStatus(codes.Error, "tunnel connection lost")
+		}
+		span.End()
+	}()
+	shared.InjectTraceContext(ctx, msg.Headers)
 
 	channelStart := time.Now()
 	respChan := tunnel.registerResponseChannel(msg.RequestID)
 	defer tunnel.unregisterResponseChannel(msg.RequestID)
 	channelDuration := time.Since(channelStart)
 
+	msg.Stream = stream
+	msg.Trailers = nil
+	if stream {
+		msg.Trailers = announcedTrailers(r.Trailer)
+	}
+
 	sendStart := time.Now()
 	if err := tunnel.SendMessage(msg); err != nil {
 		sendDuration := time.Since(sendStart)
@@ -249,37 +538,82 @@ func (tr *TunnelRouter) handleTunnelRequest(w http.ResponseWriter, r *http.Reque
 			Dur("send_duration", sendDuration).
 			Dur("total_processing_time", processingDuration).
 			Msg("failed to send message to tunnel")
-		http.Error(w, "tunnel connection lost", http.StatusBadGateway)
-		return
+		return false, true
 	}
 	sendDuration := time.Since(sendStart)
 
 	logger.Debug().
 		Dur("channel_setup_time", channelDuration).
 		Dur("message_send_time", sendDuration).
+		Bool("streamed_body", stream).
 		Msg("request forwarded to tunnel")
 
+	// closed when a streamed body turns out larger than the tunnel allows
+	var bodyTooLarge chan struct{}
+	if stream {
+		streamCtx, stopStream := context.WithCancel(r.Context())
+		controller := http.NewResponseController(w)
+		// grpc and other bidirectional streams read while the response is written
+		controller.EnableFullDuplex()
+		bodyTooLarge = make(chan struct{})
+		streamDone := make(chan struct{})
+		go func() {
+			defer close(streamDone)
+			var tooLarge *http.MaxBytesError
+			if err := tr.streamRequestBody(streamCtx, tunnel, r, msg.RequestID); errors.As(err, &tooLarge) {
+				close(bodyTooLarge)
+			}
+		}()
+		// the body must not be read once the handler returns, nor keep feeding
+		// this member after a pool fails over to another one
+		defer func() {
+			stopStream()
+			select {
+			case <-streamDone:
+				return
+			default:
+			}
+			// closing the body waits for a read blocked on the visitor, which
+			// only an expired deadline ends
+			controller.SetReadDeadline(time.Now())
+			r.Body.Close()
+			<-streamDone
+		}()
+	}
+
+	// the client enforces the header and total timeouts itself and answers
+	// 504, waiting for the longer one here only catches a client that does not
+	timeouts := tr.server.requestTimeouts(tunnel, r.URL.Path)
 	waitStart := time.Now()
-	timeout := 30 * time.Second
+	timeout := timeouts.Header()
+	if timeouts.Total() > timeout {
+		timeout = timeouts.Total()
+	}
 
 	select {
 	case resp := <-respChan:
 		waitDuration := time.Since(waitStart)
-		if resp != nil {
+		if resp != nil && resp.Stream {
+			logger.Info().
+				Int("status_code", resp.Status).
+				Dur("tunnel_response_time", waitDuration).
+				Msg("streaming response from tunnel")
+			tr.writeStreamedResponse(w, r, tunnel, resp, respChan, timeouts.Idle(), requestStart)
+		} else if resp != nil {
 			logger.Info().
 				Int("status_code", resp.Status).
 				Int("response_size", len(resp.Body)).
 				Dur("tunnel_response_time", waitDuration).
 				Dur("total_request_time", time.Since(requestStart)).
 				Msg("received response from tunnel")
-			tr.writeResponse(w, resp, requestID, requestStart)
+			tr.writeResponse(w, r, tunnel, resp, requestID, requestStart)
 		} else {
 			processingDuration := time.Since(requestStart)
 			logger.Error().
 				Dur("wait_duration", waitDuration).
 				Dur("total_processing_time", processingDuration).
 				Msg("received nil response from tunnel")
-			http.Error(w, "tunnel connection lost", http.StatusBadGateway)
+			return true, true
 		}
 	case <-time.After(timeout):
 		processingDuration := time.Since(requestStart)
@@ -288,16 +622,38 @@ func (tr *TunnelRouter) handleTunnelRequest(w http.ResponseWriter, r *http.Reque
 			Dur("wait_duration", time.Since(waitStart)).
 			Dur("total_processing_time", processingDuration).
 			Msg("request timeout waiting for tunnel response")
+		if tunnel.statistics != nil {
+			tunnel.statistics.RecordError("timeout")
+		}
+		tunnel.cancelRequest(requestID)
 		http.Error(w, "request timed out", http.StatusGatewayTimeout)
 
+	case <-bodyTooLarge:
+		// the local service got a broken off body, its answer is not wanted
+		tunnel.cancelRequest(requestID)
+		tr.rejectOversizedRequest(w, tunnel, requestID, -1)
+
 	case <-r.Context().Done():
 		processingDuration := time.Since(requestStart)
 		logger.Warn().
 			Dur("wait_duration", time.Since(waitStart)).
 			Dur("total_processing_time", processingDuration).
 			Msg("client closed connection")
+		// the local service would otherwise keep working for nobody
+		tunnel.cancelRequest(requestID)
 		http.Error(w, "client closed connection", 499)
 	}
+
+	return true, false
+}
+
+// tunnelOffline reports whether requests for tunnel should get the offline
+// page, for a pool once every member is unhealthy
+func tunnelOffline(tunnel *Tunnel) bool {
+	if tunnel.pool != nil {
+		return tunnel.pool.unhealthy()
+	}
+	return tunnel.UpstreamStatus() == UpstreamUnhealthy
 }
 
 func (tr *TunnelRouter) prepareForwardingHeaders(r *http.Request) map[string][]string {
@@ -453,9 +809,15 @@ func (tr *TunnelRouter) readBody(r *http.Request) ([]byte, error) {
 	return body, nil
 }
 
-func (tr *TunnelRouter) writeResponse(w http.ResponseWriter, resp *shared.Message, requestID string, requestStart time.Time) {
+func (tr *TunnelRouter) writeResponse(w http.ResponseWriter, r *http.Request, tunnel *Tunnel, resp *shared.Message, requestID string, requestStart time.Time) {
 	logger := shared.GetLogger("server.router")
 
+	// clients enforce the limit themselves, this catches those that do not
+	if maxBody := tunnel.bodyLimits.MaxResponseBody; maxBody > 0 && int64(len(resp.Body)) > maxBody {
+		tr.rejectOversizedResponse(w, tunnel, requestID, int64(len(resp.Body)))
+		return
+	}
+
 	writeStart := time.Now()
 
 	headerCount := 0
@@ -466,13 +828,27 @@ func (tr *TunnelRouter) writeResponse(w http.ResponseWriter, resp *shared.Messag
 		}
 	}
 
+	body := resp.Body
+	if encoding := tr.server.compression.responseEncoding(r, resp.Status, w.Header(), len(body)); encoding != "" {
+		compressed, err := compressBody(encoding, body)
+		if err != nil {
+			logger.Warn().Err(err).Str("request_id", requestID).Str("encoding", encoding).Msg("failed to compress response, sending it as it is")
+		} else {
+			prepareEncodedHeader(w.Header(), encoding)
+			if tunnel.statistics != nil {
+				tunnel.statistics.RecordCompression(int64(len(body) - len(compressed)))
+			}
+			body = compressed
+		}
+	}
+
 	if resp.Status > 0 {
 		w.WriteHeader(resp.Status)
 	}
 
 	bytesWritten := 0
-	if len(resp.Body) > 0 {
-		n, err := w.Write(resp.Body)
+	if len(body) > 0 {
+		n, err := w.Write(body)
 		bytesWritten = n
 		if err != nil {
 			logger.Error().Err(err).
@@ -483,6 +859,12 @@ func (tr *TunnelRouter) writeResponse(w http.ResponseWriter, resp *shared.Messag
 		}
 	}
 
+	for name, values := range resp.Trailers {
+		for _, value := range values {
+			w.Header().Add(http.TrailerPrefix+name, value)
+		}
+	}
+
 	writeDuration := time.Since(writeStart)
 	totalDuration := time.Since(requestStart)
 
@@ -501,7 +883,7 @@ func (tr *TunnelRouter) InvalidateCache(tunnelID string) {
 
 	invalidatedCount := 0
 	tr.hostCache.Range(func(key, value interface{}) bool {
-		if value.(string) == tunnelID {
+		if value.(hostRoute).tunnelID == tunnelID {
 			tr.hostCache.Delete(key)
 			invalidatedCount++
 		}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"testing"
+)
+
+func TestTunnelRouter_extractSubdomain(t *testing.T) {
+	tests := []struct {
+		name        string
+		baseDomains []string
+		host        string
+		expected    hostRoute
+	}{
+		{
+			name:        "tunnel under base domain",
+			baseDomains: []string{"tunnel.example.com"},
+			host:        "myapp.tunnel.example.com",
+			expected:    hostRoute{tunnelID: "myapp"},
+		},
+		{
+			name:        "nested subdomain becomes sub-route",
+			baseDomains: []string{"tunnel.example.com"},
+			host:        "v2.myapp.tunnel.example.com:8443",
+			expected:    hostRoute{tunnelID: "myapp", subroute: "/v2"},
+		},
+		{
+			name:        "deeply nested sub-route",
+			baseDomains: []string{"tunnel.example.com"},
+			host:        "a.b.myapp.tunnel.example.com",
+			expected:    hostRoute{tunnelID: "myapp", subroute: "/b/a"},
+		},
+		{
+			name:        "base domain itself",
+			baseDomains: []string{"tunnel.example.com"},
+			host:        "tunnel.example.com",
+			expected:    hostRoute{},
+		},
+		{
+			name:        "host outside base domains",
+			baseDomains: []string{"tunnel.example.com"},
+			host:        "myapp.example.org",
+			expected:    hostRoute{},
+		},
+		{
+			name:        "suffix without label boundary",
+			baseDomains: []string{"example.com"},
+			host:        "myapp.badexample.com",
+			expected:    hostRoute{},
+		},
+		{
+			name:        "longest base domain wins",
+			baseDomains: []string{"example.com", "eu.example.com"},
+			host:        "myapp.eu.example.com",
+			expected:    hostRoute{tunnelID: "myapp"},
+		},
+		{
+			name:        "base domain matching is case insensitive",
+			baseDomains: []string{"tunnel.example.com"},
+			host:        "myapp.Tunnel.Example.com",
+			expected:    hostRoute{tunnelID: "myapp"},
+		},
+		{
+			name:     "inferred multi-label public suffix",
+			host:     "myapp.example.co.uk",
+			expected: hostRoute{tunnelID: "myapp"},
+		},
+		{
+			name:     "inferred registrable domain has no tunnel",
+			host:     "example.co.uk",
+			expected: hostRoute{},
+		},
+		{
+			name:     "inferred unknown tld",
+			host:     "myapp.localhost:8080",
+			expected: hostRoute{tunnelID: "myapp"},
+		},
+		{
+			name:     "inferred nested subdomain",
+			host:     "v2.myapp.example.com",
+			expected: hostRoute{tunnelID: "myapp", subroute: "/v2"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer()
+			if tt.baseDomains != nil {
+				if err := s.SetBaseDomains(tt.baseDomains); err != nil {
+					t.Fatalf("failed to set base domains: %v", err)
+				}
+			}
+			router := NewTunnelRouter(s)
+
+			if got := router.extractSubdomain(tt.host); got != tt.expected {
+				t.Errorf("extractSubdomain(%q) = %+v, want %+v", tt.host, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestSetBaseDomainsValidation(t *testing.T) {
+	s := NewServer()
+
+	if err := s.SetBaseDomains([]string{"tunnel..example.com"}); err == nil {
+		t.Error("expected error for empty label")
+	}
+
+	if err := s.SetBaseDomains([]string{"*.Tunnel.Example.com.", "example.com"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	domains := s.BaseDomains()
+	if len(domains) != 2 || domains[0] != "tunnel.example.com" || domains[1] != "example.com" {
+		t.Errorf("expected normalized domains longest first, got %v", domains)
+	}
+}
+
+func TestTunnelRouter_ServesHost(t *testing.T) {
+	s := NewServer()
+	if err := s.SetBaseDomains([]string{"tunnel.example.com"}); err != nil {
+		t.Fatalf("failed to set base domains: %v", err)
+	}
+	router := NewTunnelRouter(s)
+
+	s.AddTunnel("myapp", nil, nil)
+	defer s.RemoveTunnel("myapp")
+
+	tests := []struct {
+		host     string
+		expected bool
+	}{
+		{host: "tunnel.example.com", expected: true},
+		{host: "myapp.tunnel.example.com", expected: true},
+		{host: "v2.myapp.tunnel.example.com", expected: true},
+		{host: "other.tunnel.example.com", expected: false},
+		{host: "myapp.example.org", expected: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			if got := router.ServesHost(tt.host); got != tt.expected {
+				t.Errorf("ServesHost(%q) = %v, want %v", tt.host, got, tt.expected)
+			}
+		})
+	}
+}
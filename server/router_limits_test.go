@@ -0,0 +1,180 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/karol-broda/funnel/shared"
+)
+
+func TestServer_negotiateBodyLimits(t *testing.T) {
+	s := NewServer()
+	if err := s.SetBodyLimits(shared.BodyLimits{MaxRequestBody: 10 << 20, MaxResponseBody: 100 << 20}); err != nil {
+		t.Fatalf("SetBodyLimits() error = %v", err)
+	}
+	store, err := NewTokenStore(filepath.Join(t.TempDir(), "tokens.json"))
+	if err != nil {
+		t.Fatalf("failed to create token store: %v", err)
+	}
+	store.Create("uploads")
+	store.Create("plain")
+	if err := store.SetBodyLimits("uploads", shared.BodyLimits{MaxRequestBody: 1 << 30}); err != nil {
+		t.Fatalf("SetBodyLimits() error = %v", err)
+	}
+	s.SetTokenStore(store)
+
+	tests := []struct {
+		name      string
+		token     string
+		requested *shared.BodyLimits
+		expected  shared.BodyLimits
+	}{
+		{"server limits", "plain", nil, shared.BodyLimits{MaxRequestBody: 10 << 20, MaxResponseBody: 100 << 20}},
+		{"token limits", "uploads", nil, shared.BodyLimits{MaxRequestBody: 1 << 30, MaxResponseBody: 100 << 20}},
+		{"lowered by the client", "plain", &shared.BodyLimits{MaxResponseBody: 1 << 20}, shared.BodyLimits{MaxRequestBody: 10 << 20, MaxResponseBody: 1 << 20}},
+		{"not raised by the client", "plain", &shared.BodyLimits{MaxRequestBody: 1 << 30}, shared.BodyLimits{MaxRequestBody: 10 << 20, MaxResponseBody: 100 << 20}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := s.negotiateBodyLimits(tt.token, tt.requested); got != tt.expected {
+				t.Errorf("negotiateBodyLimits() = %+v, want %+v", got, tt.expected)
+			}
+		})
+	}
+}
+
+// hiddenLength hides the size of a body so it is sent chunked
+type hiddenLength struct{ io.Reader }
+
+func TestTunnelRouter_RequestBodyLimit(t *testing.T) {
+	s, _, ts := newPoolTestServer(t)
+	if err := s.SetBodyLimits(shared.BodyLimits{MaxRequestBody: 1024}); err != nil {
+		t.Fatalf("SetBodyLimits() error = %v", err)
+	}
+
+	var forwarded atomic.Int64
+	received := map[string]int{}
+	_, welcome := joinTestTunnel(t, ts, "app", compressionFeatures, func(conn *websocket.Conn, msg *shared.Message) {
+		switch msg.Type {
+		case "request":
+			forwarded.Add(1)
+			received[msg.RequestID] = len(msg.Body)
+			if !msg.Stream {
+				conn.WriteJSON(&shared.Message{Type: "response", RequestID: msg.RequestID, Status: http.StatusOK, Body: []byte(strconv.Itoa(len(msg.Body)))})
+			}
+		case "request_body":
+			received[msg.RequestID] += len(msg.Body)
+			// a body broken off by the server gets no answer
+			if msg.End && msg.Error == "" {
+				conn.WriteJSON(&shared.Message{Type: "response", RequestID: msg.RequestID, Status: http.StatusOK, Body: []byte(strconv.Itoa(received[msg.RequestID]))})
+			}
+		}
+	})
+	if welcome.Limits.BodyLimits.MaxRequestBody != 1024 {
+		t.Fatalf("welcome limits %+v, want the request limit announced", welcome.Limits.BodyLimits)
+	}
+
+	tests := []struct {
+		name           string
+		body           io.Reader
+		expectedStatus int
+		forwarded      bool
+	}{
+		{"within the limit", bytes.NewReader(make([]byte, 1024)), http.StatusOK, true},
+		{"announced too large", bytes.NewReader(make([]byte, 4096)), http.StatusRequestEntityTooLarge, false},
+		{"streamed too large", hiddenLength{bytes.NewReader(make([]byte, 4096))}, http.StatusRequestEntityTooLarge, true},
+		{"streamed within the limit", hiddenLength{strings.NewReader("small upload")}, http.StatusOK, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := forwarded.Load()
+			req, _ := http.NewRequest(http.MethodPost, ts.URL+"/upload", tt.body)
+			req.Host = "app.tunnel.example.com"
+			resp, err := ts.Client().Do(req)
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.expectedStatus {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.expectedStatus)
+			}
+			if got := forwarded.Load() > before; got != tt.forwarded {
+				t.Errorf("forwarded to the client = %v, want %v", got, tt.forwarded)
+			}
+		})
+	}
+
+	tunnel, _ := s.GetTunnel("app")
+	if oversized := tunnel.statistics.GetSnapshot().OversizedBodies; oversized != 2 {
+		t.Errorf("OversizedBodies = %d, want 2", oversized)
+	}
+}
+
+func TestTunnelRouter_ResponseBodyLimit(t *testing.T) {
+	s, _, ts := newPoolTestServer(t)
+	if err := s.SetBodyLimits(shared.BodyLimits{MaxResponseBody: 1024}); err != nil {
+		t.Fatalf("SetBodyLimits() error = %v", err)
+	}
+
+	joinTestTunnel(t, ts, "app", compressionFeatures, func(conn *websocket.Conn, msg *shared.Message) {
+		if msg.Type != "request" {
+			return
+		}
+		path := msg.Path[strings.LastIndex(msg.Path, "/"):]
+		switch path {
+		case "/small":
+			conn.WriteJSON(&shared.Message{Type: "response", RequestID: msg.RequestID, Status: http.StatusOK, Body: []byte("small")})
+		case "/large":
+			// a client that does not enforce the limit itself
+			conn.WriteJSON(&shared.Message{Type: "response", RequestID: msg.RequestID, Status: http.StatusOK, Body: make([]byte, 4096)})
+		case "/declared":
+			conn.WriteJSON(&shared.Message{Type: "response", RequestID: msg.RequestID, Status: http.StatusOK, Stream: true, Headers: map[string][]string{"Content-Length": {"4096"}}})
+		case "/stream":
+			conn.WriteJSON(&shared.Message{Type: "response", RequestID: msg.RequestID, Status: http.StatusOK, Stream: true})
+			for i := 0; i < 4; i++ {
+				conn.WriteJSON(&shared.Message{Type: "response_body", RequestID: msg.RequestID, Body: make([]byte, 512)})
+			}
+			conn.WriteJSON(&shared.Message{Type: "response_body", RequestID: msg.RequestID, End: true})
+		}
+	})
+
+	get := func(path string) (*http.Response, []byte, error) {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+path, nil)
+		req.Host = "app.tunnel.example.com"
+		resp, err := ts.Client().Do(req)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return resp, body, err
+	}
+
+	for path, expected := range map[string]int{"/small": http.StatusOK, "/large": http.StatusBadGateway, "/declared": http.StatusBadGateway} {
+		resp, _, err := get(path)
+		if err != nil {
+			t.Fatalf("%s failed: %v", path, err)
+		}
+		if resp.StatusCode != expected {
+			t.Errorf("%s answered %d, want %d", path, resp.StatusCode, expected)
+		}
+	}
+	// the headers are out before the stream outgrows the limit
+	if _, body, err := get("/stream"); err == nil {
+		t.Errorf("/stream read %d bytes without an error, want the stream broken off", len(body))
+	}
+
+	tunnel, _ := s.GetTunnel("app")
+	if oversized := tunnel.statistics.GetSnapshot().OversizedBodies; oversized != 3 {
+		t.Errorf("OversizedBodies = %d, want 3", oversized)
+	}
+}
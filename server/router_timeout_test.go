@@ -0,0 +1,101 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/karol-broda/funnel/shared"
+)
+
+func TestTunnelRouter_TimeoutCancelsRequest(t *testing.T) {
+	s, router, ts := newPoolTestServer(t)
+
+	canceled := make(chan string, 1)
+	joinTestPool(t, ts, "app", "", "", func(conn *websocket.Conn, msg *shared.Message) {
+		// never answers, waits for the server to give up instead
+		var cancel shared.Message
+		if err := conn.ReadJSON(&cancel); err == nil && cancel.Type == "request_cancel" {
+			canceled <- cancel.RequestID
+		}
+	})
+
+	tunnel, _ := s.GetTunnel("app")
+	tunnel.timeouts = shared.TunnelTimeouts{
+		Timeouts: shared.Timeouts{TotalMs: 5000},
+		Paths:    []shared.PathTimeouts{{Prefix: "/quick", Timeouts: shared.Timeouts{TotalMs: 50}}},
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://app.tunnel.example.com/quick/check", nil)
+	rec := httptest.NewRecorder()
+	start := time.Now()
+	router.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusGatewayTimeout {
+		t.Fatalf("status = %d, want 504", rec.Code)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("request took %v, the path timeout should have applied", elapsed)
+	}
+
+	select {
+	case requestID := <-canceled:
+		if requestID == "" {
+			t.Error("request_cancel without a request id")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the client was not told to cancel the request")
+	}
+
+	stats := tunnel.statistics.GetSnapshot()
+	if stats.TimeoutCount != 1 || stats.CancelledCount != 1 {
+		t.Errorf("timeouts = %d, cancellations = %d, want 1 each", stats.TimeoutCount, stats.CancelledCount)
+	}
+}
+
+func TestTunnelRouter_VisitorDisconnectCancelsRequest(t *testing.T) {
+	s, router, ts := newPoolTestServer(t)
+
+	received := make(chan struct{})
+	canceled := make(chan string, 1)
+	joinTestPool(t, ts, "app", "", "", func(conn *websocket.Conn, msg *shared.Message) {
+		close(received)
+		var cancel shared.Message
+		if err := conn.ReadJSON(&cancel); err == nil && cancel.Type == "request_cancel" {
+			canceled <- cancel.RequestID
+		}
+	})
+
+	ctx, leave := context.WithCancel(context.Background())
+	req := httptest.NewRequest(http.MethodGet, "http://app.tunnel.example.com/slow", nil).WithContext(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the request never reached the client")
+	}
+	leave()
+
+	select {
+	case requestID := <-canceled:
+		if requestID == "" {
+			t.Error("request_cancel without a request id")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the client was not told the visitor left")
+	}
+	<-done
+
+	tunnel, _ := s.GetTunnel("app")
+	if stats := tunnel.statistics.GetSnapshot(); stats.CancelledCount != 1 || stats.TimeoutCount != 0 {
+		t.Errorf("cancellations = %d, timeouts = %d, want 1 and 0", stats.CancelledCount, stats.TimeoutCount)
+	}
+}
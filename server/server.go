@@ -1,20 +1,61 @@
 package server
 
 import (
+	"fmt"
 	"net/http"
+	"net/url"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/karol-broda/funnel/shared"
 
 	"github.com/gorilla/websocket"
 )
 
+const (
+	defaultRequestTimeout = 30 * time.Second
+	defaultReadDeadline   = 300 * time.Second
+	handshakeTimeout      = 10 * time.Second
+	// defaultMaxRequestTimeout caps the timeouts clients may ask for
+	defaultMaxRequestTimeout = 10 * time.Minute
+	// maxPathTimeouts limits the per path timeout overrides of a tunnel
+	maxPathTimeouts = 32
+)
+
+// serverFeatures lists the protocol features this server can negotiate
+var serverFeatures = []string{shared.FeatureBinaryFraming, shared.FeatureHealthCheck, shared.FeatureStreaming, shared.FeatureFlowControl}
+
 type Server struct {
-	Tunnels    map[string]*Tunnel
-	TunnelsMu  sync.RWMutex
-	Upgrader   websocket.Upgrader
-	router     RouterInterface
-	tokenStore *TokenStore
+	Tunnels        map[string]*Tunnel
+	TunnelsMu      sync.RWMutex
+	Upgrader       websocket.Upgrader
+	router         RouterInterface
+	tokenStore     *TokenStore
+	publicBaseURL  *url.URL
+	baseDomains    []string // longest first
+	namePolicy     *NamePolicy
+	reservations   *ReservationStore
+	clientCertAuth *ClientCertAuth
+	generateIDs    bool
+	offlinePage    *OfflinePage
+	cluster        *Cluster
+
+	domainVerifier *DomainVerifier
+	hostnames      map[string]string // custom hostname -> tunnel id
+	hostnamesMu    sync.RWMutex
+
+	// timeouts apply to requests of tunnels that did not ask for their own,
+	// maxTimeout caps what clients may ask for
+	timeouts   shared.Timeouts
+	maxTimeout time.Duration
+
+	compression Compression
+	// bodyLimits apply to tunnels whose token has none of its own
+	bodyLimits shared.BodyLimits
+	// accessLog gets a line per request through a tunnel, nil when disabled
+	accessLog *AccessLog
 }
 
 type RouterInterface interface {
@@ -25,7 +66,9 @@ func NewServer() *Server {
 	logger := shared.GetLogger("server")
 
 	server := &Server{
-		Tunnels: make(map[string]*Tunnel),
+		Tunnels:     make(map[string]*Tunnel),
+		hostnames:   make(map[string]string),
+		offlinePage: defaultOfflinePage(),
 		Upgrader: websocket.Upgrader{
 			CheckOrigin: func(r *http.Request) bool {
 				return true
@@ -33,6 +76,12 @@ func NewServer() *Server {
 			ReadBufferSize:  1024 * 64,
 			WriteBufferSize: 1024 * 64,
 		},
+		timeouts: shared.Timeouts{
+			TotalMs: defaultRequestTimeout.Milliseconds(),
+			IdleMs:  defaultStreamIdleTimeout.Milliseconds(),
+		},
+		maxTimeout:  defaultMaxRequestTimeout,
+		compression: Compression{MinSize: defaultCompressionMinSize, Types: DefaultCompressibleTypes},
 	}
 
 	logger.Info().
@@ -64,6 +113,34 @@ func (s *Server) SetTokenStore(tokenStore *TokenStore) {
 	}
 }
 
+func (s *Server) SetNamePolicy(policy *NamePolicy) {
+	s.namePolicy = policy
+}
+
+func (s *Server) SetReservationStore(reservations *ReservationStore) {
+	logger := shared.GetLogger("server")
+
+	s.reservations = reservations
+	logger.Info().
+		Int("reservations", len(reservations.List())).
+		Msg("reservation store configured")
+}
+
+// SetGenerateIDs controls whether the server assigns an id to clients that omit one
+func (s *Server) SetGenerateIDs(enabled bool) {
+	s.generateIDs = enabled
+}
+
+// SetOfflinePage sets the page served while a tunnel's local service is unhealthy
+func (s *Server) SetOfflinePage(page *OfflinePage) {
+	s.offlinePage = page
+}
+
+// SetAccessLog sets where requests through tunnels are logged, nil disables it
+func (s *Server) SetAccessLog(accessLog *AccessLog) {
+	s.accessLog = accessLog
+}
+
 func (s *Server) GetTokenStore() *TokenStore {
 	return s.tokenStore
 }
@@ -74,3 +151,198 @@ func (s *Server) ValidateToken(token string) (*TokenRecord, bool) {
 	}
 	return s.tokenStore.Validate(token)
 }
+
+// SetPublicBaseURL sets the url tunnel urls are derived from, e.g. https://tunnel.example.com
+func (s *Server) SetPublicBaseURL(rawURL string) error {
+	logger := shared.GetLogger("server")
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid public url: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("public url must use http or https scheme, got %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("public url must include a host")
+	}
+
+	s.publicBaseURL = u
+	logger.Info().Str("public_url", u.String()).Msg("public base url configured")
+	return nil
+}
+
+// SetBaseDomains sets the domains tunnels live under. a request host must end
+// in one of them, and the longest match wins so nested base domains work.
+func (s *Server) SetBaseDomains(domains []string) error {
+	logger := shared.GetLogger("server")
+
+	normalized := make([]string, 0, len(domains))
+	for _, domain := range domains {
+		domain = strings.TrimPrefix(shared.NormalizeHostname(domain), "*.")
+		if domain == "" {
+			continue
+		}
+		for _, label := range strings.Split(domain, ".") {
+			if label == "" {
+				return fmt.Errorf("invalid base domain %q", domain)
+			}
+		}
+		normalized = append(normalized, domain)
+	}
+
+	sort.Slice(normalized, func(i, j int) bool {
+		return len(normalized[i]) > len(normalized[j])
+	})
+
+	s.baseDomains = normalized
+	logger.Info().Strs("base_domains", normalized).Msg("base domains configured")
+	return nil
+}
+
+func (s *Server) BaseDomains() []string {
+	return s.baseDomains
+}
+
+// matchBaseDomain returns the base domain a lowercase host belongs to. without
+// configured base domains it is inferred from the public suffix list.
+func (s *Server) matchBaseDomain(host string) (string, bool) {
+	if len(s.baseDomains) == 0 {
+		return shared.GetBaseDomain(host), true
+	}
+
+	for _, domain := range s.baseDomains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return domain, true
+		}
+	}
+
+	return "", false
+}
+
+// PublicURL returns the canonical public url of a tunnel. without a configured
+// base url it is derived from the host and scheme the client connected with.
+func (s *Server) PublicURL(r *http.Request, tunnelID string) string {
+	if s.publicBaseURL != nil {
+		return fmt.Sprintf("%s://%s.%s", s.publicBaseURL.Scheme, tunnelID, s.publicBaseURL.Host)
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = strings.ToLower(proto)
+	}
+
+	return fmt.Sprintf("%s://%s.%s", scheme, tunnelID, r.Host)
+}
+
+// publicHost returns the bare hostname of a tunnel's public url
+func (s *Server) publicHost(r *http.Request, tunnelID string) string {
+	u, err := url.Parse(s.PublicURL(r, tunnelID))
+	if err != nil {
+		return ""
+	}
+	return shared.NormalizeHostname(u.Host)
+}
+
+// Limits returns the limits advertised to a client during the handshake
+func (s *Server) Limits(timeouts shared.TunnelTimeouts, bodyLimits shared.BodyLimits) shared.Limits {
+	return shared.Limits{
+		RequestTimeoutMs: timeouts.TotalMs,
+		IdleTimeoutMs:    defaultReadDeadline.Milliseconds(),
+		Timeouts:         timeouts,
+		StreamWindow:     shared.DefaultStreamWindow,
+		TunnelWindow:     shared.DefaultTunnelWindow,
+
+		CompressionThreshold: s.compression.TunnelMinSize,
+		BodyLimits:           bodyLimits,
+	}
+}
+
+// SetBodyLimits sets the largest request and response bodies of tunnels whose
+// token has no limits of its own, zero for no limit
+func (s *Server) SetBodyLimits(limits shared.BodyLimits) error {
+	logger := shared.GetLogger("server")
+
+	if limits.MaxRequestBody < 0 || limits.MaxResponseBody < 0 {
+		return fmt.Errorf("body limits must not be negative")
+	}
+
+	s.bodyLimits = limits
+	logger.Info().
+		Int64("max_request_body", limits.MaxRequestBody).
+		Int64("max_response_body", limits.MaxResponseBody).
+		Msg("body limits configured")
+	return nil
+}
+
+// negotiateBodyLimits returns the body limits a tunnel gets: its token's over
+// the server's, lowered to what its client asked for
+func (s *Server) negotiateBodyLimits(tokenName string, requested *shared.BodyLimits) shared.BodyLimits {
+	limits := s.bodyLimits
+	if s.tokenStore != nil {
+		if own := s.tokenStore.BodyLimits(tokenName); own != nil {
+			limits = own.Merge(limits)
+		}
+	}
+	if requested == nil {
+		return limits
+	}
+	return requested.Cap(limits)
+}
+
+// SetRequestTimeouts sets the timeouts of tunnels that do not ask for their
+// own and the most a client may ask for, zero keeps a default
+func (s *Server) SetRequestTimeouts(defaults shared.Timeouts, max time.Duration) error {
+	logger := shared.GetLogger("server")
+
+	if max < 0 || defaults.ConnectMs < 0 || defaults.HeaderMs < 0 || defaults.IdleMs < 0 || defaults.TotalMs < 0 {
+		return fmt.Errorf("request timeouts must not be negative")
+	}
+	if max == 0 {
+		max = defaultMaxRequestTimeout
+	}
+	defaults = defaults.Merge(s.timeouts)
+	if defaults.Cap(max) != defaults {
+		return fmt.Errorf("default request timeouts must not exceed the maximum of %s", max)
+	}
+
+	s.timeouts = defaults
+	s.maxTimeout = max
+	logger.Info().
+		Dur("request_timeout", defaults.Total()).
+		Dur("header_timeout", defaults.Header()).
+		Dur("stream_idle_timeout", defaults.Idle()).
+		Dur("max_request_timeout", max).
+		Msg("request timeouts configured")
+	return nil
+}
+
+// negotiateTimeouts returns the timeouts a tunnel gets: what its client asked
+// for over the server defaults, capped by the maximum
+func (s *Server) negotiateTimeouts(requested *shared.TunnelTimeouts) shared.TunnelTimeouts {
+	timeouts := shared.TunnelTimeouts{Timeouts: s.timeouts}
+	if requested == nil {
+		return timeouts
+	}
+
+	timeouts.Timeouts = requested.Timeouts.Merge(s.timeouts).Cap(s.maxTimeout)
+	for _, override := range requested.Paths {
+		if len(timeouts.Paths) == maxPathTimeouts {
+			break
+		}
+		if !strings.HasPrefix(override.Prefix, "/") {
+			continue
+		}
+		override.Timeouts = override.Timeouts.Cap(s.maxTimeout)
+		timeouts.Paths = append(timeouts.Paths, override)
+	}
+	return timeouts
+}
+
+// requestTimeouts returns the timeouts of a request to a tunnel
+func (s *Server) requestTimeouts(tunnel *Tunnel, path string) shared.Timeouts {
+	return tunnel.timeouts.ForPath(path).Merge(s.timeouts)
+}
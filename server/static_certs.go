@@ -0,0 +1,251 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/karol-broda/funnel/shared"
+	"github.com/rs/zerolog"
+)
+
+// staticReloadDelay coalesces the burst of events editors and secret mounts produce
+const staticReloadDelay = 500 * time.Millisecond
+
+// CertificateFiles is a pem encoded certificate chain and its private key
+type CertificateFiles struct {
+	CertFile string
+	KeyFile  string
+}
+
+// ParseCertificateFiles pairs --tls-cert and --tls-key values by position
+func ParseCertificateFiles(certFiles, keyFiles []string) ([]CertificateFiles, error) {
+	if len(certFiles) != len(keyFiles) {
+		return nil, fmt.Errorf("got %d certificate files but %d key files, each certificate needs a key", len(certFiles), len(keyFiles))
+	}
+
+	pairs := make([]CertificateFiles, 0, len(certFiles))
+	for i := range certFiles {
+		pairs = append(pairs, CertificateFiles{CertFile: certFiles[i], KeyFile: keyFiles[i]})
+	}
+	return pairs, nil
+}
+
+// StaticCertificateStore serves certificates loaded from files, picked by the
+// names in their subject alternative names, and reloads them when the files change
+type StaticCertificateStore struct {
+	files  []CertificateFiles
+	certs  []*tls.Certificate // same order as files
+	byName map[string]*tls.Certificate
+	mu     sync.RWMutex
+	logger zerolog.Logger
+}
+
+func NewStaticCertificateStore(files []CertificateFiles) (*StaticCertificateStore, error) {
+	if len(files) == 0 {
+		return nil, fmt.Errorf("at least one certificate and key file is required")
+	}
+
+	store := &StaticCertificateStore{
+		files:  files,
+		certs:  make([]*tls.Certificate, len(files)),
+		logger: shared.GetLogger("certs.static"),
+	}
+
+	for i, f := range files {
+		cert, err := loadCertificateFiles(f)
+		if err != nil {
+			return nil, err
+		}
+		store.certs[i] = cert
+	}
+	store.index()
+
+	return store, nil
+}
+
+func loadCertificateFiles(f CertificateFiles) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(f.CertFile, f.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load certificate %s: %w", f.CertFile, err)
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate %s: %w", f.CertFile, err)
+	}
+	cert.Leaf = leaf
+
+	return &cert, nil
+}
+
+// index maps every san to its certificate, earlier files win on overlap
+func (s *StaticCertificateStore) index() {
+	byName := make(map[string]*tls.Certificate)
+	for i, cert := range s.certs {
+		names := cert.Leaf.DNSNames
+		if len(names) == 0 && cert.Leaf.Subject.CommonName != "" {
+			names = []string{cert.Leaf.Subject.CommonName}
+		}
+
+		for _, name := range names {
+			name = strings.ToLower(name)
+			if _, exists := byName[name]; exists {
+				continue
+			}
+			byName[name] = cert
+			s.logger.Debug().Str("name", name).Str("file", s.files[i].CertFile).Msg("static certificate indexed")
+		}
+	}
+
+	s.mu.Lock()
+	s.byName = byName
+	s.mu.Unlock()
+}
+
+// Certificate returns the certificate whose sans cover host, falling back to
+// the first configured certificate like crypto/tls does
+func (s *StaticCertificateStore) Certificate(host string) *tls.Certificate {
+	host = strings.ToLower(host)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if cert, ok := s.byName[host]; ok {
+		return cert
+	}
+
+	if dot := strings.IndexByte(host, '.'); dot > 0 {
+		if cert, ok := s.byName["*"+host[dot:]]; ok {
+			return cert
+		}
+	}
+
+	s.logger.Debug().Str("host", host).Msg("no static certificate matches host, using the default")
+	return s.certs[0]
+}
+
+// Certificates returns the loaded certificates in configuration order
+func (s *StaticCertificateStore) Certificates() []*tls.Certificate {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	certs := make([]*tls.Certificate, len(s.certs))
+	copy(certs, s.certs)
+	return certs
+}
+
+// Reload reads all files again. a pair that fails to load keeps its previous
+// certificate so a half-written file never takes a domain offline.
+func (s *StaticCertificateStore) Reload() {
+	s.mu.RLock()
+	certs := make([]*tls.Certificate, len(s.certs))
+	copy(certs, s.certs)
+	s.mu.RUnlock()
+
+	for i, f := range s.files {
+		cert, err := loadCertificateFiles(f)
+		if err != nil {
+			s.logger.Error().Err(err).Str("cert_file", f.CertFile).Msg("failed to reload certificate, keeping the previous one")
+			continue
+		}
+		certs[i] = cert
+	}
+
+	s.mu.Lock()
+	s.certs = certs
+	s.mu.Unlock()
+	s.index()
+
+	s.logger.Info().Int("certificates", len(certs)).Msg("static certificates reloaded")
+}
+
+// Watch reloads the certificates when their files change until ctx is done.
+// the parent directories are watched so replacing a file or a mounted secret
+// symlink is noticed as well.
+func (s *StaticCertificateStore) Watch(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to create file watcher: %w", err)
+	}
+
+	dirs := make(map[string]struct{})
+	for _, f := range s.files {
+		dirs[filepath.Dir(f.CertFile)] = struct{}{}
+		dirs[filepath.Dir(f.KeyFile)] = struct{}{}
+	}
+	for dir := range dirs {
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+			return fmt.Errorf("failed to watch %s: %w", dir, err)
+		}
+	}
+
+	go func() {
+		defer watcher.Close()
+
+		var reload <-chan time.Time
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if event.Op == fsnotify.Chmod {
+					continue
+				}
+				s.logger.Debug().Str("file", event.Name).Str("op", event.Op.String()).Msg("certificate directory changed")
+				reload = time.After(staticReloadDelay)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				s.logger.Warn().Err(err).Msg("certificate file watcher error")
+			case <-reload:
+				reload = nil
+				s.Reload()
+			}
+		}
+	}()
+
+	s.logger.Info().Int("directories", len(dirs)).Msg("watching static certificates for changes")
+	return nil
+}
+
+func newStaticCertificateManager(certConfig CertificateConfig) (*CertificateManager, error) {
+	logger := shared.GetLogger("certs.manager")
+
+	store, err := NewStaticCertificateStore(certConfig.StaticCertificates)
+	if err != nil {
+		return nil, err
+	}
+
+	cm := &CertificateManager{
+		static:         store,
+		challenges:     NewChallengeSolver(),
+		renewals:       make(map[string]*renewalState),
+		renewalCtx:     context.Background(),
+		logger:         logger,
+		providerConfig: &ProviderConfig{},
+	}
+	cm.obtain = func(key string) (*tls.Certificate, error) {
+		return nil, fmt.Errorf("static tls mode cannot issue a certificate for %q", key)
+	}
+
+	// the lru cache is unused for static certificates but keeps the rest of the manager nil-safe
+	cm.certificates, err = newCertificateCache()
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Info().Int("certificates", len(certConfig.StaticCertificates)).Msg("certificate manager initialized with static certificates")
+	return cm, nil
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestCertificateFiles issues a certificate for name from a throwaway ca
+// and writes it to dir as <file>.crt and <file>.key
+func writeTestCertificateFiles(t *testing.T, ca *DevCA, dir, file, name string) CertificateFiles {
+	t.Helper()
+
+	resource, err := ca.Issue(name)
+	require.NoError(t, err)
+
+	files := CertificateFiles{
+		CertFile: filepath.Join(dir, file+".crt"),
+		KeyFile:  filepath.Join(dir, file+".key"),
+	}
+	require.NoError(t, os.WriteFile(files.CertFile, resource.Certificate, 0644))
+	require.NoError(t, os.WriteFile(files.KeyFile, resource.PrivateKey, 0600))
+	return files
+}
+
+func TestParseCertificateFiles(t *testing.T) {
+	pairs, err := ParseCertificateFiles([]string{"a.crt", "b.crt"}, []string{"a.key", "b.key"})
+	require.NoError(t, err)
+	assert.Equal(t, []CertificateFiles{{"a.crt", "a.key"}, {"b.crt", "b.key"}}, pairs)
+
+	_, err = ParseCertificateFiles([]string{"a.crt"}, nil)
+	assert.Error(t, err)
+}
+
+func TestStaticCertificateStore_Certificate(t *testing.T) {
+	ca, err := LoadOrCreateDevCA(t.TempDir())
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	store, err := NewStaticCertificateStore([]CertificateFiles{
+		writeTestCertificateFiles(t, ca, dir, "wildcard", "*.tunnel.example.com"),
+		writeTestCertificateFiles(t, ca, dir, "api", "api.example.com"),
+	})
+	require.NoError(t, err)
+
+	tests := []struct {
+		host     string
+		expected string
+	}{
+		{"demo.tunnel.example.com", "*.tunnel.example.com"},
+		{"tunnel.example.com", "*.tunnel.example.com"},
+		{"API.example.com", "api.example.com"},
+		{"a.b.tunnel.example.com", "*.tunnel.example.com"}, // no match, first certificate is the default
+		{"other.org", "*.tunnel.example.com"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			cert := store.Certificate(tt.host)
+			require.NotNil(t, cert)
+			assert.Equal(t, tt.expected, cert.Leaf.Subject.CommonName)
+		})
+	}
+}
+
+func TestStaticCertificateStore_Reload(t *testing.T) {
+	ca, err := LoadOrCreateDevCA(t.TempDir())
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	files := writeTestCertificateFiles(t, ca, dir, "site", "site.example.com")
+	store, err := NewStaticCertificateStore([]CertificateFiles{files})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	require.NoError(t, store.Watch(ctx))
+
+	// a broken file keeps the previous certificate
+	require.NoError(t, os.WriteFile(files.CertFile, []byte("not a certificate"), 0644))
+	store.Reload()
+	assert.Equal(t, "site.example.com", store.Certificate("site.example.com").Leaf.Subject.CommonName)
+
+	writeTestCertificateFiles(t, ca, dir, "site", "renamed.example.com")
+
+	require.Eventually(t, func() bool {
+		cert, ok := store.byNameLookup("renamed.example.com")
+		return ok && cert.Leaf.Subject.CommonName == "renamed.example.com"
+	}, 5*time.Second, 50*time.Millisecond, "watcher should pick up the replaced files")
+}
+
+func TestCertificateManager_StaticMode(t *testing.T) {
+	ca, err := LoadOrCreateDevCA(t.TempDir())
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	cm, err := NewCertificateManager(CertificateConfig{
+		Mode:               TLSModeStatic,
+		StaticCertificates: []CertificateFiles{writeTestCertificateFiles(t, ca, dir, "wildcard", "*.tunnel.example.com")},
+	})
+	require.NoError(t, err)
+	require.NoError(t, cm.PreloadCertificates())
+
+	cert, err := cm.GetCertificate(&tls.ClientHelloInfo{ServerName: "demo.tunnel.example.com"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"*.tunnel.example.com", "tunnel.example.com"}, cert.Leaf.DNSNames)
+
+	statuses := cm.Status()
+	require.Len(t, statuses, 1)
+	assert.True(t, statuses[0].Static)
+	assert.Nil(t, statuses[0].RenewAt)
+}
+
+func (s *StaticCertificateStore) byNameLookup(name string) (*tls.Certificate, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	cert, ok := s.byName[name]
+	return cert, ok
+}
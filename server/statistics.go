@@ -5,7 +5,15 @@ import (
 	"time"
 )
 
+// TunnelStatistics are the live statistics of a tunnel. the counters live in
+// the embedded snapshot so copying them never copies the lock.
 type TunnelStatistics struct {
+	TunnelStatisticsSnapshot
+
+	mu sync.RWMutex
+}
+
+type TunnelStatisticsSnapshot struct {
 	TotalRequests        int64 `json:"total_requests"`
 	TotalRequestsSuccess int64 `json:"total_requests_success"`
 	TotalRequestsError   int64 `json:"total_requests_error"`
@@ -25,14 +33,26 @@ type TunnelStatistics struct {
 	TimeoutCount     int64 `json:"timeout_count"`
 	ConnectionErrors int64 `json:"connection_errors"`
 	DataErrors       int64 `json:"data_errors"`
+	// CancelledCount counts requests the client was told to abandon
+	CancelledCount int64 `json:"cancelled_count"`
+	// OversizedBodies counts uploads refused and responses aborted for
+	// exceeding the tunnel's body limits
+	OversizedBodies int64 `json:"oversized_bodies"`
+	// QueueStalls counts messages that waited for room in a tunnel queue,
+	// FlowControlStalls body chunks that waited for the client's credit
+	QueueStalls       int64 `json:"queue_stalls"`
+	FlowControlStalls int64 `json:"flow_control_stalls"`
+	// CompressedResponses and EdgeBytesSaved count compression for visitors,
+	// TunnelBytesSaved compression on the tunnel hop
+	CompressedResponses int64 `json:"compressed_responses"`
+	EdgeBytesSaved      int64 `json:"edge_bytes_saved"`
+	TunnelBytesSaved    int64 `json:"tunnel_bytes_saved"`
 
 	ClientIP  string `json:"client_ip"`
 	UserAgent string `json:"user_agent,omitempty"`
 
 	CreatedAt   time.Time `json:"created_at"`
 	LastUpdated time.Time `json:"last_updated"`
-
-	mu sync.RWMutex
 }
 
 type HistoricalDataPoint struct {
@@ -54,6 +74,12 @@ type TunnelHistoricalData struct {
 }
 
 type ServerMetrics struct {
+	ServerMetricsSnapshot
+
+	mu sync.RWMutex
+}
+
+type ServerMetricsSnapshot struct {
 	TotalTunnels          int64 `json:"total_tunnels"`
 	ActiveTunnels         int   `json:"active_tunnels"`
 	TotalRequests         int64 `json:"total_requests"`
@@ -71,13 +97,11 @@ type ServerMetrics struct {
 
 	ServerUptime string    `json:"server_uptime"`
 	LastUpdated  time.Time `json:"last_updated"`
-
-	mu sync.RWMutex
 }
 
 func NewTunnelStatistics(tunnelID, clientIP, userAgent string) *TunnelStatistics {
 	now := time.Now()
-	return &TunnelStatistics{
+	return &TunnelStatistics{TunnelStatisticsSnapshot: TunnelStatisticsSnapshot{
 		ClientIP:          clientIP,
 		UserAgent:         userAgent,
 		CreatedAt:         now,
@@ -86,7 +110,7 @@ func NewTunnelStatistics(tunnelID, clientIP, userAgent string) *TunnelStatistics
 		MinResponseTime:   -1,
 		ConnectionsActive: 1,
 		ConnectionsTotal:  1,
-	}
+	}}
 }
 
 func (ts *TunnelStatistics) RecordRequest(responseTimeMs float64, success bool, bytesIn, bytesOut int64) {
@@ -138,9 +162,46 @@ func (ts *TunnelStatistics) RecordError(errorType string) {
 		ts.ConnectionErrors++
 	case "data":
 		ts.DataErrors++
+	case "cancelled":
+		ts.CancelledCount++
+	case "oversized":
+		ts.OversizedBodies++
+	}
+}
+
+func (ts *TunnelStatistics) RecordStall(stallType string) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	ts.LastUpdated = time.Now()
+
+	switch stallType {
+	case "queue":
+		ts.QueueStalls++
+	case "flow":
+		ts.FlowControlStalls++
 	}
 }
 
+// RecordCompression counts a response compressed for a visitor
+func (ts *TunnelStatistics) RecordCompression(saved int64) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	ts.CompressedResponses++
+	ts.EdgeBytesSaved += saved
+	ts.LastUpdated = time.Now()
+}
+
+// RecordTunnelCompression counts the bytes a compressed body saved on the tunnel hop
+func (ts *TunnelStatistics) RecordTunnelCompression(saved int64) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	ts.TunnelBytesSaved += saved
+	ts.LastUpdated = time.Now()
+}
+
 func (ts *TunnelStatistics) RecordReconnect() {
 	ts.mu.Lock()
 	defer ts.mu.Unlock()
@@ -150,11 +211,11 @@ func (ts *TunnelStatistics) RecordReconnect() {
 	ts.LastUpdated = time.Now()
 }
 
-func (ts *TunnelStatistics) GetSnapshot() TunnelStatistics {
+func (ts *TunnelStatistics) GetSnapshot() TunnelStatisticsSnapshot {
 	ts.mu.RLock()
 	defer ts.mu.RUnlock()
 
-	return *ts
+	return ts.TunnelStatisticsSnapshot
 }
 
 func NewTunnelHistoricalData(tunnelID string, maxPoints int, interval time.Duration) *TunnelHistoricalData {
@@ -166,7 +227,7 @@ func NewTunnelHistoricalData(tunnelID string, maxPoints int, interval time.Durat
 	}
 }
 
-func (thd *TunnelHistoricalData) AddDataPoint(stats TunnelStatistics) {
+func (thd *TunnelHistoricalData) AddDataPoint(stats TunnelStatisticsSnapshot) {
 	thd.mu.Lock()
 	defer thd.mu.Unlock()
 
@@ -210,9 +271,9 @@ func (thd *TunnelHistoricalData) GetDataPointsInRange(start, end time.Time) []Hi
 }
 
 func NewServerMetrics(startTime time.Time) *ServerMetrics {
-	return &ServerMetrics{
+	return &ServerMetrics{ServerMetricsSnapshot: ServerMetricsSnapshot{
 		LastUpdated: time.Now(),
-	}
+	}}
 }
 
 func (sm *ServerMetrics) UpdateServerMetrics(activeTunnels int, totalRequests int64, routerStats map[string]interface{}, startTime time.Time) {
@@ -234,9 +295,9 @@ func (sm *ServerMetrics) UpdateServerMetrics(activeTunnels int, totalRequests in
 	}
 }
 
-func (sm *ServerMetrics) GetSnapshot() ServerMetrics {
+func (sm *ServerMetrics) GetSnapshot() ServerMetricsSnapshot {
 	sm.mu.RLock()
 	defer sm.mu.RUnlock()
 
-	return *sm
+	return sm.ServerMetricsSnapshot
 }
@@ -0,0 +1,253 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/karol-broda/funnel/shared"
+)
+
+const (
+	// responseChannelSize buffers response_body chunks while the visitor is
+	// written to, a whole stream window of them with flow control
+	responseChannelSize = shared.DefaultStreamWindow/shared.ChunkOverhead + 1
+	// queueTimeout bounds the wait for room in the outgoing queue of messages
+	// that are not part of a stream
+	queueTimeout = 10 * time.Second
+	// defaultStreamIdleTimeout bounds the silence between chunks of a streamed
+	// response, server-sent event streams send keep-alive comments well within it
+	defaultStreamIdleTimeout = 60 * time.Second
+)
+
+var errOutgoingQueueFull = errors.New("outgoing message queue full")
+
+// streamableRequest reports whether a request body should be sent in chunks
+// rather than read up front: when its size is unknown, as for chunked uploads
+// and grpc, or larger than one chunk
+func streamableRequest(r *http.Request) bool {
+	if r.Body == nil || r.Body == http.NoBody {
+		return false
+	}
+	return r.ContentLength < 0 || r.ContentLength > shared.StreamChunkSize || isGRPC(r.Header)
+}
+
+func isGRPC(header http.Header) bool {
+	return strings.HasPrefix(header.Get("Content-Type"), "application/grpc")
+}
+
+// announcedTrailers returns the declared trailer names without their values
+func announcedTrailers(trailer http.Header) map[string][]string {
+	if len(trailer) == 0 {
+		return nil
+	}
+	names := make(map[string][]string, len(trailer))
+	for name := range trailer {
+		names[name] = nil
+	}
+	return names
+}
+
+// streamRequestBody sends a visitor's request body to the tunnel in
+// request_body chunks until it ends or ctx is done, returning why it stopped
+// early
+func (tr *TunnelRouter) streamRequestBody(ctx context.Context, tunnel *Tunnel, r *http.Request, requestID string) error {
+	logger := shared.GetRequestLogger("server.router", tunnel.ID, requestID)
+	defer tunnel.flow.Close(requestID)
+
+	buf := make([]byte, shared.StreamChunkSize)
+	sent := 0
+	for {
+		n, err := r.Body.Read(buf)
+		if n > 0 {
+			chunk := &shared.Message{
+				Type:      "request_body",
+				TunnelID:  tunnel.ID,
+				RequestID: requestID,
+				Body:      append([]byte(nil), buf[:n]...),
+			}
+			if sendErr := tunnel.sendStreamMessage(ctx, chunk); sendErr != nil {
+				logger.Debug().Err(sendErr).Int("bytes_sent", sent).Msg("stopped streaming request body")
+				return sendErr
+			}
+			sent += n
+		}
+
+		if err == nil {
+			continue
+		}
+		// the request is over and the read was broken off on purpose
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		end := &shared.Message{
+			Type:      "request_body",
+			TunnelID:  tunnel.ID,
+			RequestID: requestID,
+			End:       true,
+		}
+		var tooLarge *http.MaxBytesError
+		switch {
+		case err == io.EOF:
+			end.Trailers = r.Trailer
+		case errors.As(err, &tooLarge):
+			logger.Warn().Int("bytes_sent", sent).Int64("max_request_body", tooLarge.Limit).Msg("streamed request body too large")
+			end.Error = "request body too large"
+		default:
+			logger.Warn().Err(err).Int("bytes_sent", sent).Msg("failed to read streamed request body")
+			end.Error = "failed to read request body"
+		}
+		if sendErr := tunnel.sendStreamMessage(ctx, end); sendErr != nil {
+			logger.Debug().Err(sendErr).Msg("failed to end streamed request body")
+			return sendErr
+		}
+		if err != io.EOF {
+			return err
+		}
+
+		logger.Debug().Int("bytes_sent", sent).Msg("request body streamed to tunnel")
+		return nil
+	}
+}
+
+// writeStreamedResponse writes a response whose body arrives in response_body
+// chunks, flushing each one so streams like grpc and server-sent events reach
+// the visitor as they are produced. there is no total deadline, only the
+// stream idle timeout between chunks. once the headers are out a lost tunnel
+// can only abort the response, so the visitor sees a broken stream rather
+// than a truncated body that looks complete. the same goes for a body that
+// outgrows the tunnel's limit.
+func (tr *TunnelRouter) writeStreamedResponse(w http.ResponseWriter, r *http.Request, tunnel *Tunnel, resp *shared.Message, respChan chan *shared.Message, idleTimeout time.Duration, requestStart time.Time) {
+	logger := shared.GetRequestLogger("server.router", tunnel.ID, resp.RequestID)
+	controller := http.NewResponseController(w)
+	defer tunnel.credit.Forget(resp.RequestID)
+
+	maxBody := tunnel.bodyLimits.MaxResponseBody
+	if length, err := strconv.ParseInt(http.Header(resp.Headers).Get("Content-Length"), 10, 64); err == nil && maxBody > 0 && length > maxBody {
+		tunnel.cancelRequest(resp.RequestID)
+		tr.rejectOversizedResponse(w, tunnel, resp.RequestID, length)
+		return
+	}
+
+	for name, values := range resp.Headers {
+		for _, value := range values {
+			w.Header().Add(name, value)
+		}
+	}
+	for name := range resp.Trailers {
+		w.Header().Add("Trailer", name)
+	}
+
+	// body is where chunks go, compressing them when the visitor gets an
+	// encoded response
+	var body io.Writer = w
+	var encoder compressor
+	encoded := &countingWriter{w: w}
+	if encoding := tr.server.compression.responseEncoding(r, resp.Status, w.Header(), -1); encoding != "" {
+		prepareEncodedHeader(w.Header(), encoding)
+		encoder = getCompressor(encoding, encoded)
+		defer putCompressor(encoding, encoder)
+		body = encoder
+	}
+
+	w.WriteHeader(resp.Status)
+	controller.Flush()
+
+	idle := time.NewTimer(idleTimeout)
+	defer idle.Stop()
+
+	bytesWritten := 0
+	for {
+		select {
+		case chunk := <-respChan:
+			if chunk == nil {
+				logger.Error().
+					Int("bytes_written", bytesWritten).
+					Msg("tunnel connection lost while streaming response")
+				panic(http.ErrAbortHandler)
+			}
+
+			if maxBody > 0 && int64(bytesWritten+len(chunk.Body)) > maxBody {
+				// the headers are out, all that is left is breaking off the stream
+				logger.Warn().
+					Int("bytes_written", bytesWritten).
+					Int64("max_response_body", maxBody).
+					Msg("streamed response body too large, aborting")
+				tunnel.recordError("oversized")
+				tunnel.cancelRequest(resp.RequestID)
+				panic(http.ErrAbortHandler)
+			}
+			if len(chunk.Body) > 0 {
+				n, err := body.Write(chunk.Body)
+				bytesWritten += n
+				if err == nil && encoder != nil {
+					err = encoder.Flush()
+				}
+				if err != nil {
+					logger.Warn().Err(err).Int("bytes_written", bytesWritten).Msg("failed to write response chunk")
+					tunnel.cancelRequest(resp.RequestID)
+					return
+				}
+				controller.Flush()
+			}
+
+			if !chunk.End {
+				// the visitor took the chunk, the client may send another
+				tunnel.credit.Consumed(resp.RequestID, shared.ChunkCost(chunk))
+				idle.Reset(idleTimeout)
+				continue
+			}
+			if chunk.Error != "" {
+				logger.Error().
+					Str("error", chunk.Error).
+					Int("bytes_written", bytesWritten).
+					Msg("client failed while streaming response")
+				panic(http.ErrAbortHandler)
+			}
+			if encoder != nil {
+				if err := encoder.Close(); err != nil {
+					logger.Warn().Err(err).Int("bytes_written", bytesWritten).Msg("failed to finish compressed response")
+					return
+				}
+				if tunnel.statistics != nil {
+					tunnel.statistics.RecordCompression(int64(bytesWritten) - encoded.n)
+				}
+			}
+			for name, values := range chunk.Trailers {
+				for _, value := range values {
+					w.Header().Add(http.TrailerPrefix+name, value)
+				}
+			}
+
+			logger.Info().
+				Int("status_code", resp.Status).
+				Int("bytes_written", bytesWritten).
+				Int("trailers", len(chunk.Trailers)).
+				Dur("total_request_duration", time.Since(requestStart)).
+				Msg("streamed response written")
+			return
+
+		case <-idle.C:
+			logger.Warn().
+				Int("bytes_written", bytesWritten).
+				Dur("idle_timeout", idleTimeout).
+				Dur("total_request_duration", time.Since(requestStart)).
+				Msg("streamed response idle for too long, aborting")
+			tunnel.cancelRequest(resp.RequestID)
+			panic(http.ErrAbortHandler)
+
+		case <-r.Context().Done():
+			logger.Warn().
+				Int("bytes_written", bytesWritten).
+				Dur("total_processing_time", time.Since(requestStart)).
+				Msg("client closed connection while streaming response")
+			tunnel.cancelRequest(resp.RequestID)
+			return
+		}
+	}
+}
@@ -0,0 +1,271 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/karol-broda/funnel/shared"
+)
+
+// joinStreamingTunnel connects a client that negotiates streaming and answers
+// every request with its body echoed back in chunks, ending with the request
+// trailers prefixed by "Echo-" and a Grpc-Status trailer
+func joinStreamingTunnel(t *testing.T, ts *httptest.Server, id string) {
+	t.Helper()
+
+	joinTestTunnel(t, ts, id, []string{shared.FeatureStreaming}, func(conn *websocket.Conn, msg *shared.Message) {
+		switch {
+		case msg.Type == "request":
+			trailers := map[string][]string{"Grpc-Status": nil}
+			for name := range msg.Trailers {
+				trailers["Echo-"+name] = nil
+			}
+			conn.WriteJSON(&shared.Message{
+				Type:      "response",
+				RequestID: msg.RequestID,
+				Status:    http.StatusOK,
+				Headers:   map[string][]string{"Content-Type": {"application/grpc"}},
+				Stream:    true,
+				Trailers:  trailers,
+			})
+			if !msg.Stream {
+				conn.WriteJSON(&shared.Message{Type: "response_body", RequestID: msg.RequestID, Body: msg.Body, End: true})
+			}
+		case msg.Type == "request_body":
+			end := &shared.Message{Type: "response_body", RequestID: msg.RequestID, Body: msg.Body, End: msg.End}
+			if msg.End {
+				end.Trailers = map[string][]string{"Grpc-Status": {"0"}}
+				for name, values := range msg.Trailers {
+					end.Trailers["Echo-"+name] = values
+				}
+			}
+			conn.WriteJSON(end)
+		}
+	})
+}
+
+func TestTunnelRouter_StreamsGRPCOverH2C(t *testing.T) {
+	_, router, ts := newPoolTestServer(t)
+	joinStreamingTunnel(t, ts, "app")
+
+	visitors := httptest.NewUnstartedServer(router)
+	visitors.Config.Protocols = new(http.Protocols)
+	visitors.Config.Protocols.SetHTTP1(true)
+	visitors.Config.Protocols.SetUnencryptedHTTP2(true)
+	visitors.Start()
+	defer visitors.Close()
+
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{Protocols: protocols}, Timeout: 5 * time.Second}
+
+	bodyReader, bodyWriter := io.Pipe()
+	req, _ := http.NewRequest(http.MethodPost, visitors.URL+"/echo.Echo/Say", bodyReader)
+	req.Host = "app.tunnel.example.com"
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+	req.Trailer = http.Header{"X-Checksum": nil}
+
+	go func() {
+		bodyWriter.Write([]byte("hello "))
+		bodyWriter.Write([]byte("world"))
+		req.Trailer.Set("X-Checksum", "abc")
+		bodyWriter.Close()
+	}()
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+	if resp.ProtoMajor != 2 {
+		t.Errorf("protocol = HTTP/%d, want HTTP/2", resp.ProtoMajor)
+	}
+	if resp.StatusCode != http.StatusOK || string(body) != "hello world" {
+		t.Fatalf("response = %d %q, want 200 %q", resp.StatusCode, body, "hello world")
+	}
+	if got := resp.Trailer.Get("Grpc-Status"); got != "0" {
+		t.Errorf("trailer Grpc-Status = %q, want %q", got, "0")
+	}
+	if got := resp.Trailer.Get("Echo-X-Checksum"); got != "abc" {
+		t.Errorf("request trailer X-Checksum reached the client as %q, want %q", got, "abc")
+	}
+}
+
+func TestTunnelRouter_StreamedResponseAbortsWhenTunnelIsLost(t *testing.T) {
+	s, router, ts := newPoolTestServer(t)
+	joinStreamingTunnel(t, ts, "app")
+
+	tunnel, exists := s.GetTunnel("app")
+	if !exists {
+		t.Fatal("tunnel not registered")
+	}
+
+	visitors := httptest.NewServer(router)
+	defer visitors.Close()
+
+	// hold the request body open so the stream never ends on its own
+	bodyReader, bodyWriter := io.Pipe()
+	defer bodyWriter.Close()
+	req, _ := http.NewRequest(http.MethodPost, visitors.URL+"/", bodyReader)
+	req.Host = "app.tunnel.example.com"
+	req.Header.Set("Content-Type", "application/grpc")
+
+	go func() {
+		bodyWriter.Write([]byte("partial"))
+		time.Sleep(100 * time.Millisecond)
+		tunnel.conn.Close()
+	}()
+
+	resp, err := visitors.Client().Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if _, err := io.ReadAll(resp.Body); err == nil {
+		t.Error("a stream cut off by a lost tunnel must not read as complete")
+	}
+}
+
+// sendEvents answers a request with a streamed event-stream response and its first event
+func sendEvents(conn *websocket.Conn, msg *shared.Message) {
+	conn.WriteJSON(&shared.Message{
+		Type:      "response",
+		RequestID: msg.RequestID,
+		Status:    http.StatusOK,
+		Headers:   map[string][]string{"Content-Type": {"text/event-stream"}},
+		Stream:    true,
+	})
+	conn.WriteJSON(&shared.Message{Type: "response_body", RequestID: msg.RequestID, Body: []byte("data: one\n\n")})
+}
+
+func TestTunnelRouter_FlushesServerSentEvents(t *testing.T) {
+	_, router, ts := newPoolTestServer(t)
+	release := make(chan struct{})
+	joinTestPool(t, ts, "app", "", "", func(conn *websocket.Conn, msg *shared.Message) {
+		sendEvents(conn, msg)
+		<-release
+		conn.WriteJSON(&shared.Message{Type: "response_body", RequestID: msg.RequestID, Body: []byte("data: two\n\n"), End: true})
+	})
+
+	visitors := httptest.NewServer(router)
+	defer visitors.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, visitors.URL+"/events", nil)
+	req.Host = "app.tunnel.example.com"
+	resp, err := visitors.Client().Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Errorf("Content-Type = %q, want text/event-stream", resp.Header.Get("Content-Type"))
+	}
+
+	// the first event arrives while the stream is still open
+	first := make([]byte, len("data: one\n\n"))
+	if _, err := io.ReadFull(resp.Body, first); err != nil || string(first) != "data: one\n\n" {
+		t.Fatalf("first event = %q, %v", first, err)
+	}
+
+	close(release)
+	rest, err := io.ReadAll(resp.Body)
+	if err != nil || string(rest) != "data: two\n\n" {
+		t.Errorf("rest of the stream = %q, %v, want the second event", rest, err)
+	}
+}
+
+func TestTunnelRouter_AbortsIdleStreamedResponse(t *testing.T) {
+	s, router, ts := newPoolTestServer(t)
+	s.timeouts.IdleMs = 100
+	joinTestPool(t, ts, "app", "", "", func(conn *websocket.Conn, msg *shared.Message) {
+		sendEvents(conn, msg)
+	})
+
+	visitors := httptest.NewServer(router)
+	defer visitors.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, visitors.URL+"/events", nil)
+	req.Host = "app.tunnel.example.com"
+	resp, err := visitors.Client().Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	// nothing else arrives, so only the idle timeout ends the stream
+	body, err := io.ReadAll(resp.Body)
+	if err == nil {
+		t.Errorf("idle stream read as complete: %q", body)
+	}
+	if string(body) != "data: one\n\n" {
+		t.Errorf("body before the abort = %q, want the first event", body)
+	}
+}
+
+// blockingBody hands out one chunk, then blocks reads until it is closed
+type blockingBody struct {
+	first   bool
+	closed  chan struct{}
+	reading atomic.Int32
+}
+
+func (b *blockingBody) Read(p []byte) (int, error) {
+	b.reading.Add(1)
+	defer b.reading.Add(-1)
+	if !b.first {
+		b.first = true
+		return copy(p, "partial"), nil
+	}
+	<-b.closed
+	return 0, io.ErrClosedPipe
+}
+
+func (b *blockingBody) Close() error {
+	close(b.closed)
+	return nil
+}
+
+func TestTunnelRouter_StopsReadingStreamedBodyOnReturn(t *testing.T) {
+	_, router, ts := newPoolTestServer(t)
+	// the local service answers before the visitor finished sending
+	joinTestTunnel(t, ts, "app", []string{shared.FeatureStreaming}, func(conn *websocket.Conn, msg *shared.Message) {
+		if msg.Type == "request" {
+			conn.WriteJSON(&shared.Message{Type: "response", RequestID: msg.RequestID, Status: http.StatusAccepted})
+		}
+	})
+
+	body := &blockingBody{closed: make(chan struct{})}
+	req := httptest.NewRequest(http.MethodPost, "http://app.tunnel.example.com/upload", body)
+	rec := httptest.NewRecorder()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		router.ServeHTTP(rec, req)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the handler never returned")
+	}
+
+	if rec.Code != http.StatusAccepted {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusAccepted)
+	}
+	if body.reading.Load() != 0 {
+		t.Error("the request body is still read after the handler returned")
+	}
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/karol-broda/funnel/shared"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = shared.Tracer("server")
+
+// visitorRequestID is the id a request is known by outside the server: the one
+// a proxy in front of the server gave it, or its own. it is passed on to the
+// local service, which the id used on the tunnel is not, since visitors
+// cannot be trusted to keep theirs unique.
+func visitorRequestID(r *http.Request, requestID string) string {
+	if id := r.Header.Get(shared.RequestIDHeader); shared.ValidRequestID(id) {
+		return id
+	}
+	return requestID
+}
+
+// startRequestSpan starts the span of a visitor request, continuing the trace
+// it came with, and passes the new span on in the request's headers
+func startRequestSpan(r *http.Request, name, requestID string) (*http.Request, trace.Span) {
+	ctx, span := tracer.Start(shared.ExtractTraceContext(r.Context(), r.Header), name,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.request.method", r.Method),
+			attribute.String("server.address", r.Host),
+			attribute.String("url.path", r.URL.Path),
+			attribute.String("funnel.request_id", requestID),
+		),
+	)
+	shared.InjectTraceContext(ctx, r.Header)
+	return r.WithContext(ctx), span
+}
+
+// endRequestSpan ends the span of a visitor request with the status it was
+// answered with
+func endRequestSpan(span trace.Span, recorder *responseRecorder) {
+	shared.RecordHTTPStatus(span, recorder.statusCode())
+	span.SetAttributes(attribute.Int64("http.response.body.size", recorder.bytes))
+	span.End()
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/karol-broda/funnel/shared"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+var (
+	testSpans     = tracetest.NewSpanRecorder()
+	testSpansOnce sync.Once
+)
+
+// recordTestSpans installs a tracer provider recording the spans of the
+// package's tests. the global provider can only be installed once, so tests
+// tell their spans apart by trace id.
+func recordTestSpans() *tracetest.SpanRecorder {
+	testSpansOnce.Do(func() {
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(testSpans)))
+		otel.SetTextMapPropagator(propagation.TraceContext{})
+	})
+	return testSpans
+}
+
+func spansOfTrace(recorder *tracetest.SpanRecorder, traceID string) map[string]sdktrace.ReadOnlySpan {
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		if span.SpanContext().TraceID().String() == traceID {
+			spans[span.Name()] = span
+		}
+	}
+	return spans
+}
+
+func TestTunnelRouter_RequestIDAndTracing(t *testing.T) {
+	recorder := recordTestSpans()
+	_, router, ts := newPoolTestServer(t)
+
+	forwarded := make(chan map[string][]string, 1)
+	joinTestTunnel(t, ts, "app", compressionFeatures, func(conn *websocket.Conn, msg *shared.Message) {
+		if msg.Type == "request" {
+			forwarded <- msg.Headers
+			conn.WriteJSON(&shared.Message{Type: "response", RequestID: msg.RequestID, Status: http.StatusOK, Body: []byte("ok")})
+		}
+	})
+
+	tests := []struct {
+		name        string
+		requestID   string
+		traceID     string
+		keepsHeader bool
+	}{
+		{"visitor request id and trace", "edge-42", "4bf92f3577b34da6a3ce929d0e0e4736", true},
+		{"invalid request id", "two words", "5bf92f3577b34da6a3ce929d0e0e4736", false},
+		{"no request id", "", "6bf92f3577b34da6a3ce929d0e0e4736", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://app.tunnel.example.com/orders", nil)
+			req.Header.Set("Traceparent", "00-"+tt.traceID+"-00f067aa0ba902b7-01")
+			if tt.requestID != "" {
+				req.Header.Set(shared.RequestIDHeader, tt.requestID)
+			}
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200", rec.Code)
+			}
+
+			var headers http.Header
+			select {
+			case h := <-forwarded:
+				headers = http.Header(h)
+			case <-time.After(5 * time.Second):
+				t.Fatal("client did not receive the request")
+			}
+
+			requestID := headers.Get(shared.RequestIDHeader)
+			if tt.keepsHeader && requestID != tt.requestID {
+				t.Errorf("X-Request-Id = %q, want the visitor's %q", requestID, tt.requestID)
+			}
+			if !tt.keepsHeader && (requestID == "" || requestID == tt.requestID) {
+				t.Errorf("X-Request-Id = %q, want one generated by the server", requestID)
+			}
+
+			spans := spansOfTrace(recorder, tt.traceID)
+			routerSpan, tunnelSpan := spans["funnel.router"], spans["funnel.tunnel"]
+			if routerSpan == nil || tunnelSpan == nil {
+				t.Fatalf("recorded spans %v, want funnel.router and funnel.tunnel in the visitor's trace", spans)
+			}
+			if routerSpan.Parent().SpanID().String() != "00f067aa0ba902b7" {
+				t.Errorf("funnel.router parent = %s, want the visitor's span", routerSpan.Parent().SpanID())
+			}
+			if tunnelSpan.Parent().SpanID() != routerSpan.SpanContext().SpanID() {
+				t.Errorf("funnel.tunnel parent = %s, want funnel.router", tunnelSpan.Parent().SpanID())
+			}
+			expected := "00-" + tt.traceID + "-" + tunnelSpan.SpanContext().SpanID().String() + "-01"
+			if traceparent := headers.Get("Traceparent"); traceparent != expected {
+				t.Errorf("Traceparent = %q, want %q", traceparent, expected)
+			}
+			for _, attr := range routerSpan.Attributes() {
+				if attr.Key == "funnel.request_id" && attr.Value.AsString() != requestID {
+					t.Errorf("funnel.request_id = %q, want %q", attr.Value.AsString(), requestID)
+				}
+			}
+		})
+	}
+}
@@ -1,6 +1,8 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"sync"
 	"time"
@@ -17,12 +19,44 @@ type Tunnel struct {
 	outgoingMessages chan *shared.Message
 	server           *Server
 	closeOnce        sync.Once
+	closed           bool
+	closedMu         sync.RWMutex
 	runOnce          sync.Once
 	removed          bool
 	removedMu        sync.Mutex
 
+	// pool is set for members of a tunnel served by several clients
+	pool     *TunnelPool
+	memberID string
+	inflight int64
+
+	clientVersion string
+	tokenName     string
+	features      []string
+	binaryFraming bool
+	streaming     bool
+	timeouts      shared.TunnelTimeouts
+	// flow and credit are the two sides of flow control, nil when the client
+	// did not negotiate it: the credit left for request bodies sent to the
+	// client and the credit owed for its response bodies
+	flow   *shared.FlowWindow
+	credit *shared.CreditLedger
+	// done is closed with the connection, releasing senders waiting for room
+	done chan struct{}
+	// compressionThreshold is the smallest body compressed for the client,
+	// zero when it did not negotiate compression
+	compressionThreshold int
+	// bodyLimits bound the bodies of the tunnel's requests and responses
+	bodyLimits shared.BodyLimits
+
+	health          *shared.Health
+	healthChangedAt time.Time
+	healthMu        sync.RWMutex
+
 	ResponseChannels map[string]chan *shared.Message
 	ResponseMu       sync.RWMutex
+	// responseDone is closed when a request stops reading its response channel
+	responseDone map[string]chan struct{}
 
 	createdAt        time.Time
 	messagesReceived int64
@@ -41,73 +75,135 @@ func (s *Server) GetTunnel(id string) (*Tunnel, bool) {
 	return tunnel, exists
 }
 
-func (s *Server) AddTunnel(id string, conn *websocket.Conn, wg *sync.WaitGroup) *Tunnel {
-	logger := shared.GetTunnelLogger("server.tunnel", id)
-
+func (s *Server) newTunnel(id string, conn *websocket.Conn) *Tunnel {
 	clientIP := "unknown"
 	userAgent := ""
 	if conn != nil && conn.RemoteAddr() != nil {
 		clientIP = conn.RemoteAddr().String()
 	}
 
-	tunnel := &Tunnel{
+	return &Tunnel{
 		ID:               id,
 		conn:             conn,
 		ResponseChannels: make(map[string]chan *shared.Message),
+		responseDone:     make(map[string]chan struct{}),
 		incomingMessages: make(chan *shared.Message, 100),
 		outgoingMessages: make(chan *shared.Message, 100),
+		done:             make(chan struct{}),
 		server:           s,
 		createdAt:        time.Now(),
 		statistics:       NewTunnelStatistics(id, clientIP, userAgent),
 		historicalData:   NewTunnelHistoricalData(id, 1440, time.Minute), // 24 hours of minute-by-minute data
 	}
+}
+
+// AddTunnel registers a new tunnel for id, nil when the id is already taken
+func (s *Server) AddTunnel(id string, conn *websocket.Conn, wg *sync.WaitGroup) *Tunnel {
+	tunnel := s.newTunnel(id, conn)
+	if err := s.insertTunnel(tunnel); err != nil {
+		logger := shared.GetTunnelLogger("server.tunnel", id)
+		logger.Warn().Err(err).Msg("tunnel not added")
+		return nil
+	}
+	return tunnel
+}
+
+// insertTunnel makes a fully set up tunnel reachable, unless its id was taken
+// since it was checked
+func (s *Server) insertTunnel(tunnel *Tunnel) error {
+	logger := shared.GetTunnelLogger("server.tunnel", tunnel.ID)
 
 	s.TunnelsMu.Lock()
+	if _, exists := s.Tunnels[tunnel.ID]; exists {
+		s.TunnelsMu.Unlock()
+		return ErrTunnelIDInUse
+	}
+	s.Tunnels[tunnel.ID] = tunnel
 	tunnelCount := len(s.Tunnels)
-	s.Tunnels[id] = tunnel
 	s.TunnelsMu.Unlock()
 
 	logger.Info().
-		Int("total_tunnels", tunnelCount+1).
+		Int("total_tunnels", tunnelCount).
 		Int("incoming_buffer_size", cap(tunnel.incomingMessages)).
 		Int("outgoing_buffer_size", cap(tunnel.outgoingMessages)).
 		Msg("tunnel added to server")
 
-	return tunnel
+	return nil
 }
 
+// RemoveTunnel removes a tunnel, and every member when it is a pool
 func (s *Server) RemoveTunnel(id string) {
-	s.TunnelsMu.Lock()
+	s.TunnelsMu.RLock()
 	tunnel, exists := s.Tunnels[id]
-	delete(s.Tunnels, id)
+	s.TunnelsMu.RUnlock()
+
+	if !exists {
+		logger := shared.GetTunnelLogger("server.tunnel", id)
+		logger.Warn().Msg("attempted to remove non-existent tunnel")
+		return
+	}
+
+	if tunnel.pool == nil {
+		s.removeTunnel(tunnel)
+		return
+	}
+	for _, member := range tunnel.pool.Members() {
+		s.removeTunnel(member)
+	}
+}
+
+// removeTunnel removes one client connection. a pool keeps its id until the
+// last member is gone.
+func (s *Server) removeTunnel(tunnel *Tunnel) {
+	tunnel.removedMu.Lock()
+	if tunnel.removed {
+		tunnel.removedMu.Unlock()
+		return
+	}
+	tunnel.removed = true
+	tunnel.removedMu.Unlock()
+
+	s.TunnelsMu.Lock()
+	remainingMembers := 0
+	if tunnel.pool != nil {
+		remainingMembers = tunnel.pool.remove(tunnel)
+	}
+	if current, ok := s.Tunnels[tunnel.ID]; ok && current == tunnel {
+		if remainingMembers > 0 {
+			s.Tunnels[tunnel.ID] = tunnel.pool.Members()[0]
+		} else {
+			delete(s.Tunnels, tunnel.ID)
+		}
+	}
 	remainingTunnels := len(s.Tunnels)
 	s.TunnelsMu.Unlock()
 
-	if exists {
-		tunnel.removedMu.Lock()
-		tunnel.removed = true
-		tunnel.removedMu.Unlock()
+	tunnel.closeConnection()
 
-		tunnel.closeConnection()
+	if remainingMembers == 0 {
+		s.releaseHostnames(tunnel.ID)
+		s.clusterChanged()
 
 		if s.router != nil {
-			s.router.InvalidateCache(id)
+			s.router.InvalidateCache(tunnel.ID)
 		}
+	}
 
-		logger := shared.GetTunnelLogger("server.tunnel", id)
-		lifetime := time.Since(tunnel.createdAt)
-		logger.Info().
-			Int("remaining_tunnels", remainingTunnels).
-			Dur("tunnel_lifetime", lifetime).
-			Int64("messages_received", tunnel.messagesReceived).
-			Int64("messages_sent", tunnel.messagesSent).
-			Int64("bytes_received", tunnel.bytesReceived).
-			Int64("bytes_sent", tunnel.bytesSent).
-			Msg("tunnel removed from server")
-	} else {
-		logger := shared.GetTunnelLogger("server.tunnel", id)
-		logger.Warn().Msg("attempted to remove non-existent tunnel")
+	logger := shared.GetTunnelLogger("server.tunnel", tunnel.ID)
+	lifetime := time.Since(tunnel.createdAt)
+	event := logger.Info().
+		Int("remaining_tunnels", remainingTunnels).
+		Dur("tunnel_lifetime", lifetime).
+		Int64("messages_received", tunnel.messagesReceived).
+		Int64("messages_sent", tunnel.messagesSent).
+		Int64("bytes_received", tunnel.bytesReceived).
+		Int64("bytes_sent", tunnel.bytesSent)
+	if tunnel.pool != nil {
+		event = event.
+			Str("member_id", tunnel.memberID).
+			Int("remaining_members", remainingMembers)
 	}
+	event.Msg("tunnel removed from server")
 }
 
 func (s *Server) TunnelExists(id string) bool {
@@ -138,14 +234,12 @@ func (t *Tunnel) readMessages() {
 	}
 
 	for {
-		var msg shared.Message
-
 		readStart := time.Now()
 		if t.conn == nil {
 			logger.Error().Msg("tunnel connection became nil during read")
 			return
 		}
-		err := t.conn.ReadJSON(&msg)
+		frameType, data, err := t.conn.ReadMessage()
 		readDuration := time.Since(readStart)
 
 		if err != nil {
@@ -157,6 +251,24 @@ func (t *Tunnel) readMessages() {
 			return
 		}
 
+		msg, err := shared.DecodeFrame(frameType == websocket.BinaryMessage, data)
+		if err != nil {
+			logger.Error().Err(err).
+				Int("frame_size", len(data)).
+				Msg("failed to decode message from client")
+			continue
+		}
+		saved, err := shared.DecompressBody(msg)
+		if err != nil {
+			logger.Error().Err(err).
+				Str("message_type", msg.Type).
+				Str("request_id", msg.RequestID).
+				Msg("failed to decompress message from client")
+			t.closeConnection()
+			return
+		}
+		t.recordTunnelCompression(saved)
+
 		t.messagesReceived++
 		messageSize := int64(len(msg.Body))
 		t.bytesReceived += messageSize
@@ -169,12 +281,16 @@ func (t *Tunnel) readMessages() {
 			Msg("message received from client")
 
 		select {
-		case t.incomingMessages <- &msg:
+		case t.incomingMessages <- msg:
 		default:
-			logger.Warn().
+			// the router only falls behind on a slow visitor of a client
+			// without flow control, stop reading until it catches up
+			t.recordStall("queue")
+			logger.Debug().
 				Str("message_type", msg.Type).
 				Int("queue_capacity", cap(t.incomingMessages)).
-				Msg("message channel full, dropping message")
+				Msg("incoming message queue full, waiting for the router")
+			t.incomingMessages <- msg
 		}
 	}
 }
@@ -196,44 +312,121 @@ func (t *Tunnel) writeMessages() {
 		return
 	}
 
-	for msg := range t.outgoingMessages {
-		writeStart := time.Now()
-		if t.conn == nil {
-			logger.Error().Msg("tunnel connection became nil during write")
-			return
+	for {
+		var batch []*shared.Message
+		select {
+		case msg, ok := <-t.outgoingMessages:
+			if !ok {
+				return
+			}
+			batch = []*shared.Message{msg}
+		case <-t.credit.Due():
+			// credit is sent from here so the router never waits for the queue
+			batch = t.credit.Updates()
 		}
-		err := t.conn.WriteJSON(msg)
-		writeDuration := time.Since(writeStart)
 
-		if err != nil {
-			logger.Error().Err(err).
+		for _, msg := range batch {
+			writeStart := time.Now()
+			if t.conn == nil {
+				logger.Error().Msg("tunnel connection became nil during write")
+				return
+			}
+			msg, saved := shared.CompressBody(msg, t.compressionThreshold)
+			t.recordTunnelCompression(saved)
+			err := t.writeMessage(msg)
+			writeDuration := time.Since(writeStart)
+
+			if err != nil {
+				logger.Error().Err(err).
+					Str("message_type", msg.Type).
+					Str("request_id", msg.RequestID).
+					Dur("write_duration", writeDuration).
+					Msg("websocket write failed")
+				t.closeConnection()
+				return
+			}
+
+			t.messagesSent++
+			messageSize := int64(len(msg.Body))
+			t.bytesSent += messageSize
+
+			logger.Debug().
 				Str("message_type", msg.Type).
 				Str("request_id", msg.RequestID).
+				Int64("message_size", messageSize).
 				Dur("write_duration", writeDuration).
-				Msg("websocket write failed")
-			t.closeConnection()
-			return
+				Msg("message sent to client")
 		}
+	}
+}
 
-		t.messagesSent++
-		messageSize := int64(len(msg.Body))
-		t.bytesSent += messageSize
+func (t *Tunnel) writeMessage(msg *shared.Message) error {
+	if !t.binaryFraming {
+		return t.conn.WriteJSON(msg)
+	}
 
-		logger.Debug().
+	frame, err := shared.EncodeBinaryMessage(msg)
+	if err != nil {
+		return err
+	}
+	return t.conn.WriteMessage(websocket.BinaryMessage, frame)
+}
+
+// SendMessage queues a message for the client, waiting up to queueTimeout
+// while the outgoing queue is full
+func (t *Tunnel) SendMessage(msg *shared.Message) error {
+	ctx, cancel := context.WithTimeout(context.Background(), queueTimeout)
+	defer cancel()
+
+	err := t.queueMessage(ctx, msg)
+	if errors.Is(err, errOutgoingQueueFull) {
+		logger := shared.GetTunnelLogger("server.tunnel", t.ID)
+		logger.Error().
 			Str("message_type", msg.Type).
 			Str("request_id", msg.RequestID).
-			Int64("message_size", messageSize).
-			Dur("write_duration", writeDuration).
-			Msg("message sent to client")
+			Int("queue_capacity", cap(t.outgoingMessages)).
+			Dur("queue_timeout", queueTimeout).
+			Msg("outgoing message queue stayed full, dropping message")
 	}
+	return err
 }
 
-func (t *Tunnel) SendMessage(msg *shared.Message) error {
+// sendStreamMessage queues a body chunk once the client granted credit for
+// it, waiting for credit and for room in the queue until ctx is done
+func (t *Tunnel) sendStreamMessage(ctx context.Context, msg *shared.Message) error {
+	stalled, err := t.flow.Acquire(ctx, msg.RequestID, shared.ChunkCost(msg))
+	if stalled {
+		t.recordStall("flow")
+	}
+	if err != nil {
+		return err
+	}
+	return t.queueMessage(ctx, msg)
+}
+
+// cancelRequest tells the client to stop working on a request the server gave
+// up on, because the visitor left or it ran out of time
+func (t *Tunnel) cancelRequest(requestID string) {
+	if t.statistics != nil {
+		t.statistics.RecordError("cancelled")
+	}
+	if err := t.SendMessage(&shared.Message{Type: "request_cancel", TunnelID: t.ID, RequestID: requestID}); err != nil {
+		logger := shared.GetRequestLogger("server.tunnel", t.ID, requestID)
+		logger.Debug().Err(err).Msg("failed to send request cancellation")
+	}
+}
+
+// queueMessage queues a message for the writer, waiting for room until ctx is
+// done or the tunnel closes
+func (t *Tunnel) queueMessage(ctx context.Context, msg *shared.Message) error {
 	if t.conn == nil {
 		return fmt.Errorf("tunnel connection is nil")
 	}
 
-	if t.outgoingMessages == nil {
+	// closeConnection closes outgoingMessages while holding the write lock
+	t.closedMu.RLock()
+	defer t.closedMu.RUnlock()
+	if t.outgoingMessages == nil || t.closed {
 		return fmt.Errorf("tunnel is closed, dropping message")
 	}
 
@@ -249,19 +442,41 @@ func (t *Tunnel) SendMessage(msg *shared.Message) error {
 
 	select {
 	case t.outgoingMessages <- msg:
-		logger.Debug().
-			Str("message_type", msg.Type).
-			Str("request_id", msg.RequestID).
-			Int("queue_len", len(t.outgoingMessages)).
-			Msg("message queued for sending")
-		return nil
 	default:
-		logger.Error().
-			Str("message_type", msg.Type).
-			Str("request_id", msg.RequestID).
-			Int("queue_capacity", cap(t.outgoingMessages)).
-			Msg("outgoing message queue full, dropping message")
-		return fmt.Errorf("outgoing message queue full")
+		t.recordStall("queue")
+		// closeConnection closes done before it takes the write lock
+		select {
+		case t.outgoingMessages <- msg:
+		case <-t.done:
+			return fmt.Errorf("tunnel is closed, dropping message")
+		case <-ctx.Done():
+			return fmt.Errorf("%w: %w", errOutgoingQueueFull, ctx.Err())
+		}
+	}
+
+	logger.Debug().
+		Str("message_type", msg.Type).
+		Str("request_id", msg.RequestID).
+		Int("queue_len", len(t.outgoingMessages)).
+		Msg("message queued for sending")
+	return nil
+}
+
+func (t *Tunnel) recordError(kind string) {
+	if t.statistics != nil {
+		t.statistics.RecordError(kind)
+	}
+}
+
+func (t *Tunnel) recordStall(kind string) {
+	if t.statistics != nil {
+		t.statistics.RecordStall(kind)
+	}
+}
+
+func (t *Tunnel) recordTunnelCompression(saved int) {
+	if saved != 0 && t.statistics != nil {
+		t.statistics.RecordTunnelCompression(int64(saved))
 	}
 }
 
@@ -288,18 +503,50 @@ func (t *Tunnel) routeMessages() {
 		switch msg.Type {
 		case "response":
 			t.ResponseMu.RLock()
-			if respChan, ok := t.ResponseChannels[msg.RequestID]; ok {
-				select {
-				case respChan <- msg:
-				default:
-					logger.Warn().
-						Str("request_id", msg.RequestID).
-						Msg("response channel was full, response dropped")
-				}
+			respChan, ok := t.ResponseChannels[msg.RequestID]
+			done := t.responseDone[msg.RequestID]
+			t.ResponseMu.RUnlock()
+			if !ok {
+				continue
+			}
+			select {
+			case respChan <- msg:
+			case <-done:
 			}
+		case "response_body":
+			// the chunk is off the tunnel, whatever becomes of its stream
+			t.credit.Received(shared.ChunkCost(msg))
+
+			t.ResponseMu.RLock()
+			respChan, ok := t.ResponseChannels[msg.RequestID]
+			done := t.responseDone[msg.RequestID]
 			t.ResponseMu.RUnlock()
+			if !ok {
+				continue
+			}
+			// chunks must not be dropped, a slow visitor holds up this tunnel
+			// until it takes the chunk or goes away
+			select {
+			case respChan <- msg:
+			case <-done:
+			}
+		case "window_update":
+			t.flow.Grant(msg.RequestID, msg.Credit)
 		case "ping":
 			t.SendMessage(&shared.Message{Type: "pong"})
+		case "health":
+			if msg.Health == nil {
+				continue
+			}
+			previous := t.UpstreamStatus()
+			t.setUpstreamHealth(msg.Health)
+			if current := t.UpstreamStatus(); current != previous {
+				logger.Info().
+					Str("upstream", current).
+					Int("status", msg.Health.Status).
+					Str("error", msg.Health.Error).
+					Msg("local service health changed")
+			}
 		default:
 			logger.Debug().
 				Str("message_type", msg.Type).
@@ -310,9 +557,12 @@ func (t *Tunnel) routeMessages() {
 }
 
 func (t *Tunnel) registerResponseChannel(requestID string) chan *shared.Message {
-	respChan := make(chan *shared.Message, 1)
+	respChan := make(chan *shared.Message, responseChannelSize)
 	t.ResponseMu.Lock()
 	t.ResponseChannels[requestID] = respChan
+	if t.responseDone != nil {
+		t.responseDone[requestID] = make(chan struct{})
+	}
 	t.ResponseMu.Unlock()
 	logger := shared.GetTunnelLogger("server.tunnel", t.ID)
 	logger.Debug().
@@ -325,6 +575,10 @@ func (t *Tunnel) unregisterResponseChannel(requestID string) {
 	t.ResponseMu.Lock()
 	defer t.ResponseMu.Unlock()
 	delete(t.ResponseChannels, requestID)
+	if done, ok := t.responseDone[requestID]; ok {
+		close(done)
+		delete(t.responseDone, requestID)
+	}
 }
 
 func (t *Tunnel) Run() {
@@ -335,13 +589,8 @@ func (t *Tunnel) Run() {
 				logger.Error().Msgf("recovered in run: %v", r)
 			}
 			t.closeConnection()
-			t.removedMu.Lock()
-			if !t.removed && t.server != nil {
-				t.removed = true
-				t.removedMu.Unlock()
-				t.server.RemoveTunnel(t.ID)
-			} else {
-				t.removedMu.Unlock()
+			if t.server != nil {
+				t.server.removeTunnel(t)
 			}
 		}()
 
@@ -404,8 +653,14 @@ func (t *Tunnel) closeConnection() {
 		if t.conn != nil {
 			t.conn.Close()
 		}
+		if t.done != nil {
+			close(t.done)
+		}
+		t.closedMu.Lock()
+		t.closed = true
 		if t.outgoingMessages != nil {
 			close(t.outgoingMessages)
 		}
+		t.closedMu.Unlock()
 	})
 }
@@ -73,6 +73,19 @@ func TestServerTunnelManagement(t *testing.T) {
 		}
 	})
 
+	t.Run("add taken id", func(t *testing.T) {
+		tunnelID := "test-tunnel-taken"
+		first := server.AddTunnel(tunnelID, nil, nil)
+		defer server.RemoveTunnel(tunnelID)
+
+		if second := server.AddTunnel(tunnelID, nil, nil); second != nil {
+			t.Error("expected a taken id to be refused")
+		}
+		if current, _ := server.GetTunnel(tunnelID); current != first {
+			t.Error("the connected tunnel must not be replaced")
+		}
+	})
+
 	t.Run("remove tunnel", func(t *testing.T) {
 		tunnelID := "test-tunnel-remove"
 		server.AddTunnel(tunnelID, nil, nil)
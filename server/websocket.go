@@ -1,6 +1,7 @@
 package server
 
 import (
+	"errors"
 	"net/http"
 	"strings"
 	"time"
@@ -17,40 +18,94 @@ func (s *Server) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 		Str("origin", r.Header.Get("Origin")).
 		Msg("websocket connection attempt")
 
-	token := extractToken(r)
-	tokenRecord, valid := s.ValidateToken(token)
-	if !valid {
+	// a certificate identity shares the token namespace, so reservations and
+	// id generation treat both the same
+	tokenName, authMethod, err := s.authenticate(r)
+	if err != nil {
 		logger.Warn().
+			Err(err).
 			Str("remote_addr", r.RemoteAddr).
-			Msg("websocket upgrade rejected - invalid or missing token")
+			Msg("websocket upgrade rejected - authentication failed")
+		if errors.Is(err, ErrClientCertRequired) {
+			http.Error(w, "unauthorized: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
 		http.Error(w, "unauthorized", http.StatusUnauthorized)
 		return
 	}
-
-	tokenName := ""
-	if tokenRecord != nil {
-		tokenName = tokenRecord.Name
+	if authMethod != "" {
+		logger.Debug().
+			Str("identity", tokenName).
+			Str("auth_method", authMethod).
+			Msg("tunnel client authenticated")
 	}
 
 	tunnelID := r.URL.Query().Get("id")
-	if tunnelID == "" {
-		logger.Warn().
-			Str("remote_addr", r.RemoteAddr).
-			Str("token_name", tokenName).
-			Msg("websocket upgrade rejected - missing tunnel id")
-		http.Error(w, "tunnel id required", http.StatusBadRequest)
-		return
+
+	poolStrategy := r.URL.Query().Get("pool")
+	if poolStrategy != "" {
+		if err := shared.ValidatePoolStrategy(poolStrategy); err != nil {
+			logger.Warn().Err(err).
+				Str("remote_addr", r.RemoteAddr).
+				Msg("websocket upgrade rejected - invalid pool strategy")
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if tunnelID == "" {
+			logger.Warn().
+				Str("remote_addr", r.RemoteAddr).
+				Msg("websocket upgrade rejected - pool without tunnel id")
+			http.Error(w, "joining a tunnel pool requires a tunnel id", http.StatusBadRequest)
+			return
+		}
 	}
 
-	if err := shared.ValidateTunnelID(tunnelID); err != nil {
-		logger.Warn().
-			Str("remote_addr", r.RemoteAddr).
+	if tunnelID == "" {
+		if !s.generateIDs {
+			logger.Warn().
+				Str("remote_addr", r.RemoteAddr).
+				Str("token_name", tokenName).
+				Msg("websocket upgrade rejected - missing tunnel id")
+			http.Error(w, "tunnel id required", http.StatusBadRequest)
+			return
+		}
+
+		generatedID, err := s.generateTunnelID(tokenName)
+		if err != nil {
+			logger.Error().Err(err).
+				Str("remote_addr", r.RemoteAddr).
+				Msg("websocket upgrade rejected - failed to generate tunnel id")
+			http.Error(w, "failed to generate tunnel id", http.StatusServiceUnavailable)
+			return
+		}
+		tunnelID = generatedID
+
+		logger.Info().
 			Str("tunnel_id", tunnelID).
 			Str("token_name", tokenName).
-			Err(err).
-			Msg("websocket upgrade rejected - invalid tunnel id format")
-		http.Error(w, "invalid tunnel id format: "+err.Error(), http.StatusBadRequest)
-		return
+			Msg("generated tunnel id for client")
+	} else {
+		if err := shared.ValidateTunnelID(tunnelID); err != nil {
+			logger.Warn().
+				Str("remote_addr", r.RemoteAddr).
+				Str("tunnel_id", tunnelID).
+				Str("token_name", tokenName).
+				Err(err).
+				Msg("websocket upgrade rejected - invalid tunnel id format")
+			http.Error(w, "invalid tunnel id format: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := s.checkTunnelID(tunnelID, tokenName); err != nil {
+			logger.Warn().
+				Str("remote_addr", r.RemoteAddr).
+				Str("tunnel_id", tunnelID).
+				Str("token_name", tokenName).
+				Err(err).
+				Msg("websocket upgrade rejected - tunnel id not available")
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
 	}
 
 	tunnelLogger := shared.GetTunnelLogger("server.websocket", tunnelID)
@@ -61,11 +116,12 @@ func (s *Server) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 		Str("token_name", tokenName).
 		Msg("websocket upgrade requested")
 
-	if s.TunnelExists(tunnelID) {
-		tunnelLogger.Warn().
+	if err := s.checkTunnelAvailable(tunnelID, tokenName, poolStrategy); err != nil {
+		tunnelLogger.Warn().Err(err).
 			Str("remote_addr", r.RemoteAddr).
+			Str("pool", poolStrategy).
 			Msg("websocket upgrade rejected - tunnel id already in use")
-		http.Error(w, "tunnel id already in use", http.StatusConflict)
+		http.Error(w, err.Error(), http.StatusConflict)
 		return
 	}
 
@@ -86,14 +142,88 @@ func (s *Server) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 		Str("remote_addr", r.RemoteAddr).
 		Msg("websocket upgrade successful")
 
-	tunnel := s.AddTunnel(tunnelID, conn, nil)
+	hello, err := s.readHello(conn)
+	if err != nil {
+		tunnelLogger.Warn().Err(err).
+			Str("remote_addr", r.RemoteAddr).
+			Msg("handshake failed, rejecting client")
+		s.rejectConnection(conn, err.Error())
+		return
+	}
+
+	hostnames, err := s.verifyHostnames(r.Context(), hello.Hostnames, tunnelID, s.publicHost(r, tunnelID))
+	if err != nil {
+		tunnelLogger.Warn().Err(err).
+			Strs("hostnames", hello.Hostnames).
+			Msg("custom hostnames rejected")
+		s.rejectConnection(conn, err.Error())
+		return
+	}
+
+	features := shared.NegotiateFeatures(hello.Features, s.features())
+
+	tunnel := s.newTunnel(tunnelID, conn)
+	tunnel.clientVersion = hello.ClientVersion
+	tunnel.tokenName = tokenName
+	tunnel.features = features
+	tunnel.binaryFraming = shared.HasFeature(features, shared.FeatureBinaryFraming)
+	tunnel.streaming = shared.HasFeature(features, shared.FeatureStreaming)
+	tunnel.timeouts = s.negotiateTimeouts(hello.Timeouts)
+	tunnel.bodyLimits = s.negotiateBodyLimits(tokenName, hello.BodyLimits)
+	if shared.HasFeature(features, shared.FeatureFlowControl) {
+		tunnel.flow = shared.NewFlowWindow(shared.DefaultTunnelWindow, shared.DefaultStreamWindow)
+		tunnel.credit = shared.NewCreditLedger(shared.DefaultTunnelWindow, shared.DefaultStreamWindow)
+	}
+	if shared.HasFeature(features, shared.FeatureCompression) {
+		tunnel.compressionThreshold = s.compression.TunnelMinSize
+	}
+
+	// the id may have been taken during the handshake, so it is checked again
+	// as the tunnel becomes reachable
+	if poolStrategy == "" {
+		err = s.insertTunnel(tunnel)
+	} else {
+		err = s.joinPool(tunnel, tokenName, poolStrategy)
+	}
+	if err != nil {
+		tunnelLogger.Warn().Err(err).
+			Str("pool", poolStrategy).
+			Msg("tunnel id taken during handshake, rejecting client")
+		s.rejectConnection(conn, err.Error())
+		return
+	}
 	tunnelLogger.Info().Msg("tunnel connected via websocket")
 
 	defer func() {
-		s.RemoveTunnel(tunnelID)
+		s.removeTunnel(tunnel)
 		tunnelLogger.Info().Msg("tunnel disconnected and cleaned up")
 	}()
 
+	if err := s.claimHostnames(tunnelID, hostnames); err != nil {
+		tunnelLogger.Warn().Err(err).Strs("hostnames", hostnames).Msg("custom hostnames rejected")
+		s.rejectConnection(conn, err.Error())
+		return
+	}
+	s.clusterChanged()
+
+	welcome := s.buildWelcome(r, tunnel, hostnames)
+	if err := conn.WriteJSON(&shared.Message{Type: "welcome", TunnelID: tunnelID, Welcome: welcome}); err != nil {
+		tunnelLogger.Error().Err(err).Msg("failed to send welcome message")
+		return
+	}
+
+	tunnelLogger.Info().
+		Str("client_version", hello.ClientVersion).
+		Int("protocol_version", hello.ProtocolVersion).
+		Strs("features", features).
+		Strs("hostnames", hostnames).
+		Int64("request_timeout_ms", tunnel.timeouts.TotalMs).
+		Int("path_timeouts", len(tunnel.timeouts.Paths)).
+		Int64("max_request_body", tunnel.bodyLimits.MaxRequestBody).
+		Int64("max_response_body", tunnel.bodyLimits.MaxResponseBody).
+		Str("public_url", welcome.PublicURL).
+		Msg("handshake completed")
+
 	s.setupWebSocketConnection(tunnel)
 	tunnel.Run()
 }
@@ -101,7 +231,7 @@ func (s *Server) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 func (s *Server) setupWebSocketConnection(tunnel *Tunnel) {
 	logger := shared.GetTunnelLogger("server.websocket", tunnel.ID)
 
-	readDeadline := 300 * time.Second
+	readDeadline := defaultReadDeadline
 	if err := tunnel.conn.SetReadDeadline(time.Now().Add(readDeadline)); err != nil {
 		logger.Error().Err(err).Msg("failed to set initial read deadline")
 		return
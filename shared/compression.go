@@ -0,0 +1,77 @@
+package shared
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// with compression negotiated, bodies on the tunnel hop are gzipped by the
+// sender, independent of any content-encoding the body itself has. a body is
+// compressed when it has at least the threshold the server announced and is
+// only sent compressed when that made it smaller.
+const (
+	DefaultCompressionThreshold = 1024
+	// MaxDecompressedBody bounds what a single compressed body may expand to
+	MaxDecompressedBody = 64 * 1024 * 1024
+)
+
+var gzipWriters = sync.Pool{
+	New: func() any {
+		w, _ := gzip.NewWriterLevel(nil, gzip.BestSpeed)
+		return w
+	},
+}
+
+// CompressBody returns a copy of msg with its body compressed and the bytes
+// that saved, or msg itself when its body is too small or does not shrink
+func CompressBody(msg *Message, threshold int) (*Message, int) {
+	if threshold <= 0 || len(msg.Body) < threshold || msg.Compressed {
+		return msg, 0
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(len(msg.Body) / 2)
+	w := gzipWriters.Get().(*gzip.Writer)
+	w.Reset(&buf)
+	_, err := w.Write(msg.Body)
+	if err == nil {
+		err = w.Close()
+	}
+	gzipWriters.Put(w)
+	if err != nil || buf.Len() >= len(msg.Body) {
+		return msg, 0
+	}
+
+	compressed := *msg
+	compressed.Body = buf.Bytes()
+	compressed.Compressed = true
+	return &compressed, len(msg.Body) - buf.Len()
+}
+
+// DecompressBody restores the body of a message compressed on the tunnel hop
+// in place, returning the bytes the compression saved
+func DecompressBody(msg *Message) (int, error) {
+	if !msg.Compressed {
+		return 0, nil
+	}
+
+	r, err := gzip.NewReader(bytes.NewReader(msg.Body))
+	if err != nil {
+		return 0, fmt.Errorf("failed to decompress body: %w", err)
+	}
+	body, err := io.ReadAll(io.LimitReader(r, MaxDecompressedBody+1))
+	if err != nil {
+		return 0, fmt.Errorf("failed to decompress body: %w", err)
+	}
+	if len(body) > MaxDecompressedBody {
+		return 0, fmt.Errorf("decompressed body exceeds %d bytes", MaxDecompressedBody)
+	}
+
+	saved := len(body) - len(msg.Body)
+	msg.Body = body
+	msg.Compressed = false
+	return saved, nil
+}
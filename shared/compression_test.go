@@ -0,0 +1,67 @@
+package shared
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+func TestCompressBody(t *testing.T) {
+	text := bytes.Repeat([]byte("funnel compresses repetitive bodies. "), 100)
+	random := make([]byte, 4096)
+	rand.Read(random)
+
+	tests := []struct {
+		name       string
+		body       []byte
+		threshold  int
+		compressed bool
+	}{
+		{"compressible body", text, DefaultCompressionThreshold, true},
+		{"below the threshold", text[:512], DefaultCompressionThreshold, false},
+		{"compression off", text, 0, false},
+		{"does not shrink", random, DefaultCompressionThreshold, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := &Message{Type: "response_body", RequestID: "req-1", Body: tt.body}
+			sent, saved := CompressBody(msg, tt.threshold)
+			if sent.Compressed != tt.compressed {
+				t.Fatalf("Compressed = %v, want %v", sent.Compressed, tt.compressed)
+			}
+			if !bytes.Equal(msg.Body, tt.body) || msg.Compressed {
+				t.Fatal("CompressBody() changed the original message")
+			}
+			if !tt.compressed {
+				if sent != msg || saved != 0 {
+					t.Errorf("CompressBody() = a copy saving %d bytes, want the message itself", saved)
+				}
+				return
+			}
+			if saved != len(tt.body)-len(sent.Body) || saved <= 0 {
+				t.Errorf("saved = %d, want %d", saved, len(tt.body)-len(sent.Body))
+			}
+
+			restored, err := DecompressBody(sent)
+			if err != nil {
+				t.Fatalf("DecompressBody() error = %v", err)
+			}
+			if restored != saved || !bytes.Equal(sent.Body, tt.body) || sent.Compressed {
+				t.Errorf("DecompressBody() did not restore the body")
+			}
+		})
+	}
+}
+
+func TestDecompressBody_Invalid(t *testing.T) {
+	msg := &Message{Type: "response_body", Body: []byte("not gzip"), Compressed: true}
+	if _, err := DecompressBody(msg); err == nil {
+		t.Error("expected an error for a body that is not gzip")
+	}
+
+	plain := &Message{Type: "response_body", Body: []byte("plain")}
+	if saved, err := DecompressBody(plain); saved != 0 || err != nil || string(plain.Body) != "plain" {
+		t.Errorf("DecompressBody() = %d, %v on an uncompressed body", saved, err)
+	}
+}
@@ -0,0 +1,222 @@
+package shared
+
+import (
+	"context"
+	"sync"
+)
+
+// with flow control the receiver of a streamed body grants the sender credit
+// for what it took off the tunnel and what it consumed. a sender may have no
+// more than a stream window of one body in flight, and no more than the
+// tunnel window of all bodies together, so one fast stream can neither bury
+// the tunnel nor outgrow the buffers of the other side.
+const (
+	DefaultStreamWindow = 256 * 1024
+	DefaultTunnelWindow = 4 * 1024 * 1024
+	// ChunkOverhead is charged for every body message on top of its bytes,
+	// bounding the number of messages of streams that send tiny chunks
+	ChunkOverhead = 4 * 1024
+)
+
+// ChunkCost is the credit a request_body or response_body message takes
+func ChunkCost(msg *Message) int64 {
+	return int64(len(msg.Body)) + ChunkOverhead
+}
+
+// FlowWindow is the sender's side of flow control: the credit left on the
+// tunnel and on each of its streams. a nil FlowWindow never blocks, for peers
+// that did not negotiate flow control.
+type FlowWindow struct {
+	mu         sync.Mutex
+	tunnel     int64
+	tunnelSize int64
+	streamSize int64
+	streams    map[string]int64
+	changed    chan struct{}
+	stalls     int64
+}
+
+func NewFlowWindow(tunnelWindow, streamWindow int64) *FlowWindow {
+	return &FlowWindow{
+		tunnel:     tunnelWindow,
+		tunnelSize: tunnelWindow,
+		streamSize: streamWindow,
+		streams:    make(map[string]int64),
+		changed:    make(chan struct{}),
+	}
+}
+
+// Acquire waits until the stream and the tunnel both have credit for cost and
+// takes it from them, reporting whether it had to wait
+func (w *FlowWindow) Acquire(ctx context.Context, streamID string, cost int64) (bool, error) {
+	if w == nil {
+		return false, nil
+	}
+	// a chunk larger than a whole window waits for the window to be free
+	cost = min(cost, w.tunnelSize, w.streamSize)
+
+	stalled := false
+	for {
+		w.mu.Lock()
+		stream, ok := w.streams[streamID]
+		if !ok {
+			stream = w.streamSize
+		}
+		if stream >= cost && w.tunnel >= cost {
+			w.streams[streamID] = stream - cost
+			w.tunnel -= cost
+			w.mu.Unlock()
+			return stalled, nil
+		}
+		if !stalled {
+			stalled = true
+			w.stalls++
+		}
+		changed := w.changed
+		w.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return stalled, ctx.Err()
+		}
+	}
+}
+
+// Grant returns credit to a stream, or to the tunnel when streamID is empty.
+// credit for a stream that already ended is ignored.
+func (w *FlowWindow) Grant(streamID string, credit int64) {
+	if w == nil || credit <= 0 {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if streamID == "" {
+		w.tunnel = min(w.tunnel+credit, w.tunnelSize)
+	} else if stream, ok := w.streams[streamID]; ok {
+		w.streams[streamID] = min(stream+credit, w.streamSize)
+	} else {
+		return
+	}
+	close(w.changed)
+	w.changed = make(chan struct{})
+}
+
+// Close forgets the window of a stream that ended
+func (w *FlowWindow) Close(streamID string) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	delete(w.streams, streamID)
+	w.mu.Unlock()
+}
+
+// Stalls counts the sends that had to wait for credit
+func (w *FlowWindow) Stalls() int64 {
+	if w == nil {
+		return 0
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.stalls
+}
+
+// CreditLedger is the receiver's side of flow control: the credit it owes the
+// sender until a window_update carries it back. the reader records credit
+// without ever blocking on the outgoing queue, the writer sends it once half
+// a window is due so there is no update for every chunk.
+type CreditLedger struct {
+	mu         sync.Mutex
+	tunnel     int64
+	tunnelSize int64
+	streamSize int64
+	streams    map[string]int64
+	due        chan struct{}
+}
+
+func NewCreditLedger(tunnelWindow, streamWindow int64) *CreditLedger {
+	return &CreditLedger{
+		tunnelSize: tunnelWindow,
+		streamSize: streamWindow,
+		streams:    make(map[string]int64),
+		due:        make(chan struct{}, 1),
+	}
+}
+
+// Received records a body message taken off the tunnel, its tunnel credit
+// is owed right away
+func (l *CreditLedger) Received(cost int64) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	l.tunnel += cost
+	due := l.tunnel*2 >= l.tunnelSize
+	l.mu.Unlock()
+	if due {
+		l.signal()
+	}
+}
+
+// Consumed records a body message of a stream that was passed on
+func (l *CreditLedger) Consumed(streamID string, cost int64) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	l.streams[streamID] += cost
+	due := l.streams[streamID]*2 >= l.streamSize
+	l.mu.Unlock()
+	if due {
+		l.signal()
+	}
+}
+
+// Forget drops the credit owed to a stream that ended
+func (l *CreditLedger) Forget(streamID string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	delete(l.streams, streamID)
+	l.mu.Unlock()
+}
+
+func (l *CreditLedger) signal() {
+	select {
+	case l.due <- struct{}{}:
+	default:
+	}
+}
+
+// Due is signaled when credit is due to be sent
+func (l *CreditLedger) Due() <-chan struct{} {
+	if l == nil {
+		return nil
+	}
+	return l.due
+}
+
+// Updates takes the credit that is due as window_update messages
+func (l *CreditLedger) Updates() []*Message {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var updates []*Message
+	if l.tunnel*2 >= l.tunnelSize {
+		updates = append(updates, &Message{Type: "window_update", Credit: l.tunnel})
+		l.tunnel = 0
+	}
+	for streamID, credit := range l.streams {
+		if credit*2 >= l.streamSize {
+			updates = append(updates, &Message{Type: "window_update", RequestID: streamID, Credit: credit})
+			l.streams[streamID] = 0
+		}
+	}
+	return updates
+}
@@ -0,0 +1,105 @@
+package shared
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestFlowWindow(t *testing.T) {
+	window := NewFlowWindow(100, 40)
+	ctx := context.Background()
+
+	if stalled, err := window.Acquire(ctx, "a", 30); stalled || err != nil {
+		t.Fatalf("Acquire() = %v, %v, want credit right away", stalled, err)
+	}
+
+	// the stream window is used up, the next chunk waits for credit
+	acquired := make(chan bool)
+	go func() {
+		stalled, _ := window.Acquire(ctx, "a", 30)
+		acquired <- stalled
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("Acquire() went past the stream window")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// other streams still have their own window
+	if _, err := window.Acquire(ctx, "b", 30); err != nil {
+		t.Fatalf("Acquire() on another stream = %v", err)
+	}
+
+	window.Grant("a", 30)
+	select {
+	case stalled := <-acquired:
+		if !stalled {
+			t.Error("Acquire() did not report the stall")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Acquire() still blocked after the grant")
+	}
+	if window.Stalls() != 1 {
+		t.Errorf("Stalls() = %d, want 1", window.Stalls())
+	}
+
+	// 90 of the tunnel window is taken, a third stream has to wait for it
+	timeout, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := window.Acquire(timeout, "c", 30); err == nil {
+		t.Fatal("Acquire() went past the tunnel window")
+	}
+	window.Grant("", 60)
+	if _, err := window.Acquire(ctx, "c", 30); err != nil {
+		t.Fatalf("Acquire() after tunnel credit = %v", err)
+	}
+
+	var unlimited *FlowWindow
+	if stalled, err := unlimited.Acquire(ctx, "a", 1<<30); stalled || err != nil {
+		t.Errorf("nil window Acquire() = %v, %v, want no flow control", stalled, err)
+	}
+}
+
+func TestCreditLedger(t *testing.T) {
+	ledger := NewCreditLedger(100, 40)
+
+	ledger.Received(30)
+	ledger.Consumed("a", 10)
+	if updates := ledger.Updates(); len(updates) != 0 {
+		t.Fatalf("Updates() = %d messages before half a window was due", len(updates))
+	}
+
+	ledger.Received(30)
+	ledger.Consumed("a", 10)
+	select {
+	case <-ledger.Due():
+	default:
+		t.Fatal("Due() not signaled")
+	}
+
+	updates := ledger.Updates()
+	if len(updates) != 2 {
+		t.Fatalf("Updates() = %d messages, want the tunnel and the stream update", len(updates))
+	}
+	for _, update := range updates {
+		switch update.RequestID {
+		case "":
+			if update.Credit != 60 {
+				t.Errorf("tunnel credit = %d, want 60", update.Credit)
+			}
+		case "a":
+			if update.Credit != 20 {
+				t.Errorf("stream credit = %d, want 20", update.Credit)
+			}
+		default:
+			t.Errorf("unexpected update for %q", update.RequestID)
+		}
+	}
+
+	ledger.Consumed("b", 30)
+	ledger.Forget("b")
+	if updates := ledger.Updates(); len(updates) != 0 {
+		t.Errorf("Updates() = %d messages for a forgotten stream", len(updates))
+	}
+}
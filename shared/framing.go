@@ -0,0 +1,67 @@
+package shared
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// binary frames carry a 4 byte big-endian header length, the json encoded
+// message without its body, and then the raw body bytes. this avoids the
+// base64 overhead json adds to []byte fields.
+const binaryHeaderPrefixSize = 4
+
+func EncodeBinaryMessage(msg *Message) ([]byte, error) {
+	header := *msg
+	header.Body = nil
+
+	headerBytes, err := json.Marshal(&header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal message header: %w", err)
+	}
+
+	frame := make([]byte, binaryHeaderPrefixSize+len(headerBytes)+len(msg.Body))
+	binary.BigEndian.PutUint32(frame, uint32(len(headerBytes)))
+	copy(frame[binaryHeaderPrefixSize:], headerBytes)
+	copy(frame[binaryHeaderPrefixSize+len(headerBytes):], msg.Body)
+
+	return frame, nil
+}
+
+func DecodeBinaryMessage(frame []byte) (*Message, error) {
+	if len(frame) < binaryHeaderPrefixSize {
+		return nil, errors.New("binary frame too short")
+	}
+
+	headerLen := int(binary.BigEndian.Uint32(frame))
+	if headerLen > len(frame)-binaryHeaderPrefixSize {
+		return nil, fmt.Errorf("binary frame header length %d exceeds frame size %d", headerLen, len(frame))
+	}
+
+	var msg Message
+	if err := json.Unmarshal(frame[binaryHeaderPrefixSize:binaryHeaderPrefixSize+headerLen], &msg); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal message header: %w", err)
+	}
+
+	body := frame[binaryHeaderPrefixSize+headerLen:]
+	if len(body) > 0 {
+		msg.Body = body
+	}
+
+	return &msg, nil
+}
+
+// DecodeFrame decodes a websocket frame payload into a message, using the
+// binary codec for binary frames and plain json for text frames
+func DecodeFrame(isBinary bool, data []byte) (*Message, error) {
+	if isBinary {
+		return DecodeBinaryMessage(data)
+	}
+
+	var msg Message
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
@@ -0,0 +1,92 @@
+package shared
+
+import (
+	"fmt"
+)
+
+// ProtocolVersion is the tunnel protocol version spoken by this build
+const ProtocolVersion = 1
+
+// MinProtocolVersion is the oldest protocol version this build still accepts
+const MinProtocolVersion = 1
+
+const (
+	FeatureCompression   = "compression"
+	FeatureBinaryFraming = "binary_framing"
+	FeatureStreaming     = "streaming"
+	FeatureHealthCheck   = "health_check"
+	FeatureFlowControl   = "flow_control"
+)
+
+// Hello is sent by the client as the first message after the websocket upgrade
+type Hello struct {
+	ClientVersion   string   `json:"client_version"`
+	GitCommit       string   `json:"git_commit,omitempty"`
+	ProtocolVersion int      `json:"protocol_version"`
+	Features        []string `json:"features,omitempty"`
+	Hostnames       []string `json:"hostnames,omitempty"`
+	// Timeouts asks for request timeouts other than the server's defaults,
+	// within the server's maximum
+	Timeouts *TunnelTimeouts `json:"timeouts,omitempty"`
+	// BodyLimits asks for smaller body limits than the server's
+	BodyLimits *BodyLimits `json:"body_limits,omitempty"`
+}
+
+// Limits describes the limits the server enforces for a tunnel
+type Limits struct {
+	RequestTimeoutMs int64 `json:"request_timeout_ms,omitempty"`
+	IdleTimeoutMs    int64 `json:"idle_timeout_ms,omitempty"`
+	// Timeouts are the request timeouts the tunnel got, what the client asked
+	// for capped by the server
+	Timeouts TunnelTimeouts `json:"timeouts"`
+	// StreamWindow and TunnelWindow are the flow control windows both sides
+	// keep, in bytes, when flow control was negotiated
+	StreamWindow int64 `json:"stream_window,omitempty"`
+	TunnelWindow int64 `json:"tunnel_window,omitempty"`
+	// CompressionThreshold is the smallest body either side compresses on the
+	// tunnel hop when compression was negotiated
+	CompressionThreshold int `json:"compression_threshold,omitempty"`
+	// BodyLimits are the body sizes the server enforces for the tunnel
+	BodyLimits BodyLimits `json:"body_limits"`
+}
+
+// Welcome is the server's answer to an accepted hello
+type Welcome struct {
+	TunnelID        string   `json:"tunnel_id"`
+	PublicURL       string   `json:"public_url"`
+	ServerVersion   string   `json:"server_version"`
+	ProtocolVersion int      `json:"protocol_version"`
+	Features        []string `json:"features,omitempty"`
+	Hostnames       []string `json:"hostnames,omitempty"`
+	Limits          Limits   `json:"limits"`
+}
+
+func CheckProtocolVersion(version int) error {
+	if version < MinProtocolVersion {
+		return fmt.Errorf("protocol version %d is too old, this build supports versions %d to %d - please upgrade funnel", version, MinProtocolVersion, ProtocolVersion)
+	}
+	if version > ProtocolVersion {
+		return fmt.Errorf("protocol version %d is newer than supported versions %d to %d - please upgrade the other side", version, MinProtocolVersion, ProtocolVersion)
+	}
+	return nil
+}
+
+// NegotiateFeatures returns the offered features that are also supported, in offered order
+func NegotiateFeatures(offered, supported []string) []string {
+	negotiated := make([]string, 0, len(offered))
+	for _, feature := range offered {
+		if HasFeature(supported, feature) && !HasFeature(negotiated, feature) {
+			negotiated = append(negotiated, feature)
+		}
+	}
+	return negotiated
+}
+
+func HasFeature(features []string, feature string) bool {
+	for _, f := range features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,140 @@
+package shared
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCheckProtocolVersion(t *testing.T) {
+	tests := []struct {
+		name        string
+		version     int
+		expectError bool
+	}{
+		{name: "current version", version: ProtocolVersion, expectError: false},
+		{name: "minimum version", version: MinProtocolVersion, expectError: false},
+		{name: "too old", version: MinProtocolVersion - 1, expectError: true},
+		{name: "too new", version: ProtocolVersion + 1, expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckProtocolVersion(tt.version)
+			if tt.expectError && err == nil {
+				t.Error("expected error but got none")
+			}
+			if !tt.expectError && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestNegotiateFeatures(t *testing.T) {
+	tests := []struct {
+		name      string
+		offered   []string
+		supported []string
+		expected  []string
+	}{
+		{
+			name:      "intersection keeps offered order",
+			offered:   []string{FeatureStreaming, FeatureBinaryFraming, FeatureCompression},
+			supported: []string{FeatureCompression, FeatureBinaryFraming},
+			expected:  []string{FeatureBinaryFraming, FeatureCompression},
+		},
+		{
+			name:      "nothing in common",
+			offered:   []string{FeatureStreaming},
+			supported: []string{FeatureBinaryFraming},
+			expected:  []string{},
+		},
+		{
+			name:      "duplicates are removed",
+			offered:   []string{FeatureBinaryFraming, FeatureBinaryFraming},
+			supported: []string{FeatureBinaryFraming},
+			expected:  []string{FeatureBinaryFraming},
+		},
+		{
+			name:      "nil offer",
+			offered:   nil,
+			supported: []string{FeatureBinaryFraming},
+			expected:  []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := NegotiateFeatures(tt.offered, tt.supported)
+			if !reflect.DeepEqual(result, tt.expected) {
+				t.Errorf("expected %v, got %v", tt.expected, result)
+			}
+		})
+	}
+}
+
+func TestBinaryFramingRoundtrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		message Message
+	}{
+		{
+			name: "request with binary body",
+			message: Message{
+				Type:      "request",
+				TunnelID:  "my-tunnel",
+				RequestID: "req-1",
+				Method:    "POST",
+				Path:      "/upload?x=1",
+				Headers:   map[string][]string{"Content-Type": {"application/octet-stream"}},
+				Body:      []byte{0x00, 0xff, 0x10, '{', '"'},
+			},
+		},
+		{
+			name: "response without body",
+			message: Message{
+				Type:      "response",
+				RequestID: "req-2",
+				Status:    204,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frame, err := EncodeBinaryMessage(&tt.message)
+			if err != nil {
+				t.Fatalf("failed to encode: %v", err)
+			}
+
+			decoded, err := DecodeFrame(true, frame)
+			if err != nil {
+				t.Fatalf("failed to decode: %v", err)
+			}
+
+			if !messagesEqual(tt.message, *decoded) {
+				t.Errorf("roundtrip mismatch:\noriginal: %+v\ndecoded:  %+v", tt.message, *decoded)
+			}
+		})
+	}
+}
+
+func TestDecodeBinaryMessageErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame []byte
+	}{
+		{name: "empty frame", frame: []byte{}},
+		{name: "truncated prefix", frame: []byte{0x00, 0x01}},
+		{name: "header length exceeds frame", frame: []byte{0x00, 0x00, 0x00, 0x10, '{', '}'}},
+		{name: "invalid header json", frame: []byte{0x00, 0x00, 0x00, 0x02, '{', 'x'}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := DecodeBinaryMessage(tt.frame); err == nil {
+				t.Error("expected error but got none")
+			}
+		})
+	}
+}
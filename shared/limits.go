@@ -0,0 +1,95 @@
+package shared
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// BodyLimits bound the size of the bodies through a tunnel, in bytes. a zero
+// limit is left to the default, or unlimited without one.
+type BodyLimits struct {
+	// MaxRequestBody bounds what a visitor may upload, the server answers
+	// 413 Content Too Large beyond it
+	MaxRequestBody int64 `json:"max_request_body,omitempty"`
+	// MaxResponseBody bounds what the local service may answer, the visitor
+	// gets 502 Bad Gateway beyond it
+	MaxResponseBody int64 `json:"max_response_body,omitempty"`
+}
+
+// Merge returns l with its unset limits taken from fallback
+func (l BodyLimits) Merge(fallback BodyLimits) BodyLimits {
+	if l.MaxRequestBody <= 0 {
+		l.MaxRequestBody = fallback.MaxRequestBody
+	}
+	if l.MaxResponseBody <= 0 {
+		l.MaxResponseBody = fallback.MaxResponseBody
+	}
+	return l
+}
+
+// Cap returns l with every limit no larger than the one of max, an unset
+// limit takes the one of max
+func (l BodyLimits) Cap(max BodyLimits) BodyLimits {
+	l.MaxRequestBody = capLimit(l.MaxRequestBody, max.MaxRequestBody)
+	l.MaxResponseBody = capLimit(l.MaxResponseBody, max.MaxResponseBody)
+	return l
+}
+
+func capLimit(limit, max int64) int64 {
+	if limit <= 0 || (max > 0 && limit > max) {
+		return max
+	}
+	return limit
+}
+
+var byteUnits = map[string]int64{
+	"":    1,
+	"b":   1,
+	"k":   1 << 10,
+	"kb":  1 << 10,
+	"kib": 1 << 10,
+	"m":   1 << 20,
+	"mb":  1 << 20,
+	"mib": 1 << 20,
+	"g":   1 << 30,
+	"gb":  1 << 30,
+	"gib": 1 << 30,
+}
+
+// ParseByteSize parses a size like 512, 64KB or 1.5GiB. units are powers of
+// 1024 whichever way they are written, so 1MB is 1048576 bytes.
+func ParseByteSize(s string) (int64, error) {
+	value := strings.TrimSpace(s)
+	i := strings.IndexFunc(value, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if i < 0 {
+		i = len(value)
+	}
+
+	unit, ok := byteUnits[strings.ToLower(strings.TrimSpace(value[i:]))]
+	if !ok {
+		return 0, fmt.Errorf("invalid size %q: unknown unit", s)
+	}
+	number, err := strconv.ParseFloat(value[:i], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	size := number * float64(unit)
+	if size >= 1<<63 {
+		return 0, fmt.Errorf("invalid size %q: too large", s)
+	}
+	return int64(size), nil
+}
+
+// FormatByteSize formats a size in the largest unit it is a whole multiple of
+func FormatByteSize(size int64) string {
+	for _, unit := range []string{"GiB", "MiB", "KiB"} {
+		multiple := byteUnits[strings.ToLower(unit)]
+		if size != 0 && size%multiple == 0 {
+			return strconv.FormatInt(size/multiple, 10) + unit
+		}
+	}
+	return strconv.FormatInt(size, 10) + "B"
+}
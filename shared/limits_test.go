@@ -0,0 +1,70 @@
+package shared
+
+import "testing"
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected int64
+		wantErr  bool
+	}{
+		{"0", 0, false},
+		{"512", 512, false},
+		{"64KB", 64 << 10, false},
+		{"10mb", 10 << 20, false},
+		{"10 MiB", 10 << 20, false},
+		{"1.5G", 3 << 29, false},
+		{"100b", 100, false},
+		{"", 0, true},
+		{"MB", 0, true},
+		{"10TB", 0, true},
+		{"-5MB", 0, true},
+		{"1.2.3K", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			size, err := ParseByteSize(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseByteSize(%q) error = %v, wantErr %v", tt.input, err, tt.wantErr)
+			}
+			if size != tt.expected {
+				t.Errorf("ParseByteSize(%q) = %d, want %d", tt.input, size, tt.expected)
+			}
+		})
+	}
+}
+
+func TestFormatByteSize(t *testing.T) {
+	tests := map[int64]string{
+		0:        "0B",
+		100:      "100B",
+		64 << 10: "64KiB",
+		10 << 20: "10MiB",
+		2 << 30:  "2GiB",
+		1536:     "1536B",
+	}
+	for size, expected := range tests {
+		if got := FormatByteSize(size); got != expected {
+			t.Errorf("FormatByteSize(%d) = %q, want %q", size, got, expected)
+		}
+	}
+}
+
+func TestBodyLimits(t *testing.T) {
+	server := BodyLimits{MaxRequestBody: 10 << 20}
+
+	merged := BodyLimits{MaxResponseBody: 5 << 20}.Merge(server)
+	if merged != (BodyLimits{MaxRequestBody: 10 << 20, MaxResponseBody: 5 << 20}) {
+		t.Errorf("Merge() = %+v", merged)
+	}
+
+	// a tunnel may ask for less than the server allows but never for more
+	capped := BodyLimits{MaxRequestBody: 100 << 20, MaxResponseBody: 1 << 20}.Cap(server)
+	if capped != (BodyLimits{MaxRequestBody: 10 << 20, MaxResponseBody: 1 << 20}) {
+		t.Errorf("Cap() = %+v", capped)
+	}
+	if (BodyLimits{}).Cap(server) != server {
+		t.Error("Cap() of unset limits must take the maximum")
+	}
+}
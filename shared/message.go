@@ -1,5 +1,9 @@
 package shared
 
+// StreamChunkSize is the most body bytes carried by one request_body or
+// response_body message
+const StreamChunkSize = 32 * 1024
+
 type Message struct {
 	Type      string              `json:"type"`
 	TunnelID  string              `json:"tunnel_id,omitempty"`
@@ -9,4 +13,28 @@ type Message struct {
 	Headers   map[string][]string `json:"headers,omitempty"`
 	Body      []byte              `json:"body,omitempty"`
 	Status    int                 `json:"status,omitempty"`
+	Error     string              `json:"error,omitempty"`
+	Hello     *Hello              `json:"hello,omitempty"`
+	Welcome   *Welcome            `json:"welcome,omitempty"`
+	Health    *Health             `json:"health,omitempty"`
+	// Stream marks a request or response whose body follows in request_body or
+	// response_body messages, the last of them with End set
+	Stream bool `json:"stream,omitempty"`
+	End    bool `json:"end,omitempty"`
+	// Trailers are announced with empty values on a streamed request or
+	// response and sent with their values on its last body message
+	Trailers map[string][]string `json:"trailers,omitempty"`
+	// Credit is the flow control credit a window_update returns to the
+	// stream of RequestID, or to the whole tunnel without one
+	Credit int64 `json:"credit,omitempty"`
+	// Compressed marks a body gzipped for the tunnel hop, see CompressBody
+	Compressed bool `json:"compressed,omitempty"`
+}
+
+// Health is sent by the client whenever the health of its local service changes
+type Health struct {
+	Healthy bool `json:"healthy"`
+	// Status is the status code of the last probe, 0 when the service was unreachable
+	Status int    `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
 }
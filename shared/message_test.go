@@ -13,12 +13,16 @@ func messagesEqual(a, b Message) bool {
 		a.RequestID != b.RequestID ||
 		a.Method != b.Method ||
 		a.Path != b.Path ||
-		a.Status != b.Status {
+		a.Status != b.Status ||
+		a.Stream != b.Stream ||
+		a.End != b.End ||
+		a.Credit != b.Credit ||
+		a.Compressed != b.Compressed {
 		return false
 	}
 
 	// compare headers - treat nil and empty maps as equal
-	if !headersEqual(a.Headers, b.Headers) {
+	if !headersEqual(a.Headers, b.Headers) || !headersEqual(a.Trailers, b.Trailers) {
 		return false
 	}
 
@@ -107,6 +111,35 @@ func TestMessageJSONSerialization(t *testing.T) {
 				Body:   []byte{},
 			},
 		},
+		{
+			name: "last chunk of a streamed body",
+			message: Message{
+				Type:      "response_body",
+				RequestID: "req-456",
+				Body:      []byte("tail"),
+				End:       true,
+				Trailers: map[string][]string{
+					"Grpc-Status": {"0"},
+				},
+			},
+		},
+		{
+			name: "window update",
+			message: Message{
+				Type:      "window_update",
+				RequestID: "req-456",
+				Credit:    131072,
+			},
+		},
+		{
+			name: "compressed body",
+			message: Message{
+				Type:       "response_body",
+				RequestID:  "req-456",
+				Body:       []byte{0x1f, 0x8b, 0x08, 0x00},
+				Compressed: true,
+			},
+		},
 		{
 			name: "nil body",
 			message: Message{
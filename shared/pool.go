@@ -0,0 +1,26 @@
+package shared
+
+import (
+	"fmt"
+	"strings"
+)
+
+// pool strategies decide which client of a pooled tunnel serves a request
+const (
+	PoolRoundRobin    = "round_robin"
+	PoolLeastInFlight = "least_inflight"
+	PoolStickyCookie  = "sticky_cookie"
+	PoolStickyIP      = "sticky_ip"
+)
+
+// PoolStrategies lists every supported pool strategy
+var PoolStrategies = []string{PoolRoundRobin, PoolLeastInFlight, PoolStickyCookie, PoolStickyIP}
+
+func ValidatePoolStrategy(strategy string) error {
+	for _, s := range PoolStrategies {
+		if s == strategy {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown pool strategy %q, use one of %s", strategy, strings.Join(PoolStrategies, ", "))
+}
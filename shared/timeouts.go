@@ -0,0 +1,118 @@
+package shared
+
+import (
+	"strings"
+	"time"
+)
+
+// Timeouts bound the requests through a tunnel, in milliseconds. a zero
+// timeout is left to the default, HeaderMs falls back to TotalMs.
+type Timeouts struct {
+	// ConnectMs bounds connecting to the local service
+	ConnectMs int64 `json:"connect_ms,omitempty"`
+	// HeaderMs bounds the wait for the response headers
+	HeaderMs int64 `json:"header_ms,omitempty"`
+	// IdleMs bounds the silence between chunks of a streamed response
+	IdleMs int64 `json:"idle_ms,omitempty"`
+	// TotalMs bounds a request whose response is read whole
+	TotalMs int64 `json:"total_ms,omitempty"`
+}
+
+// PathTimeouts overrides the timeouts of requests below a path prefix
+type PathTimeouts struct {
+	Prefix string `json:"prefix"`
+	Timeouts
+}
+
+// TunnelTimeouts are the timeouts of a tunnel with their per path overrides
+type TunnelTimeouts struct {
+	Timeouts
+	Paths []PathTimeouts `json:"paths,omitempty"`
+}
+
+func (t Timeouts) Connect() time.Duration {
+	return millis(t.ConnectMs)
+}
+
+func (t Timeouts) Idle() time.Duration {
+	return millis(t.IdleMs)
+}
+
+func (t Timeouts) Total() time.Duration {
+	return millis(t.TotalMs)
+}
+
+func (t Timeouts) Header() time.Duration {
+	if t.HeaderMs > 0 {
+		return millis(t.HeaderMs)
+	}
+	return millis(t.TotalMs)
+}
+
+func millis(ms int64) time.Duration {
+	return time.Duration(ms) * time.Millisecond
+}
+
+// Merge returns t with its unset timeouts taken from fallback. a total
+// timeout without a header timeout covers the headers too.
+func (t Timeouts) Merge(fallback Timeouts) Timeouts {
+	if t.ConnectMs <= 0 {
+		t.ConnectMs = fallback.ConnectMs
+	}
+	if t.HeaderMs <= 0 && t.TotalMs <= 0 {
+		t.HeaderMs = fallback.HeaderMs
+	}
+	if t.IdleMs <= 0 {
+		t.IdleMs = fallback.IdleMs
+	}
+	if t.TotalMs <= 0 {
+		t.TotalMs = fallback.TotalMs
+	}
+	return t
+}
+
+// Cap returns t with every timeout limited to max, a zero max leaves t as is
+func (t Timeouts) Cap(max time.Duration) Timeouts {
+	if max <= 0 {
+		return t
+	}
+	limit := max.Milliseconds()
+	for _, ms := range []*int64{&t.ConnectMs, &t.HeaderMs, &t.IdleMs, &t.TotalMs} {
+		if *ms > limit {
+			*ms = limit
+		}
+	}
+	return t
+}
+
+// ForPath returns the timeouts of a request: the override with the longest
+// prefix matching its path over the tunnel's own timeouts
+func (t TunnelTimeouts) ForPath(path string) Timeouts {
+	if i := strings.IndexAny(path, "?#"); i >= 0 {
+		path = path[:i]
+	}
+
+	var match *PathTimeouts
+	for i := range t.Paths {
+		override := &t.Paths[i]
+		if !matchesPathPrefix(path, override.Prefix) {
+			continue
+		}
+		if match == nil || len(override.Prefix) > len(match.Prefix) {
+			match = override
+		}
+	}
+	if match == nil {
+		return t.Timeouts
+	}
+	return match.Timeouts.Merge(t.Timeouts)
+}
+
+// matchesPathPrefix reports whether path is prefix or below it, /api matches
+// /api and /api/users but not /apis
+func matchesPathPrefix(path, prefix string) bool {
+	if prefix == "" || !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
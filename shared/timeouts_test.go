@@ -0,0 +1,61 @@
+package shared
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTunnelTimeoutsForPath(t *testing.T) {
+	timeouts := TunnelTimeouts{
+		Timeouts: Timeouts{ConnectMs: 5000, TotalMs: 30000, IdleMs: 60000},
+		Paths: []PathTimeouts{
+			{Prefix: "/reports", Timeouts: Timeouts{TotalMs: 600000}},
+			{Prefix: "/reports/yearly", Timeouts: Timeouts{TotalMs: 1800000, HeaderMs: 900000}},
+			{Prefix: "/events/", Timeouts: Timeouts{IdleMs: 300000}},
+		},
+	}
+
+	tests := []struct {
+		path     string
+		expected Timeouts
+	}{
+		{"/", Timeouts{ConnectMs: 5000, TotalMs: 30000, IdleMs: 60000}},
+		{"/reports", Timeouts{ConnectMs: 5000, TotalMs: 600000, IdleMs: 60000}},
+		{"/reports/monthly?year=2024", Timeouts{ConnectMs: 5000, TotalMs: 600000, IdleMs: 60000}},
+		{"/reports/yearly/2024", Timeouts{ConnectMs: 5000, HeaderMs: 900000, TotalMs: 1800000, IdleMs: 60000}},
+		{"/reportsarchive", Timeouts{ConnectMs: 5000, TotalMs: 30000, IdleMs: 60000}},
+		{"/events/stream", Timeouts{ConnectMs: 5000, TotalMs: 30000, IdleMs: 300000}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if got := timeouts.ForPath(tt.path); got != tt.expected {
+				t.Errorf("ForPath(%q) = %+v, want %+v", tt.path, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestTimeouts(t *testing.T) {
+	timeouts := Timeouts{TotalMs: 30000}.Merge(Timeouts{ConnectMs: 5000, TotalMs: 10000, IdleMs: 60000})
+	if timeouts != (Timeouts{ConnectMs: 5000, TotalMs: 30000, IdleMs: 60000}) {
+		t.Errorf("Merge() = %+v", timeouts)
+	}
+	if timeouts.Header() != 30*time.Second {
+		t.Errorf("Header() = %v, want the total timeout when unset", timeouts.Header())
+	}
+
+	capped := timeouts.Cap(20 * time.Second)
+	if capped != (Timeouts{ConnectMs: 5000, TotalMs: 20000, IdleMs: 20000}) {
+		t.Errorf("Cap() = %+v", capped)
+	}
+	if timeouts.Cap(0) != timeouts {
+		t.Error("Cap(0) must not change the timeouts")
+	}
+
+	// a longer total timeout is not cut short by the fallback's header timeout
+	long := Timeouts{TotalMs: 600000}.Merge(Timeouts{HeaderMs: 30000, TotalMs: 30000})
+	if long.Header() != 10*time.Minute {
+		t.Errorf("Header() = %v, want the total timeout over the fallback's header timeout", long.Header())
+	}
+}
@@ -0,0 +1,113 @@
+package shared
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// RequestIDHeader carries the id of a request to the local service, and from
+// proxies in front of the server to it
+const RequestIDHeader = "X-Request-Id"
+
+// maxRequestIDLength bounds the request ids taken from visitors
+const maxRequestIDLength = 128
+
+// TracingConfig configures exporting traces over OTLP/HTTP
+type TracingConfig struct {
+	// Endpoint is the collector url, like http://localhost:4318. tracing is
+	// off without one
+	Endpoint       string
+	ServiceName    string
+	ServiceVersion string
+	// SampleRatio is the share of new traces recorded, traces started by a
+	// sampled parent are always recorded
+	SampleRatio float64
+}
+
+// InitTracing installs a tracer provider exporting to the configured
+// collector and the w3c trace context propagator. the returned function
+// flushes the spans left and must be called on shutdown.
+func InitTracing(config TracingConfig) (func(context.Context) error, error) {
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid tracing endpoint %q: must be an http or https url", config.Endpoint)
+	}
+	if endpoint.Path == "" || endpoint.Path == "/" {
+		endpoint.Path = "/v1/traces"
+	}
+	if config.SampleRatio < 0 || config.SampleRatio > 1 {
+		return nil, fmt.Errorf("invalid trace sample ratio %v: must be between 0 and 1", config.SampleRatio)
+	}
+
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(endpoint.String()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create trace exporter: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.SampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", config.ServiceName),
+			attribute.String("service.version", config.ServiceVersion),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	logger := GetLogger("tracing")
+	logger.Info().
+		Str("endpoint", endpoint.String()).
+		Str("service_name", config.ServiceName).
+		Float64("sample_ratio", config.SampleRatio).
+		Msg("exporting traces")
+
+	return provider.Shutdown, nil
+}
+
+// Tracer returns the tracer of a funnel component
+func Tracer(component string) trace.Tracer {
+	return otel.Tracer("github.com/karol-broda/funnel/" + component)
+}
+
+// ExtractTraceContext returns ctx with the trace context carried by headers
+func ExtractTraceContext(ctx context.Context, headers map[string][]string) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.HeaderCarrier(headers))
+}
+
+// InjectTraceContext sets the traceparent headers of the span in ctx
+func InjectTraceContext(ctx context.Context, headers map[string][]string) {
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(headers))
+}
+
+// ValidRequestID reports whether id, taken from a request header, is safe to
+// pass on and log: short and printable ascii without spaces
+func ValidRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	return !strings.ContainsFunc(id, func(r rune) bool {
+		return r <= ' ' || r > '~'
+	})
+}
+
+// RecordHTTPStatus sets the status of a span from an http status code,
+// marking server errors as failed
+func RecordHTTPStatus(span trace.Span, status int) {
+	span.SetAttributes(attribute.Int("http.response.status_code", status))
+	if status >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+}
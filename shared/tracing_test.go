@@ -0,0 +1,92 @@
+package shared
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	collectortrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestValidRequestID(t *testing.T) {
+	tests := map[string]bool{
+		"":                                     false,
+		"0195a3c1-7f2e-7b4d-9c1a-5e8f2d6b4a10": true,
+		"req_42/edge-1":                        true,
+		"two words":                            false,
+		"line\nbreak":                          false,
+		"ünicode":                              false,
+		strings.Repeat("a", 128):               true,
+		strings.Repeat("a", 129):               false,
+	}
+	for id, expected := range tests {
+		if got := ValidRequestID(id); got != expected {
+			t.Errorf("ValidRequestID(%q) = %v, want %v", id, got, expected)
+		}
+	}
+}
+
+func TestInitTracing_InvalidConfig(t *testing.T) {
+	tests := []TracingConfig{
+		{Endpoint: "localhost:4318", SampleRatio: 1},
+		{Endpoint: "grpc://collector:4317", SampleRatio: 1},
+		{Endpoint: "http://collector:4318", SampleRatio: 2},
+	}
+	for _, config := range tests {
+		if _, err := InitTracing(config); err == nil {
+			t.Errorf("InitTracing(%+v) succeeded, want an error", config)
+		}
+	}
+}
+
+func TestInitTracing_ExportsToCollector(t *testing.T) {
+	received := make(chan *collectortrace.ExportTraceServiceRequest, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" {
+			http.NotFound(w, r)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		var export collectortrace.ExportTraceServiceRequest
+		if err := proto.Unmarshal(body, &export); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		received <- &export
+		w.Header().Set("Content-Type", "application/x-protobuf")
+	}))
+	defer collector.Close()
+
+	shutdown, err := InitTracing(TracingConfig{Endpoint: collector.URL, ServiceName: "funnel-test", SampleRatio: 1})
+	if err != nil {
+		t.Fatalf("InitTracing() error = %v", err)
+	}
+
+	// the trace of an incoming request is continued and passed on
+	headers := map[string][]string{"Traceparent": {"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}}
+	ctx, span := Tracer("test").Start(ExtractTraceContext(context.Background(), headers), "funnel.test")
+	outgoing := map[string][]string{}
+	InjectTraceContext(ctx, outgoing)
+	span.End()
+
+	if len(outgoing["Traceparent"]) != 1 || !strings.HasPrefix(outgoing["Traceparent"][0], "00-4bf92f3577b34da6a3ce929d0e0e4736-") {
+		t.Errorf("Traceparent = %v, want the incoming trace", outgoing["Traceparent"])
+	}
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatalf("shutdown error = %v", err)
+	}
+
+	select {
+	case export := <-received:
+		spans := export.GetResourceSpans()[0].GetScopeSpans()[0].GetSpans()
+		if len(spans) != 1 || spans[0].GetName() != "funnel.test" {
+			t.Fatalf("collector received %v, want the funnel.test span", spans)
+		}
+	default:
+		t.Fatal("collector received no spans")
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"math"
 	"regexp"
 	"strings"
+
+	"golang.org/x/net/publicsuffix"
 )
 
 var defaultAlphabet = []rune("_-0123456789abcdefghijklmnopqrstuvwxyz")
@@ -14,6 +16,7 @@ var domainSafeAlphabet = []rune("0123456789abcdefghijklmnopqrstuvwxyz")
 const defaultSize = 8
 
 var tunnelIDRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*[a-z0-9]$`)
+var hostnameLabelRegex = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
 
 func getMask(alphabetSize int) int {
 	for i := 1; i <= 8; i++ {
@@ -179,10 +182,60 @@ func MustGenerateNanoID(length ...int) string {
 	return id
 }
 
+// GetBaseDomain returns the registrable domain of a host using the public
+// suffix list, so "a.b.example.co.uk" yields "example.co.uk". hosts under a tld
+// the list does not know, like "app.localhost", yield that tld.
 func GetBaseDomain(domain string) string {
-	parts := strings.Split(domain, ".")
-	if len(parts) > 2 {
-		return strings.Join(parts[len(parts)-2:], ".")
+	domain = NormalizeHostname(domain)
+
+	suffix, icann := publicsuffix.PublicSuffix(domain)
+	if !icann && !strings.Contains(suffix, ".") && suffix != domain {
+		return suffix
+	}
+
+	base, err := publicsuffix.EffectiveTLDPlusOne(domain)
+	if err != nil {
+		return domain
+	}
+	return base
+}
+
+// NormalizeHostname lowercases a host and strips any port and trailing dot
+func NormalizeHostname(host string) string {
+	host = strings.ToLower(strings.TrimSpace(host))
+	if i := strings.LastIndexByte(host, ':'); i != -1 && !strings.Contains(host[i:], "]") {
+		host = host[:i]
+	}
+	return strings.TrimSuffix(host, ".")
+}
+
+// ValidateHostname checks that host is a fully qualified dns name usable as a custom domain
+func ValidateHostname(host string) error {
+	if len(host) == 0 {
+		return errors.New("hostname cannot be empty")
 	}
-	return domain
+
+	if len(host) > 253 {
+		return errors.New("hostname must be no more than 253 characters long")
+	}
+
+	if host != strings.ToLower(host) {
+		return errors.New("hostname must be lowercase")
+	}
+
+	labels := strings.Split(host, ".")
+	if len(labels) < 2 {
+		return errors.New("hostname must contain at least two labels")
+	}
+
+	for _, label := range labels {
+		if len(label) > 63 {
+			return errors.New("hostname labels must be no more than 63 characters long")
+		}
+		if !hostnameLabelRegex.MatchString(label) {
+			return errors.New("hostname labels must contain only lowercase letters, numbers, and hyphens, and cannot start or end with a hyphen")
+		}
+	}
+
+	return nil
 }
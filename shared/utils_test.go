@@ -538,3 +538,77 @@ func TestBackwardCompatibilityNanoID(t *testing.T) {
 		}
 	}
 }
+
+func TestNormalizeHostname(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{input: "Demo.Customer.com", expected: "demo.customer.com"},
+		{input: "demo.customer.com:8443", expected: "demo.customer.com"},
+		{input: "demo.customer.com.", expected: "demo.customer.com"},
+		{input: "[::1]:8080", expected: "[::1]"},
+		{input: "[::1]", expected: "[::1]"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			if got := NormalizeHostname(tt.input); got != tt.expected {
+				t.Errorf("NormalizeHostname(%q) = %q, want %q", tt.input, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestValidateHostname(t *testing.T) {
+	tests := []struct {
+		name        string
+		host        string
+		expectError bool
+	}{
+		{name: "valid", host: "demo.customer.com", expectError: false},
+		{name: "deeply nested", host: "a.b.c.customer.co.uk", expectError: false},
+		{name: "empty", host: "", expectError: true},
+		{name: "single label", host: "localhost", expectError: true},
+		{name: "uppercase", host: "Demo.customer.com", expectError: true},
+		{name: "wildcard", host: "*.customer.com", expectError: true},
+		{name: "leading hyphen", host: "-demo.customer.com", expectError: true},
+		{name: "empty label", host: "demo..com", expectError: true},
+		{name: "with port", host: "demo.customer.com:443", expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateHostname(tt.host)
+			if tt.expectError && err == nil {
+				t.Error("expected error but got none")
+			}
+			if !tt.expectError && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestGetBaseDomain(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{input: "myapp.example.com", expected: "example.com"},
+		{input: "a.b.myapp.example.com", expected: "example.com"},
+		{input: "myapp.example.co.uk", expected: "example.co.uk"},
+		{input: "example.co.uk", expected: "example.co.uk"},
+		{input: "myapp.localhost:8080", expected: "localhost"},
+		{input: "localhost", expected: "localhost"},
+		{input: "user.github.io", expected: "user.github.io"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			if got := GetBaseDomain(tt.input); got != tt.expected {
+				t.Errorf("GetBaseDomain(%q) = %q, want %q", tt.input, got, tt.expected)
+			}
+		})
+	}
+}